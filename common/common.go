@@ -18,12 +18,11 @@ package common
 
 import (
     "context"
-    "errors"
-    "fmt"
     "log"
     "time"
 
     "github.com/libp2p/go-libp2p-core/host"
+    "github.com/libp2p/go-libp2p-core/network"
     "github.com/libp2p/go-libp2p-core/pnet"
     "github.com/libp2p/go-libp2p-core/protocol"
     "github.com/libp2p/go-libp2p-discovery"
@@ -32,7 +31,6 @@ import (
 
     "github.com/PhysarumSM/common/p2pnode"
     "github.com/PhysarumSM/common/p2putil"
-    "github.com/PhysarumSM/common/util"
 )
 
 const (
@@ -42,6 +40,15 @@ const (
     GetProtocolID protocol.ID = "/get/0.1"
     ListProtocolID protocol.ID = "/list/0.1"
     DeleteProtocolID protocol.ID = "/delete/0.1"
+    WatchProtocolID protocol.ID = "/watch/0.1"
+    RenewProtocolID protocol.ID = "/renew/0.1"
+    TransferOwnershipProtocolID protocol.ID = "/transfer-ownership/0.1"
+    QueryProtocolID protocol.ID = "/query/0.1"
+    FindProtocolID protocol.ID = "/find/0.1"
+    HistoryProtocolID protocol.ID = "/history/0.1"
+    RollbackProtocolID protocol.ID = "/rollback/0.1"
+    UndeleteProtocolID protocol.ID = "/undelete/0.1"
+    AuditProtocolID protocol.ID = "/audit/0.1"
 )
 
 // Info field in the following structs should be a json encoding of
@@ -53,19 +60,326 @@ const (
 // decode the info field into their outdated version of the ServiceInfo struct,
 // since they would not contain the new field.
 
+type StatusCode string
+
+const (
+    StatusOK StatusCode = "ok"
+
+    // Requested entry does not exist
+    StatusNotFound StatusCode = "not-found"
+
+    // Conditions of a conditional request were not satisfied
+    StatusConflict StatusCode = "conflict"
+
+    // Registry-service was unable to reach its store, or lost every attempt to write an entry that
+    // others kept changing
+    StatusUnavailable StatusCode = "unavailable"
+
+    // Request was malformed, retrying it unchanged will not help
+    StatusInvalidRequest StatusCode = "invalid-request"
+
+    // Requesting peer is not allowed to make the request, eg. it does not own the entry
+    StatusForbidden StatusCode = "forbidden"
+
+    // Registry-service, or the requesting peer, has too many requests in progress, retry later
+    StatusThrottled StatusCode = "throttled"
+)
+
+// Outcome of a request, carried by every response
+// Message is a human readable description of the outcome
+type Status struct {
+    Code StatusCode
+    Message string
+
+    // With StatusThrottled, how long to wait before retrying, if known
+    RetryAfter time.Duration `json:",omitempty"`
+}
+
+// Responses from older registry-service instances have an empty Code, treat those as ok
+func (s Status) Ok() bool {
+    return s.Code == StatusOK || s.Code == ""
+}
+
+// Sent in place of the usual response when a request fails before one could be built
+// Since all responses have a Status field, it decodes into any of them
+type ErrorResponse struct {
+    Status Status
+}
+
+// IfAbsent and IfRevision make the add conditional, see AddResponse
 type AddRequest struct {
     Name string
     InfoStr string
+
+    // Only add if Name does not exist yet
+    IfAbsent bool
+
+    // Only add if Name was last modified at this revision, ignored if 0
+    IfRevision int64
+
+    // Delete entry unless renewed within TTL seconds, see RenewResponse
+    // Entry never expires if 0
+    TTL int64
+
+    // Publisher's signature over the entry, see SignEntry
+    // Entry is unsigned if empty
+    PublicKey []byte
+    Signature []byte
+
+    // Don't make the requesting peer the owner of a new or unowned entry, leaving any peer free to modify it
+    // Set by clients without a stable key, which could not modify the entry again once restarted
+    Unowned bool `json:",omitempty"`
+}
+
+// If the add's conditions were not satisfied Status is StatusConflict and
+// CurrentRevision holds the revision Name is currently at (0 if it does not exist)
+// Otherwise Revision is the revision of the newly added entry
+type AddResponse struct {
+    Status Status
+    Revision int64
+    CurrentRevision int64
 }
 
+// Metadata kept by registry-service alongside each entry
+type EntryMeta struct {
+    // Revision entry was last modified at, pass to AddRequest.IfRevision to
+    // only update the entry if nobody else has changed it since
+    Revision int64
+
+    // Peer ID of the publisher that signed the entry, checked by registry-service on add
+    // Empty if the entry is unsigned
+    Publisher string
+    PublicKey []byte
+    Signature []byte
+
+    // Peer ID of the peer that added the entry, the only one besides admins allowed to modify it
+    // Empty for entries added before owners were recorded, which the next peer to add them claims
+    Owner string
+}
+
+// Name is the service name the query resolved to
+// Same as the query unless it contained a version constraint, eg. my-service@^1.2
 type GetResponse struct {
+    Status Status
+    Name string
     InfoStr string
+    Meta EntryMeta
     LookupOk bool
 }
 
+// List requests are either empty, listing all entries, or a ListRequest listing a page of them
+// Older registry-service instances ignore the request, always listing all entries
+type ListRequest struct {
+    // Only list entries whose names begin with Prefix
+    Prefix string
+
+    // Maximum number of entries to list, all if 0
+    Limit int64
+
+    // Start from ListResponse.Continue of the previous page, empty for the first page
+    Continue string
+
+    // List deleted entries that can still be undeleted instead
+    Deleted bool `json:",omitempty"`
+}
+
+// Continue is set if there are more entries than listed, see ListRequest
+// NameToDeletion is only set when listing deleted entries
 type ListResponse struct {
+    Status Status
     NameToInfoStr map[string]string
+    NameToMeta map[string]EntryMeta
+    NameToDeletion map[string]DeletionMeta `json:",omitempty"`
     LookupOk bool
+    Continue string `json:",omitempty"`
+}
+
+// Peer ID of the peer that deleted an entry, and when
+type DeletionMeta struct {
+    DeletedBy string
+    DeletedAt time.Time
+}
+
+// Find entries whose requirements are met by a node with the given resources and network conditions
+// Responses are ListResponses holding a page of the matching entries, see ListRequest for paging
+type QueryRequest struct {
+    // Only match entries whose names begin with Prefix
+    Prefix string
+
+    // CPU and memory available on the node, in the units of ServiceInfo.CpuReq and MemoryReq
+    // Entries requiring more don't match, not checked if 0
+    Cpu int
+    Memory int
+
+    // RTT between the node and its clients
+    // Entries whose NetworkHardReq RTT is lower don't match, not checked if 0
+    RTT time.Duration
+
+    // Also require entries' NetworkSoftReq RTT to be met
+    MeetSoftReq bool
+
+    Limit int64
+    Continue string
+}
+
+// Indexes that entries can be found by, see FindRequest
+const (
+    ContentHashIndex = "content-hash"
+    DockerHashIndex = "docker-hash"
+)
+
+// Find the entries whose Index field, ContentHashIndex or DockerHashIndex, is Value
+// Responses are ListResponses, with LookupOk false if no entry matches
+type FindRequest struct {
+    Index string
+    Value string
+}
+
+// Get the past versions of the entry named Name, or the one it had at a revision
+type HistoryRequest struct {
+    Name string
+
+    // Only return the version current at this store revision, unless 0
+    Revision int64
+
+    // Return at most Limit versions, all if 0
+    Limit int64
+}
+
+// Versions are newest first, Status is not found if there are none
+type HistoryResponse struct {
+    Status Status
+    Versions []EntryVersion
+}
+
+type EntryVersion struct {
+    InfoStr string
+
+    // Meta.Revision is the revision the version was put or deleted at
+    Meta EntryMeta
+
+    // Set if the entry was deleted, InfoStr and the rest of Meta are then empty
+    Deleted bool
+}
+
+// Restore the version Name had at ToRevision as its current value
+// ToRevision 0 restores the version before the current one, or the last version of a deleted entry
+type RollbackRequest struct {
+    Name string
+    ToRevision int64
+
+    // Only roll back if the entry is currently at this revision, ignored if 0
+    // The revision of a deleted entry is the revision it was deleted at
+    IfRevision int64
+
+    // Same as AddRequest.Unowned
+    Unowned bool `json:",omitempty"`
+}
+
+// Same as AddResponse, RestoredRevision is the revision of the version that was restored
+type RollbackResponse struct {
+    Status Status
+    Revision int64
+    RestoredRevision int64
+    CurrentRevision int64
+}
+
+// Delete requests are the name of the entry to delete
+// Deleted entries are kept for a while, see UndeleteResponse
+type DeleteResponse struct {
+    Status Status
+    Deleted int64
+}
+
+// Undelete requests are the name of the deleted entry to restore
+// Status is StatusConflict if an entry of that name was added since, with CurrentRevision its revision
+type UndeleteResponse struct {
+    Status Status
+    Revision int64
+    CurrentRevision int64
+}
+
+// Get the audit records of changes made to the registry, filtered by the fields that are set
+type AuditRequest struct {
+    // Only return records of changes to the entry named Name, or of adding the member named Name
+    Name string `json:",omitempty"`
+
+    // Only return records of changes requested by this peer ID
+    Peer string `json:",omitempty"`
+
+    // Only return records from Since up to but excluding Until
+    Since time.Time
+    Until time.Time
+
+    // Return at most Limit records, all if 0
+    Limit int64 `json:",omitempty"`
+}
+
+// Records are newest first
+type AuditResponse struct {
+    Status Status
+    Records []AuditRecord
+}
+
+// Change requested by Peer with the Protocol it sent the request to
+// Digests are of the entry's InfoStr before and after the change, empty if the entry did not exist
+type AuditRecord struct {
+    Time time.Time
+    Peer string
+    Protocol string
+    Name string
+    OldDigest string `json:",omitempty"`
+    NewDigest string `json:",omitempty"`
+}
+
+// Renew requests are the name of the entry to renew, restarting its TTL
+// RenewOk is false if the entry does not exist or was added without a TTL
+type RenewResponse struct {
+    Status Status
+    Name string
+    TTL int64
+    RenewOk bool
+}
+
+// Hand the entry called Name over to the peer with ID NewOwner
+// Only allowed for the entry's current owner and admins
+type TransferOwnershipRequest struct {
+    Name string
+    NewOwner string
+}
+
+// Revision is the revision of the entry after the transfer
+type TransferOwnershipResponse struct {
+    Status Status
+    Revision int64
+}
+
+// Watch a single service name, or all names beginning with Name if Prefix is set
+type WatchRequest struct {
+    Name string
+    Prefix bool
+}
+
+type WatchEventType string
+
+const (
+    WatchAdd WatchEventType = "add"
+    WatchUpdate WatchEventType = "update"
+    WatchDelete WatchEventType = "delete"
+
+    // Sent once the watch is set up, then periodically while there are no changes
+    // Carries no Name/InfoStr
+    WatchProgress WatchEventType = "progress"
+)
+
+// Watch responses are a stream of newline separated json encoded WatchEvents
+// InfoStr is empty for WatchDelete events
+// If the watch fails, the last event only has its Status set
+type WatchEvent struct {
+    Status Status
+    Type WatchEventType
+    Name string
+    InfoStr string
 }
 
 func init() {
@@ -96,42 +410,64 @@ func SendRequestWithHostRouting(
     ctx context.Context, host host.Host, routingDiscovery *discovery.RoutingDiscovery,
     protocolID protocol.ID, request []byte) (response []byte, err error) {
 
-    eba, err := util.NewExpoBackoffAttempts(1 * time.Second, 8 * time.Second, 5)
-    if err != nil {
-        return nil, err
-    }
-    for eba.Attempt() {
-        peerChan, err := routingDiscovery.FindPeers(ctx, RegistryServiceRendezvousString)
-        if err != nil {
-            return nil, fmt.Errorf("registry: Unable to find peer with service ID %s\n%w",
-                                    RegistryServiceRendezvousString, err)
-        }
-
-        for peer := range peerChan {
-            if peer.ID == host.ID() {
-                continue
-            }
+    return SendRequestWithPolicy(ctx, host, routingDiscovery, DefaultRetryPolicy, protocolID, request)
+}
 
-            log.Println("Connecting to:", peer)
-            stream, err := host.NewStream(ctx, peer.ID, protocolID)
-            if err != nil {
-                log.Println("Connection failed:", err)
-                continue
-            }
+// Same as SendRequestWithHostRouting, retrying according to policy
+// If ctx has a deadline, reading the response is bounded by it too
+func SendRequestWithPolicy(
+    ctx context.Context, host host.Host, routingDiscovery *discovery.RoutingDiscovery,
+    policy RetryPolicy, protocolID protocol.ID, request []byte) (response []byte, err error) {
 
+    err = policy.do(ctx, host, routingDiscovery, protocolID,
+        func(stream network.Stream) (sent bool, err error) {
             err = p2putil.WriteMsg(stream, request)
             if err != nil {
-                return nil, err
+                return false, err
             }
 
-            response, err := p2putil.ReadMsg(stream)
+            response, err = p2putil.ReadMsg(stream)
+            return true, err
+        })
+    if err != nil {
+        return nil, err
+    }
+
+    return response, nil
+}
+
+// Send request to registry-service, returning the stream to read the response from
+// Used by protocols that stream back responses, such as watch
+func OpenRequestStream(
+    ctx context.Context, host host.Host, routingDiscovery *discovery.RoutingDiscovery,
+    protocolID protocol.ID, request []byte) (stream network.Stream, err error) {
+
+    return OpenRequestStreamWithPolicy(ctx, host, routingDiscovery, DefaultRetryPolicy, protocolID, request)
+}
+
+// Same as OpenRequestStream, retrying according to policy
+// If ctx has a deadline, it is set as the stream's deadline
+// Policy's AttemptTimeout only bounds opening the stream and sending the request
+func OpenRequestStreamWithPolicy(
+    ctx context.Context, host host.Host, routingDiscovery *discovery.RoutingDiscovery,
+    policy RetryPolicy, protocolID protocol.ID, request []byte) (stream network.Stream, err error) {
+
+    err = policy.do(ctx, host, routingDiscovery, protocolID,
+        func(attemptStream network.Stream) (sent bool, err error) {
+            err = p2putil.WriteMsg(attemptStream, request)
             if err != nil {
-                return nil, err
+                return false, err
             }
 
-            return response, nil
-        }
+            stream = attemptStream
+            return true, nil
+        })
+    if err != nil {
+        return nil, err
     }
 
-    return nil, errors.New("registry: Failed to connect to any registry-service peers")
+    // Lift the attempt's deadline, leaving only the caller's
+    deadline, _ := ctx.Deadline()
+    stream.SetDeadline(deadline)
+    return stream, nil
 }
@@ -0,0 +1,222 @@
+/* Copyright 2020 PhysarumSM Development Team
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package common
+
+// Choosing which registry-service peer to send a request to
+
+import (
+    "context"
+    "fmt"
+    "math/rand"
+    "sort"
+    "sync"
+    "sync/atomic"
+    "time"
+
+    "github.com/libp2p/go-libp2p-core/host"
+    "github.com/libp2p/go-libp2p-core/peer"
+    "github.com/libp2p/go-libp2p/p2p/protocol/ping"
+
+    "github.com/PhysarumSM/common/p2putil"
+)
+
+// How long to wait for a ping response before considering a peer unhealthy
+const pingTimeout = time.Second
+
+// Orders discovered registry-service peers, most preferred first
+// Requests are sent to the first peer, failing over to the next ones in order
+type PeerSelector interface {
+    Order(ctx context.Context, host host.Host, peers []peer.AddrInfo) []peer.AddrInfo
+}
+
+// Optionally implemented by PeerSelectors that want to know when a request to a peer failed
+type failureReporter interface {
+    ReportFailure(id peer.ID)
+}
+
+// Used when a RetryPolicy does not set a Selector
+var DefaultPeerSelector PeerSelector = NearestPeers(NewRTTCache(time.Minute))
+
+// Get selector by strategy name: nearest, random or round-robin
+func PeerSelectorByName(name string) (PeerSelector, error) {
+    switch name {
+    case "nearest":
+        return NearestPeers(NewRTTCache(time.Minute)), nil
+    case "random":
+        return RandomPeers(), nil
+    case "round-robin":
+        return RoundRobinPeers(), nil
+    default:
+        return nil, fmt.Errorf("Unknown peer selection strategy %s", name)
+    }
+}
+
+type rttEntry struct {
+    perf p2putil.PerfInd
+    healthy bool
+    measured time.Time
+}
+
+// Cache of round trip times to peers, measured with libp2p ping
+// Safe for concurrent use
+type RTTCache struct {
+    // How long a measurement is used before pinging the peer again
+    ttl time.Duration
+
+    mutex sync.Mutex
+    entries map[peer.ID]rttEntry
+}
+
+func NewRTTCache(ttl time.Duration) *RTTCache {
+    return &RTTCache{ttl: ttl, entries: make(map[peer.ID]rttEntry)}
+}
+
+// Get cached performance of peer, healthy is false if the peer did not respond to its last ping
+// ok is false if the peer has no measurement, or it is older than the cache's TTL
+func (c *RTTCache) Get(id peer.ID) (perf p2putil.PerfInd, healthy, ok bool) {
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+
+    entry, ok := c.entries[id]
+    if !ok || time.Since(entry.measured) > c.ttl {
+        return perf, false, false
+    }
+    return entry.perf, entry.healthy, true
+}
+
+// Ping peers without a fresh measurement, concurrently
+func (c *RTTCache) Measure(ctx context.Context, host host.Host, ids []peer.ID) {
+    var wg sync.WaitGroup
+    for _, id := range ids {
+        if _, _, ok := c.Get(id); ok {
+            continue
+        }
+
+        wg.Add(1)
+        go func(id peer.ID) {
+            defer wg.Done()
+
+            pingCtx, cancel := context.WithTimeout(ctx, pingTimeout)
+            defer cancel()
+
+            entry := rttEntry{measured: time.Now()}
+            result, ok := <-ping.Ping(pingCtx, host, id)
+            if ok && result.Error == nil {
+                entry.perf.RTT = result.RTT
+                entry.healthy = true
+            }
+
+            c.mutex.Lock()
+            c.entries[id] = entry
+            c.mutex.Unlock()
+        }(id)
+    }
+    wg.Wait()
+}
+
+// Consider peer unhealthy until it is measured again
+func (c *RTTCache) MarkUnhealthy(id peer.ID) {
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+
+    entry := c.entries[id]
+    entry.healthy = false
+    entry.measured = time.Now()
+    c.entries[id] = entry
+}
+
+type nearestSelector struct {
+    cache *RTTCache
+}
+
+// Prefer healthy peers with the lowest RTT, trying unhealthy peers last
+func NearestPeers(cache *RTTCache) PeerSelector {
+    return &nearestSelector{cache: cache}
+}
+
+func (s *nearestSelector) Order(ctx context.Context, host host.Host, peers []peer.AddrInfo) []peer.AddrInfo {
+    ids := make([]peer.ID, len(peers))
+    for i, p := range peers {
+        ids[i] = p.ID
+    }
+    s.cache.Measure(ctx, host, ids)
+
+    type rankedPeer struct {
+        info peer.AddrInfo
+        perf p2putil.PerfInd
+        healthy bool
+    }
+    ranked := make([]rankedPeer, len(peers))
+    for i, p := range peers {
+        perf, healthy, _ := s.cache.Get(p.ID)
+        ranked[i] = rankedPeer{info: p, perf: perf, healthy: healthy}
+    }
+
+    sort.SliceStable(ranked, func(i, j int) bool {
+        if ranked[i].healthy != ranked[j].healthy {
+            return ranked[i].healthy
+        }
+        return ranked[i].perf.LessThan(ranked[j].perf)
+    })
+
+    ordered := make([]peer.AddrInfo, len(ranked))
+    for i, r := range ranked {
+        ordered[i] = r.info
+    }
+    return ordered
+}
+
+func (s *nearestSelector) ReportFailure(id peer.ID) {
+    s.cache.MarkUnhealthy(id)
+}
+
+type randomSelector struct{}
+
+// Try peers in random order, spreading load evenly
+func RandomPeers() PeerSelector {
+    return randomSelector{}
+}
+
+func (randomSelector) Order(ctx context.Context, host host.Host, peers []peer.AddrInfo) []peer.AddrInfo {
+    ordered := append([]peer.AddrInfo{}, peers...)
+    rand.Shuffle(len(ordered), func(i, j int) {
+        ordered[i], ordered[j] = ordered[j], ordered[i]
+    })
+    return ordered
+}
+
+type roundRobinSelector struct {
+    next uint64
+}
+
+// Start each request at the peer after the one the previous request started at
+func RoundRobinPeers() PeerSelector {
+    return &roundRobinSelector{}
+}
+
+func (s *roundRobinSelector) Order(ctx context.Context, host host.Host, peers []peer.AddrInfo) []peer.AddrInfo {
+    if len(peers) == 0 {
+        return peers
+    }
+
+    // Discovery order varies between requests, so rotate a stable order instead
+    sorted := append([]peer.AddrInfo{}, peers...)
+    sort.Slice(sorted, func(i, j int) bool {
+        return sorted[i].ID < sorted[j].ID
+    })
+
+    start := int(atomic.AddUint64(&s.next, 1) - 1) % len(sorted)
+    return append(sorted[start:], sorted[:start]...)
+}
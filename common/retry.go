@@ -0,0 +1,259 @@
+/* Copyright 2020 PhysarumSM Development Team
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package common
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "log"
+    "time"
+
+    "github.com/libp2p/go-libp2p-core/host"
+    "github.com/libp2p/go-libp2p-core/network"
+    "github.com/libp2p/go-libp2p-core/peer"
+    "github.com/libp2p/go-libp2p-core/protocol"
+    "github.com/libp2p/go-libp2p-discovery"
+)
+
+// How requests to registry-service are retried
+// Each attempt discovers registry-service peers and tries them in batches as they are found,
+// each in the order given by Selector, failing over to the next peer when one can't be reached or fails mid-request
+type RetryPolicy struct {
+    // Total number of attempts, including the first
+    Attempts int
+
+    // Wait before the second attempt, doubling after each attempt up to MaxBackoff
+    MinBackoff time.Duration
+    MaxBackoff time.Duration
+
+    // Limit on trying a single peer, including connecting to it, no limit if 0
+    AttemptTimeout time.Duration
+
+    // Whether a request that failed with err should be tried on another peer
+    // All errors are retried if nil
+    Retryable func(err error) bool
+
+    // Also retry requests that are not idempotent, such as add and delete, once they
+    // may have reached a peer
+    // Such requests could then be applied twice, eg. an add overwriting a concurrent add
+    // made between the two tries
+    RetryNonIdempotent bool
+
+    // Order in which discovered peers are tried, DefaultPeerSelector if nil
+    Selector PeerSelector
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+    Attempts: 5,
+    MinBackoff: 1 * time.Second,
+    MaxBackoff: 8 * time.Second,
+}
+
+// Requests to these protocols can safely be sent more than once
+var idempotentProtocols = map[protocol.ID]bool{
+    GetProtocolID: true,
+    ListProtocolID: true,
+    WatchProtocolID: true,
+    RenewProtocolID: true,
+    QueryProtocolID: true,
+    FindProtocolID: true,
+    HistoryProtocolID: true,
+    AuditProtocolID: true,
+}
+
+func IsIdempotent(protocolID protocol.ID) bool {
+    return idempotentProtocols[protocolID]
+}
+
+var ErrNoRegistryPeers = errors.New("registry: Failed to connect to any registry-service peers")
+
+// Time to wait after the given attempt (starting at 1) before making the next one
+func (p RetryPolicy) Backoff(attempt int) time.Duration {
+    backoff := p.MinBackoff
+    for i := 1; i < attempt && backoff < p.MaxBackoff; i++ {
+        backoff *= 2
+    }
+    if backoff > p.MaxBackoff {
+        backoff = p.MaxBackoff
+    }
+    return backoff
+}
+
+// Wait out the backoff after the given attempt
+// Returns ctx.Err() if ctx is done before then
+func (p RetryPolicy) wait(ctx context.Context, attempt int) error {
+    timer := time.NewTimer(p.Backoff(attempt))
+    defer timer.Stop()
+
+    select {
+    case <-timer.C:
+        return nil
+    case <-ctx.Done():
+        return ctx.Err()
+    }
+}
+
+func (p RetryPolicy) retryable(err error) bool {
+    return p.Retryable == nil || p.Retryable(err)
+}
+
+// Run request on a stream to a registry-service peer, retrying according to the policy
+// request returns whether the request may have reached the peer, in which case
+// non-idempotent requests are not retried unless allowed by the policy
+func (p RetryPolicy) do(
+    ctx context.Context, host host.Host, routingDiscovery *discovery.RoutingDiscovery,
+    protocolID protocol.ID, request func(stream network.Stream) (sent bool, err error)) error {
+
+    canResend := IsIdempotent(protocolID) || p.RetryNonIdempotent
+    selector := p.Selector
+    if selector == nil {
+        selector = DefaultPeerSelector
+    }
+    var lastErr error
+
+    // Always make at least one attempt
+    for attempt := 1; attempt == 1 || attempt <= p.Attempts; attempt++ {
+        if attempt > 1 {
+            err := p.wait(ctx, attempt - 1)
+            if err != nil {
+                return err
+            }
+        }
+
+        done, err := p.tryDiscovered(ctx, host, routingDiscovery, selector, canResend, protocolID, request)
+        if done {
+            return err
+        }
+        if err != nil {
+            lastErr = err
+        }
+    }
+
+    if lastErr != nil {
+        return fmt.Errorf("%w\nLast error: %v", ErrNoRegistryPeers, lastErr)
+    }
+    return ErrNoRegistryPeers
+}
+
+// Discover registry-service peers and try them in batches as they arrive, so a request
+// does not wait for discovery to finish, and only each batch is ordered by the selector
+// done is true if err is final, either success (nil) or an error that must not be retried
+func (p RetryPolicy) tryDiscovered(
+    ctx context.Context, host host.Host, routingDiscovery *discovery.RoutingDiscovery,
+    selector PeerSelector, canResend bool, protocolID protocol.ID,
+    request func(stream network.Stream) (sent bool, err error)) (done bool, err error) {
+
+    // Stop discovery once a peer has handled the request
+    findCtx, cancel := context.WithCancel(ctx)
+    defer cancel()
+
+    peerChan, err := routingDiscovery.FindPeers(findCtx, RegistryServiceRendezvousString)
+    if err != nil {
+        return true, fmt.Errorf("registry: Unable to find peer with service ID %s\n%w",
+                            RegistryServiceRendezvousString, err)
+    }
+
+    var lastErr error
+    for {
+        candidates, more := nextCandidates(ctx, host, peerChan)
+        if ctx.Err() != nil {
+            return true, ctx.Err()
+        }
+
+        for _, target := range selector.Order(ctx, host, candidates) {
+            sent, err := p.tryPeer(ctx, host, target.ID, protocolID, request)
+            if err == nil {
+                return true, nil
+            }
+            if ctx.Err() != nil {
+                return true, ctx.Err()
+            }
+
+            if reporter, ok := selector.(failureReporter); ok {
+                reporter.ReportFailure(target.ID)
+            }
+
+            lastErr = err
+            if (sent && !canResend) || !p.retryable(err) {
+                return true, err
+            }
+            log.Println("Request to", target.ID, "failed, trying next peer:", err)
+        }
+
+        if !more {
+            return false, lastErr
+        }
+    }
+}
+
+// Most peers tried per batch, and how long to wait for more once the first one is found
+const (
+    maxCandidates = 4
+    candidateWindow = 200 * time.Millisecond
+)
+
+// Collect the next batch of discovered peers, other than host itself
+// Waits for the first peer, then returns once maxCandidates are found or candidateWindow
+// passes, whichever is first
+// more is false once discovery has finished
+func nextCandidates(ctx context.Context, host host.Host, peerChan <-chan peer.AddrInfo) (candidates []peer.AddrInfo, more bool) {
+    var window <-chan time.Time
+    for len(candidates) < maxCandidates {
+        select {
+        case discovered, ok := <-peerChan:
+            if !ok {
+                return candidates, false
+            }
+            if discovered.ID == host.ID() {
+                continue
+            }
+            candidates = append(candidates, discovered)
+            if window == nil {
+                timer := time.NewTimer(candidateWindow)
+                defer timer.Stop()
+                window = timer.C
+            }
+        case <-window:
+            return candidates, true
+        case <-ctx.Done():
+            return candidates, false
+        }
+    }
+    return candidates, true
+}
+
+func (p RetryPolicy) tryPeer(
+    ctx context.Context, host host.Host, peerID peer.ID, protocolID protocol.ID,
+    request func(stream network.Stream) (sent bool, err error)) (sent bool, err error) {
+
+    if p.AttemptTimeout > 0 {
+        var cancel context.CancelFunc
+        ctx, cancel = context.WithTimeout(ctx, p.AttemptTimeout)
+        defer cancel()
+    }
+
+    log.Println("Connecting to:", peerID)
+    stream, err := host.NewStream(ctx, peerID, protocolID)
+    if err != nil {
+        return false, err
+    }
+
+    if deadline, ok := ctx.Deadline(); ok {
+        stream.SetDeadline(deadline)
+    }
+
+    return request(stream)
+}
@@ -0,0 +1,328 @@
+/* Copyright 2020 PhysarumSM Development Team
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package semver
+
+// Semantic versioning of service names
+//
+// Versioned service names take the form <name>:<version>, eg. my-service:1.2.0
+// Queries take the form <name>@<constraint>, eg. my-service@^1.2 or my-service@latest
+
+import (
+    "fmt"
+    "strconv"
+    "strings"
+)
+
+const (
+    // Separates service name from version in stored names
+    VersionSeparator = ":"
+
+    // Separates service name from version constraint in queries
+    ConstraintSeparator = "@"
+
+    Latest = "latest"
+)
+
+// Split stored service name into its base name and version
+// Version is empty if name is not versioned
+func SplitName(name string) (base, version string) {
+    i := strings.LastIndex(name, VersionSeparator)
+    if i < 0 {
+        return name, ""
+    }
+    return name[:i], name[i+1:]
+}
+
+// Split query into its base name and version constraint
+// ok is false if query does not contain a constraint
+func SplitQuery(query string) (base, constraint string, ok bool) {
+    i := strings.LastIndex(query, ConstraintSeparator)
+    if i < 0 {
+        return query, "", false
+    }
+    return query[:i], query[i+1:], true
+}
+
+type Version struct {
+    Major int64
+    Minor int64
+    Patch int64
+    Prerelease string
+}
+
+// Parse version string
+// Missing minor and patch numbers default to 0, so 1.0 is the same as 1.0.0
+// Leading v and build metadata (+...) are ignored
+func Parse(versionStr string) (v Version, err error) {
+    s := strings.TrimPrefix(strings.TrimSpace(versionStr), "v")
+    if i := strings.Index(s, "+"); i >= 0 {
+        s = s[:i]
+    }
+    if i := strings.Index(s, "-"); i >= 0 {
+        v.Prerelease = s[i+1:]
+        s = s[:i]
+        if v.Prerelease == "" {
+            return v, fmt.Errorf("Invalid version '%s': empty prerelease", versionStr)
+        }
+    }
+
+    parts := strings.Split(s, ".")
+    if len(parts) > 3 {
+        return v, fmt.Errorf("Invalid version '%s': too many components", versionStr)
+    }
+    nums := []*int64{&v.Major, &v.Minor, &v.Patch}
+    for i, part := range parts {
+        *nums[i], err = strconv.ParseInt(part, 10, 64)
+        if err != nil || *nums[i] < 0 {
+            return v, fmt.Errorf("Invalid version '%s'", versionStr)
+        }
+    }
+
+    return v, nil
+}
+
+func (v Version) String() string {
+    s := fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+    if v.Prerelease != "" {
+        s += "-" + v.Prerelease
+    }
+    return s
+}
+
+// Returns -1, 0 or 1 if v is less than, equal to, or greater than o
+func (v Version) Compare(o Version) int {
+    if c := compareInt(v.Major, o.Major); c != 0 {
+        return c
+    }
+    if c := compareInt(v.Minor, o.Minor); c != 0 {
+        return c
+    }
+    if c := compareInt(v.Patch, o.Patch); c != 0 {
+        return c
+    }
+
+    // A prerelease version has lower precedence than the release
+    switch {
+    case v.Prerelease == o.Prerelease:
+        return 0
+    case v.Prerelease == "":
+        return 1
+    case o.Prerelease == "":
+        return -1
+    }
+    return comparePrerelease(v.Prerelease, o.Prerelease)
+}
+
+func compareInt(a, b int64) int {
+    switch {
+    case a < b:
+        return -1
+    case a > b:
+        return 1
+    }
+    return 0
+}
+
+// Compare dot separated prerelease identifiers
+// Numeric identifiers compare numerically and sort before alphanumeric ones
+func comparePrerelease(a, b string) int {
+    aParts := strings.Split(a, ".")
+    bParts := strings.Split(b, ".")
+    for i := 0; i < len(aParts) && i < len(bParts); i++ {
+        aNum, aErr := strconv.ParseInt(aParts[i], 10, 64)
+        bNum, bErr := strconv.ParseInt(bParts[i], 10, 64)
+        switch {
+        case aErr == nil && bErr == nil:
+            if c := compareInt(aNum, bNum); c != 0 {
+                return c
+            }
+        case aErr == nil:
+            return -1
+        case bErr == nil:
+            return 1
+        default:
+            if c := strings.Compare(aParts[i], bParts[i]); c != 0 {
+                return c
+            }
+        }
+    }
+    return compareInt(int64(len(aParts)), int64(len(bParts)))
+}
+
+type comparator struct {
+    op string
+    version Version
+}
+
+func (c comparator) check(v Version) bool {
+    cmp := v.Compare(c.version)
+    switch c.op {
+    case "=":
+        return cmp == 0
+    case ">":
+        return cmp > 0
+    case ">=":
+        return cmp >= 0
+    case "<":
+        return cmp < 0
+    case "<=":
+        return cmp <= 0
+    }
+    return false
+}
+
+// Version constraint, eg. ^1.2, ~1.2.3, >=1.0 <2.0, 1.x or latest
+// Space separated comparators must all be satisfied
+type Constraint struct {
+    comparators []comparator
+}
+
+// Parse constraint string
+// Supported forms:
+//  latest or *       any release version
+//  1.2.3 or =1.2.3   exactly 1.2.3
+//  1.2 or 1.2.x      any 1.2.* version
+//  ^1.2.3            >=1.2.3 <2.0.0 (>=0.2.3 <0.3.0 for 0.* versions)
+//  ~1.2.3            >=1.2.3 <1.3.0
+//  >, >=, <, <=      comparison against version
+func ParseConstraint(constraintStr string) (c Constraint, err error) {
+    fields := strings.Fields(constraintStr)
+    if len(fields) == 0 {
+        return c, fmt.Errorf("Empty version constraint")
+    }
+
+    for _, field := range fields {
+        comps, err := parseComparators(field)
+        if err != nil {
+            return c, fmt.Errorf("Invalid version constraint '%s': %w", constraintStr, err)
+        }
+        c.comparators = append(c.comparators, comps...)
+    }
+
+    return c, nil
+}
+
+func parseComparators(field string) ([]comparator, error) {
+    if field == Latest || field == "*" || field == "x" {
+        return nil, nil
+    }
+
+    for _, op := range []string{">=", "<=", ">", "<", "="} {
+        if strings.HasPrefix(field, op) {
+            v, err := Parse(field[len(op):])
+            if err != nil {
+                return nil, err
+            }
+            return []comparator{{op, v}}, nil
+        }
+    }
+
+    if strings.HasPrefix(field, "^") || strings.HasPrefix(field, "~") {
+        v, numParts, err := parsePartial(field[1:])
+        if err != nil {
+            return nil, err
+        }
+        var upper Version
+        switch {
+        case field[0] == '~' && numParts > 1:
+            upper = Version{Major: v.Major, Minor: v.Minor + 1}
+        case field[0] == '~' || v.Major > 0 || numParts == 1:
+            upper = Version{Major: v.Major + 1}
+        case v.Minor > 0 || numParts == 2:
+            upper = Version{Minor: v.Minor + 1}
+        default:
+            upper = Version{Patch: v.Patch + 1}
+        }
+        // Prerelease of upper bound keeps eg. 2.0.0-beta out of ^1.2
+        upper.Prerelease = "0"
+        return []comparator{{">=", v}, {"<", upper}}, nil
+    }
+
+    // Bare version, possibly partial or with x wildcards
+    v, numParts, err := parsePartial(field)
+    if err != nil {
+        return nil, err
+    }
+    switch numParts {
+    case 1:
+        return []comparator{{">=", v}, {"<", Version{Major: v.Major + 1, Prerelease: "0"}}}, nil
+    case 2:
+        upper := Version{Major: v.Major, Minor: v.Minor + 1, Prerelease: "0"}
+        return []comparator{{">=", v}, {"<", upper}}, nil
+    }
+    return []comparator{{"=", v}}, nil
+}
+
+// Parse version that may be missing components or use x/* wildcards
+// Returns the number of components actually specified
+func parsePartial(s string) (v Version, numParts int, err error) {
+    base := s
+    if i := strings.IndexAny(s, "-+"); i >= 0 {
+        base = s[:i]
+    }
+    parts := strings.Split(strings.TrimPrefix(base, "v"), ".")
+    numParts = len(parts)
+    for i, part := range parts {
+        if part == "x" || part == "X" || part == "*" {
+            numParts = i
+            break
+        }
+    }
+    if numParts == 0 {
+        return v, 0, fmt.Errorf("Version must start with a number")
+    }
+    if numParts < len(parts) {
+        s = strings.Join(parts[:numParts], ".")
+    }
+
+    v, err = Parse(s)
+    return v, numParts, err
+}
+
+// Check whether version satisfies the constraint
+// Prerelease versions only satisfy constraints that name a prerelease of the same
+// major.minor.patch version, so ^1.2 does not match 1.3.0-beta
+func (c Constraint) Check(v Version) bool {
+    allowPrerelease := v.Prerelease == ""
+    for _, comp := range c.comparators {
+        if !comp.check(v) {
+            return false
+        }
+        if comp.version.Prerelease != "" && comp.version.Prerelease != "0" &&
+            comp.version.Major == v.Major && comp.version.Minor == v.Minor &&
+            comp.version.Patch == v.Patch {
+            allowPrerelease = true
+        }
+    }
+    return allowPrerelease
+}
+
+// Find the highest version satisfying the constraint
+// Versions that fail to parse are ignored
+// Returns index into versions of the match, or -1 if there is none
+func Resolve(c Constraint, versions []string) int {
+    best := -1
+    var bestVersion Version
+    for i, versionStr := range versions {
+        v, err := Parse(versionStr)
+        if err != nil || !c.Check(v) {
+            continue
+        }
+        if best < 0 || v.Compare(bestVersion) > 0 {
+            best, bestVersion = i, v
+        }
+    }
+    return best
+}
@@ -0,0 +1,161 @@
+/* Copyright 2020 PhysarumSM Development Team
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package semver
+
+import (
+    "testing"
+)
+
+func TestParse(t *testing.T) {
+    tests := []struct {
+        in string
+        out string
+        ok bool
+    }{
+        {"1.2.3", "1.2.3", true},
+        {"1.0", "1.0.0", true},
+        {"2", "2.0.0", true},
+        {"v1.2.3", "1.2.3", true},
+        {"1.2.3-beta.1", "1.2.3-beta.1", true},
+        {"1.2.3+build5", "1.2.3", true},
+        {"latest", "", false},
+        {"1.2.3.4", "", false},
+        {"1.-2", "", false},
+        {"1.2.3-", "", false},
+    }
+
+    for _, test := range tests {
+        v, err := Parse(test.in)
+        if (err == nil) != test.ok {
+            t.Errorf("Parse(%s) returned err=%v, expected ok=%v", test.in, err, test.ok)
+            continue
+        }
+        if test.ok && v.String() != test.out {
+            t.Errorf("Parse(%s) = %s, expected %s", test.in, v, test.out)
+        }
+    }
+}
+
+func TestCompare(t *testing.T) {
+    ordered := []string{
+        "0.9.0", "1.0.0-alpha", "1.0.0-alpha.1", "1.0.0-alpha.beta",
+        "1.0.0-beta.2", "1.0.0-beta.11", "1.0.0", "1.0.1", "1.10.0", "2.0.0",
+    }
+
+    for i := 0; i < len(ordered) - 1; i++ {
+        a, _ := Parse(ordered[i])
+        b, _ := Parse(ordered[i+1])
+        if a.Compare(b) != -1 || b.Compare(a) != 1 {
+            t.Errorf("Expected %s < %s", a, b)
+        }
+        if a.Compare(a) != 0 {
+            t.Errorf("Expected %s == %s", a, a)
+        }
+    }
+}
+
+func TestConstraint(t *testing.T) {
+    tests := []struct {
+        constraint string
+        version string
+        match bool
+    }{
+        {"latest", "3.1.4", true},
+        {"latest", "3.1.4-rc.1", false},
+        {"1.2.3", "1.2.3", true},
+        {"1.2.3", "1.2.4", false},
+        {"1.2", "1.2.9", true},
+        {"1.2", "1.3.0", false},
+        {"1.x", "1.9.0", true},
+        {"^1.2", "1.2.0", true},
+        {"^1.2", "1.9.9", true},
+        {"^1.2", "2.0.0", false},
+        {"^1.2", "2.0.0-beta", false},
+        {"^1.2", "1.1.9", false},
+        {"^0.2.3", "0.2.9", true},
+        {"^0.2.3", "0.3.0", false},
+        {"^0.0.3", "0.0.4", false},
+        {"~1.2.3", "1.2.9", true},
+        {"~1.2.3", "1.3.0", false},
+        {">=1.0 <2.0", "1.5.0", true},
+        {">=1.0 <2.0", "2.0.0", false},
+        {">1.0", "1.0.0", false},
+        {"<=1.0", "1.0.0", true},
+        {"1.2.3-beta", "1.2.3-beta", true},
+        {">=1.2.3-beta", "1.2.3-rc", true},
+        {">=1.2.3-beta", "1.2.4-rc", false},
+    }
+
+    for _, test := range tests {
+        c, err := ParseConstraint(test.constraint)
+        if err != nil {
+            t.Errorf("ParseConstraint(%s) failed: %v", test.constraint, err)
+            continue
+        }
+        v, err := Parse(test.version)
+        if err != nil {
+            t.Errorf("Parse(%s) failed: %v", test.version, err)
+            continue
+        }
+        if c.Check(v) != test.match {
+            t.Errorf("%s satisfies %s = %v, expected %v",
+                test.version, test.constraint, !test.match, test.match)
+        }
+    }
+
+    for _, invalid := range []string{"", "^", "~x", ">=abc", "1.2.3.4"} {
+        if _, err := ParseConstraint(invalid); err == nil {
+            t.Errorf("ParseConstraint(%s) should have failed", invalid)
+        }
+    }
+}
+
+func TestResolve(t *testing.T) {
+    versions := []string{"1.0", "1.2.0", "1.10.1", "2.0.0-beta", "tip", "0.9"}
+
+    tests := map[string]int{
+        "latest": 2,
+        "^1.2": 2,
+        "~1.2": 1,
+        "<1.0": 5,
+        ">=2.0.0-beta": 3,
+        "3": -1,
+    }
+
+    for constraintStr, expected := range tests {
+        c, err := ParseConstraint(constraintStr)
+        if err != nil {
+            t.Fatalf("%v", err)
+        }
+        if i := Resolve(c, versions); i != expected {
+            t.Errorf("Resolve(%s) = %d, expected %d", constraintStr, i, expected)
+        }
+    }
+}
+
+func TestSplit(t *testing.T) {
+    if base, version := SplitName("my-service:1.0"); base != "my-service" || version != "1.0" {
+        t.Errorf("SplitName returned (%s, %s)", base, version)
+    }
+    if base, version := SplitName("test-entry"); base != "test-entry" || version != "" {
+        t.Errorf("SplitName returned (%s, %s)", base, version)
+    }
+    if base, c, ok := SplitQuery("my-service@^1.2"); base != "my-service" || c != "^1.2" || !ok {
+        t.Errorf("SplitQuery returned (%s, %s, %v)", base, c, ok)
+    }
+    if _, _, ok := SplitQuery("my-service:1.0"); ok {
+        t.Errorf("SplitQuery found constraint in plain name")
+    }
+}
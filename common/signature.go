@@ -0,0 +1,88 @@
+/* Copyright 2020 PhysarumSM Development Team
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package common
+
+// Publisher signatures over entries, checked by registry-service on add and by clients on lookup
+
+import (
+    "errors"
+    "strings"
+
+    "github.com/libp2p/go-libp2p-core/crypto"
+    "github.com/libp2p/go-libp2p-core/peer"
+)
+
+// Prefixed to signed data so entry signatures can't be mistaken for anything else signed by the same key
+const signaturePrefix = "physarum-service-registry-entry:"
+
+// The name is signed along with the info so a signed entry can't be replayed under another name
+// Names can't contain the newline separating them from the info, see CheckName
+func signedData(name, infoStr string) []byte {
+    return []byte(signaturePrefix + name + "\n" + infoStr)
+}
+
+// Check that name can be used for an entry
+// Otherwise a signature over ("a\nb", "c") would also hold for ("a", "b\nc")
+func CheckName(name string) error {
+    if strings.Contains(name, "\n") {
+        return errors.New("Service names must not contain a newline")
+    }
+    return nil
+}
+
+// Sign entry {name: infoStr} with the publisher's private key
+// Returns the marshalled public key and signature to send in AddRequest
+func SignEntry(priv crypto.PrivKey, name, infoStr string) (pubKey, signature []byte, err error) {
+    err = CheckName(name)
+    if err != nil {
+        return nil, nil, err
+    }
+
+    signature, err = priv.Sign(signedData(name, infoStr))
+    if err != nil {
+        return nil, nil, err
+    }
+
+    pubKey, err = crypto.MarshalPublicKey(priv.GetPublic())
+    if err != nil {
+        return nil, nil, err
+    }
+
+    return pubKey, signature, nil
+}
+
+// Check signature over entry {name: infoStr} made with SignEntry
+// Returns ID of the publisher that signed it
+func VerifyEntry(name, infoStr string, pubKey, signature []byte) (publisher peer.ID, err error) {
+    err = CheckName(name)
+    if err != nil {
+        return "", err
+    }
+
+    key, err := crypto.UnmarshalPublicKey(pubKey)
+    if err != nil {
+        return "", err
+    }
+
+    ok, err := key.Verify(signedData(name, infoStr), signature)
+    if err != nil {
+        return "", err
+    }
+    if !ok {
+        return "", errors.New("Signature does not match entry")
+    }
+
+    return peer.IDFromPublicKey(key)
+}
@@ -9,13 +9,26 @@ require (
 	github.com/PhysarumSM/common v0.10.0
 	github.com/PhysarumSM/docker-driver v0.3.0
 	github.com/PhysarumSM/service-manager v0.3.0
+	github.com/coreos/bbolt v1.3.3
+	github.com/coreos/etcd v3.3.27+incompatible // indirect
+	github.com/dgrijalva/jwt-go v3.2.0+incompatible // indirect
+	github.com/google/btree v1.0.0 // indirect
+	github.com/grpc-ecosystem/go-grpc-middleware v1.0.0 // indirect
+	github.com/grpc-ecosystem/go-grpc-prometheus v1.2.0 // indirect
+	github.com/grpc-ecosystem/grpc-gateway v1.9.5 // indirect
+	github.com/jonboulle/clockwork v0.1.0 // indirect
 	github.com/libp2p/go-libp2p v0.9.2
 	github.com/libp2p/go-libp2p-core v0.5.6
 	github.com/libp2p/go-libp2p-discovery v0.4.0
 	github.com/libp2p/go-libp2p-kad-dht v0.7.11
 	github.com/multiformats/go-multiaddr v0.2.2
 	github.com/prometheus/client_golang v1.6.0
+	github.com/soheilhy/cmux v0.1.4 // indirect
+	github.com/tmc/grpc-websocket-proxy v0.0.0-20200427203606-3cfed13b9966 // indirect
+	github.com/xiang90/probing v0.0.0-20190116061207-43a291ad63a2 // indirect
 	//go.etcd.io/etcd v0.5.0-alpha.5.0.20200212203316-09304a4d8263
-	go.etcd.io/etcd v3.3.22+incompatible
+	go.etcd.io/etcd v3.3.27+incompatible
 	golang.org/x/crypto v0.0.0-20200510223506-06a226fb4e37
+	golang.org/x/time v0.0.0-20181108054448-85acf8d2951c
+	sigs.k8s.io/yaml v1.2.0 // indirect
 )
@@ -75,6 +75,17 @@ func addCmd() {
         "Note that you still have to provide a config file since it is needed for performance requirements.")
     contentIdFlag := addFlags.String("content-id", "",
         "Instead of hashing to get a content ID, use this user specified string")
+    ifAbsentFlag := addFlags.Bool("if-absent", false,
+        "Only add if no service named <service-name> exists yet")
+    ifRevisionFlag := addFlags.Int64("if-revision", 0,
+        "Only add if <service-name> was last modified at this revision (see get).\n" +
+        "Fails instead of overwriting changes made by someone else since.")
+    ttlFlag := addFlags.Duration("ttl", 0,
+        "Have registry-service delete the entry unless it is renewed within this duration, eg. 10m.\n" +
+        "By default, the entry is kept until deleted.")
+    signKeyFlag := addFlags.String("sign-key", "",
+        "Sign the entry with the libp2p private key in this file, so clients can verify who published it.\n" +
+        "By default, the entry is unsigned.")
 
     addUsage := func() {
         exeName := getExeName()
@@ -245,8 +256,25 @@ Config is a json file used to setup the microservice. Its format is as follows:
         CpuReq: config.CpuReq,
         MemoryReq: config.MemoryReq,
     }
+    addOpts := []registry.AddOption{}
+    if *ifAbsentFlag {
+        addOpts = append(addOpts, registry.IfAbsent())
+    }
+    if *ifRevisionFlag != 0 {
+        addOpts = append(addOpts, registry.IfRevision(*ifRevisionFlag))
+    }
+    if *ttlFlag > 0 {
+        addOpts = append(addOpts, registry.WithTTL(*ttlFlag))
+    }
+    if *signKeyFlag != "" {
+        priv, err := util.LoadPrivKeyFromFile(*signKeyFlag)
+        if err != nil {
+            log.Fatalln(err)
+        }
+        addOpts = append(addOpts, registry.SignedBy(priv))
+    }
     respStr, err := registry.AddServiceWithHostRouting(
-        ctx, node.Host, node.RoutingDiscovery, serviceName, info)
+        ctx, node.Host, node.RoutingDiscovery, serviceName, info, addOpts...)
     if err != nil {
         log.Fatalln(err)
     }
@@ -0,0 +1,119 @@
+/* Copyright 2020 PhysarumSM Development Team
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+    "flag"
+    "fmt"
+    "log"
+    "os"
+    "time"
+
+    "github.com/libp2p/go-libp2p-core/peer"
+
+    "github.com/PhysarumSM/service-registry/registry"
+)
+
+func auditCmd() {
+    auditFlags := flag.NewFlagSet("audit", flag.ExitOnError)
+
+    auditUsage := func() {
+        exeName := getExeName()
+        fmt.Fprintf(os.Stderr, "Usage of %s audit:\n", exeName)
+        fmt.Fprintf(os.Stderr, "$ %s audit [OPTIONS ...]\n", exeName)
+        fmt.Fprintln(os.Stderr,
+`
+Show who changed what in the registry, newest first
+Digests are of a microservice's information before and after the change
+
+OPTIONS:`)
+        auditFlags.PrintDefaults()
+    }
+    name := auditFlags.String("name", "",
+        "Only show changes to the microservice with this name")
+    peerStr := auditFlags.String("peer", "",
+        "Only show changes made by the peer with this ID")
+    since := auditFlags.String("since", "",
+        "Only show changes made at or after this time, eg. 2020-06-01T00:00:00Z")
+    until := auditFlags.String("until", "",
+        "Only show changes made before this time, eg. 2020-07-01T00:00:00Z")
+    limit := auditFlags.Int64("limit", 100,
+        "Show at most this many changes, 0 for all")
+
+    auditFlags.Usage = auditUsage
+    auditFlags.Parse(flag.Args()[1:])
+
+    if len(auditFlags.Args()) > 0 {
+        fmt.Fprintln(os.Stderr, "Error: too many arguments")
+        auditUsage()
+        return
+    }
+
+    opts := []registry.AuditOption{registry.AuditLimit(*limit)}
+    if *name != "" {
+        opts = append(opts, registry.AuditService(*name))
+    }
+    if *peerStr != "" {
+        id, err := peer.IDB58Decode(*peerStr)
+        if err != nil {
+            log.Fatalln("Invalid peer ID:", err)
+        }
+        opts = append(opts, registry.AuditPeer(id))
+    }
+    sinceTime, err := parseAuditTime(*since)
+    if err != nil {
+        log.Fatalln(err)
+    }
+    untilTime, err := parseAuditTime(*until)
+    if err != nil {
+        log.Fatalln(err)
+    }
+    opts = append(opts, registry.AuditBetween(sinceTime, untilTime))
+
+    ctx, node, err := setupNode(*bootstraps, *psk)
+    if err != nil {
+        log.Fatalln(err)
+    }
+    defer node.Close()
+
+    records, err := registry.GetAuditLogWithHostRouting(ctx, node.Host, node.RoutingDiscovery, opts...)
+    if err != nil {
+        log.Fatalln(err)
+    }
+
+    fmt.Println("Response:")
+    for _, record := range records {
+        fmt.Printf("%s %s %s by %s\n",
+            record.Time.Format(time.RFC3339), record.Protocol, record.Name, record.Peer.Pretty())
+        if record.OldDigest != "" || record.NewDigest != "" {
+            fmt.Printf("    %s -> %s\n", digestOrNone(record.OldDigest), digestOrNone(record.NewDigest))
+        }
+    }
+}
+
+// Zero time if value is empty
+func parseAuditTime(value string) (t time.Time, err error) {
+    if value == "" {
+        return t, nil
+    }
+    return time.Parse(time.RFC3339, value)
+}
+
+func digestOrNone(digest string) string {
+    if digest == "" {
+        return "(none)"
+    }
+    return digest
+}
@@ -0,0 +1,166 @@
+/* Copyright 2020 PhysarumSM Development Team
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+// Backups of all entries in the registry, written by the export command and read by the import command
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "sort"
+    "time"
+
+    "github.com/libp2p/go-libp2p-core/peer"
+
+    "github.com/PhysarumSM/service-registry/registry"
+)
+
+// Format of a backup file
+type backup struct {
+    // Time the export started
+    ExportedAt time.Time
+
+    // Sorted by name
+    Entries []backupEntry
+}
+
+// Peer IDs are kept in their base58 form
+type backupEntry struct {
+    Name string
+
+    // Serialized info exactly as stored, imported as is so fields unknown to this version of
+    // ServiceInfo, and signatures, still hold
+    InfoStr string
+
+    // Revision the entry had when exported, only kept for reference since imports get new revisions
+    Revision int64
+
+    // Peer the entry is handed over to after it is imported, see transfer-ownership
+    Owner string `json:",omitempty"`
+
+    Signature *backupSignature `json:",omitempty"`
+}
+
+// Signature over the entry's InfoStr
+type backupSignature struct {
+    Publisher string
+    PublicKey []byte
+    Signature []byte
+}
+
+// What import does with an entry of the backup
+type importAction string
+
+const (
+    importAdd importAction = "add"
+    importOverwrite importAction = "overwrite"
+    importSkip importAction = "skip"
+)
+
+func newBackup(exportedAt time.Time, nameToEntry map[string]registry.ServiceEntry) backup {
+    b := backup{ExportedAt: exportedAt, Entries: []backupEntry{}}
+    for _, entry := range nameToEntry {
+        e := backupEntry{
+            Name: entry.Name,
+            InfoStr: entry.InfoStr,
+            Revision: entry.Revision,
+        }
+        if entry.Owner != "" {
+            e.Owner = entry.Owner.Pretty()
+        }
+        if entry.Signature != nil {
+            e.Signature = &backupSignature{
+                Publisher: entry.Signature.Publisher.Pretty(),
+                PublicKey: entry.Signature.PublicKey,
+                Signature: entry.Signature.Signature,
+            }
+        }
+        b.Entries = append(b.Entries, e)
+    }
+    sort.Slice(b.Entries, func(i, j int) bool {
+        return b.Entries[i].Name < b.Entries[j].Name
+    })
+    return b
+}
+
+func unmarshalBackup(data []byte) (b backup, err error) {
+    err = json.Unmarshal(data, &b)
+    if err != nil {
+        return b, err
+    }
+
+    seen := make(map[string]bool)
+    for _, e := range b.Entries {
+        if e.Name == "" {
+            return b, errors.New("Backup has an entry without a name")
+        }
+        if seen[e.Name] {
+            return b, fmt.Errorf("Backup has more than one entry named %s", e.Name)
+        }
+        seen[e.Name] = true
+
+        if e.InfoStr == "" {
+            return b, fmt.Errorf("Backup entry %s has no info", e.Name)
+        }
+
+        if e.Owner != "" {
+            _, err = peer.IDB58Decode(e.Owner)
+            if err != nil {
+                return b, fmt.Errorf("Invalid owner of %s: %v", e.Name, err)
+            }
+        }
+        if e.Signature != nil {
+            _, err = peer.IDB58Decode(e.Signature.Publisher)
+            if err != nil {
+                return b, fmt.Errorf("Invalid publisher of %s: %v", e.Name, err)
+            }
+        }
+    }
+    return b, nil
+}
+
+// Options adding e as it was exported
+func (e backupEntry) addOptions() []registry.AddOption {
+    opts := []registry.AddOption{registry.WithInfoStr(e.InfoStr)}
+    if e.Signature == nil {
+        return opts
+    }
+    // Publisher was checked by unmarshalBackup, registry-service derives it from the key anyway
+    publisher, _ := peer.IDB58Decode(e.Signature.Publisher)
+    return append(opts, registry.WithSignature(registry.EntrySignature{
+        Publisher: publisher,
+        InfoStr: e.InfoStr,
+        PublicKey: e.Signature.PublicKey,
+        Signature: e.Signature.Signature,
+    }))
+}
+
+// Decide what import does with each entry of b, given the names of the entries that already exist
+// Existing entries are skipped unless overwrite is set
+func planImport(b backup, existing map[string]bool, overwrite bool) map[string]importAction {
+    plan := make(map[string]importAction)
+    for _, e := range b.Entries {
+        switch {
+        case !existing[e.Name]:
+            plan[e.Name] = importAdd
+        case overwrite:
+            plan[e.Name] = importOverwrite
+        default:
+            plan[e.Name] = importSkip
+        }
+    }
+    return plan
+}
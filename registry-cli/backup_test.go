@@ -0,0 +1,115 @@
+/* Copyright 2020 PhysarumSM Development Team
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+    "encoding/json"
+    "testing"
+    "time"
+
+    "github.com/libp2p/go-libp2p-core/crypto"
+    "github.com/libp2p/go-libp2p-core/peer"
+
+    "github.com/PhysarumSM/service-registry/registry"
+)
+
+func TestBackupRoundTrip(t *testing.T) {
+    _, pub, err := crypto.GenerateKeyPair(crypto.Ed25519, 0)
+    if err != nil {
+        t.Fatalf("%v", err)
+    }
+    owner, err := peer.IDFromPublicKey(pub)
+    if err != nil {
+        t.Fatalf("%v", err)
+    }
+
+    signature := &registry.EntrySignature{
+        Publisher: owner,
+        InfoStr: `{"ContentHash":"abc"}`,
+        PublicKey: []byte("public-key"),
+        Signature: []byte("signature"),
+    }
+    // Fields unknown to ServiceInfo must survive the round trip
+    unknownFields := `{"ContentHash":"def","FutureField":1}`
+    nameToEntry := map[string]registry.ServiceEntry{
+        "my-service:2.0": registry.ServiceEntry{
+            Name: "my-service:2.0",
+            Info: registry.ServiceInfo{ContentHash: "def"},
+            InfoStr: unknownFields,
+            Revision: 7,
+        },
+        "my-service:1.0": registry.ServiceEntry{
+            Name: "my-service:1.0",
+            Info: registry.ServiceInfo{ContentHash: "abc"},
+            InfoStr: signature.InfoStr,
+            Revision: 5,
+            Owner: owner,
+            Signature: signature,
+        },
+    }
+
+    data, err := json.Marshal(newBackup(time.Now(), nameToEntry))
+    if err != nil {
+        t.Fatalf("%v", err)
+    }
+    b, err := unmarshalBackup(data)
+    if err != nil {
+        t.Fatalf("%v", err)
+    }
+
+    if len(b.Entries) != 2 || b.Entries[0].Name != "my-service:1.0" || b.Entries[1].Name != "my-service:2.0" {
+        t.Fatalf("Backup has entries %v, expected my-service:1.0 and 2.0 in order", b.Entries)
+    }
+    e := b.Entries[0]
+    if e.Owner != owner.Pretty() || e.Revision != 5 || e.InfoStr != signature.InfoStr {
+        t.Errorf("Entry %+v lost its owner, revision or info", e)
+    }
+    if e.Signature == nil || e.Signature.Publisher != owner.Pretty() || string(e.Signature.Signature) != "signature" {
+        t.Errorf("Entry signature %+v does not match %+v", e.Signature, signature)
+    }
+    if b.Entries[1].InfoStr != unknownFields {
+        t.Errorf("Unsigned entry has info %s, expected %s as exported", b.Entries[1].InfoStr, unknownFields)
+    }
+    if len(e.addOptions()) != 2 || len(b.Entries[1].addOptions()) != 1 {
+        t.Errorf("Only the signed entry should be added with its signature")
+    }
+
+    _, err = unmarshalBackup([]byte(`{"Entries": [{"Name": "a", "InfoStr": "{}"}, {"Name": "a", "InfoStr": "{}"}]}`))
+    if err == nil {
+        t.Errorf("Backup with duplicate names was accepted")
+    }
+    _, err = unmarshalBackup([]byte(`{"Entries": [{"Name": "a", "InfoStr": "{}", "Owner": "not-a-peer"}]}`))
+    if err == nil {
+        t.Errorf("Backup with invalid owner was accepted")
+    }
+    _, err = unmarshalBackup([]byte(`{"Entries": [{"Name": "a"}]}`))
+    if err == nil {
+        t.Errorf("Backup entry without info was accepted")
+    }
+}
+
+func TestPlanImport(t *testing.T) {
+    b := backup{Entries: []backupEntry{{Name: "new"}, {Name: "existing"}}}
+    existing := map[string]bool{"existing": true, "other": true}
+
+    plan := planImport(b, existing, false)
+    if plan["new"] != importAdd || plan["existing"] != importSkip || len(plan) != 2 {
+        t.Errorf("Plan without overwrite is %v, expected to add new and skip existing", plan)
+    }
+    plan = planImport(b, existing, true)
+    if plan["new"] != importAdd || plan["existing"] != importOverwrite {
+        t.Errorf("Plan with overwrite is %v, expected to add new and overwrite existing", plan)
+    }
+}
@@ -33,6 +33,7 @@ func deleteCmd() {
         fmt.Fprintln(os.Stderr,
 `
 Delete a microservice entry
+It can be restored with the undelete command until registry-service purges it
 
 <service-name>
         Name of microservice to delete
@@ -0,0 +1,92 @@
+/* Copyright 2020 PhysarumSM Development Team
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+    "encoding/json"
+    "flag"
+    "fmt"
+    "io/ioutil"
+    "log"
+    "os"
+    "time"
+
+    "github.com/PhysarumSM/service-registry/registry"
+)
+
+func exportCmd() {
+    exportFlags := flag.NewFlagSet("export", flag.ExitOnError)
+
+    exportUsage := func() {
+        exeName := getExeName()
+        fmt.Fprintf(os.Stderr, "Usage of %s export:\n", exeName)
+        fmt.Fprintf(os.Stderr, "$ %s export [OPTIONS ...] > backup.json\n", exeName)
+        fmt.Fprintln(os.Stderr,
+`
+Write all microservice entries, along with their owners and signatures, as a backup
+that can be restored with the import command
+Deleted entries, history and leases are not included
+
+OPTIONS:`)
+        exportFlags.PrintDefaults()
+    }
+    prefix := exportFlags.String("prefix", "",
+        "Only export microservices whose names begin with this prefix, eg. my-service:")
+    output := exportFlags.String("output", "",
+        "File to write the backup to instead of stdout")
+
+    exportFlags.Usage = exportUsage
+    exportFlags.Parse(flag.Args()[1:])
+
+    if len(exportFlags.Args()) > 0 {
+        fmt.Fprintln(os.Stderr, "Error: too many arguments")
+        exportUsage()
+        return
+    }
+
+    ctx, node, err := setupNode(*bootstraps, *psk)
+    if err != nil {
+        log.Fatalln(err)
+    }
+    defer node.Close()
+
+    exportedAt := time.Now().UTC()
+    nameToEntry := make(map[string]registry.ServiceEntry)
+    pages := registry.ListServicePagesWithHostRouting(ctx, node.Host, node.RoutingDiscovery, *prefix, listPageSize)
+    for pages.Next() {
+        for serviceName, entry := range pages.Page() {
+            nameToEntry[serviceName] = entry
+        }
+    }
+    if err := pages.Err(); err != nil {
+        log.Fatalln(err)
+    }
+
+    data, err := json.MarshalIndent(newBackup(exportedAt, nameToEntry), "", "    ")
+    if err != nil {
+        log.Fatalln(err)
+    }
+    data = append(data, '\n')
+
+    if *output == "" {
+        _, err = os.Stdout.Write(data)
+    } else {
+        err = ioutil.WriteFile(*output, data, 0600)
+    }
+    if err != nil {
+        log.Fatalln(err)
+    }
+    log.Printf("Exported %d entries\n", len(nameToEntry))
+}
@@ -20,6 +20,7 @@ import (
     "fmt"
     "log"
     "os"
+    "sort"
 
     "github.com/PhysarumSM/service-registry/registry"
 )
@@ -31,20 +32,43 @@ func getCmd() {
         exeName := getExeName()
         fmt.Fprintf(os.Stderr, "Usage of %s get:\n", exeName)
         fmt.Fprintf(os.Stderr, "$ %s get [OPTIONS ...] <service-name>\n", exeName)
+        fmt.Fprintf(os.Stderr, "$ %s get --by-content-hash <hash>\n", exeName)
+        fmt.Fprintf(os.Stderr, "$ %s get --by-docker-hash <hash>\n", exeName)
         fmt.Fprintln(os.Stderr,
 `
-Get information about a microservice
+Get information about a microservice, or find the microservices with a
+content or docker hash
 
 <service-name>
         Name of microservice to get hash of
+        Use <name>@<constraint> to get the highest version satisfying a
+        semver constraint, eg. my-service@^1.2, my-service@~1.2.3 or my-service@latest
 
 OPTIONS:`)
         getFlags.PrintDefaults()
     }
-    
+    contentHash := getFlags.String("by-content-hash", "",
+        "Find the microservices with this content hash instead of getting one by name")
+    dockerHash := getFlags.String("by-docker-hash", "",
+        "Find the microservices with this docker hash instead of getting one by name")
+    revision := getFlags.Int64("revision", 0,
+        "Get the microservice as it was at this revision instead of its latest version,\n" +
+        "see the history command")
+
     getFlags.Usage = getUsage
     getFlags.Parse(flag.Args()[1:])
 
+    if *contentHash != "" || *dockerHash != "" {
+        if (*contentHash != "" && *dockerHash != "") || len(getFlags.Args()) > 0 {
+            fmt.Fprintln(os.Stderr,
+                "Error: --by-content-hash and --by-docker-hash take the place of <service-name> and each other")
+            getUsage()
+            return
+        }
+        findByHash(*contentHash, *dockerHash)
+        return
+    }
+
     if len(getFlags.Args()) < 1 {
         fmt.Fprintln(os.Stderr, "Error: missing required argument <name>")
         getUsage()
@@ -65,16 +89,63 @@ OPTIONS:`)
     }
     defer node.Close()
 
-    info, err := registry.GetServiceWithHostRouting(
-        ctx, node.Host, node.RoutingDiscovery, serviceName)
+    opts := []registry.LookupOption{}
+    if *revision != 0 {
+        opts = append(opts, registry.AtRevision(*revision))
+    }
+    entry, err := registry.GetServiceEntryWithHostRouting(
+        ctx, node.Host, node.RoutingDiscovery, serviceName, opts...)
+    if err != nil {
+        log.Fatalln(err)
+    }
+
+    fmt.Println("Response:")
+    printEntry(entry)
+}
+
+// Get the microservices with either contentHash or dockerHash, whichever is not empty
+func findByHash(contentHash, dockerHash string) {
+    ctx, node, err := setupNode(*bootstraps, *psk)
     if err != nil {
         log.Fatalln(err)
     }
+    defer node.Close()
 
-    infoBytes, err := json.Marshal(info)
+    var nameToEntry map[string]registry.ServiceEntry
+    if contentHash != "" {
+        nameToEntry, err = registry.FindByContentHashWithHostRouting(
+            ctx, node.Host, node.RoutingDiscovery, contentHash)
+    } else {
+        nameToEntry, err = registry.FindByDockerHashWithHostRouting(
+            ctx, node.Host, node.RoutingDiscovery, dockerHash)
+    }
     if err != nil {
         log.Fatalln(err)
     }
+
+    serviceNames := make([]string, 0, len(nameToEntry))
+    for serviceName := range nameToEntry {
+        serviceNames = append(serviceNames, serviceName)
+    }
+    sort.Strings(serviceNames)
+
     fmt.Println("Response:")
+    for _, serviceName := range serviceNames {
+        printEntry(nameToEntry[serviceName])
+    }
+}
+
+func printEntry(entry registry.ServiceEntry) {
+    infoBytes, err := json.Marshal(entry.Info)
+    if err != nil {
+        log.Fatalln(err)
+    }
+    fmt.Printf("%s (revision %d)\n", entry.Name, entry.Revision)
+    if entry.Signature != nil {
+        fmt.Println("Signed by", entry.Signature.Publisher.Pretty())
+    }
+    if entry.Owner != "" {
+        fmt.Println("Owned by", entry.Owner.Pretty())
+    }
     fmt.Println(string(infoBytes))
 }
\ No newline at end of file
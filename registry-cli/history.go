@@ -0,0 +1,84 @@
+/* Copyright 2020 PhysarumSM Development Team
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+    "flag"
+    "fmt"
+    "log"
+    "os"
+
+    "github.com/PhysarumSM/service-registry/registry"
+)
+
+func historyCmd() {
+    historyFlags := flag.NewFlagSet("history", flag.ExitOnError)
+
+    historyUsage := func() {
+        exeName := getExeName()
+        fmt.Fprintf(os.Stderr, "Usage of %s history:\n", exeName)
+        fmt.Fprintf(os.Stderr, "$ %s history [OPTIONS ...] <service-name>\n", exeName)
+        fmt.Fprintln(os.Stderr,
+`
+Show past versions of a microservice entry, newest first
+Get a past version in full with get --revision
+
+<service-name>
+        Name of microservice to show versions of
+
+OPTIONS:`)
+        historyFlags.PrintDefaults()
+    }
+    limit := historyFlags.Int64("limit", 0,
+        "Show at most this many versions, 0 for all")
+
+    historyFlags.Usage = historyUsage
+    historyFlags.Parse(flag.Args()[1:])
+
+    if len(historyFlags.Args()) < 1 {
+        fmt.Fprintln(os.Stderr, "Error: missing required argument <service-name>")
+        historyUsage()
+        return
+    }
+
+    if len(historyFlags.Args()) > 1 {
+        fmt.Fprintln(os.Stderr, "Error: too many arguments")
+        historyUsage()
+        return
+    }
+
+    serviceName := historyFlags.Arg(0)
+
+    ctx, node, err := setupNode(*bootstraps, *psk)
+    if err != nil {
+        log.Fatalln(err)
+    }
+    defer node.Close()
+
+    versions, err := registry.GetServiceHistoryWithHostRouting(
+        ctx, node.Host, node.RoutingDiscovery, serviceName, *limit)
+    if err != nil {
+        log.Fatalln(err)
+    }
+
+    fmt.Println("Response:")
+    for _, version := range versions {
+        if version.Deleted {
+            fmt.Printf("%s (revision %d)\nDeleted\n", version.Name, version.Revision)
+            continue
+        }
+        printEntry(version.ServiceEntry)
+    }
+}
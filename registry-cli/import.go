@@ -0,0 +1,171 @@
+/* Copyright 2020 PhysarumSM Development Team
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+    "errors"
+    "flag"
+    "fmt"
+    "io/ioutil"
+    "log"
+    "os"
+
+    "github.com/libp2p/go-libp2p-core/peer"
+
+    "github.com/PhysarumSM/service-registry/registry"
+)
+
+// Past tense of each action, for reporting entries once imported
+var importDone = map[importAction]string{
+    importAdd: "added",
+    importOverwrite: "overwritten",
+    importSkip: "skipped",
+}
+
+func importCmd() {
+    importFlags := flag.NewFlagSet("import", flag.ExitOnError)
+
+    importUsage := func() {
+        exeName := getExeName()
+        fmt.Fprintf(os.Stderr, "Usage of %s import:\n", exeName)
+        fmt.Fprintf(os.Stderr, "$ %s import [OPTIONS ...] <backup-file>\n", exeName)
+        fmt.Fprintln(os.Stderr,
+`
+Add the microservice entries of a backup written by the export command
+Entries are handed over to the owners they had when exported, and keep their signatures
+Entries that already exist are skipped, unless --overwrite is given
+
+<backup-file>
+        Backup to import, - for stdin
+
+OPTIONS:`)
+        importFlags.PrintDefaults()
+    }
+    dryRun := importFlags.Bool("dry-run", false,
+        "Only show what would be imported, without changing anything")
+    overwrite := importFlags.Bool("overwrite", false,
+        "Replace entries that already exist instead of skipping them\n" +
+        "Entries owned by other peers can only be replaced by registry-service admins")
+
+    importFlags.Usage = importUsage
+    importFlags.Parse(flag.Args()[1:])
+
+    if len(importFlags.Args()) < 1 {
+        fmt.Fprintln(os.Stderr, "Error: missing required argument <backup-file>")
+        importUsage()
+        return
+    }
+
+    if len(importFlags.Args()) > 1 {
+        fmt.Fprintln(os.Stderr, "Error: too many arguments")
+        importUsage()
+        return
+    }
+
+    var data []byte
+    var err error
+    if path := importFlags.Arg(0); path == "-" {
+        data, err = ioutil.ReadAll(os.Stdin)
+    } else {
+        data, err = ioutil.ReadFile(path)
+    }
+    if err != nil {
+        log.Fatalln(err)
+    }
+    b, err := unmarshalBackup(data)
+    if err != nil {
+        log.Fatalln("Invalid backup:", err)
+    }
+
+    ctx, node, err := setupNode(*bootstraps, *psk)
+    if err != nil {
+        log.Fatalln(err)
+    }
+    defer node.Close()
+
+    existing := make(map[string]bool)
+    pages := registry.ListServicePagesWithHostRouting(ctx, node.Host, node.RoutingDiscovery, "", listPageSize)
+    for pages.Next() {
+        for serviceName := range pages.Page() {
+            existing[serviceName] = true
+        }
+    }
+    if err := pages.Err(); err != nil {
+        log.Fatalln(err)
+    }
+    plan := planImport(b, existing, *overwrite)
+
+    fmt.Printf("Importing %d entries exported at %s\n", len(b.Entries), b.ExportedAt)
+    counts := make(map[importAction]int)
+    failed := 0
+    for _, e := range b.Entries {
+        action := plan[e.Name]
+        if *dryRun {
+            fmt.Printf("%s: would %s\n", e.Name, action)
+            counts[action]++
+            continue
+        }
+        if action == importSkip {
+            fmt.Printf("%s: skipped, already exists\n", e.Name)
+            counts[action]++
+            continue
+        }
+
+        opts := e.addOptions()
+        if action == importAdd {
+            // Entries added since the list was taken are skipped rather than overwritten
+            opts = append(opts, registry.IfAbsent())
+        }
+        // The info is sent as exported by addOptions
+        _, err := registry.AddServiceWithHostRouting(
+            ctx, node.Host, node.RoutingDiscovery, e.Name, registry.ServiceInfo{}, opts...)
+        var conflict *registry.ConflictError
+        if errors.As(err, &conflict) {
+            fmt.Printf("%s: skipped, added by someone else meanwhile\n", e.Name)
+            counts[importSkip]++
+            continue
+        }
+        if err != nil {
+            fmt.Printf("%s: failed: %v\n", e.Name, err)
+            failed++
+            continue
+        }
+
+        // Owner was checked by unmarshalBackup
+        owner, _ := peer.IDB58Decode(e.Owner)
+        if e.Owner != "" && owner != node.Host.ID() {
+            _, err = registry.TransferOwnershipWithHostRouting(
+                ctx, node.Host, node.RoutingDiscovery, e.Name, owner)
+            if err != nil {
+                fmt.Printf("%s: %s, but failed to hand over to %s: %v\n",
+                    e.Name, importDone[action], e.Owner, err)
+                failed++
+                continue
+            }
+        }
+        fmt.Printf("%s: %s\n", e.Name, importDone[action])
+        counts[action]++
+    }
+
+    verb := ""
+    if *dryRun {
+        verb = "would be "
+    }
+    fmt.Printf("%d %sadded, %d %soverwritten, %d %sskipped\n",
+        counts[importAdd], verb, counts[importOverwrite], verb, counts[importSkip], verb)
+    if failed > 0 {
+        log.Fatalf("Failed to import %d entries\n", failed)
+    }
+}
@@ -20,10 +20,16 @@ import (
     "fmt"
     "log"
     "os"
+    "sort"
+    "time"
 
+    "github.com/PhysarumSM/service-registry/common/semver"
     "github.com/PhysarumSM/service-registry/registry"
 )
 
+// Number of microservices fetched per request
+const listPageSize = 500
+
 func listCmd() {
     listFlags := flag.NewFlagSet("list", flag.ExitOnError)
 
@@ -34,10 +40,17 @@ func listCmd() {
         fmt.Fprintln(os.Stderr,
 `
 List all microservices and information stored by the registry-service
+Versions of a microservice (<name>:<version>) are grouped under its name
 
 OPTIONS:`)
         listFlags.PrintDefaults()
     }
+    prefix := listFlags.String("prefix", "",
+        "Only list microservices whose names begin with this prefix, eg. my-service:")
+    limit := listFlags.Int64("limit", 0,
+        "List at most this many microservices, 0 for all")
+    deleted := listFlags.Bool("deleted", false,
+        "List deleted microservices that can still be restored with the undelete command instead")
     
     listFlags.Usage = listUsage
     listFlags.Parse(flag.Args()[1:])
@@ -48,17 +61,119 @@ OPTIONS:`)
     }
     defer node.Close()
 
-    nameToInfo, err := registry.ListServicesWithHostRouting(ctx, node.Host, node.RoutingDiscovery)
-    if err != nil {
+    if *deleted {
+        nameToEntry, err := registry.ListDeletedServicesWithHostRouting(
+            ctx, node.Host, node.RoutingDiscovery, *prefix)
+        if err != nil {
+            log.Fatalln(err)
+        }
+        printDeleted(nameToEntry, *limit)
+        return
+    }
+
+    pageSize := int64(listPageSize)
+    if *limit > 0 && *limit < pageSize {
+        pageSize = *limit
+    }
+
+    nameToInfo := make(map[string]registry.ServiceInfo)
+    pages := registry.ListServicePagesWithHostRouting(ctx, node.Host, node.RoutingDiscovery, *prefix, pageSize)
+    full := func() bool {
+        return *limit > 0 && int64(len(nameToInfo)) >= *limit
+    }
+    for !full() && pages.Next() {
+        // Pages are in name order, so the first services of the last page are the ones within the limit
+        page := pages.Page()
+        serviceNames := make([]string, 0, len(page))
+        for serviceName := range page {
+            serviceNames = append(serviceNames, serviceName)
+        }
+        sort.Strings(serviceNames)
+        for _, serviceName := range serviceNames {
+            if full() {
+                break
+            }
+            nameToInfo[serviceName] = page[serviceName].Info
+        }
+    }
+    if err := pages.Err(); err != nil {
         log.Fatalln(err)
     }
 
     fmt.Println("Response:")
-    for serviceName, info := range nameToInfo {
-        infoBytes, err := json.Marshal(info)
+    baseToVersions := groupVersions(nameToInfo)
+    bases := make([]string, 0, len(baseToVersions))
+    for base := range baseToVersions {
+        bases = append(bases, base)
+    }
+    sort.Strings(bases)
+
+    for _, base := range bases {
+        fmt.Printf("Service Name: %s\n", base)
+        for _, version := range baseToVersions[base] {
+            serviceName := base
+            if version != "" {
+                serviceName += semver.VersionSeparator + version
+            }
+            infoBytes, err := json.Marshal(nameToInfo[serviceName])
+            if err != nil {
+                log.Fatalln(err)
+            }
+            if version == "" {
+                version = "(unversioned)"
+            }
+            fmt.Printf("    Version: %s, Info: %s\n", version, string(infoBytes))
+        }
+    }
+}
+
+// Print deleted services in name order, at most limit unless 0
+func printDeleted(nameToEntry map[string]registry.DeletedEntry, limit int64) {
+    serviceNames := make([]string, 0, len(nameToEntry))
+    for serviceName := range nameToEntry {
+        serviceNames = append(serviceNames, serviceName)
+    }
+    sort.Strings(serviceNames)
+    if limit > 0 && int64(len(serviceNames)) > limit {
+        serviceNames = serviceNames[:limit]
+    }
+
+    fmt.Println("Response:")
+    for _, serviceName := range serviceNames {
+        entry := nameToEntry[serviceName]
+        infoBytes, err := json.Marshal(entry.Info)
         if err != nil {
             log.Fatalln(err)
         }
-        fmt.Printf("Service Name: %s, Info: %s\n", serviceName, string(infoBytes))
+        fmt.Printf("Service Name: %s\n", serviceName)
+        fmt.Printf("    Deleted By: %s, Deleted At: %s\n", entry.DeletedBy.Pretty(), entry.DeletedAt.Format(time.RFC3339))
+        fmt.Printf("    Info: %s\n", string(infoBytes))
+    }
+}
+
+// Group service names by base name
+// Returns mapping from base name to its versions, sorted lowest to highest
+func groupVersions(nameToInfo map[string]registry.ServiceInfo) (baseToVersions map[string][]string) {
+    baseToVersions = make(map[string][]string)
+    for serviceName := range nameToInfo {
+        base, version := semver.SplitName(serviceName)
+        baseToVersions[base] = append(baseToVersions[base], version)
     }
+
+    for _, versions := range baseToVersions {
+        sort.Slice(versions, func(i, j int) bool {
+            vi, errI := semver.Parse(versions[i])
+            vj, errJ := semver.Parse(versions[j])
+            if errI != nil || errJ != nil {
+                // Non-semver versions sort before semver ones, then alphabetically
+                if (errI == nil) != (errJ == nil) {
+                    return errI != nil
+                }
+                return versions[i] < versions[j]
+            }
+            return vi.Compare(vj) < 0
+        })
+    }
+
+    return baseToVersions
 }
\ No newline at end of file
@@ -0,0 +1,101 @@
+/* Copyright 2020 PhysarumSM Development Team
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+    "encoding/json"
+    "flag"
+    "fmt"
+    "log"
+    "os"
+    "sort"
+
+    "github.com/PhysarumSM/service-registry/registry"
+)
+
+func queryCmd() {
+    queryFlags := flag.NewFlagSet("query", flag.ExitOnError)
+
+    queryUsage := func() {
+        exeName := getExeName()
+        fmt.Fprintf(os.Stderr, "Usage of %s query:\n", exeName)
+        fmt.Fprintf(os.Stderr, "$ %s query [OPTIONS ...]\n", exeName)
+        fmt.Fprintln(os.Stderr,
+`
+Find microservices whose requirements are met by a node with the given
+resources and network conditions, eg.
+$ registry-cli query --cpu 2 --memory 1024 --rtt 50ms
+CPU and memory are in the units of the microservices' CpuReq and MemoryReq
+
+OPTIONS:`)
+        queryFlags.PrintDefaults()
+    }
+    prefix := queryFlags.String("prefix", "",
+        "Only match microservices whose names begin with this prefix")
+    cpu := queryFlags.Int("cpu", 0,
+        "CPU available on the node, 0 to not check")
+    memory := queryFlags.Int("memory", 0,
+        "Memory available on the node, 0 to not check")
+    rtt := queryFlags.Duration("rtt", 0,
+        "RTT between the node and its clients, which must meet the microservices'\n" +
+        "hard network requirement, 0 to not check")
+    soft := queryFlags.Bool("soft", false,
+        "Also require --rtt to meet the microservices' soft network requirement")
+
+    queryFlags.Usage = queryUsage
+    queryFlags.Parse(flag.Args()[1:])
+
+    if len(queryFlags.Args()) > 0 {
+        fmt.Fprintln(os.Stderr, "Error: too many arguments")
+        queryUsage()
+        return
+    }
+
+    ctx, node, err := setupNode(*bootstraps, *psk)
+    if err != nil {
+        log.Fatalln(err)
+    }
+    defer node.Close()
+
+    query := registry.Query{
+        Prefix: *prefix,
+        Cpu: *cpu,
+        Memory: *memory,
+        RTT: *rtt,
+        MeetSoftReq: *soft,
+    }
+    nameToEntry, err := registry.QueryServicesWithHostRouting(ctx, node.Host, node.RoutingDiscovery, query)
+    if err != nil {
+        log.Fatalln(err)
+    }
+
+    serviceNames := make([]string, 0, len(nameToEntry))
+    for serviceName := range nameToEntry {
+        serviceNames = append(serviceNames, serviceName)
+    }
+    sort.Strings(serviceNames)
+
+    fmt.Println("Response:")
+    if len(serviceNames) == 0 {
+        fmt.Println("No matching microservices")
+    }
+    for _, serviceName := range serviceNames {
+        infoBytes, err := json.Marshal(nameToEntry[serviceName].Info)
+        if err != nil {
+            log.Fatalln(err)
+        }
+        fmt.Printf("Service Name: %s, Info: %s\n", serviceName, string(infoBytes))
+    }
+}
@@ -30,6 +30,7 @@ import (
 
     "github.com/PhysarumSM/common/p2pnode"
     "github.com/PhysarumSM/common/util"
+    "github.com/PhysarumSM/service-registry/common"
 )
 
 type commandData struct {
@@ -55,17 +56,62 @@ var (
             "List all microservices and information stored by the registry-service",
             listCmd,
         },
+        commandData{
+            "query",
+            "Find microservices whose requirements fit a node's resources and network conditions",
+            queryCmd,
+        },
+        commandData{
+            "history",
+            "Show past versions of a microservice entry",
+            historyCmd,
+        },
+        commandData{
+            "rollback",
+            "Restore an earlier version of a microservice entry",
+            rollbackCmd,
+        },
+        commandData{
+            "audit",
+            "Show who changed what in the registry",
+            auditCmd,
+        },
         commandData{
             "delete",
             "Delete a microservice entry",
             deleteCmd,
         },
+        commandData{
+            "undelete",
+            "Restore a deleted microservice entry",
+            undeleteCmd,
+        },
+        commandData{
+            "transfer-ownership",
+            "Hand a microservice entry over to another peer",
+            transferOwnershipCmd,
+        },
+        commandData{
+            "export",
+            "Write all microservice entries as a backup",
+            exportCmd,
+        },
+        commandData{
+            "import",
+            "Add the microservice entries of a backup",
+            importCmd,
+        },
     }
 
     bootstraps *[]multiaddr.Multiaddr
     psk *pnet.PSK
+
+    // Identifies the CLI to registry-service as the owner of the entries it adds
+    keyFlags util.KeyFlags
 )
 
+const defaultKeyFile = "~/.privKeyRegistryCli"
+
 func main() {
     var err error
     if bootstraps, err = util.AddBootstrapFlags(); err != nil {
@@ -74,9 +120,22 @@ func main() {
     if psk, err = util.AddPSKFlag(); err != nil {
         log.Fatalln(err)
     }
+    if keyFlags, err = util.AddKeyFlags(defaultKeyFile); err != nil {
+        log.Fatalln(err)
+    }
+    peerSelectionFlag := flag.String("peer-selection", "nearest",
+        "Order in which to try registry-service peers: nearest, random or round-robin")
     flag.Usage = usage
     flag.Parse()
 
+    common.DefaultPeerSelector, err = common.PeerSelectorByName(*peerSelectionFlag)
+    if err != nil {
+        fmt.Fprintln(os.Stderr, "Error:", err)
+        fmt.Fprintln(os.Stderr)
+        usage()
+        os.Exit(1)
+    }
+
     // If CLI didn't specify any bootstraps, fallback to environment variable
     if len(*bootstraps) == 0 {
         envBootstraps, err := util.GetEnvBootstraps()
@@ -157,7 +216,12 @@ func setupNode(bootstraps []multiaddr.Multiaddr, psk pnet.PSK) (
     ctx context.Context, node p2pnode.Node, err error) {
 
     ctx = context.Background()
+    priv, err := util.CreateOrLoadKey(keyFlags)
+    if err != nil {
+        return ctx, node, err
+    }
     nodeConfig := p2pnode.NewConfig()
+    nodeConfig.PrivKey = priv
     nodeConfig.PSK = psk
     if len(bootstraps) > 0 {
         nodeConfig.BootstrapPeers = bootstraps
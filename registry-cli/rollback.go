@@ -0,0 +1,89 @@
+/* Copyright 2020 PhysarumSM Development Team
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+    "flag"
+    "fmt"
+    "log"
+    "os"
+
+    "github.com/PhysarumSM/service-registry/registry"
+)
+
+func rollbackCmd() {
+    rollbackFlags := flag.NewFlagSet("rollback", flag.ExitOnError)
+
+    rollbackUsage := func() {
+        exeName := getExeName()
+        fmt.Fprintf(os.Stderr, "Usage of %s rollback:\n", exeName)
+        fmt.Fprintf(os.Stderr, "$ %s rollback [OPTIONS ...] <service-name>\n", exeName)
+        fmt.Fprintln(os.Stderr,
+`
+Restore an earlier version of a microservice entry as its current value
+Fails without changing anything if the entry is updated by someone else meanwhile
+Only the entry's current owner, or a registry-service admin, may do so
+
+<service-name>
+        Name of microservice to roll back
+
+OPTIONS:`)
+        rollbackFlags.PrintDefaults()
+    }
+    toRevision := rollbackFlags.Int64("to-revision", 0,
+        "Revision to restore, see the history command\n" +
+        "Defaults to the version before the current one, or the last version of a deleted entry")
+
+    rollbackFlags.Usage = rollbackUsage
+    rollbackFlags.Parse(flag.Args()[1:])
+
+    if len(rollbackFlags.Args()) < 1 {
+        fmt.Fprintln(os.Stderr, "Error: missing required argument <service-name>")
+        rollbackUsage()
+        return
+    }
+
+    if len(rollbackFlags.Args()) > 1 {
+        fmt.Fprintln(os.Stderr, "Error: too many arguments")
+        rollbackUsage()
+        return
+    }
+
+    serviceName := rollbackFlags.Arg(0)
+
+    ctx, node, err := setupNode(*bootstraps, *psk)
+    if err != nil {
+        log.Fatalln(err)
+    }
+    defer node.Close()
+
+    // Pin the version being rolled back, so a concurrent rollback isn't rolled back again
+    versions, err := registry.GetServiceHistoryWithHostRouting(
+        ctx, node.Host, node.RoutingDiscovery, serviceName, 1)
+    if err != nil {
+        log.Fatalln(err)
+    }
+    fromRevision := versions[0].Revision
+    fmt.Printf("Rolling back %s from revision %d\n", serviceName, fromRevision)
+
+    respStr, err := registry.RollbackServiceWithHostRouting(
+        ctx, node.Host, node.RoutingDiscovery, serviceName, *toRevision, registry.RollbackFrom(fromRevision))
+    if err != nil {
+        log.Fatalln(err)
+    }
+
+    fmt.Println("Response:")
+    fmt.Println(respStr)
+}
@@ -0,0 +1,87 @@
+/* Copyright 2020 PhysarumSM Development Team
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+    "flag"
+    "fmt"
+    "log"
+    "os"
+
+    "github.com/libp2p/go-libp2p-core/peer"
+
+    "github.com/PhysarumSM/service-registry/registry"
+)
+
+func transferOwnershipCmd() {
+    transferFlags := flag.NewFlagSet("transfer-ownership", flag.ExitOnError)
+
+    transferUsage := func() {
+        exeName := getExeName()
+        fmt.Fprintf(os.Stderr, "Usage of %s transfer-ownership:\n", exeName)
+        fmt.Fprintf(os.Stderr, "$ %s transfer-ownership [OPTIONS ...] <service-name> <new-owner>\n", exeName)
+        fmt.Fprintln(os.Stderr,
+`
+Hand a microservice entry over to another peer
+Only the entry's current owner, or a registry-service admin, may do so
+
+<service-name>
+        Name of microservice to transfer
+
+<new-owner>
+        Peer ID that will own the entry, and be allowed to update or delete it
+
+OPTIONS:`)
+        transferFlags.PrintDefaults()
+    }
+
+    transferFlags.Usage = transferUsage
+    transferFlags.Parse(flag.Args()[1:])
+
+    if len(transferFlags.Args()) < 2 {
+        fmt.Fprintln(os.Stderr, "Error: missing required arguments")
+        transferUsage()
+        return
+    }
+
+    if len(transferFlags.Args()) > 2 {
+        fmt.Fprintln(os.Stderr, "Error: too many arguments")
+        transferUsage()
+        return
+    }
+
+    serviceName := transferFlags.Arg(0)
+    newOwner, err := peer.IDB58Decode(transferFlags.Arg(1))
+    if err != nil {
+        fmt.Fprintln(os.Stderr, "Error: invalid <new-owner>:", err)
+        transferUsage()
+        return
+    }
+
+    ctx, node, err := setupNode(*bootstraps, *psk)
+    if err != nil {
+        log.Fatalln(err)
+    }
+    defer node.Close()
+
+    respStr, err := registry.TransferOwnershipWithHostRouting(
+        ctx, node.Host, node.RoutingDiscovery, serviceName, newOwner)
+    if err != nil {
+        log.Fatalln(err)
+    }
+
+    fmt.Println("Response:")
+    fmt.Println(respStr)
+}
@@ -0,0 +1,77 @@
+/* Copyright 2020 PhysarumSM Development Team
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+    "flag"
+    "fmt"
+    "log"
+    "os"
+
+    "github.com/PhysarumSM/service-registry/registry"
+)
+
+func undeleteCmd() {
+    undeleteFlags := flag.NewFlagSet("undelete", flag.ExitOnError)
+
+    undeleteUsage := func() {
+        exeName := getExeName()
+        fmt.Fprintf(os.Stderr, "Usage of %s undelete:\n", exeName)
+        fmt.Fprintf(os.Stderr, "$ %s undelete [OPTIONS ...] <service-name>\n", exeName)
+        fmt.Fprintln(os.Stderr,
+`
+Restore a deleted microservice entry as it was when deleted, see list --deleted
+Fails if another entry was added under the same name since
+Only the entry's owner, or a registry-service admin, may do so
+
+<service-name>
+        Name of microservice to restore
+
+OPTIONS:`)
+        undeleteFlags.PrintDefaults()
+    }
+
+    undeleteFlags.Usage = undeleteUsage
+    undeleteFlags.Parse(flag.Args()[1:])
+
+    if len(undeleteFlags.Args()) < 1 {
+        fmt.Fprintln(os.Stderr, "Error: missing required argument <service-name>")
+        undeleteUsage()
+        return
+    }
+
+    if len(undeleteFlags.Args()) > 1 {
+        fmt.Fprintln(os.Stderr, "Error: too many arguments")
+        undeleteUsage()
+        return
+    }
+
+    serviceName := undeleteFlags.Arg(0)
+
+    ctx, node, err := setupNode(*bootstraps, *psk)
+    if err != nil {
+        log.Fatalln(err)
+    }
+    defer node.Close()
+
+    respStr, err := registry.UndeleteServiceWithHostRouting(
+        ctx, node.Host, node.RoutingDiscovery, serviceName)
+    if err != nil {
+        log.Fatalln(err)
+    }
+
+    fmt.Println("Response:")
+    fmt.Println(respStr)
+}
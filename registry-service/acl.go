@@ -0,0 +1,266 @@
+/* Copyright 2020 PhysarumSM Development Team
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+// Access control list mapping peer IDs to roles, checked before any request is handled
+
+import (
+    "encoding/json"
+    "fmt"
+    "io/ioutil"
+    "log"
+    "os"
+    "sync"
+    "time"
+
+    "github.com/libp2p/go-libp2p-core/network"
+    "github.com/libp2p/go-libp2p-core/peer"
+    "github.com/libp2p/go-libp2p-core/protocol"
+
+    "github.com/prometheus/client_golang/prometheus"
+    "github.com/prometheus/client_golang/prometheus/promauto"
+
+    "github.com/PhysarumSM/service-registry/common"
+)
+
+// How often the ACL file is checked for changes
+var aclReloadInterval = 5 * time.Second
+
+var deniedRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+    Name: "registry_service_denied_requests_total",
+    Help: "Number of requests rejected because the requesting peer's role does not allow them",
+}, []string{"protocol"})
+
+// Each role may do everything the roles before it may
+type role int
+
+const (
+    roleNone role = iota
+    roleReader
+    rolePublisher
+    roleAdmin
+)
+
+var roleNames = map[string]role{
+    "": roleNone,
+    "reader": roleReader,
+    "publisher": rolePublisher,
+    "admin": roleAdmin,
+}
+
+func (r role) String() string {
+    for name, nameRole := range roleNames {
+        if nameRole == r && name != "" {
+            return name
+        }
+    }
+    return "none"
+}
+
+// Role required for each protocol
+var protocolRoles = map[protocol.ID]role{
+    common.GetProtocolID: roleReader,
+    common.ListProtocolID: roleReader,
+    common.WatchProtocolID: roleReader,
+    common.QueryProtocolID: roleReader,
+    common.FindProtocolID: roleReader,
+    common.HistoryProtocolID: roleReader,
+    common.AddProtocolID: rolePublisher,
+    common.DeleteProtocolID: rolePublisher,
+    common.RenewProtocolID: rolePublisher,
+    common.TransferOwnershipProtocolID: rolePublisher,
+    common.RollbackProtocolID: rolePublisher,
+    common.UndeleteProtocolID: rolePublisher,
+    // The audit log names every peer and what it changed
+    common.AuditProtocolID: roleAdmin,
+    memberAddProtocolID: roleAdmin,
+}
+
+// Format of the ACL file
+// Peers not listed get DefaultRole, no access at all if it is empty
+type aclFile struct {
+    DefaultRole string
+    Peers map[string]string
+}
+
+// Returned when the requesting peer's role does not allow a request
+type accessDeniedError struct {
+    Peer peer.ID
+    Protocol protocol.ID
+    Role role
+}
+
+func (e *accessDeniedError) Error() string {
+    return fmt.Sprintf("Peer %s with role %s may not use %s, requires role %s",
+        e.Peer.Pretty(), e.Role, e.Protocol, protocolRoles[e.Protocol])
+}
+
+type accessControl struct {
+    // ACL file, empty if all peers may make any request
+    path string
+
+    // Admins given on the command line, in addition to those in the ACL file
+    admins peerSet
+
+    mutex sync.RWMutex
+    defaultRole role
+    roles map[peer.ID]role
+    modTime time.Time
+
+    stopReload chan struct{}
+}
+
+// Load ACL file at path, reloading it whenever it changes until close() is called
+// If path is empty, all peers may make any request, and only admins may modify entries owned by others
+func newAccessControl(path string, admins peerSet) (*accessControl, error) {
+    a := &accessControl{path: path, admins: admins, stopReload: make(chan struct{})}
+    if path == "" {
+        return a, nil
+    }
+
+    err := a.load()
+    if err != nil {
+        return nil, err
+    }
+    go a.reload()
+    return a, nil
+}
+
+func (a *accessControl) load() error {
+    info, err := os.Stat(a.path)
+    if err != nil {
+        return err
+    }
+    data, err := ioutil.ReadFile(a.path)
+    if err != nil {
+        return err
+    }
+
+    var file aclFile
+    err = json.Unmarshal(data, &file)
+    if err != nil {
+        return fmt.Errorf("Invalid ACL file %s: %v", a.path, err)
+    }
+
+    defaultRole, ok := roleNames[file.DefaultRole]
+    if !ok {
+        return fmt.Errorf("Invalid ACL file %s: unknown role %s", a.path, file.DefaultRole)
+    }
+    roles := make(map[peer.ID]role)
+    for idStr, roleName := range file.Peers {
+        id, err := peer.IDB58Decode(idStr)
+        if err != nil {
+            return fmt.Errorf("Invalid ACL file %s: bad peer ID %s: %v", a.path, idStr, err)
+        }
+        peerRole, ok := roleNames[roleName]
+        if !ok {
+            return fmt.Errorf("Invalid ACL file %s: unknown role %s", a.path, roleName)
+        }
+        roles[id] = peerRole
+    }
+
+    a.mutex.Lock()
+    defer a.mutex.Unlock()
+    a.defaultRole = defaultRole
+    a.roles = roles
+    a.modTime = info.ModTime()
+    return nil
+}
+
+// Periodically reload the ACL file if it was modified
+// An invalid file is logged and ignored, keeping the previous ACL in effect
+func (a *accessControl) reload() {
+    ticker := time.NewTicker(aclReloadInterval)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <-ticker.C:
+            info, err := os.Stat(a.path)
+            if err != nil {
+                log.Println("Unable to check ACL file for changes:", err)
+                continue
+            }
+
+            a.mutex.RLock()
+            modified := !info.ModTime().Equal(a.modTime)
+            a.mutex.RUnlock()
+            if !modified {
+                continue
+            }
+
+            err = a.load()
+            if err != nil {
+                log.Println("Keeping previous ACL:", err)
+                continue
+            }
+            log.Println("Reloaded ACL file", a.path)
+        case <-a.stopReload:
+            return
+        }
+    }
+}
+
+func (a *accessControl) close() {
+    close(a.stopReload)
+}
+
+func (a *accessControl) roleOf(id peer.ID) role {
+    if a.admins[id] {
+        return roleAdmin
+    }
+    if a.path == "" {
+        return rolePublisher
+    }
+
+    a.mutex.RLock()
+    defer a.mutex.RUnlock()
+    if peerRole, ok := a.roles[id]; ok {
+        return peerRole
+    }
+    return a.defaultRole
+}
+
+// Whether id may modify entries owned by other peers
+func (a *accessControl) isAdmin(id peer.ID) bool {
+    return a.roleOf(id) == roleAdmin
+}
+
+// Check whether id may use protocolID
+func (a *accessControl) check(id peer.ID, protocolID protocol.ID) error {
+    // Without an ACL file, requests are only limited by ownership
+    if a.path == "" {
+        return nil
+    }
+
+    peerRole := a.roleOf(id)
+    if peerRole < protocolRoles[protocolID] {
+        return &accessDeniedError{Peer: id, Protocol: protocolID, Role: peerRole}
+    }
+    return nil
+}
+
+// Wrap handler for protocolID, rejecting requests from peers whose role does not allow them
+func (a *accessControl) guard(protocolID protocol.ID, handler func(network.Stream)) func(network.Stream) {
+    return func(stream network.Stream) {
+        err := a.check(stream.Conn().RemotePeer(), protocolID)
+        if err != nil {
+            deniedRequests.WithLabelValues(string(protocolID)).Inc()
+            streamError(stream, err)
+            return
+        }
+        handler(stream)
+    }
+}
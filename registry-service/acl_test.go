@@ -0,0 +1,123 @@
+/* Copyright 2020 PhysarumSM Development Team
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+    "fmt"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+
+    "github.com/PhysarumSM/service-registry/common"
+)
+
+func writeACL(t *testing.T, path, contents string, modTime time.Time) {
+    err := ioutil.WriteFile(path, []byte(contents), 0600)
+    if err != nil {
+        t.Fatalf("%v", err)
+    }
+    // Set explicitly, rewrites within the file system's timestamp resolution would otherwise go unnoticed
+    err = os.Chtimes(path, modTime, modTime)
+    if err != nil {
+        t.Fatalf("%v", err)
+    }
+}
+
+func TestAccessControl(t *testing.T) {
+    dir, err := ioutil.TempDir("", "acl")
+    if err != nil {
+        t.Fatalf("%v", err)
+    }
+    defer os.RemoveAll(dir)
+    path := filepath.Join(dir, "acl.json")
+
+    reader, publisher, admin, flagAdmin := testPeerID(t), testPeerID(t), testPeerID(t), testPeerID(t)
+    writeACL(t, path, fmt.Sprintf(`{"DefaultRole": "reader", "Peers": {"%s": "publisher", "%s": "admin"}}`,
+        publisher.Pretty(), admin.Pretty()), time.Now())
+
+    acl, err := newAccessControl(path, peerSet{flagAdmin: true})
+    if err != nil {
+        t.Fatalf("%v", err)
+    }
+    defer acl.close()
+
+    if err := acl.check(reader, common.GetProtocolID); err != nil {
+        t.Errorf("Unlisted peer denied get: %v", err)
+    }
+    if err := acl.check(reader, common.AddProtocolID); err == nil {
+        t.Errorf("Unlisted peer allowed to add")
+    }
+    if err := acl.check(publisher, common.AddProtocolID); err != nil {
+        t.Errorf("Publisher denied add: %v", err)
+    }
+    if err := acl.check(publisher, memberAddProtocolID); err == nil {
+        t.Errorf("Publisher allowed to add etcd members")
+    }
+    if err := acl.check(publisher, common.AuditProtocolID); err == nil {
+        t.Errorf("Publisher allowed to read the audit log")
+    }
+    if err := acl.check(admin, common.AuditProtocolID); err != nil {
+        t.Errorf("Admin denied audit log: %v", err)
+    }
+    if acl.isAdmin(publisher) || !acl.isAdmin(admin) || !acl.isAdmin(flagAdmin) {
+        t.Errorf("Wrong admins: publisher %v, admin %v, --admin %v",
+            acl.isAdmin(publisher), acl.isAdmin(admin), acl.isAdmin(flagAdmin))
+    }
+}
+
+func TestAccessControlReload(t *testing.T) {
+    defer func(interval time.Duration) { aclReloadInterval = interval }(aclReloadInterval)
+    aclReloadInterval = 10 * time.Millisecond
+
+    dir, err := ioutil.TempDir("", "acl")
+    if err != nil {
+        t.Fatalf("%v", err)
+    }
+    defer os.RemoveAll(dir)
+    path := filepath.Join(dir, "acl.json")
+
+    id := testPeerID(t)
+    start := time.Now().Add(-time.Hour)
+    writeACL(t, path, `{"DefaultRole": "reader"}`, start)
+
+    acl, err := newAccessControl(path, peerSet{})
+    if err != nil {
+        t.Fatalf("%v", err)
+    }
+    defer acl.close()
+
+    waitForRole := func(expected role) {
+        deadline := time.Now().Add(2 * time.Second)
+        for acl.roleOf(id) != expected && time.Now().Before(deadline) {
+            time.Sleep(aclReloadInterval)
+        }
+        if r := acl.roleOf(id); r != expected {
+            t.Errorf("Peer has role %s, expected %s", r, expected)
+        }
+    }
+
+    writeACL(t, path, fmt.Sprintf(`{"Peers": {"%s": "publisher"}}`, id.Pretty()), start.Add(time.Minute))
+    waitForRole(rolePublisher)
+
+    // Invalid files are ignored, keeping the previous ACL
+    writeACL(t, path, `{"DefaultRole": "superuser"}`, start.Add(2 * time.Minute))
+    time.Sleep(10 * aclReloadInterval)
+    waitForRole(rolePublisher)
+
+    writeACL(t, path, `{}`, start.Add(3 * time.Minute))
+    waitForRole(roleNone)
+}
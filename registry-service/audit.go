@@ -0,0 +1,138 @@
+/* Copyright 2020 PhysarumSM Development Team
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+// Audit log of changes made through registry-service, recording which peer changed what and when
+
+import (
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "log"
+    "os"
+    "sync"
+    "time"
+
+    "github.com/libp2p/go-libp2p-core/peer"
+    "github.com/libp2p/go-libp2p-core/protocol"
+
+    "github.com/prometheus/client_golang/prometheus"
+    "github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var auditFailures = promauto.NewCounter(prometheus.CounterOpts{
+    Name: "registry_service_audit_failures_total",
+    Help: "Number of changes that could not be recorded in the audit log",
+})
+
+// Records of changes to entries are appended by the store along with the changes, see PutOptions.Audit
+// The audit log appends the others to the store, and all records to a file if one is given
+type auditLog struct {
+    store Store
+
+    // Records are also written to file as json lines, unless nil
+    file *os.File
+    fileMutex sync.Mutex
+}
+
+// Create audit log writing to store, and to the file at path unless empty
+func newAuditLog(store Store, path string) (*auditLog, error) {
+    a := &auditLog{store: store}
+    if path != "" {
+        file, err := os.OpenFile(path, os.O_WRONLY | os.O_APPEND | os.O_CREATE, 0600)
+        if err != nil {
+            return nil, err
+        }
+        a.file = file
+    }
+    return a, nil
+}
+
+func (a *auditLog) close() error {
+    if a.file == nil {
+        return nil
+    }
+    return a.file.Close()
+}
+
+// Record a storage cluster member named name being added by requester
+// Failures are logged rather than returned, since the member was already added
+func (a *auditLog) recordMemberAdd(requester peer.ID, protocolID protocol.ID, name string) {
+    record := newAuditRecord(requester, protocolID, name)
+    err := a.store.AppendAudit(record)
+    if err != nil {
+        auditFailures.Inc()
+        log.Println("Failed to append audit record to store:", err)
+    }
+    a.appendFile(record)
+}
+
+// Write record of a change to the audit file, once the store made the change along with
+// appending the record, see PutOptions.Audit
+func (a *auditLog) committed(record AuditRecord) {
+    a.appendFile(record)
+}
+
+// Failures are logged rather than returned, since the change was already made
+func (a *auditLog) appendFile(record AuditRecord) {
+    if a.file == nil {
+        return
+    }
+    data, err := json.Marshal(record)
+    if err != nil {
+        auditFailures.Inc()
+        log.Println("Failed to encode audit record:", err)
+        return
+    }
+
+    a.fileMutex.Lock()
+    defer a.fileMutex.Unlock()
+    _, err = a.file.Write(append(data, '\n'))
+    if err != nil {
+        auditFailures.Inc()
+        log.Println("Failed to append audit record to file:", err)
+    }
+}
+
+// Record of a change by requester, to be appended to the audit log along with the change
+func newAuditRecord(requester peer.ID, protocolID protocol.ID, name string) AuditRecord {
+    return AuditRecord{
+        Time: time.Now().UTC(),
+        Peer: requester.Pretty(),
+        Protocol: string(protocolID),
+        Name: name,
+    }
+}
+
+// Set the digests of record to those of an entry's value before and after a change, unless record is nil
+// Digests of values that don't exist are left empty
+func setAuditDigests(record *AuditRecord, old KeyValue, oldExists bool, newValue string, newExists bool) {
+    if record == nil {
+        return
+    }
+    record.OldDigest, record.NewDigest = "", ""
+    if oldExists {
+        record.OldDigest = valueDigest(old.Value)
+    }
+    if newExists {
+        record.NewDigest = valueDigest(newValue)
+    }
+}
+
+// Digest of a stored value, so audit records tell versions apart without holding them
+func valueDigest(value string) string {
+    sum := sha256.Sum256([]byte(value))
+    return "sha256:" + hex.EncodeToString(sum[:])
+}
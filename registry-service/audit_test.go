@@ -0,0 +1,128 @@
+/* Copyright 2020 PhysarumSM Development Team
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+    "bufio"
+    "encoding/json"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+
+    "github.com/libp2p/go-libp2p-core/peer"
+
+    "github.com/PhysarumSM/service-registry/common"
+)
+
+func TestAuditLog(t *testing.T) {
+    testLocalStores(t, func(t *testing.T, store Store) {
+        dir, err := ioutil.TempDir("", "audit")
+        if err != nil {
+            t.Fatalf("%v", err)
+        }
+        defer os.RemoveAll(dir)
+        path := filepath.Join(dir, "audit.jsonl")
+
+        audit, err := newAuditLog(store, path)
+        if err != nil {
+            t.Fatalf("%v", err)
+        }
+        defer audit.close()
+
+        owner, other := testPeerID(t), testPeerID(t)
+        acl, _ := newAccessControl("", peerSet{})
+
+        put := func(requester peer.ID, key, value string) {
+            record := newAuditRecord(requester, common.AddProtocolID, key)
+            _, err := ownedPut(store, acl, requester, key, value, PutOptions{Audit: &record})
+            if err != nil {
+                t.Fatalf("%v", err)
+            }
+            audit.committed(record)
+        }
+        put(owner, "my-service:1.0", "info-1")
+        put(owner, "my-service:1.0", "info-2")
+        beforeOther := time.Now()
+        put(other, "other-service:1.0", "other")
+        record := newAuditRecord(owner, common.DeleteProtocolID, "my-service:1.0")
+        _, _, err = ownedDelete(store, acl, owner, "my-service:1.0", &record)
+        if err != nil {
+            t.Fatalf("%v", err)
+        }
+        audit.committed(record)
+
+        // Records are only appended along with writes that succeed
+        record = newAuditRecord(other, common.AddProtocolID, "other-service:1.0")
+        _, err = store.Put("other-service:1.0", "conflicting", PutOptions{IfAbsent: true, Audit: &record})
+        if _, ok := err.(*conflictError); !ok {
+            t.Fatalf("Conflicting put returned %v, expected conflictError", err)
+        }
+
+        records, err := queryAudit(store, common.AuditRequest{Name: "my-service:1.0"})
+        if err != nil || len(records) != 3 {
+            t.Fatalf("Audit of my-service:1.0 returned (%v, %v), expected 3 records", records, err)
+        }
+        deleteRecord, secondAdd, firstAdd := records[0], records[1], records[2]
+        if firstAdd.OldDigest != "" || firstAdd.NewDigest != valueDigest("info-1") {
+            t.Errorf("First add recorded as %+v, expected no old digest and the digest of info-1", firstAdd)
+        }
+        if secondAdd.OldDigest != firstAdd.NewDigest || secondAdd.NewDigest != valueDigest("info-2") {
+            t.Errorf("Second add recorded as %+v, expected digests of info-1 and info-2", secondAdd)
+        }
+        if deleteRecord.Protocol != string(common.DeleteProtocolID) || deleteRecord.Peer != owner.Pretty() ||
+            deleteRecord.OldDigest != secondAdd.NewDigest || deleteRecord.NewDigest != "" {
+            t.Errorf("Delete recorded as %+v, expected delete by %s of info-2", deleteRecord, owner.Pretty())
+        }
+
+        records, err = queryAudit(store, common.AuditRequest{Peer: other.Pretty()})
+        if err != nil || len(records) != 1 || records[0].Name != "other-service:1.0" {
+            t.Errorf("Audit of other peer returned (%v, %v), expected its add of other-service:1.0", records, err)
+        }
+
+        records, err = queryAudit(store, common.AuditRequest{Since: beforeOther, Limit: 1})
+        if err != nil || len(records) != 1 || records[0].Protocol != string(common.DeleteProtocolID) {
+            t.Errorf("Audit with limit 1 returned (%v, %v), expected the delete", records, err)
+        }
+        records, err = queryAudit(store, common.AuditRequest{Until: beforeOther})
+        if err != nil || len(records) != 2 {
+            t.Errorf("Audit until the other peer's add returned (%v, %v), expected the 2 adds before it",
+                records, err)
+        }
+
+        _, err = queryAudit(store, common.AuditRequest{Peer: "not-a-peer"})
+        if _, ok := err.(*requestError); !ok {
+            t.Errorf("Audit of invalid peer returned %v, expected requestError", err)
+        }
+
+        file, err := os.Open(path)
+        if err != nil {
+            t.Fatalf("%v", err)
+        }
+        defer file.Close()
+        lines := 0
+        for scanner := bufio.NewScanner(file); scanner.Scan(); lines++ {
+            var record AuditRecord
+            err = json.Unmarshal(scanner.Bytes(), &record)
+            if err != nil {
+                t.Errorf("Audit file line %d is invalid: %v", lines + 1, err)
+            }
+        }
+        if lines != 4 {
+            t.Errorf("Audit file has %d records, expected 4", lines)
+        }
+    })
+}
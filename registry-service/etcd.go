@@ -0,0 +1,204 @@
+/* Copyright 2020 PhysarumSM Development Team
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+// Starting the local etcd instance backing the etcd store
+
+import (
+    "errors"
+    "fmt"
+    "log"
+    "net/url"
+    "os"
+    "os/exec"
+    "strconv"
+    "time"
+
+    "github.com/libp2p/go-libp2p-core/crypto"
+    "github.com/libp2p/go-libp2p-core/pnet"
+
+    "go.etcd.io/etcd/clientv3"
+    "go.etcd.io/etcd/embed"
+
+    "github.com/multiformats/go-multiaddr"
+)
+
+const etcdReadyTimeout = 60 * time.Second
+
+type etcdConfig struct {
+    NewCluster bool
+    Embed bool
+    IP string
+    ClientPort int
+    PeerPort int
+}
+
+// Local etcd instance, either embedded in this process or run as a child process
+type etcdInstance struct {
+    Client *clientv3.Client
+
+    // Receives an error if the instance stops before it is told to
+    Err <-chan error
+
+    stop func()
+}
+
+// Start local etcd instance, joining existing cluster unless conf.NewCluster is set
+// Returns once the instance is ready to serve requests
+func startEtcd(
+    conf etcdConfig, local bool, bootstraps []multiaddr.Multiaddr, psk pnet.PSK, priv crypto.PrivKey) (
+    etcd *etcdInstance, err error) {
+
+    etcdClientEndpoint := conf.IP + ":" + strconv.Itoa(conf.ClientPort)
+    etcdPeerEndpoint := conf.IP + ":" + strconv.Itoa(conf.PeerPort)
+
+    etcdClientUrl := "http://" + etcdClientEndpoint
+    etcdPeerUrl := "http://" + etcdPeerEndpoint
+
+    etcdName := fmt.Sprintf("%s-%d-%d", conf.IP, conf.ClientPort, conf.PeerPort)
+
+    initialCluster := etcdName + "=" + etcdPeerUrl
+    clusterState := embed.ClusterStateFlagNew
+
+    if !conf.NewCluster {
+        initialCluster, err = sendMemberAddRequest(
+            etcdName, etcdPeerUrl, local, bootstraps, psk, priv)
+        if err != nil {
+            return nil, err
+        }
+        clusterState = embed.ClusterStateFlagExisting
+    }
+
+    if conf.Embed {
+        etcd, err = startEmbeddedEtcd(
+            etcdName, etcdClientUrl, etcdPeerUrl, initialCluster, clusterState)
+    } else {
+        etcd, err = startEtcdProcess(
+            etcdName, etcdClientUrl, etcdPeerUrl, initialCluster, clusterState)
+    }
+    if err != nil {
+        return nil, err
+    }
+
+    etcd.Client, err = clientv3.New(clientv3.Config{
+        Endpoints: []string{etcdClientEndpoint},
+        DialTimeout: 5 * time.Second,
+    })
+    if err != nil {
+        etcd.stop()
+        return nil, err
+    }
+
+    return etcd, nil
+}
+
+// Run etcd in-process using the embed package
+func startEmbeddedEtcd(
+    name, clientUrl, peerUrl, initialCluster, clusterState string) (etcd *etcdInstance, err error) {
+
+    cUrl, err := url.Parse(clientUrl)
+    if err != nil {
+        return nil, err
+    }
+    pUrl, err := url.Parse(peerUrl)
+    if err != nil {
+        return nil, err
+    }
+
+    cfg := embed.NewConfig()
+    cfg.Name = name
+    cfg.Dir = name + ".etcd"
+    cfg.LCUrls, cfg.ACUrls = []url.URL{*cUrl}, []url.URL{*cUrl}
+    cfg.LPUrls, cfg.APUrls = []url.URL{*pUrl}, []url.URL{*pUrl}
+    cfg.InitialCluster = initialCluster
+    cfg.ClusterState = clusterState
+    log.Printf("Starting embedded etcd %s (initial cluster %s, state %s)\n",
+        name, initialCluster, clusterState)
+
+    e, err := embed.StartEtcd(cfg)
+    if err != nil {
+        return nil, err
+    }
+
+    select {
+    case <-e.Server.ReadyNotify():
+        log.Println("Embedded etcd is ready")
+    case err = <-e.Err():
+        e.Close()
+        return nil, err
+    case <-time.After(etcdReadyTimeout):
+        e.Server.Stop()
+        e.Close()
+        return nil, errors.New("Timed out waiting for embedded etcd to be ready")
+    }
+
+    errChan := make(chan error, 1)
+    stopped := make(chan struct{})
+    go func() {
+        select {
+        case err := <-e.Err():
+            errChan <- err
+        case <-e.Server.StopNotify():
+            errChan <- errors.New("Embedded etcd server stopped")
+        case <-stopped:
+        }
+    }()
+
+    stop := func() {
+        close(stopped)
+        e.Close()
+    }
+
+    return &etcdInstance{Err: errChan, stop: stop}, nil
+}
+
+// Run etcd binary as a child process
+func startEtcdProcess(
+    name, clientUrl, peerUrl, initialCluster, clusterState string) (etcd *etcdInstance, err error) {
+
+    etcdArgs := []string{
+        "--name", name,
+        "--listen-client-urls", clientUrl,
+        "--advertise-client-urls", clientUrl,
+        "--listen-peer-urls", peerUrl,
+        "--initial-advertise-peer-urls", peerUrl,
+        "--initial-cluster", initialCluster,
+        "--initial-cluster-state", clusterState,
+    }
+    log.Println(etcdArgs)
+
+    cmd := exec.Command("etcd", etcdArgs...)
+    cmd.Stdout = os.Stdout
+    cmd.Stderr = os.Stderr
+    err = cmd.Start()
+    if err != nil {
+        return nil, err
+    }
+
+    errChan := make(chan error, 1)
+    go func() {
+        err := cmd.Wait()
+        if err == nil {
+            err = errors.New("etcd process exited")
+        }
+        errChan <- err
+    }()
+
+    stop := func() {
+        cmd.Process.Signal(os.Interrupt)
+    }
+
+    return &etcdInstance{Err: errChan, stop: stop}, nil
+}
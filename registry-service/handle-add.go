@@ -16,6 +16,7 @@
 
  import (
     "encoding/json"
+    "errors"
     "fmt"
     "io/ioutil"
     "log"
@@ -23,12 +24,10 @@
 
     "github.com/libp2p/go-libp2p-core/network"
 
-    "go.etcd.io/etcd/clientv3"
-
     "github.com/PhysarumSM/service-registry/common"
 )
 
-func handleAdd(etcdCli *clientv3.Client) func(network.Stream) {
+func handleAdd(store Store, acl *accessControl, audit *auditLog) func(network.Stream) {
     return func(stream network.Stream) {
         data, err := ioutil.ReadAll(stream)
         if err != nil {
@@ -42,22 +41,75 @@ func handleAdd(etcdCli *clientv3.Client) func(network.Stream) {
         var reqInfo common.AddRequest
         err = json.Unmarshal([]byte(reqStr), &reqInfo)
         if err != nil {
+            streamError(stream, &requestError{err})
+            return
+        }
+
+        if reqInfo.Name == "" {
+            streamError(stream, &requestError{errors.New("Add request is missing a service name")})
+            return
+        }
+        if err := common.CheckName(reqInfo.Name); err != nil {
+            streamError(stream, &requestError{err})
+            return
+        }
+
+        opts := PutOptions{
+            IfAbsent: reqInfo.IfAbsent,
+            IfRevision: reqInfo.IfRevision,
+            TTL: reqInfo.TTL,
+        }
+
+        // Only store signatures that hold, so clients can rely on the publisher reported for an entry
+        if len(reqInfo.Signature) != 0 {
+            publisher, err := common.VerifyEntry(
+                reqInfo.Name, reqInfo.InfoStr, reqInfo.PublicKey, reqInfo.Signature)
+            if err != nil {
+                streamError(stream, &requestError{fmt.Errorf("Invalid signature: %v", err)})
+                return
+            }
+            opts.Attrs = EntryAttrs{
+                Publisher: publisher.Pretty(),
+                PublicKey: reqInfo.PublicKey,
+                Signature: reqInfo.Signature,
+            }
+        }
+
+        requester := stream.Conn().RemotePeer()
+        owner := requester
+        if reqInfo.Unowned {
+            owner = ""
+        }
+        record := newAuditRecord(requester, common.AddProtocolID, reqInfo.Name)
+        opts.Audit = &record
+        rev, err := ownedPut(store, acl, owner, reqInfo.Name, reqInfo.InfoStr, opts)
+
+        var respInfo common.AddResponse
+        if conflict, ok := err.(*conflictError); ok {
+            respInfo.Status = common.Status{Code: common.StatusConflict, Message: conflict.Error()}
+            respInfo.CurrentRevision = conflict.CurrentRevision
+        } else if err != nil {
             streamError(stream, err)
             return
+        } else {
+            respInfo.Status = common.Status{
+                Code: common.StatusOK,
+                Message: fmt.Sprintf("Added {%s: %s}", reqInfo.Name, reqInfo.InfoStr),
+            }
+            respInfo.Revision = rev
+            audit.committed(record)
         }
 
-        err = etcdPut(etcdCli, reqInfo.Name, reqInfo.InfoStr)
+        respBytes, err := json.Marshal(respInfo)
         if err != nil {
             streamError(stream, err)
             return
         }
 
-        respStr := fmt.Sprintf("Added {%s: %s}", reqInfo.Name, reqInfo.InfoStr)
-
-        log.Println("Add response:", respStr)
-        _, err = stream.Write([]byte(respStr))
+        log.Println("Add response:", string(respBytes))
+        _, err = stream.Write(respBytes)
         if err != nil {
-            streamError(stream, err)
+            streamReset(stream, err)
             return
         }
 
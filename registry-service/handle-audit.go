@@ -0,0 +1,99 @@
+/* Copyright 2020 PhysarumSM Development Team
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "io/ioutil"
+    "log"
+    "strings"
+
+    "github.com/libp2p/go-libp2p-core/network"
+    "github.com/libp2p/go-libp2p-core/peer"
+
+    "github.com/PhysarumSM/service-registry/common"
+)
+
+func handleAudit(store Store) func(network.Stream) {
+    return func(stream network.Stream) {
+        data, err := ioutil.ReadAll(stream)
+        if err != nil {
+            streamError(stream, err)
+            return
+        }
+
+        reqStr := strings.TrimSpace(string(data))
+        log.Println("Audit request:", reqStr)
+
+        var reqInfo common.AuditRequest
+        err = json.Unmarshal([]byte(reqStr), &reqInfo)
+        if err != nil {
+            streamError(stream, &requestError{err})
+            return
+        }
+
+        records, err := queryAudit(store, reqInfo)
+        if err != nil {
+            streamError(stream, err)
+            return
+        }
+
+        respInfo := common.AuditResponse{
+            Status: common.Status{Code: common.StatusOK},
+            Records: []common.AuditRecord{},
+        }
+        for _, record := range records {
+            respInfo.Records = append(respInfo.Records, common.AuditRecord(record))
+        }
+        respBytes, err := json.Marshal(respInfo)
+        if err != nil {
+            streamError(stream, err)
+            return
+        }
+
+        log.Printf("Audit response: %d records\n", len(respInfo.Records))
+        _, err = stream.Write(respBytes)
+        if err != nil {
+            streamReset(stream, err)
+            return
+        }
+
+        stream.Close()
+    }
+}
+
+// Get the audit records matching every filter set in req, newest first
+func queryAudit(store Store, req common.AuditRequest) (records []AuditRecord, err error) {
+    if req.Limit < 0 {
+        return nil, &requestError{fmt.Errorf("Invalid limit %d", req.Limit)}
+    }
+    if req.Peer != "" {
+        _, err := peer.IDB58Decode(req.Peer)
+        if err != nil {
+            return nil, &requestError{fmt.Errorf("Invalid peer: %v", err)}
+        }
+    }
+
+    opts := AuditOptions{
+        Since: req.Since,
+        Until: req.Until,
+        Limit: req.Limit,
+        Match: func(record AuditRecord) bool {
+            return (req.Name == "" || record.Name == req.Name) && (req.Peer == "" || record.Peer == req.Peer)
+        },
+    }
+    return store.ListAudit(opts)
+}
@@ -15,18 +15,18 @@
  package main
 
  import (
-	"context"
-	"fmt"
+    "encoding/json"
+    "fmt"
     "io/ioutil"
     "log"
     "strings"
 
     "github.com/libp2p/go-libp2p-core/network"
 
-    "go.etcd.io/etcd/clientv3"
+    "github.com/PhysarumSM/service-registry/common"
 )
 
-func handleDelete(etcdCli *clientv3.Client) func(network.Stream) {
+func handleDelete(store Store, acl *accessControl, audit *auditLog) func(network.Stream) {
     return func(stream network.Stream) {
         data, err := ioutil.ReadAll(stream)
         if err != nil {
@@ -37,27 +37,43 @@ func handleDelete(etcdCli *clientv3.Client) func(network.Stream) {
         reqStr := strings.TrimSpace(string(data))
         log.Println("Delete request:", reqStr)
 
-        ctx := context.Background()
-        deleteResp, err := etcdCli.Delete(ctx, reqStr)
+        requester := stream.Conn().RemotePeer()
+        record := newAuditRecord(requester, common.DeleteProtocolID, reqStr)
+        deleted, _, err := ownedDelete(store, acl, requester, reqStr, &record)
         if err != nil {
             streamError(stream, err)
             return
         }
+        if deleted != 0 {
+            audit.committed(record)
+        }
 
-        var respStr string
-        if deleteResp.Deleted != 0 {
-            respStr = fmt.Sprintf("Deleted %d entry from hash lookup", deleteResp.Deleted)
+        respInfo := common.DeleteResponse{Deleted: deleted}
+        if deleted != 0 {
+            respInfo.Status = common.Status{
+                Code: common.StatusOK,
+                Message: fmt.Sprintf("Deleted %d entry from hash lookup", deleted),
+            }
         } else {
-            respStr = "Error: Failed to delete any entries from hash lookup"
+            respInfo.Status = common.Status{
+                Code: common.StatusNotFound,
+                Message: "Failed to delete any entries from hash lookup",
+            }
         }
 
-        log.Println("Delete response: ", respStr)
-        _, err = stream.Write([]byte(respStr))
+        respBytes, err := json.Marshal(respInfo)
         if err != nil {
             streamError(stream, err)
             return
         }
 
+        log.Println("Delete response: ", string(respBytes))
+        _, err = stream.Write(respBytes)
+        if err != nil {
+            streamReset(stream, err)
+            return
+        }
+
         stream.Close()
     }
 }
@@ -0,0 +1,97 @@
+/* Copyright 2020 PhysarumSM Development Team
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "io/ioutil"
+    "log"
+    "strings"
+
+    "github.com/libp2p/go-libp2p-core/network"
+
+    "github.com/PhysarumSM/service-registry/common"
+)
+
+func handleFind(store Store) func(network.Stream) {
+    return func(stream network.Stream) {
+        data, err := ioutil.ReadAll(stream)
+        if err != nil {
+            streamError(stream, err)
+            return
+        }
+
+        reqStr := strings.TrimSpace(string(data))
+        log.Println("Find request:", reqStr)
+
+        var reqInfo common.FindRequest
+        err = json.Unmarshal([]byte(reqStr), &reqInfo)
+        if err != nil {
+            streamError(stream, &requestError{err})
+            return
+        }
+
+        kvs, err := findServiceInfo(store, reqInfo)
+        if err != nil {
+            streamError(stream, err)
+            return
+        }
+
+        status := common.Status{Code: common.StatusOK}
+        if len(kvs) == 0 {
+            status = common.Status{
+                Code: common.StatusNotFound,
+                Message: fmt.Sprintf("No services with %s %s", reqInfo.Index, reqInfo.Value),
+            }
+        }
+
+        respInfo := common.ListResponse{
+            Status: status,
+            NameToInfoStr: make(map[string]string),
+            NameToMeta: make(map[string]common.EntryMeta),
+            LookupOk: len(kvs) > 0,
+        }
+        for _, kv := range kvs {
+            respInfo.NameToInfoStr[kv.Key] = kv.Value
+            respInfo.NameToMeta[kv.Key] = entryMeta(kv)
+        }
+        respBytes, err := json.Marshal(respInfo)
+        if err != nil {
+            streamError(stream, err)
+            return
+        }
+
+        log.Println("Find response: ", string(respBytes))
+
+        _, err = stream.Write(respBytes)
+        if err != nil {
+            streamReset(stream, err)
+            return
+        }
+
+        stream.Close()
+    }
+}
+
+func findServiceInfo(store Store, req common.FindRequest) (kvs []KeyValue, err error) {
+    if req.Index != common.ContentHashIndex && req.Index != common.DockerHashIndex {
+        return nil, &requestError{fmt.Errorf("Unknown index %q", req.Index)}
+    }
+    if req.Value == "" {
+        return nil, &requestError{fmt.Errorf("Find request is missing a %s", req.Index)}
+    }
+    return store.FindByIndex(req.Index, req.Value)
+}
@@ -0,0 +1,132 @@
+/* Copyright 2020 PhysarumSM Development Team
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+    "encoding/json"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+
+    bolt "github.com/coreos/bbolt"
+
+    "github.com/PhysarumSM/service-registry/common"
+    "github.com/PhysarumSM/service-registry/registry"
+)
+
+func TestFindServiceInfo(t *testing.T) {
+    testLocalStores(t, func(t *testing.T, store Store) {
+        put := func(name string, info registry.ServiceInfo) {
+            infoBytes, err := json.Marshal(info)
+            if err != nil {
+                t.Fatalf("%v", err)
+            }
+            infoStr := string(infoBytes)
+            if _, err := store.Put(name, infoStr, PutOptions{}); err != nil {
+                t.Fatalf("%v", err)
+            }
+        }
+        find := func(index, value string) string {
+            kvs, err := findServiceInfo(store, common.FindRequest{Index: index, Value: value})
+            if err != nil {
+                t.Fatalf("%v", err)
+            }
+            names := []string{}
+            for _, kv := range kvs {
+                names = append(names, kv.Key)
+            }
+            return strings.Join(names, ",")
+        }
+
+        put("a:1.0", registry.ServiceInfo{ContentHash: "c1", DockerHash: "d1"})
+        put("a:1.1", registry.ServiceInfo{ContentHash: "c1", DockerHash: "d2"})
+        put("b:1.0", registry.ServiceInfo{ContentHash: "c2"})
+        store.Put("corrupt:1.0", "not json", PutOptions{})
+
+        for _, test := range []struct {
+            index, value, expected string
+        }{
+            {common.ContentHashIndex, "c1", "a:1.0,a:1.1"},
+            {common.DockerHashIndex, "d2", "a:1.1"},
+            {common.DockerHashIndex, "c1", ""},
+            {common.ContentHashIndex, "missing", ""},
+        } {
+            if found := find(test.index, test.value); found != test.expected {
+                t.Errorf("Find %s %s returned %q, expected %q", test.index, test.value, found, test.expected)
+            }
+        }
+
+        // Replacing and deleting entries updates the index along with them
+        put("a:1.0", registry.ServiceInfo{ContentHash: "c3"})
+        store.Delete("a:1.1", DeleteOptions{})
+        if found := find(common.ContentHashIndex, "c1"); found != "" {
+            t.Errorf("Find returned %q after entries were replaced and deleted, expected none", found)
+        }
+        if found := find(common.ContentHashIndex, "c3"); found != "a:1.0" {
+            t.Errorf("Find returned %q for the replaced entry, expected a:1.0", found)
+        }
+
+        for _, req := range []common.FindRequest{
+            {Index: "name", Value: "a:1.0"},
+            {Index: common.ContentHashIndex},
+        } {
+            _, err := findServiceInfo(store, req)
+            if _, ok := err.(*requestError); !ok {
+                t.Errorf("Find %+v returned %v, expected a requestError", req, err)
+            }
+        }
+    })
+}
+
+func TestBoltBackfillIndexes(t *testing.T) {
+    tmpDir, err := ioutil.TempDir("", "store-test-")
+    if err != nil {
+        t.Fatalf("%v", err)
+    }
+    defer os.RemoveAll(tmpDir)
+    path := filepath.Join(tmpDir, "registry.db")
+
+    store, err := newBoltStore(path)
+    if err != nil {
+        t.Fatalf("%v", err)
+    }
+    store.Put("a:1.0", `{"ContentHash": "c1"}`, PutOptions{})
+    store.Close()
+
+    // Files written before indexes were kept have no indexes bucket
+    db, err := bolt.Open(path, 0600, nil)
+    if err != nil {
+        t.Fatalf("%v", err)
+    }
+    err = db.Update(func(tx *bolt.Tx) error {
+        return tx.DeleteBucket(boltIndexesBucket)
+    })
+    db.Close()
+    if err != nil {
+        t.Fatalf("%v", err)
+    }
+
+    store, err = newBoltStore(path)
+    if err != nil {
+        t.Fatalf("%v", err)
+    }
+    defer store.Close()
+    kvs, err := store.FindByIndex(common.ContentHashIndex, "c1")
+    if err != nil || len(kvs) != 1 || kvs[0].Key != "a:1.0" {
+        t.Errorf("Find after reopening returned (%v, %v), expected a:1.0", kvs, err)
+    }
+}
@@ -22,12 +22,10 @@
 
     "github.com/libp2p/go-libp2p-core/network"
 
-    "go.etcd.io/etcd/clientv3"
-
     "github.com/PhysarumSM/service-registry/common"
 )
 
-func handleGet(etcdCli *clientv3.Client) func(network.Stream) {
+func handleGet(store Store) func(network.Stream) {
     return func(stream network.Stream) {
         data, err := ioutil.ReadAll(stream)
         if err != nil {
@@ -38,13 +36,24 @@ func handleGet(etcdCli *clientv3.Client) func(network.Stream) {
         reqStr := strings.TrimSpace(string(data))
         log.Println("Lookup request:", reqStr)
 
-        infoStr, ok, err := getServiceInfo(etcdCli, reqStr)
+        kv, ok, err := getServiceInfo(store, reqStr)
         if err != nil {
             streamError(stream, err)
             return
         }
 
-        respInfo := common.GetResponse{InfoStr: infoStr, LookupOk: ok}
+        status := common.Status{Code: common.StatusOK}
+        if !ok {
+            status = common.Status{Code: common.StatusNotFound, Message: "No service matching " + reqStr}
+        }
+
+        respInfo := common.GetResponse{
+            Status: status,
+            Name: kv.Key,
+            InfoStr: kv.Value,
+            Meta: entryMeta(kv),
+            LookupOk: ok,
+        }
         respBytes, err := json.Marshal(respInfo)
         if err != nil {
             streamError(stream, err)
@@ -55,7 +64,7 @@ func handleGet(etcdCli *clientv3.Client) func(network.Stream) {
 
         _, err = stream.Write(respBytes)
         if err != nil {
-            streamError(stream, err)
+            streamReset(stream, err)
             return
         }
 
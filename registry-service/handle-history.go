@@ -0,0 +1,103 @@
+/* Copyright 2020 PhysarumSM Development Team
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "io/ioutil"
+    "log"
+    "strings"
+
+    "github.com/libp2p/go-libp2p-core/network"
+
+    "github.com/PhysarumSM/service-registry/common"
+)
+
+func handleHistory(store Store) func(network.Stream) {
+    return func(stream network.Stream) {
+        data, err := ioutil.ReadAll(stream)
+        if err != nil {
+            streamError(stream, err)
+            return
+        }
+
+        reqStr := strings.TrimSpace(string(data))
+        log.Println("History request:", reqStr)
+
+        var reqInfo common.HistoryRequest
+        err = json.Unmarshal([]byte(reqStr), &reqInfo)
+        if err != nil {
+            streamError(stream, &requestError{err})
+            return
+        }
+
+        versions, err := serviceHistory(store, reqInfo)
+        if err != nil {
+            streamError(stream, err)
+            return
+        }
+
+        respInfo := common.HistoryResponse{
+            Status: common.Status{Code: common.StatusOK},
+            Versions: []common.EntryVersion{},
+        }
+        if len(versions) == 0 {
+            respInfo.Status = common.Status{Code: common.StatusNotFound, Message: "No history of " + reqInfo.Name}
+        }
+        for _, version := range versions {
+            respInfo.Versions = append(respInfo.Versions, common.EntryVersion{
+                InfoStr: version.Value,
+                Meta: entryMeta(version.KeyValue),
+                Deleted: version.Deleted,
+            })
+        }
+        respBytes, err := json.Marshal(respInfo)
+        if err != nil {
+            streamError(stream, err)
+            return
+        }
+
+        log.Println("History response: ", string(respBytes))
+
+        _, err = stream.Write(respBytes)
+        if err != nil {
+            streamReset(stream, err)
+            return
+        }
+
+        stream.Close()
+    }
+}
+
+// Versions of the entry named by req, or the one it had at req.Revision
+func serviceHistory(store Store, req common.HistoryRequest) (versions []EntryVersion, err error) {
+    if req.Name == "" {
+        return nil, &requestError{errors.New("History request is missing a service name")}
+    }
+    if req.Revision < 0 || req.Limit < 0 {
+        return nil, &requestError{errors.New("History revision and limit must not be negative")}
+    }
+
+    if req.Revision == 0 {
+        return store.History(req.Name, req.Limit)
+    }
+
+    kv, ok, err := store.GetAt(req.Name, req.Revision)
+    if err != nil || !ok {
+        return []EntryVersion{}, err
+    }
+    return []EntryVersion{{KeyValue: kv}}, nil
+}
@@ -16,26 +16,47 @@
 
  import (
     "encoding/json"
+    "io/ioutil"
     "log"
+    "strings"
 
     "github.com/libp2p/go-libp2p-core/network"
 
-    "go.etcd.io/etcd/clientv3"
-
     "github.com/PhysarumSM/service-registry/common"
 )
 
-func handleList(etcdCli *clientv3.Client) func(network.Stream) {
+func handleList(store Store) func(network.Stream) {
     return func(stream network.Stream) {
-        log.Println("List request")
+        data, err := ioutil.ReadAll(stream)
+        if err != nil {
+            streamError(stream, err)
+            return
+        }
+
+        reqStr := strings.TrimSpace(string(data))
+        log.Println("List request:", reqStr)
+
+        // Older clients send an empty request, listing everything
+        var reqInfo common.ListRequest
+        if reqStr != "" {
+            err = json.Unmarshal([]byte(reqStr), &reqInfo)
+            if err != nil {
+                streamError(stream, &requestError{err})
+                return
+            }
+        }
 
-        nameToInfoStr, ok, err := listServiceInfo(etcdCli)
+        var respInfo common.ListResponse
+        if reqInfo.Deleted {
+            respInfo, err = deletedListResponse(store, reqInfo)
+        } else {
+            respInfo, err = listResponse(store, reqInfo)
+        }
         if err != nil {
             streamError(stream, err)
             return
         }
 
-        respInfo := common.ListResponse{NameToInfoStr: nameToInfoStr, LookupOk: ok}
         respBytes, err := json.Marshal(respInfo)
         if err != nil {
             streamError(stream, err)
@@ -46,10 +67,65 @@ func handleList(etcdCli *clientv3.Client) func(network.Stream) {
 
         _, err = stream.Write(respBytes)
         if err != nil {
-            streamError(stream, err)
+            streamReset(stream, err)
             return
         }
 
         stream.Close()
     }
 }
+
+func listResponse(store Store, req common.ListRequest) (respInfo common.ListResponse, err error) {
+    kvs, next, ok, err := listServiceInfo(store, req)
+    if err != nil {
+        return respInfo, err
+    }
+
+    status := common.Status{Code: common.StatusOK}
+    if !ok {
+        status = common.Status{Code: common.StatusNotFound, Message: "No services found"}
+    }
+
+    respInfo = common.ListResponse{
+        Status: status,
+        NameToInfoStr: make(map[string]string),
+        NameToMeta: make(map[string]common.EntryMeta),
+        LookupOk: ok,
+        Continue: next,
+    }
+    for _, kv := range kvs {
+        respInfo.NameToInfoStr[kv.Key] = kv.Value
+        respInfo.NameToMeta[kv.Key] = entryMeta(kv)
+    }
+    return respInfo, nil
+}
+
+func deletedListResponse(store Store, req common.ListRequest) (respInfo common.ListResponse, err error) {
+    tombstones, next, ok, err := listTombstones(store, req)
+    if err != nil {
+        return respInfo, err
+    }
+
+    status := common.Status{Code: common.StatusOK}
+    if !ok {
+        status = common.Status{Code: common.StatusNotFound, Message: "No deleted services found"}
+    }
+
+    respInfo = common.ListResponse{
+        Status: status,
+        NameToInfoStr: make(map[string]string),
+        NameToMeta: make(map[string]common.EntryMeta),
+        NameToDeletion: make(map[string]common.DeletionMeta),
+        LookupOk: ok,
+        Continue: next,
+    }
+    for _, tombstone := range tombstones {
+        respInfo.NameToInfoStr[tombstone.Key] = tombstone.Value
+        respInfo.NameToMeta[tombstone.Key] = entryMeta(tombstone.KeyValue)
+        respInfo.NameToDeletion[tombstone.Key] = common.DeletionMeta{
+            DeletedBy: tombstone.Deleter,
+            DeletedAt: tombstone.DeletedAt,
+        }
+    }
+    return respInfo, nil
+}
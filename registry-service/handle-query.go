@@ -0,0 +1,147 @@
+/* Copyright 2020 PhysarumSM Development Team
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "io/ioutil"
+    "log"
+    "strings"
+
+    "github.com/libp2p/go-libp2p-core/network"
+
+    "github.com/PhysarumSM/service-registry/common"
+    "github.com/PhysarumSM/service-registry/registry"
+)
+
+// Number of entries read from the store at a time while looking for matches
+const queryScanBatch = 500
+
+func handleQuery(store Store) func(network.Stream) {
+    return func(stream network.Stream) {
+        data, err := ioutil.ReadAll(stream)
+        if err != nil {
+            streamError(stream, err)
+            return
+        }
+
+        reqStr := strings.TrimSpace(string(data))
+        log.Println("Query request:", reqStr)
+
+        var reqInfo common.QueryRequest
+        err = json.Unmarshal([]byte(reqStr), &reqInfo)
+        if err != nil {
+            streamError(stream, &requestError{err})
+            return
+        }
+
+        kvs, next, err := queryServiceInfo(store, reqInfo)
+        if err != nil {
+            streamError(stream, err)
+            return
+        }
+
+        // No matches is a successful query, unlike an empty list
+        respInfo := common.ListResponse{
+            Status: common.Status{Code: common.StatusOK},
+            NameToInfoStr: make(map[string]string),
+            NameToMeta: make(map[string]common.EntryMeta),
+            LookupOk: true,
+            Continue: next,
+        }
+        for _, kv := range kvs {
+            respInfo.NameToInfoStr[kv.Key] = kv.Value
+            respInfo.NameToMeta[kv.Key] = entryMeta(kv)
+        }
+        respBytes, err := json.Marshal(respInfo)
+        if err != nil {
+            streamError(stream, err)
+            return
+        }
+
+        log.Println("Query response: ", string(respBytes))
+
+        _, err = stream.Write(respBytes)
+        if err != nil {
+            streamReset(stream, err)
+            return
+        }
+
+        stream.Close()
+    }
+}
+
+// Find a page of entries matching req
+// next is where the following page starts, empty if this is the last page
+func queryServiceInfo(store Store, req common.QueryRequest) (kvs []KeyValue, next string, err error) {
+    if req.Cpu < 0 || req.Memory < 0 || req.RTT < 0 || req.Limit < 0 {
+        return nil, "", &requestError{errors.New("Query bounds and limit must not be negative")}
+    }
+
+    kvs = []KeyValue{}
+    start := req.Continue
+    for {
+        batch, more, err := store.List(req.Prefix, ListOptions{Start: start, Limit: queryScanBatch})
+        if err != nil {
+            return nil, "", err
+        }
+
+        for i, kv := range batch {
+            if !serviceFits(kv.Value, req) {
+                continue
+            }
+            kvs = append(kvs, kv)
+            if req.Limit > 0 && int64(len(kvs)) == req.Limit {
+                if more || i < len(batch) - 1 {
+                    next = keyAfter(kv.Key)
+                }
+                return kvs, next, nil
+            }
+        }
+
+        if !more || len(batch) == 0 {
+            return kvs, "", nil
+        }
+        start = keyAfter(batch[len(batch) - 1].Key)
+    }
+}
+
+// Whether a node with the resources and network conditions of req meets the requirements in infoStr
+// Entries whose info can't be decoded never match
+func serviceFits(infoStr string, req common.QueryRequest) bool {
+    var info registry.ServiceInfo
+    err := json.Unmarshal([]byte(infoStr), &info)
+    if err != nil {
+        return false
+    }
+
+    if req.Cpu > 0 && info.CpuReq > req.Cpu {
+        return false
+    }
+    if req.Memory > 0 && info.MemoryReq > req.Memory {
+        return false
+    }
+    if req.RTT > 0 {
+        hardRTT, softRTT := info.NetworkHardReq.RTT, info.NetworkSoftReq.RTT
+        if hardRTT > 0 && req.RTT > hardRTT {
+            return false
+        }
+        if req.MeetSoftReq && softRTT > 0 && req.RTT > softRTT {
+            return false
+        }
+    }
+    return true
+}
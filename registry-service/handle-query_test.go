@@ -0,0 +1,91 @@
+/* Copyright 2020 PhysarumSM Development Team
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+    "encoding/json"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/PhysarumSM/common/p2putil"
+
+    "github.com/PhysarumSM/service-registry/common"
+    "github.com/PhysarumSM/service-registry/registry"
+)
+
+func TestQueryServiceInfo(t *testing.T) {
+    store := newMemoryStore()
+    defer store.Close()
+
+    for name, info := range map[string]registry.ServiceInfo{
+        "small:1.0": {CpuReq: 1, MemoryReq: 256},
+        "large:1.0": {CpuReq: 8, MemoryReq: 4096},
+        "near:1.0": {CpuReq: 1, MemoryReq: 256, NetworkHardReq: p2putil.PerfInd{RTT: 20 * time.Millisecond}},
+        "picky:1.0": {
+            CpuReq: 1,
+            MemoryReq: 256,
+            NetworkSoftReq: p2putil.PerfInd{RTT: 10 * time.Millisecond},
+            NetworkHardReq: p2putil.PerfInd{RTT: 100 * time.Millisecond},
+        },
+    } {
+        infoBytes, err := json.Marshal(info)
+        if err != nil {
+            t.Fatalf("%v", err)
+        }
+        if _, err := store.Put(name, string(infoBytes), PutOptions{}); err != nil {
+            t.Fatalf("%v", err)
+        }
+    }
+    store.Put("corrupt:1.0", "not json", PutOptions{})
+
+    for _, test := range []struct {
+        req common.QueryRequest
+        expected string
+    }{
+        {common.QueryRequest{Cpu: 2, Memory: 1024}, "near:1.0,picky:1.0,small:1.0"},
+        {common.QueryRequest{Cpu: 2, Memory: 1024, RTT: 50 * time.Millisecond}, "picky:1.0,small:1.0"},
+        {common.QueryRequest{Cpu: 2, Memory: 1024, RTT: 50 * time.Millisecond, MeetSoftReq: true}, "small:1.0"},
+        {common.QueryRequest{Memory: 8192, Prefix: "l"}, "large:1.0"},
+    } {
+        kvs, next, err := queryServiceInfo(store, test.req)
+        if err != nil {
+            t.Fatalf("%v", err)
+        }
+        names := []string{}
+        for _, kv := range kvs {
+            names = append(names, kv.Key)
+        }
+        if strings.Join(names, ",") != test.expected || next != "" {
+            t.Errorf("Query %+v matched %v (next %q), expected %s", test.req, names, next, test.expected)
+        }
+    }
+
+    // Pages hold Limit matches, skipping entries that don't match
+    req := common.QueryRequest{Cpu: 2, Memory: 1024, Limit: 2}
+    kvs, next, err := queryServiceInfo(store, req)
+    if err != nil || len(kvs) != 2 || kvs[1].Key != "picky:1.0" || next == "" {
+        t.Fatalf("First page returned (%v, %q, %v)", kvs, next, err)
+    }
+    req.Continue = next
+    kvs, next, err = queryServiceInfo(store, req)
+    if err != nil || len(kvs) != 1 || kvs[0].Key != "small:1.0" || next != "" {
+        t.Errorf("Last page returned (%v, %q, %v)", kvs, next, err)
+    }
+
+    if _, _, err := queryServiceInfo(store, common.QueryRequest{Cpu: -1}); err == nil {
+        t.Errorf("Query with negative bound succeeded")
+    }
+}
@@ -0,0 +1,69 @@
+/* Copyright 2020 PhysarumSM Development Team
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+    "encoding/json"
+    "io/ioutil"
+    "log"
+    "strings"
+
+    "github.com/libp2p/go-libp2p-core/network"
+
+    "github.com/PhysarumSM/service-registry/common"
+)
+
+func handleRenew(store Store) func(network.Stream) {
+    return func(stream network.Stream) {
+        data, err := ioutil.ReadAll(stream)
+        if err != nil {
+            streamError(stream, err)
+            return
+        }
+
+        reqStr := strings.TrimSpace(string(data))
+        log.Println("Renew request:", reqStr)
+
+        ttl, ok, err := store.Renew(reqStr)
+        if err != nil {
+            streamError(stream, err)
+            return
+        }
+
+        status := common.Status{Code: common.StatusOK}
+        if !ok {
+            status = common.Status{
+                Code: common.StatusNotFound,
+                Message: "No entry named " + reqStr + " with a TTL",
+            }
+        }
+
+        respInfo := common.RenewResponse{Status: status, Name: reqStr, TTL: ttl, RenewOk: ok}
+        respBytes, err := json.Marshal(respInfo)
+        if err != nil {
+            streamError(stream, err)
+            return
+        }
+
+        log.Println("Renew response:", string(respBytes))
+        _, err = stream.Write(respBytes)
+        if err != nil {
+            streamReset(stream, err)
+            return
+        }
+
+        stream.Close()
+    }
+}
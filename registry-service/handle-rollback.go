@@ -0,0 +1,189 @@
+/* Copyright 2020 PhysarumSM Development Team
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io/ioutil"
+    "log"
+
+    "github.com/libp2p/go-libp2p-core/network"
+    "github.com/libp2p/go-libp2p-core/peer"
+
+    "github.com/PhysarumSM/service-registry/common"
+)
+
+func handleRollback(store Store, acl *accessControl, audit *auditLog) func(network.Stream) {
+    return func(stream network.Stream) {
+        data, err := ioutil.ReadAll(stream)
+        if err != nil {
+            streamError(stream, err)
+            return
+        }
+
+        requester := stream.Conn().RemotePeer()
+        log.Println("Rollback request from", requester.Pretty(), ":", string(data))
+
+        var reqInfo common.RollbackRequest
+        err = json.Unmarshal(data, &reqInfo)
+        if err != nil {
+            streamError(stream, &requestError{err})
+            return
+        }
+
+        record := newAuditRecord(requester, common.RollbackProtocolID, reqInfo.Name)
+        rev, restoredRev, ok, err := rollbackEntry(store, acl, requester, reqInfo, &record)
+
+        var respInfo common.RollbackResponse
+        if conflict, isConflict := err.(*conflictError); isConflict {
+            respInfo.Status = common.Status{Code: common.StatusConflict, Message: conflict.Error()}
+            respInfo.CurrentRevision = conflict.CurrentRevision
+        } else if err != nil {
+            streamError(stream, err)
+            return
+        } else if !ok {
+            respInfo.Status = common.Status{
+                Code: common.StatusNotFound,
+                Message: "No version of " + reqInfo.Name + " to roll back to",
+            }
+        } else {
+            respInfo.Status = common.Status{
+                Code: common.StatusOK,
+                Message: fmt.Sprintf("Restored revision %d of %s as revision %d", restoredRev, reqInfo.Name, rev),
+            }
+            respInfo.Revision = rev
+            respInfo.RestoredRevision = restoredRev
+            audit.committed(record)
+        }
+
+        respBytes, err := json.Marshal(respInfo)
+        if err != nil {
+            streamError(stream, err)
+            return
+        }
+
+        log.Println("Rollback response:", string(respBytes))
+        _, err = stream.Write(respBytes)
+        if err != nil {
+            streamReset(stream, err)
+            return
+        }
+
+        stream.Close()
+    }
+}
+
+// Put the version of an entry given by req back as its current value, on behalf of requester
+// ok is false if there is no such version
+// Returns *conflictError if the entry is not at req.IfRevision, or changes before the rollback is written
+// record is appended to the audit log along with the rollback unless nil
+func rollbackEntry(
+    store Store, acl *accessControl, requester peer.ID, req common.RollbackRequest, record *AuditRecord) (
+    rev, restoredRev int64, ok bool, err error) {
+
+    if req.Name == "" {
+        return 0, 0, false, &requestError{errors.New("Rollback request is missing a service name")}
+    }
+    if req.ToRevision < 0 || req.IfRevision < 0 {
+        return 0, 0, false, &requestError{errors.New("Rollback revisions must not be negative")}
+    }
+
+    cur, exists, err := store.Get(req.Name)
+    if err != nil {
+        return 0, 0, false, err
+    }
+    versions, err := store.History(req.Name, 0)
+    if err != nil {
+        return 0, 0, false, err
+    }
+
+    curRev := cur.ModRevision
+    if !exists && len(versions) > 0 {
+        curRev = versions[0].ModRevision
+    }
+    if req.IfRevision != 0 && req.IfRevision != curRev {
+        return 0, 0, false, &conflictError{Key: req.Name, CurrentRevision: curRev}
+    }
+
+    var target KeyValue
+    if req.ToRevision != 0 {
+        target, ok, err = store.GetAt(req.Name, req.ToRevision)
+        if err != nil || !ok {
+            return 0, 0, false, err
+        }
+    } else {
+        for _, v := range versions {
+            if !v.Deleted && (!exists || v.ModRevision < cur.ModRevision) {
+                target, ok = v.KeyValue, true
+                break
+            }
+        }
+        if !ok {
+            return 0, 0, false, nil
+        }
+    }
+
+    // Only write over the state checked above, so concurrent rollbacks can't both apply
+    opts := PutOptions{
+        Attrs: target.Attrs, IfAbsent: !exists, IfRevision: cur.ModRevision, KeepLease: exists, Audit: record}
+    owner := requester
+    if req.Unowned {
+        owner = ""
+    }
+    if exists {
+        rev, err = ownedPut(store, acl, owner, req.Name, target.Value, opts)
+    } else {
+        rev, err = restoreDeleted(store, acl, owner, req.Name, target, versions, opts)
+    }
+    if err != nil {
+        return 0, 0, false, err
+    }
+    return rev, target.ModRevision, true, nil
+}
+
+// Put target back as the value of a deleted entry, on behalf of requester
+// The entry stays owned by whoever owned it when deleted, as kept by its tombstone or else its
+// last live version, instead of being claimed by the first peer to roll it back
+func restoreDeleted(
+    store Store, acl *accessControl, requester peer.ID, key string, target KeyValue, versions []EntryVersion,
+    opts PutOptions) (rev int64, err error) {
+
+    tombstone, ok, err := store.GetTombstone(key)
+    if err != nil {
+        return 0, err
+    }
+    last := target
+    if ok {
+        last = tombstone.KeyValue
+    } else {
+        for _, v := range versions {
+            if !v.Deleted {
+                last = v.KeyValue
+                break
+            }
+        }
+    }
+
+    owner, err := checkOwner(acl, requester, key, last, true)
+    if err != nil {
+        return 0, err
+    }
+
+    setAuditDigests(opts.Audit, KeyValue{}, false, target.Value, true)
+    opts.Attrs.Owner = owner
+    return store.Put(key, target.Value, opts)
+}
@@ -0,0 +1,85 @@
+/* Copyright 2020 PhysarumSM Development Team
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+    "testing"
+
+    "github.com/PhysarumSM/service-registry/common"
+)
+
+func TestRollbackEntry(t *testing.T) {
+    testLocalStores(t, func(t *testing.T, store Store) {
+        owner, other := testPeerID(t), testPeerID(t)
+        acl, _ := newAccessControl("", peerSet{})
+
+        rev1, _ := ownedPut(store, acl, owner, "my-service:1.0", "info-1", PutOptions{TTL: 60})
+        rev2, _ := ownedPut(store, acl, owner, "my-service:1.0", "info-2", PutOptions{KeepLease: true})
+        rev3, err := ownedPut(store, acl, owner, "my-service:1.0", "bad", PutOptions{KeepLease: true})
+        if err != nil {
+            t.Fatalf("%v", err)
+        }
+
+        _, _, _, err = rollbackEntry(store, acl, other, common.RollbackRequest{Name: "my-service:1.0"}, nil)
+        if _, ok := err.(*forbiddenError); !ok {
+            t.Errorf("Rollback by other peer returned %v, expected forbiddenError", err)
+        }
+
+        // Rolls back to the previous version, keeping the lease
+        rev, restoredRev, ok, err := rollbackEntry(store, acl, owner,
+            common.RollbackRequest{Name: "my-service:1.0", IfRevision: rev3}, nil)
+        if err != nil || !ok || restoredRev != rev2 {
+            t.Fatalf("Rollback returned (%d, %v, %v), expected to restore revision %d", restoredRev, ok, err, rev2)
+        }
+        kv, _, _ := store.Get("my-service:1.0")
+        if kv.Value != "info-2" || kv.ModRevision != rev || kv.Lease == 0 || kv.Attrs.Owner != owner.Pretty() {
+            t.Errorf("Rollback left entry %+v, expected info-2 at revision %d with its lease and owner", kv, rev)
+        }
+
+        // A second rollback from the same revision must not undo the first
+        _, _, _, err = rollbackEntry(store, acl, owner,
+            common.RollbackRequest{Name: "my-service:1.0", IfRevision: rev3}, nil)
+        if conflict, isConflict := err.(*conflictError); !isConflict || conflict.CurrentRevision != rev {
+            t.Errorf("Rollback from a stale revision returned %v, expected conflict at revision %d", err, rev)
+        }
+
+        // Deleted entries can be restored too, by their previous owner only
+        store.Delete("my-service:1.0", DeleteOptions{})
+        _, _, _, err = rollbackEntry(store, acl, other,
+            common.RollbackRequest{Name: "my-service:1.0", ToRevision: rev1}, nil)
+        if _, ok := err.(*forbiddenError); !ok {
+            t.Errorf("Rollback of deleted entry by other peer returned %v, expected forbiddenError", err)
+        }
+        _, restoredRev, ok, err = rollbackEntry(store, acl, owner,
+            common.RollbackRequest{Name: "my-service:1.0", ToRevision: rev1}, nil)
+        kv, _, _ = store.Get("my-service:1.0")
+        if err != nil || !ok || restoredRev != rev1 || kv.Value != "info-1" || kv.Attrs.Owner != owner.Pretty() {
+            t.Errorf("Rollback of deleted entry to revision %d returned (%d, %v, %v), left entry %+v",
+                rev1, restoredRev, ok, err, kv)
+        }
+
+        // Soft deleted entries are checked against their tombstone
+        ownedDelete(store, acl, owner, "my-service:1.0", nil)
+        _, _, _, err = rollbackEntry(store, acl, other, common.RollbackRequest{Name: "my-service:1.0"}, nil)
+        if _, ok := err.(*forbiddenError); !ok {
+            t.Errorf("Rollback of soft deleted entry by other peer returned %v, expected forbiddenError", err)
+        }
+
+        _, _, ok, err = rollbackEntry(store, acl, owner, common.RollbackRequest{Name: "other-service:1.0"}, nil)
+        if err != nil || ok {
+            t.Errorf("Rollback of unknown entry returned (%v, %v), expected not found", ok, err)
+        }
+    })
+}
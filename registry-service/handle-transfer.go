@@ -0,0 +1,89 @@
+/* Copyright 2020 PhysarumSM Development Team
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "io/ioutil"
+    "log"
+
+    "github.com/libp2p/go-libp2p-core/network"
+    "github.com/libp2p/go-libp2p-core/peer"
+
+    "github.com/PhysarumSM/service-registry/common"
+)
+
+func handleTransferOwnership(store Store, acl *accessControl, audit *auditLog) func(network.Stream) {
+    return func(stream network.Stream) {
+        data, err := ioutil.ReadAll(stream)
+        if err != nil {
+            streamError(stream, err)
+            return
+        }
+
+        requester := stream.Conn().RemotePeer()
+        log.Println("Transfer ownership request from", requester.Pretty(), ":", string(data))
+
+        var reqInfo common.TransferOwnershipRequest
+        err = json.Unmarshal(data, &reqInfo)
+        if err != nil {
+            streamError(stream, &requestError{err})
+            return
+        }
+
+        newOwner, err := peer.IDB58Decode(reqInfo.NewOwner)
+        if err != nil {
+            streamError(stream, &requestError{fmt.Errorf("Invalid new owner: %v", err)})
+            return
+        }
+
+        record := newAuditRecord(requester, common.TransferOwnershipProtocolID, reqInfo.Name)
+        rev, ok, err := transferOwnership(store, acl, requester, reqInfo.Name, newOwner, &record)
+        if err != nil {
+            streamError(stream, err)
+            return
+        }
+
+        respInfo := common.TransferOwnershipResponse{Revision: rev}
+        if ok {
+            respInfo.Status = common.Status{
+                Code: common.StatusOK,
+                Message: fmt.Sprintf("Transferred %s to %s", reqInfo.Name, reqInfo.NewOwner),
+            }
+            audit.committed(record)
+        } else {
+            respInfo.Status = common.Status{
+                Code: common.StatusNotFound,
+                Message: "No entry named " + reqInfo.Name,
+            }
+        }
+
+        respBytes, err := json.Marshal(respInfo)
+        if err != nil {
+            streamError(stream, err)
+            return
+        }
+
+        log.Println("Transfer ownership response:", string(respBytes))
+        _, err = stream.Write(respBytes)
+        if err != nil {
+            streamReset(stream, err)
+            return
+        }
+
+        stream.Close()
+    }
+}
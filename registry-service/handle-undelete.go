@@ -0,0 +1,83 @@
+/* Copyright 2020 PhysarumSM Development Team
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "io/ioutil"
+    "log"
+    "strings"
+
+    "github.com/libp2p/go-libp2p-core/network"
+
+    "github.com/PhysarumSM/service-registry/common"
+)
+
+func handleUndelete(store Store, acl *accessControl, audit *auditLog) func(network.Stream) {
+    return func(stream network.Stream) {
+        data, err := ioutil.ReadAll(stream)
+        if err != nil {
+            streamError(stream, err)
+            return
+        }
+
+        reqStr := strings.TrimSpace(string(data))
+        log.Println("Undelete request:", reqStr)
+
+        requester := stream.Conn().RemotePeer()
+        record := newAuditRecord(requester, common.UndeleteProtocolID, reqStr)
+        rev, ok, err := undeleteEntry(store, acl, requester, reqStr, &record)
+
+        var respInfo common.UndeleteResponse
+        if conflict, isConflict := err.(*conflictError); isConflict {
+            respInfo.Status = common.Status{
+                Code: common.StatusConflict,
+                Message: fmt.Sprintf("%s was added again since it was deleted", reqStr),
+            }
+            respInfo.CurrentRevision = conflict.CurrentRevision
+        } else if err != nil {
+            streamError(stream, err)
+            return
+        } else if !ok {
+            respInfo.Status = common.Status{
+                Code: common.StatusNotFound,
+                Message: "No deleted entry named " + reqStr,
+            }
+        } else {
+            respInfo.Status = common.Status{
+                Code: common.StatusOK,
+                Message: fmt.Sprintf("Restored %s as revision %d", reqStr, rev),
+            }
+            respInfo.Revision = rev
+            audit.committed(record)
+        }
+
+        respBytes, err := json.Marshal(respInfo)
+        if err != nil {
+            streamError(stream, err)
+            return
+        }
+
+        log.Println("Undelete response:", string(respBytes))
+        _, err = stream.Write(respBytes)
+        if err != nil {
+            streamReset(stream, err)
+            return
+        }
+
+        stream.Close()
+    }
+}
@@ -0,0 +1,112 @@
+/* Copyright 2020 PhysarumSM Development Team
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "io/ioutil"
+    "log"
+    "strings"
+    "time"
+
+    "github.com/libp2p/go-libp2p-core/network"
+
+    "github.com/PhysarumSM/service-registry/common"
+)
+
+// How often to send progress events while there are no changes
+// Lets us notice watchers that have gone away
+const watchProgressInterval = 30 * time.Second
+
+var storeEventToWatchType = map[StoreEventType]common.WatchEventType{
+    storeEventCreate: common.WatchAdd,
+    storeEventUpdate: common.WatchUpdate,
+    storeEventDelete: common.WatchDelete,
+}
+
+func handleWatch(store Store) func(network.Stream) {
+    return func(stream network.Stream) {
+        data, err := ioutil.ReadAll(stream)
+        if err != nil {
+            streamError(stream, err)
+            return
+        }
+
+        reqStr := strings.TrimSpace(string(data))
+        log.Println("Watch request:", reqStr)
+
+        var reqInfo common.WatchRequest
+        err = json.Unmarshal([]byte(reqStr), &reqInfo)
+        if err != nil {
+            streamError(stream, &requestError{err})
+            return
+        }
+
+        ctx, cancel := context.WithCancel(context.Background())
+        defer cancel()
+
+        events, err := store.Watch(ctx, reqInfo.Name, reqInfo.Prefix)
+        if err != nil {
+            streamError(stream, err)
+            return
+        }
+
+        ticker := time.NewTicker(watchProgressInterval)
+        defer ticker.Stop()
+
+        // Let the watcher know the watch was set up before any changes arrive
+        encoder := json.NewEncoder(stream)
+        err = encoder.Encode(common.WatchEvent{
+            Status: common.Status{Code: common.StatusOK},
+            Type: common.WatchProgress,
+        })
+        if err != nil {
+            streamReset(stream, err)
+            return
+        }
+
+        for {
+            var watchEvent common.WatchEvent
+            select {
+            case event, ok := <-events:
+                if !ok {
+                    // Store failed or the watcher fell behind, either way it has to watch again
+                    streamError(stream, errors.New("Watch ended: " + reqStr))
+                    return
+                }
+                watchEvent = common.WatchEvent{
+                    Status: common.Status{Code: common.StatusOK},
+                    Type: storeEventToWatchType[event.Type],
+                    Name: event.Key,
+                    InfoStr: event.Value,
+                }
+            case <-ticker.C:
+                watchEvent = common.WatchEvent{
+                    Status: common.Status{Code: common.StatusOK},
+                    Type: common.WatchProgress,
+                }
+            }
+
+            err = encoder.Encode(watchEvent)
+            if err != nil {
+                // Usually the watcher closing its end of the stream
+                streamReset(stream, err)
+                return
+            }
+        }
+    }
+}
@@ -0,0 +1,211 @@
+/* Copyright 2020 PhysarumSM Development Team
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+// Limits on request size, stream deadlines and requests in flight,
+// so a misbehaving peer cannot tie up registry-service's memory or goroutines
+
+import (
+    "fmt"
+    "net"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/libp2p/go-libp2p-core/network"
+    "github.com/libp2p/go-libp2p-core/peer"
+    "github.com/libp2p/go-libp2p-core/protocol"
+)
+
+// Maximum request size of protocols without their own limit
+const defaultMaxRequestSize = 64 << 10
+
+// Maximum request size per protocol, the empty protocol ID holds the limit of all other protocols
+// Usable as a repeatable command line flag, taking either <bytes> or <protocol ID>=<bytes>
+type requestSizes map[protocol.ID]int64
+
+func (s requestSizes) String() string {
+    sizes := []string{}
+    for protocolID, size := range s {
+        if protocolID == "" {
+            sizes = append(sizes, strconv.FormatInt(size, 10))
+        } else {
+            sizes = append(sizes, fmt.Sprintf("%s=%d", protocolID, size))
+        }
+    }
+    sort.Strings(sizes)
+    return strings.Join(sizes, ",")
+}
+
+func (s requestSizes) Set(value string) error {
+    var protocolID protocol.ID
+    sizeStr := value
+    if i := strings.LastIndex(value, "="); i >= 0 {
+        protocolID, sizeStr = protocol.ID(value[:i]), value[i+1:]
+    }
+    size, err := strconv.ParseInt(sizeStr, 10, 64)
+    if err != nil || size <= 0 {
+        return fmt.Errorf("Invalid request size %s", sizeStr)
+    }
+    s[protocolID] = size
+    return nil
+}
+
+func (s requestSizes) of(protocolID protocol.ID) int64 {
+    if size, ok := s[protocolID]; ok {
+        return size
+    }
+    if size, ok := s[""]; ok {
+        return size
+    }
+    return defaultMaxRequestSize
+}
+
+// Zero timeouts and in flight limits disable them
+type limitsConfig struct {
+    MaxRequestSize requestSizes
+    ReadTimeout time.Duration
+    WriteTimeout time.Duration
+    MaxInFlight int
+    MaxInFlightPerPeer int
+}
+
+// Returned when a request is too large or too slow to arrive
+type requestLimitError struct {
+    Reason string
+}
+
+func (e *requestLimitError) Error() string {
+    return e.Reason
+}
+
+// Returned when registry-service, or the requesting peer, has too many requests in flight,
+// or the peer exceeded its rate limit
+type throttledError struct {
+    Reason string
+
+    // How long the peer should wait before retrying, 0 if unknown
+    RetryAfter time.Duration
+}
+
+func (e *throttledError) Error() string {
+    return e.Reason
+}
+
+type requestLimits struct {
+    conf limitsConfig
+
+    mutex sync.Mutex
+    inFlight int
+    peerInFlight map[peer.ID]int
+}
+
+func newRequestLimits(conf limitsConfig) *requestLimits {
+    return &requestLimits{conf: conf, peerInFlight: make(map[peer.ID]int)}
+}
+
+// Count a request from id as in flight, unless that would exceed the limits
+func (l *requestLimits) acquire(id peer.ID) error {
+    l.mutex.Lock()
+    defer l.mutex.Unlock()
+
+    if l.conf.MaxInFlight > 0 && l.inFlight >= l.conf.MaxInFlight {
+        return &throttledError{Reason: fmt.Sprintf("Too many requests in flight, limit is %d", l.conf.MaxInFlight)}
+    }
+    if l.conf.MaxInFlightPerPeer > 0 && l.peerInFlight[id] >= l.conf.MaxInFlightPerPeer {
+        return &throttledError{Reason: fmt.Sprintf("Too many requests in flight from %s, limit is %d",
+            id.Pretty(), l.conf.MaxInFlightPerPeer)}
+    }
+    l.inFlight++
+    l.peerInFlight[id]++
+    return nil
+}
+
+func (l *requestLimits) release(id peer.ID) {
+    l.mutex.Lock()
+    defer l.mutex.Unlock()
+
+    l.inFlight--
+    l.peerInFlight[id]--
+    if l.peerInFlight[id] == 0 {
+        delete(l.peerInFlight, id)
+    }
+}
+
+// Wrap handler for protocolID, enforcing the limits on its streams
+// Requests over the limits get an error response
+func (l *requestLimits) guard(protocolID protocol.ID, handler func(network.Stream)) func(network.Stream) {
+    return func(stream network.Stream) {
+        limited := &limitedStream{
+            Stream: stream,
+            maxSize: l.conf.MaxRequestSize.of(protocolID),
+            writeTimeout: l.conf.WriteTimeout,
+        }
+        if l.conf.ReadTimeout > 0 {
+            stream.SetReadDeadline(time.Now().Add(l.conf.ReadTimeout))
+        }
+
+        id := stream.Conn().RemotePeer()
+        err := l.acquire(id)
+        if err != nil {
+            throttledRequests.WithLabelValues(string(protocolID), "in-flight").Inc()
+            streamError(limited, err)
+            return
+        }
+        defer l.release(id)
+
+        handler(limited)
+    }
+}
+
+// Stream failing reads past the request size limit or read deadline with *requestLimitError,
+// and renewing the write deadline before every write
+type limitedStream struct {
+    network.Stream
+    maxSize int64
+    read int64
+    writeTimeout time.Duration
+}
+
+func (s *limitedStream) Read(p []byte) (n int, err error) {
+    tooLarge := &requestLimitError{fmt.Sprintf("Request exceeds %d bytes", s.maxSize)}
+    if s.read > s.maxSize {
+        return 0, tooLarge
+    }
+
+    // Read at most one byte past the limit, enough to tell the request is too large
+    if left := s.maxSize - s.read + 1; int64(len(p)) > left {
+        p = p[:left]
+    }
+
+    n, err = s.Stream.Read(p)
+    s.read += int64(n)
+    if s.read > s.maxSize {
+        return n, tooLarge
+    }
+    if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+        return n, &requestLimitError{"Timed out reading request"}
+    }
+    return n, err
+}
+
+func (s *limitedStream) Write(p []byte) (n int, err error) {
+    if s.writeTimeout > 0 {
+        s.Stream.SetWriteDeadline(time.Now().Add(s.writeTimeout))
+    }
+    return s.Stream.Write(p)
+}
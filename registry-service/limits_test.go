@@ -0,0 +1,102 @@
+/* Copyright 2020 PhysarumSM Development Team
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+    "io"
+    "io/ioutil"
+    "strings"
+    "testing"
+
+    "github.com/libp2p/go-libp2p-core/network"
+
+    "github.com/PhysarumSM/service-registry/common"
+)
+
+// Stream reading from a string, other methods are not implemented
+type readerStream struct {
+    network.Stream
+    reader io.Reader
+}
+
+func (s *readerStream) Read(p []byte) (int, error) {
+    return s.reader.Read(p)
+}
+
+func TestRequestSizes(t *testing.T) {
+    sizes := requestSizes{}
+    if size := sizes.of(common.AddProtocolID); size != defaultMaxRequestSize {
+        t.Errorf("Size limit is %d without flags, expected %d", size, defaultMaxRequestSize)
+    }
+
+    for _, value := range []string{"1024", "/add/0.1=4096"} {
+        if err := sizes.Set(value); err != nil {
+            t.Fatalf("Set(%s) failed: %v", value, err)
+        }
+    }
+    if size := sizes.of(common.AddProtocolID); size != 4096 {
+        t.Errorf("Add size limit is %d, expected 4096", size)
+    }
+    if size := sizes.of(common.GetProtocolID); size != 1024 {
+        t.Errorf("Get size limit is %d, expected 1024", size)
+    }
+    if err := sizes.Set("/add/0.1=lots"); err == nil {
+        t.Errorf("Set accepted invalid size")
+    }
+}
+
+func TestLimitedStream(t *testing.T) {
+    for _, test := range []struct {
+        request string
+        ok bool
+    }{
+        {"0123456789", true},
+        {"0123456789a", false},
+        {strings.Repeat("0123456789", 100), false},
+    } {
+        stream := &limitedStream{Stream: &readerStream{reader: strings.NewReader(test.request)}, maxSize: 10}
+        data, err := ioutil.ReadAll(stream)
+        if _, tooLarge := err.(*requestLimitError); test.ok && (err != nil || string(data) != test.request) {
+            t.Errorf("Reading %d byte request returned (%q, %v)", len(test.request), data, err)
+        } else if !test.ok && !tooLarge {
+            t.Errorf("Reading %d byte request returned %v, expected requestLimitError", len(test.request), err)
+        }
+    }
+}
+
+func TestInFlightLimits(t *testing.T) {
+    limits := newRequestLimits(limitsConfig{MaxInFlight: 3, MaxInFlightPerPeer: 2})
+    busy, other, third := testPeerID(t), testPeerID(t), testPeerID(t)
+
+    for i := 0; i < 2; i++ {
+        if err := limits.acquire(busy); err != nil {
+            t.Fatalf("Request %d failed: %v", i, err)
+        }
+    }
+    if _, ok := limits.acquire(busy).(*throttledError); !ok {
+        t.Errorf("Peer exceeded its in flight limit")
+    }
+    if err := limits.acquire(other); err != nil {
+        t.Errorf("Other peer throttled: %v", err)
+    }
+    if _, ok := limits.acquire(third).(*throttledError); !ok {
+        t.Errorf("Exceeded global in flight limit")
+    }
+
+    limits.release(busy)
+    if err := limits.acquire(third); err != nil {
+        t.Errorf("Still throttled after a request finished: %v", err)
+    }
+}
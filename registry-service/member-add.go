@@ -17,17 +17,16 @@ package main
 import (
     "context"
     "encoding/json"
+    "errors"
     "io/ioutil"
     "log"
-    "fmt"
     "strings"
 
+	"github.com/libp2p/go-libp2p-core/crypto"
 	"github.com/libp2p/go-libp2p-core/network"
 	"github.com/libp2p/go-libp2p-core/pnet"
 	"github.com/libp2p/go-libp2p-core/protocol"
 
-    "go.etcd.io/etcd/clientv3"
-
     "github.com/PhysarumSM/common/p2pnode"
     "github.com/PhysarumSM/service-registry/common"
 
@@ -41,13 +40,20 @@ type memberAddRequest struct {
     MemberPeerUrl string
 }
 
+type memberAddResponse struct {
+    Status common.Status
+    InitialCluster string
+}
+
 func sendMemberAddRequest(
-    newMemName, newMemPeerUrl string, local bool, bootstraps []multiaddr.Multiaddr, psk pnet.PSK) (
-    initialCluster string, err error) {
+    newMemName, newMemPeerUrl string, local bool, bootstraps []multiaddr.Multiaddr, psk pnet.PSK,
+    priv crypto.PrivKey) (initialCluster string, err error) {
 
     ctx := context.Background()
     nodeConfig := p2pnode.NewConfig()
     nodeConfig.PSK = psk
+    // Identify as this instance, so an ACL can allow it to join the cluster
+    nodeConfig.PrivKey = priv
     if local {
         nodeConfig.BootstrapPeers = []multiaddr.Multiaddr{}
     } else if len(bootstraps) > 0 {
@@ -71,12 +77,20 @@ func sendMemberAddRequest(
         return "", err
     }
 
-    initialCluster = strings.TrimSpace(string(response))
+    var respInfo memberAddResponse
+    err = json.Unmarshal(response, &respInfo)
+    if err != nil {
+        return "", err
+    }
+
+    if !respInfo.Status.Ok() {
+        return "", errors.New(respInfo.Status.Message)
+    }
 
-    return initialCluster, nil
+    return respInfo.InitialCluster, nil
 }
 
-func handleMemberAdd(etcdCli *clientv3.Client) func(network.Stream) {
+func handleMemberAdd(store Store, audit *auditLog) func(network.Stream) {
     return func(stream network.Stream) {
         data, err := ioutil.ReadAll(stream)
         if err != nil {
@@ -90,50 +104,34 @@ func handleMemberAdd(etcdCli *clientv3.Client) func(network.Stream) {
         var reqInfo memberAddRequest
         err = json.Unmarshal([]byte(reqStr), &reqInfo)
         if err != nil {
-            streamError(stream, err)
+            streamError(stream, &requestError{err})
             return
         }
 
-        initialCluster, err := addEtcdMember(etcdCli, reqInfo.MemberName, reqInfo.MemberPeerUrl)
+        initialCluster, err := store.MemberAdd(reqInfo.MemberName, reqInfo.MemberPeerUrl)
         if err != nil {
             streamError(stream, err)
             return
         }
+        audit.recordMemberAdd(stream.Conn().RemotePeer(), memberAddProtocolID, reqInfo.MemberName)
 
-        log.Println("Member add response: ", initialCluster)
-        _, err = stream.Write([]byte(initialCluster))
+        respInfo := memberAddResponse{
+            Status: common.Status{Code: common.StatusOK},
+            InitialCluster: initialCluster,
+        }
+        respBytes, err := json.Marshal(respInfo)
         if err != nil {
             streamError(stream, err)
             return
         }
 
-        stream.Close()
-    }
-}
-
-func addEtcdMember(
-    etcdCli *clientv3.Client, newMemName, newMemPeerUrl string) (initialCluster string, err error) {
-
-    ctx := context.Background()
-    memAddResp, err := etcdCli.MemberAdd(ctx, []string{newMemPeerUrl})
-    if err != nil {
-        return "", nil
-    }
-
-    newMemId := memAddResp.Member.ID
-
-    clusterPeerUrls := []string{}
-    for _, mem := range memAddResp.Members {
-        name := mem.Name
-        if mem.ID == newMemId {
-            name = newMemName
-        }
-        for _, peerUrl := range mem.PeerURLs {
-            clusterPeerUrls = append(clusterPeerUrls, fmt.Sprintf("%s=%s", name, peerUrl))
+        log.Println("Member add response: ", string(respBytes))
+        _, err = stream.Write(respBytes)
+        if err != nil {
+            streamReset(stream, err)
+            return
         }
-    }
 
-    initialCluster = strings.Join(clusterPeerUrls, ",")
-
-    return initialCluster, nil
+        stream.Close()
+    }
 }
@@ -0,0 +1,178 @@
+/* Copyright 2020 PhysarumSM Development Team
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+// Each entry is owned by the peer that added it, only it and admins may modify the entry
+
+import (
+    "fmt"
+    "strings"
+
+    "github.com/libp2p/go-libp2p-core/peer"
+)
+
+// How often a write is retried when the entry changes between checking its owner and writing it
+const ownershipWriteAttempts = 5
+
+// Set of peer IDs, usable as a repeatable command line flag
+type peerSet map[peer.ID]bool
+
+func (s peerSet) String() string {
+    ids := []string{}
+    for id := range s {
+        ids = append(ids, id.Pretty())
+    }
+    return strings.Join(ids, ",")
+}
+
+func (s peerSet) Set(value string) error {
+    id, err := peer.IDB58Decode(value)
+    if err != nil {
+        return err
+    }
+    s[id] = true
+    return nil
+}
+
+// Returned when the requesting peer may not modify an entry
+type forbiddenError struct {
+    Key string
+    Owner string
+}
+
+func (e *forbiddenError) Error() string {
+    return fmt.Sprintf("Entry %s is owned by %s", e.Key, e.Owner)
+}
+
+// Check whether requester may modify cur, returning who should own it afterwards
+// Entries without an owner are claimed by whoever modifies them, admins leave the owner as is
+// An empty requester may only modify entries without an owner, and leaves them unowned
+func checkOwner(acl *accessControl, requester peer.ID, key string, cur KeyValue, exists bool) (
+    owner string, err error) {
+
+    if !exists || cur.Attrs.Owner == "" {
+        if requester == "" {
+            return "", nil
+        }
+        return requester.Pretty(), nil
+    }
+    if cur.Attrs.Owner == requester.Pretty() || acl.isAdmin(requester) {
+        return cur.Attrs.Owner, nil
+    }
+    return "", &forbiddenError{Key: key, Owner: cur.Attrs.Owner}
+}
+
+// Put on behalf of requester, failing with *forbiddenError if it does not own the entry
+// See checkOwner for an empty requester
+// The digests of opts.Audit are set to those of the entry's value before and after the put
+func ownedPut(store Store, acl *accessControl, requester peer.ID, key, value string, opts PutOptions) (
+    rev int64, err error) {
+
+    for attempt := 1; ; attempt++ {
+        cur, exists, err := store.Get(key)
+        if err != nil {
+            return 0, err
+        }
+        err = checkPutOptions(key, cur, exists, opts)
+        if err != nil {
+            return 0, err
+        }
+        owner, err := checkOwner(acl, requester, key, cur, exists)
+        if err != nil {
+            return 0, err
+        }
+
+        setAuditDigests(opts.Audit, cur, exists, value, true)
+
+        // Only write if the entry is still the one whose owner was checked
+        ownedOpts := opts
+        ownedOpts.Attrs.Owner = owner
+        ownedOpts.IfAbsent = !exists
+        ownedOpts.IfRevision = cur.ModRevision
+        rev, err = store.Put(key, value, ownedOpts)
+        if conflict, ok := err.(*conflictError); ok {
+            if attempt < ownershipWriteAttempts {
+                continue
+            }
+            // The conditions that failed may be only those added above
+            conditional := opts.IfAbsent || opts.IfRevision != 0 || opts.IfTombstone != 0
+            err = writeRaceError(key, conflict.CurrentRevision, conditional)
+        }
+        return rev, err
+    }
+}
+
+// Delete on behalf of requester, failing with *forbiddenError if it does not own the entry
+// The entry is kept as a tombstone, see undeleteEntry
+// old is the deleted entry, record is appended to the audit log along with the delete unless nil
+func ownedDelete(store Store, acl *accessControl, requester peer.ID, key string, record *AuditRecord) (
+    deleted int64, old KeyValue, err error) {
+
+    for attempt := 1; ; attempt++ {
+        cur, exists, err := store.Get(key)
+        if err != nil || !exists {
+            return 0, old, err
+        }
+        _, err = checkOwner(acl, requester, key, cur, exists)
+        if err != nil {
+            return 0, old, err
+        }
+
+        setAuditDigests(record, cur, true, "", false)
+        opts := DeleteOptions{
+            IfRevision: cur.ModRevision, SoftDelete: true, Deleter: requester.Pretty(), Audit: record}
+        deleted, err = store.Delete(key, opts)
+        if conflict, ok := err.(*conflictError); ok {
+            if attempt < ownershipWriteAttempts {
+                continue
+            }
+            err = writeRaceError(key, conflict.CurrentRevision, false)
+        }
+        return deleted, cur, err
+    }
+}
+
+// Make newOwner the owner of the entry, on behalf of requester
+// ok is false if the entry does not exist
+// record is appended to the audit log along with the transfer unless nil
+func transferOwnership(
+    store Store, acl *accessControl, requester peer.ID, key string, newOwner peer.ID, record *AuditRecord) (
+    rev int64, ok bool, err error) {
+
+    for attempt := 1; ; attempt++ {
+        cur, exists, err := store.Get(key)
+        if err != nil || !exists {
+            return 0, false, err
+        }
+        _, err = checkOwner(acl, requester, key, cur, exists)
+        if err != nil {
+            return 0, false, err
+        }
+
+        // Everything but the owner stays the same, including the signature and lease
+        attrs := cur.Attrs
+        attrs.Owner = newOwner.Pretty()
+        setAuditDigests(record, cur, true, cur.Value, true)
+        opts := PutOptions{IfRevision: cur.ModRevision, KeepLease: true, Attrs: attrs, Audit: record}
+        rev, err = store.Put(key, cur.Value, opts)
+        if conflict, ok := err.(*conflictError); ok {
+            if attempt < ownershipWriteAttempts {
+                continue
+            }
+            err = writeRaceError(key, conflict.CurrentRevision, false)
+        }
+        return rev, err == nil, err
+    }
+}
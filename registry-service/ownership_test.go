@@ -0,0 +1,156 @@
+/* Copyright 2020 PhysarumSM Development Team
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+    "testing"
+
+    "github.com/libp2p/go-libp2p-core/crypto"
+    "github.com/libp2p/go-libp2p-core/peer"
+)
+
+func testPeerID(t *testing.T) peer.ID {
+    _, pub, err := crypto.GenerateKeyPair(crypto.Ed25519, 0)
+    if err != nil {
+        t.Fatalf("%v", err)
+    }
+    id, err := peer.IDFromPublicKey(pub)
+    if err != nil {
+        t.Fatalf("%v", err)
+    }
+    return id
+}
+
+func TestOwnership(t *testing.T) {
+    store := newMemoryStore()
+    defer store.Close()
+
+    owner, other, admin := testPeerID(t), testPeerID(t), testPeerID(t)
+    acl, _ := newAccessControl("", peerSet{admin: true})
+
+    _, err := ownedPut(store, acl, owner, "my-service:1.0", "info-1", PutOptions{TTL: 60})
+    if err != nil {
+        t.Fatalf("%v", err)
+    }
+    kv, _, _ := store.Get("my-service:1.0")
+    if kv.Attrs.Owner != owner.Pretty() {
+        t.Errorf("Entry owned by %s, expected publisher %s", kv.Attrs.Owner, owner.Pretty())
+    }
+
+    _, err = ownedPut(store, acl, other, "my-service:1.0", "info-2", PutOptions{})
+    if _, ok := err.(*forbiddenError); !ok {
+        t.Errorf("Add by other peer returned %v, expected forbiddenError", err)
+    }
+    _, _, err = ownedDelete(store, acl, other, "my-service:1.0", nil)
+    if _, ok := err.(*forbiddenError); !ok {
+        t.Errorf("Delete by other peer returned %v, expected forbiddenError", err)
+    }
+
+    // Admins may modify the entry, without taking it over
+    _, err = ownedPut(store, acl, admin, "my-service:1.0", "info-3", PutOptions{TTL: 60})
+    if err != nil {
+        t.Errorf("Add by admin returned %v", err)
+    }
+    kv, _, _ = store.Get("my-service:1.0")
+    if kv.Value != "info-3" || kv.Attrs.Owner != owner.Pretty() {
+        t.Errorf("Entry is (%s, owned by %s) after admin add, expected (info-3, %s)",
+            kv.Value, kv.Attrs.Owner, owner.Pretty())
+    }
+
+    _, err = ownedPut(store, acl, owner, "my-service:1.0", "info-4", PutOptions{IfRevision: kv.ModRevision - 1})
+    if _, ok := err.(*conflictError); !ok {
+        t.Errorf("Add at wrong revision returned %v, expected conflictError", err)
+    }
+
+    _, ok, err := transferOwnership(store, acl, other, "my-service:1.0", other, nil)
+    if _, isForbidden := err.(*forbiddenError); ok || !isForbidden {
+        t.Errorf("Transfer by other peer returned (%v, %v), expected forbiddenError", ok, err)
+    }
+    _, ok, err = transferOwnership(store, acl, owner, "my-service:1.0", other, nil)
+    if err != nil || !ok {
+        t.Fatalf("Transfer by owner returned (%v, %v)", ok, err)
+    }
+    transferred, _, _ := store.Get("my-service:1.0")
+    if transferred.Attrs.Owner != other.Pretty() || transferred.Value != kv.Value || transferred.Lease == 0 {
+        t.Errorf("Transfer left entry %v, expected same entry and lease owned by %s", transferred, other.Pretty())
+    }
+
+    if _, _, err = ownedDelete(store, acl, owner, "my-service:1.0", nil); err == nil {
+        t.Errorf("Previous owner could still delete the entry")
+    }
+    deleted, old, err := ownedDelete(store, acl, other, "my-service:1.0", nil)
+    if err != nil || deleted != 1 || old.Value != transferred.Value {
+        t.Errorf("Delete by new owner returned (%d, %v, %v), expected (1, %v, nil)", deleted, old, err, transferred)
+    }
+}
+
+func TestOwnershipUnowned(t *testing.T) {
+    store := newMemoryStore()
+    defer store.Close()
+
+    // Entries added before owners were recorded are claimed by the next peer to add them
+    store.Put("legacy:1.0", "info", PutOptions{})
+
+    // Unless the add is made without an owner
+    _, err := ownedPut(store, &accessControl{}, "", "legacy:1.0", "info-1", PutOptions{})
+    if err != nil {
+        t.Fatalf("%v", err)
+    }
+    kv, _, _ := store.Get("legacy:1.0")
+    if kv.Attrs.Owner != "" {
+        t.Errorf("Entry owned by %q after add without an owner", kv.Attrs.Owner)
+    }
+
+    claimer := testPeerID(t)
+    _, err = ownedPut(store, &accessControl{}, claimer, "legacy:1.0", "info-2", PutOptions{})
+    if err != nil {
+        t.Fatalf("%v", err)
+    }
+    kv, _, _ = store.Get("legacy:1.0")
+    if kv.Attrs.Owner != claimer.Pretty() {
+        t.Errorf("Unowned entry owned by %q after add, expected %s", kv.Attrs.Owner, claimer.Pretty())
+    }
+
+    // Owned entries can't be modified without an owner
+    _, err = ownedPut(store, &accessControl{}, "", "legacy:1.0", "info-3", PutOptions{})
+    if _, ok := err.(*forbiddenError); !ok {
+        t.Errorf("Add without an owner returned %v, expected forbidden", err)
+    }
+}
+
+// Store whose entries always change between reading and writing them
+type racingStore struct {
+    Store
+}
+
+func (s racingStore) Put(key, value string, opts PutOptions) (int64, error) {
+    return 0, &conflictError{Key: key, CurrentRevision: 1}
+}
+
+func TestOwnershipContention(t *testing.T) {
+    store := newMemoryStore()
+    defer store.Close()
+    rev, _ := store.Put("my-service:1.0", "info", PutOptions{})
+
+    // Only conditions set by the caller are reported as conflicts
+    _, err := ownedPut(racingStore{store}, &accessControl{}, "", "my-service:1.0", "info-1", PutOptions{})
+    if _, ok := err.(*contentionError); !ok {
+        t.Errorf("Unconditional add returned %v, expected contentionError", err)
+    }
+    _, err = ownedPut(racingStore{store}, &accessControl{}, "", "my-service:1.0", "info-1", PutOptions{IfRevision: rev})
+    if _, ok := err.(*conflictError); !ok {
+        t.Errorf("Conditional add returned %v, expected conflictError", err)
+    }
+}
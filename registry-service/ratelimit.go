@@ -0,0 +1,248 @@
+/* Copyright 2020 PhysarumSM Development Team
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+// Token bucket rate limits per requesting peer and protocol
+
+import (
+    "encoding/json"
+    "fmt"
+    "io/ioutil"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/libp2p/go-libp2p-core/network"
+    "github.com/libp2p/go-libp2p-core/peer"
+    "github.com/libp2p/go-libp2p-core/protocol"
+
+    "github.com/prometheus/client_golang/prometheus"
+    "github.com/prometheus/client_golang/prometheus/promauto"
+
+    "golang.org/x/time/rate"
+
+    "github.com/PhysarumSM/service-registry/common"
+)
+
+// How often buckets of peers that stopped sending requests are dropped
+const rateLimitSweepInterval = time.Minute
+
+var throttledRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+    Name: "registry_service_throttled_requests_total",
+    Help: "Number of requests rejected for exceeding a rate limit or the limits on requests in flight",
+}, []string{"protocol", "reason"})
+
+// Each peer may make Rate requests per second on average, and up to Burst requests at once
+// A Rate of 0 disables the limit
+type rateLimit struct {
+    Rate float64
+    Burst int
+}
+
+func (l rateLimit) String() string {
+    return fmt.Sprintf("%g/%d", l.Rate, l.Burst)
+}
+
+// Rate limit per protocol, the empty protocol ID holds the limit of all other protocols
+// Usable as a repeatable command line flag, taking [<protocol ID>=]<rate>[/<burst>]
+type rateLimits map[protocol.ID]rateLimit
+
+var defaultRateLimits = rateLimits{
+    "": {Rate: 20, Burst: 40},
+    // Lists and queries go through every entry, so are much more costly than other requests
+    common.ListProtocolID: {Rate: 2, Burst: 10},
+    common.QueryProtocolID: {Rate: 2, Burst: 10},
+}
+
+func (r rateLimits) String() string {
+    limits := []string{}
+    for protocolID, limit := range r {
+        if protocolID == "" {
+            limits = append(limits, limit.String())
+        } else {
+            limits = append(limits, fmt.Sprintf("%s=%s", protocolID, limit))
+        }
+    }
+    sort.Strings(limits)
+    return strings.Join(limits, ",")
+}
+
+func (r rateLimits) Set(value string) error {
+    var protocolID protocol.ID
+    limitStr := value
+    if i := strings.LastIndex(value, "="); i >= 0 {
+        protocolID, limitStr = protocol.ID(value[:i]), value[i+1:]
+    }
+
+    rateStr, burstStr := limitStr, ""
+    if i := strings.Index(limitStr, "/"); i >= 0 {
+        rateStr, burstStr = limitStr[:i], limitStr[i+1:]
+    }
+    rateValue, err := strconv.ParseFloat(rateStr, 64)
+    if err != nil || rateValue < 0 {
+        return fmt.Errorf("Invalid rate %s", rateStr)
+    }
+    limit := rateLimit{Rate: rateValue, Burst: int(rateValue)}
+    if burstStr != "" {
+        limit.Burst, err = strconv.Atoi(burstStr)
+        if err != nil {
+            return fmt.Errorf("Invalid burst %s", burstStr)
+        }
+    }
+    if limit.Burst < 1 {
+        limit.Burst = 1
+    }
+
+    r[protocolID] = limit
+    return nil
+}
+
+func (r rateLimits) of(protocolID protocol.ID) rateLimit {
+    if limit, ok := r[protocolID]; ok {
+        return limit
+    }
+    return r[""]
+}
+
+// Format of the rate limit file
+type rateLimitFile struct {
+    // Limit of protocols not listed in Protocols
+    Default *rateLimit
+    Protocols map[protocol.ID]rateLimit
+}
+
+// Combine the default limits with those from the file at path, if not empty,
+// and then those given by flags
+func loadRateLimits(path string, flags rateLimits) (rateLimits, error) {
+    limits := rateLimits{}
+    for protocolID, limit := range defaultRateLimits {
+        limits[protocolID] = limit
+    }
+
+    if path != "" {
+        data, err := ioutil.ReadFile(path)
+        if err != nil {
+            return nil, err
+        }
+        var file rateLimitFile
+        err = json.Unmarshal(data, &file)
+        if err != nil {
+            return nil, fmt.Errorf("Invalid rate limit file %s: %v", path, err)
+        }
+
+        if file.Default != nil {
+            limits[""] = *file.Default
+        }
+        for protocolID, limit := range file.Protocols {
+            limits[protocolID] = limit
+        }
+    }
+
+    for protocolID, limit := range flags {
+        limits[protocolID] = limit
+    }
+
+    for protocolID, limit := range limits {
+        if limit.Rate > 0 && limit.Burst < 1 {
+            return nil, fmt.Errorf("Rate limit of %s has burst %d, must be at least 1", protocolID, limit.Burst)
+        }
+    }
+    return limits, nil
+}
+
+type rateKey struct {
+    peer peer.ID
+    protocol protocol.ID
+}
+
+type rateBucket struct {
+    limiter *rate.Limiter
+    lastUsed time.Time
+}
+
+type rateLimiter struct {
+    limits rateLimits
+
+    mutex sync.Mutex
+    buckets map[rateKey]*rateBucket
+    lastSweep time.Time
+}
+
+func newRateLimiter(limits rateLimits) *rateLimiter {
+    return &rateLimiter{limits: limits, buckets: make(map[rateKey]*rateBucket), lastSweep: time.Now()}
+}
+
+// Take a token for a request from id to protocolID
+// If there is none, returns how long until there will be
+func (r *rateLimiter) allow(id peer.ID, protocolID protocol.ID) (retryAfter time.Duration, ok bool) {
+    limit := r.limits.of(protocolID)
+    if limit.Rate <= 0 {
+        return 0, true
+    }
+
+    now := time.Now()
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+
+    if now.Sub(r.lastSweep) > rateLimitSweepInterval {
+        r.sweep(now)
+    }
+
+    key := rateKey{peer: id, protocol: protocolID}
+    bucket, exists := r.buckets[key]
+    if !exists {
+        bucket = &rateBucket{limiter: rate.NewLimiter(rate.Limit(limit.Rate), limit.Burst)}
+        r.buckets[key] = bucket
+    }
+    bucket.lastUsed = now
+
+    reservation := bucket.limiter.ReserveN(now, 1)
+    delay := reservation.DelayFrom(now)
+    if delay > 0 {
+        reservation.CancelAt(now)
+        return delay, false
+    }
+    return 0, true
+}
+
+// Drop buckets that have refilled since their last use, they are no different from new ones
+func (r *rateLimiter) sweep(now time.Time) {
+    for key, bucket := range r.buckets {
+        limit := r.limits.of(key.protocol)
+        refill := time.Duration(float64(limit.Burst) / limit.Rate * float64(time.Second))
+        if now.Sub(bucket.lastUsed) > refill {
+            delete(r.buckets, key)
+        }
+    }
+    r.lastSweep = now
+}
+
+// Wrap handler for protocolID, rejecting requests from peers over their rate limit
+func (r *rateLimiter) guard(protocolID protocol.ID, handler func(network.Stream)) func(network.Stream) {
+    return func(stream network.Stream) {
+        retryAfter, ok := r.allow(stream.Conn().RemotePeer(), protocolID)
+        if !ok {
+            throttledRequests.WithLabelValues(string(protocolID), "rate").Inc()
+            streamError(stream, &throttledError{
+                Reason: fmt.Sprintf("Rate limit of %g requests per second exceeded", r.limits.of(protocolID).Rate),
+                RetryAfter: retryAfter,
+            })
+            return
+        }
+        handler(stream)
+    }
+}
@@ -0,0 +1,95 @@
+/* Copyright 2020 PhysarumSM Development Team
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+    "io/ioutil"
+    "os"
+    "testing"
+    "time"
+
+    "github.com/libp2p/go-libp2p-core/protocol"
+
+    "github.com/PhysarumSM/service-registry/common"
+)
+
+func TestRateLimitsConfig(t *testing.T) {
+    file, err := ioutil.TempFile("", "rate-limits")
+    if err != nil {
+        t.Fatalf("%v", err)
+    }
+    defer os.Remove(file.Name())
+    _, err = file.WriteString(`{"Default": {"Rate": 100, "Burst": 200}, "Protocols": {"/get/0.1": {"Rate": 50, "Burst": 50}}}`)
+    file.Close()
+    if err != nil {
+        t.Fatalf("%v", err)
+    }
+
+    flags := rateLimits{}
+    for _, value := range []string{"/get/0.1=5", "/add/0.1=0.5/3"} {
+        if err := flags.Set(value); err != nil {
+            t.Fatalf("Set(%s) failed: %v", value, err)
+        }
+    }
+    if err := flags.Set("/add/0.1=fast"); err == nil {
+        t.Errorf("Set accepted invalid rate")
+    }
+
+    limits, err := loadRateLimits(file.Name(), flags)
+    if err != nil {
+        t.Fatalf("%v", err)
+    }
+    for protocolID, expected := range map[protocol.ID]rateLimit{
+        // From the flags, which override the file
+        common.GetProtocolID: {Rate: 5, Burst: 5},
+        common.AddProtocolID: {Rate: 0.5, Burst: 3},
+        // From the file
+        common.DeleteProtocolID: {Rate: 100, Burst: 200},
+        // Built in default, not overridden
+        common.ListProtocolID: defaultRateLimits[common.ListProtocolID],
+    } {
+        if limit := limits.of(protocolID); limit != expected {
+            t.Errorf("Limit of %s is %v, expected %v", protocolID, limit, expected)
+        }
+    }
+}
+
+func TestRateLimiter(t *testing.T) {
+    limiter := newRateLimiter(rateLimits{"": {Rate: 1, Burst: 2}, common.GetProtocolID: {}})
+    busy, other := testPeerID(t), testPeerID(t)
+
+    for i := 0; i < 2; i++ {
+        if _, ok := limiter.allow(busy, common.AddProtocolID); !ok {
+            t.Fatalf("Request %d within burst throttled", i)
+        }
+    }
+    retryAfter, ok := limiter.allow(busy, common.AddProtocolID)
+    if ok || retryAfter <= 0 || retryAfter > time.Second {
+        t.Errorf("Request past burst returned (%v, %v), expected to retry within a second", retryAfter, ok)
+    }
+
+    // Buckets are separate per peer and protocol
+    if _, ok := limiter.allow(other, common.AddProtocolID); !ok {
+        t.Errorf("Other peer throttled")
+    }
+    if _, ok := limiter.allow(busy, common.DeleteProtocolID); !ok {
+        t.Errorf("Other protocol throttled")
+    }
+    for i := 0; i < 10; i++ {
+        if _, ok := limiter.allow(busy, common.GetProtocolID); !ok {
+            t.Fatalf("Unlimited protocol throttled")
+        }
+    }
+}
@@ -24,19 +24,20 @@ import (
     "log"
     "net/http"
     "os"
-    "os/exec"
+    "os/signal"
     "strconv"
+    "syscall"
     "time"
 
     "github.com/libp2p/go-libp2p-core/network"
     "github.com/libp2p/go-libp2p-core/pnet"
-
-    "go.etcd.io/etcd/clientv3"
+    "github.com/libp2p/go-libp2p-core/protocol"
 
     "github.com/PhysarumSM/common/p2pnode"
     "github.com/PhysarumSM/common/p2putil"
     "github.com/PhysarumSM/common/util"
     "github.com/PhysarumSM/service-registry/common"
+    "github.com/PhysarumSM/service-registry/common/semver"
     "github.com/PhysarumSM/service-registry/registry"
 
     "github.com/prometheus/client_golang/prometheus/promhttp"
@@ -65,8 +66,15 @@ func main() {
     if psk, err = util.AddPSKFlag(); err != nil {
         log.Fatalln(err)
     }
+    storeFlag := flag.String("store", "etcd",
+        "Storage backend for service info, one of {etcd, memory, bolt}\n" +
+        "memory and bolt run standalone without etcd, for dev registries")
+    boltFileFlag := flag.String("bolt-file", "registry.db",
+        "File to store service info in when using the bolt store")
     newEtcdClusterFlag := flag.Bool("new-etcd-cluster", false,
         "Start running new etcd cluster")
+    embedEtcdFlag := flag.Bool("embed-etcd", false,
+        "Run etcd embedded in this process instead of running the etcd binary")
     etcdIpFlag := flag.String("etcd-ip", "127.0.0.1",
         "Local etcd instance IP address")
     etcdClientPortFlag := flag.Int("etcd-client-port", 2379,
@@ -78,6 +86,38 @@ func main() {
         "(this option overrides the '--bootstrap' flag)")
     promEndpoint := flag.String("prom-listen-addr", ":9102",
         "Listening address/endpoint for Prometheus to scrape")
+    admins := peerSet{}
+    flag.Var(admins, "admin",
+        "Peer ID allowed to modify and transfer entries owned by other peers.\n" +
+        "This flag can be specified multiple times.")
+    aclFlag := flag.String("acl", "",
+        "JSON file mapping peer IDs to roles (reader, publisher or admin),\n" +
+        "reloaded when it changes. If unset, all peers may make any request.")
+    maxRequestSize := requestSizes{}
+    flag.Var(maxRequestSize, "max-request-size",
+        "Maximum request size in bytes, either for all protocols (<bytes>) or\n" +
+        "for one protocol (<protocol ID>=<bytes>, eg. /add/0.1=4096).\n" +
+        "This flag can be specified multiple times. (default " + strconv.Itoa(defaultMaxRequestSize) + ")")
+    readTimeout := flag.Duration("read-timeout", 10 * time.Second,
+        "Time allowed for a peer to send its request, 0 for no limit")
+    writeTimeout := flag.Duration("write-timeout", 10 * time.Second,
+        "Time allowed for each write of a response, 0 for no limit")
+    maxInFlight := flag.Int("max-in-flight", 1024,
+        "Maximum number of requests handled at once, including open watches, 0 for no limit")
+    maxInFlightPerPeer := flag.Int("max-in-flight-per-peer", 64,
+        "Maximum number of requests handled at once for a single peer, 0 for no limit")
+    rateLimitFlags := rateLimits{}
+    flag.Var(rateLimitFlags, "rate-limit",
+        "Requests per second and burst allowed for each peer, as [<protocol ID>=]<rate>[/<burst>],\n" +
+        "eg. /list/0.1=1/5. Without a protocol ID, sets the limit of all other protocols.\n" +
+        "A rate of 0 disables the limit. This flag can be specified multiple times.\n" +
+        "(default " + defaultRateLimits.String() + ")")
+    rateLimitFile := flag.String("rate-limit-file", "",
+        "JSON file with rate limits, overridden by --rate-limit")
+    purgeDeletedAfter := flag.Duration("purge-deleted-after", 7 * 24 * time.Hour,
+        "Time deleted entries can be undeleted for, before they are purged, 0 to keep them forever")
+    auditFile := flag.String("audit-file", "",
+        "JSON lines file to also append audit records of changes to, besides the store")
     flag.Parse()
 
     // If CLI didn't specify any bootstraps, fallback to environment variable
@@ -104,180 +144,305 @@ func main() {
         *psk = envPsk
     }
 
-    priv, err := util.CreateOrLoadKey(keyFlags)
-    if err != nil {
-        log.Fatalln(err)
-    }
+    // Errors are returned rather than fatal from here on, so deferred cleanup such as stopping etcd runs
+    run := func() error {
+        priv, err := util.CreateOrLoadKey(keyFlags)
+        if err != nil {
+            return err
+        }
 
-    // Start Prometheus endpoint for stats collection
-    http.Handle("/metrics", promhttp.Handler())
-    go http.ListenAndServe(*promEndpoint, nil)
+        acl, err := newAccessControl(*aclFlag, admins)
+        if err != nil {
+            return err
+        }
+        defer acl.close()
 
-    ctx := context.Background()
+        limits := newRequestLimits(limitsConfig{
+            MaxRequestSize: maxRequestSize,
+            ReadTimeout: *readTimeout,
+            WriteTimeout: *writeTimeout,
+            MaxInFlight: *maxInFlight,
+            MaxInFlightPerPeer: *maxInFlightPerPeer,
+        })
 
-    // etcd setup
-    etcdClientEndpoint := *etcdIpFlag + ":" + strconv.Itoa(*etcdClientPortFlag)
-    etcdPeerEndpoint := *etcdIpFlag + ":" + strconv.Itoa(*etcdPeerPortFlag)
+        rates, err := loadRateLimits(*rateLimitFile, rateLimitFlags)
+        if err != nil {
+            return err
+        }
+        rateLimiter := newRateLimiter(rates)
 
-    etcdClientUrl := "http://" + etcdClientEndpoint
-    etcdPeerUrl := "http://" + etcdPeerEndpoint
+        // Limits are enforced first, so even denied requests can't exceed them
+        guard := func(protocolID protocol.ID, handler func(network.Stream)) func(network.Stream) {
+            return limits.guard(protocolID, rateLimiter.guard(protocolID, acl.guard(protocolID, handler)))
+        }
 
-    etcdName := fmt.Sprintf(
-        "%s-%d-%d", *etcdIpFlag, *etcdClientPortFlag, *etcdPeerPortFlag)
+        // Start Prometheus endpoint for stats collection
+        http.Handle("/metrics", promhttp.Handler())
+        go http.ListenAndServe(*promEndpoint, nil)
+
+        ctx := context.Background()
+
+        // Receives an error if the local etcd instance stops, stays nil for other stores
+        var etcdErr <-chan error
+
+        var store Store
+        switch *storeFlag {
+        case "etcd":
+            etcdConf := etcdConfig{
+                NewCluster: *newEtcdClusterFlag,
+                Embed: *embedEtcdFlag,
+                IP: *etcdIpFlag,
+                ClientPort: *etcdClientPortFlag,
+                PeerPort: *etcdPeerPortFlag,
+            }
+            etcd, err := startEtcd(etcdConf, *localFlag, *bootstraps, *psk, priv)
+            if err != nil {
+                return err
+            }
+            defer etcd.stop()
+            etcdErr = etcd.Err
+            store, err = newEtcdStore(etcd.Client)
+            if err != nil {
+                return err
+            }
+        case "memory":
+            store = newMemoryStore()
+        case "bolt":
+            store, err = newBoltStore(*boltFileFlag)
+            if err != nil {
+                return err
+            }
+        default:
+            return fmt.Errorf("Unknown store type '%s'", *storeFlag)
+        }
+        defer store.Close()
 
-    initialCluster := etcdName + "=" + etcdPeerUrl
-    clusterState := "new"
+        go purgeTombstones(ctx, store, *purgeDeletedAfter)
 
-    if !(*newEtcdClusterFlag) {
-        initialCluster, err = sendMemberAddRequest(
-            etcdName, etcdPeerUrl, *localFlag, *bootstraps, *psk)
+        audit, err := newAuditLog(store, *auditFile)
         if err != nil {
-            log.Fatalln(err)
+            return err
         }
-        clusterState = "existing"
-    }
+        defer audit.close()
+
+        // TODO: Remove this test entry at some point...
+        //       Currently useful to serve as a negative test case when pulling images
+        // BEGIN test entry
+        testEntry := registry.ServiceInfo{
+            ContentHash: "UofT",
+            DockerHash: "ECE",
+            NetworkSoftReq: p2putil.PerfInd{RTT: 2019},
+            NetworkHardReq: p2putil.PerfInd{RTT: 2020},
+            CpuReq: 50,
+            MemoryReq: 496,
+        }
+        testEntryBytes, err := json.Marshal(testEntry)
+        if err != nil {
+            return err
+        }
+        _, err = store.Put("test-entry", string(testEntryBytes), PutOptions{})
+        if err != nil {
+            return err
+        }
+        log.Printf("Test entry: {test-entry: %v}\n", testEntry)
+        // END test entry
+
+        nodeConfig := p2pnode.NewConfig()
+        nodeConfig.PrivKey = priv
+        nodeConfig.PSK = *psk
+        if *localFlag {
+            nodeConfig.BootstrapPeers = []multiaddr.Multiaddr{}
+        } else if len(*bootstraps) > 0 {
+            nodeConfig.BootstrapPeers = *bootstraps
+        }
+        nodeConfig.StreamHandlers = append(nodeConfig.StreamHandlers,
+            guard(common.AddProtocolID, handleAdd(store, acl, audit)),
+            guard(common.GetProtocolID, handleGet(store)),
+            guard(common.ListProtocolID, handleList(store)),
+            guard(common.DeleteProtocolID, handleDelete(store, acl, audit)),
+            guard(common.WatchProtocolID, handleWatch(store)),
+            guard(common.RenewProtocolID, handleRenew(store)),
+            guard(common.TransferOwnershipProtocolID, handleTransferOwnership(store, acl, audit)),
+            guard(common.QueryProtocolID, handleQuery(store)),
+            guard(common.FindProtocolID, handleFind(store)),
+            guard(common.HistoryProtocolID, handleHistory(store)),
+            guard(common.RollbackProtocolID, handleRollback(store, acl, audit)),
+            guard(common.UndeleteProtocolID, handleUndelete(store, acl, audit)),
+            guard(common.AuditProtocolID, handleAudit(store)),
+            guard(memberAddProtocolID, handleMemberAdd(store, audit)))
+        nodeConfig.HandlerProtocolIDs = append(nodeConfig.HandlerProtocolIDs,
+            common.AddProtocolID, common.GetProtocolID, common.ListProtocolID,
+            common.DeleteProtocolID, common.WatchProtocolID, common.RenewProtocolID,
+            common.TransferOwnershipProtocolID, common.QueryProtocolID, common.FindProtocolID,
+            common.HistoryProtocolID, common.RollbackProtocolID, common.UndeleteProtocolID,
+            common.AuditProtocolID, memberAddProtocolID)
+        nodeConfig.Rendezvous = append(nodeConfig.Rendezvous, common.RegistryServiceRendezvousString)
+        node, err := p2pnode.NewNode(ctx, nodeConfig)
+        if err != nil {
+            if *localFlag && err.Error() == "Failed to connect to any bootstraps" {
+                log.Println("Local run, not connecting to bootstraps")
+            } else {
+                return err
+            }
+        }
+        defer node.Close()
 
-    etcdArgs := []string{
-        "--name", etcdName,
-        "--listen-client-urls", etcdClientUrl,
-        "--advertise-client-urls", etcdClientUrl,
-        "--listen-peer-urls", etcdPeerUrl,
-        "--initial-advertise-peer-urls", etcdPeerUrl,
-        "--initial-cluster", initialCluster,
-        "--initial-cluster-state", clusterState,
-    }
-    log.Println(etcdArgs)
+        // log.Println("Host ID:", node.Host.ID())
+        // log.Println("Listening on:", node.Host.Addrs())
 
-    cmd := exec.Command("etcd", etcdArgs...)
-    cmd.Stdout = os.Stdout
-    cmd.Stderr = os.Stderr
-    go func() {
-        err := cmd.Run()
-        if err != nil {
-            log.Fatalln(err)
+        log.Println("Waiting to serve connections...")
+
+        sigChan := make(chan os.Signal, 1)
+        signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+
+        select {
+        case err := <-etcdErr:
+            log.Println("Error: etcd stopped, shutting down:", err)
+        case sig := <-sigChan:
+            log.Println("Received", sig, "shutting down")
         }
-    }()
+        return nil
+    }
 
-    etcdCli, err := clientv3.New(clientv3.Config{
-        Endpoints: []string{etcdClientEndpoint},
-        DialTimeout: 5 * time.Second,
-    })
+    err = run()
     if err != nil {
         log.Fatalln(err)
     }
-    defer etcdCli.Close()
-
-    // TODO: Remove this test entry at some point...
-    //       Currently useful to serve as a negative test case when pulling images
-    // BEGIN test entry
-    testEntry := registry.ServiceInfo{
-        ContentHash: "UofT",
-        DockerHash: "ECE",
-        NetworkSoftReq: p2putil.PerfInd{RTT: 2019},
-        NetworkHardReq: p2putil.PerfInd{RTT: 2020},
-        CpuReq: 50,
-        MemoryReq: 496,
-    }
-    testEntryBytes, err := json.Marshal(testEntry)
-    if err != nil {
-        log.Fatalln(err)
+}
+
+// Error caused by the request itself rather than by the store
+type requestError struct {
+    err error
+}
+
+func (e *requestError) Error() string {
+    return e.err.Error()
+}
+
+func errorStatusCode(err error) common.StatusCode {
+    switch err.(type) {
+    case *requestError, *requestLimitError:
+        return common.StatusInvalidRequest
+    case *conflictError:
+        return common.StatusConflict
+    case *contentionError:
+        return common.StatusUnavailable
+    case *forbiddenError, *accessDeniedError:
+        return common.StatusForbidden
+    case *throttledError:
+        return common.StatusThrottled
+    default:
+        return common.StatusUnavailable
     }
-    err = etcdPut(etcdCli, "test-entry", string(testEntryBytes))
-    if err != nil {
-        log.Fatalln(err)
+}
+
+// Respond to a failed request with an ErrorResponse describing err
+func streamError(stream network.Stream, err error) {
+    log.Println(err)
+
+    respInfo := common.ErrorResponse{
+        Status: common.Status{Code: errorStatusCode(err), Message: err.Error()},
     }
-    log.Printf("Test entry: {test-entry: %v}\n", testEntry)
-    // END test entry
-
-    nodeConfig := p2pnode.NewConfig()
-    nodeConfig.PrivKey = priv
-    nodeConfig.PSK = *psk
-    if *localFlag {
-        nodeConfig.BootstrapPeers = []multiaddr.Multiaddr{}
-    } else if len(*bootstraps) > 0 {
-        nodeConfig.BootstrapPeers = *bootstraps
+    if throttled, ok := err.(*throttledError); ok {
+        respInfo.Status.RetryAfter = throttled.RetryAfter
     }
-    nodeConfig.StreamHandlers = append(nodeConfig.StreamHandlers,
-        handleAdd(etcdCli), handleGet(etcdCli), handleList(etcdCli),
-        handleDelete(etcdCli), handleMemberAdd(etcdCli))
-    nodeConfig.HandlerProtocolIDs = append(nodeConfig.HandlerProtocolIDs,
-        common.AddProtocolID, common.GetProtocolID, common.ListProtocolID,
-        common.DeleteProtocolID, memberAddProtocolID)
-    nodeConfig.Rendezvous = append(nodeConfig.Rendezvous, common.RegistryServiceRendezvousString)
-    node, err := p2pnode.NewNode(ctx, nodeConfig)
+    respBytes, err := json.Marshal(respInfo)
     if err != nil {
-        if *localFlag && err.Error() == "Failed to connect to any bootstraps" {
-            log.Println("Local run, not connecting to bootstraps")
-        } else {
-            log.Fatalln(err)
-        }
+        streamReset(stream, err)
+        return
     }
-    defer node.Close()
-
-    // log.Println("Host ID:", node.Host.ID())
-    // log.Println("Listening on:", node.Host.Addrs())
 
-    log.Println("Waiting to serve connections...")
+    _, err = stream.Write(respBytes)
+    if err != nil {
+        streamReset(stream, err)
+        return
+    }
 
-    select {}
+    stream.Close()
 }
 
-func streamError(stream network.Stream, err error) {
+// Abort the stream when it can no longer be used to respond
+func streamReset(stream network.Stream, err error) {
     log.Println(err)
     stream.Reset()
 }
 
-func etcdPut(etcdCli *clientv3.Client, serviceName string, putData string) (err error) {
-    ctx := context.Background()
-    _, err = etcdCli.Put(ctx, serviceName, putData)
-    if err != nil {
-        return err
+// Look up service info by name
+// Queries of the form <name>@<constraint> resolve to the highest stored version
+// <name>:<version> satisfying the constraint, unless an entry is named exactly query
+func getServiceInfo(store Store, query string) (kv KeyValue, queryOk bool, err error) {
+    base, constraintStr, ok := semver.SplitQuery(query)
+    if !ok {
+        return store.Get(query)
     }
 
-    return nil
-}
+    // Names may themselves contain @, eg. svc@host
+    kv, queryOk, err = store.Get(query)
+    if err != nil || queryOk {
+        return kv, queryOk, err
+    }
 
-func getServiceInfo(etcdCli *clientv3.Client, query string) (
-    infoStr string, queryOk bool, err error) {
+    constraint, err := semver.ParseConstraint(constraintStr)
+    if err != nil {
+        return kv, false, &requestError{err}
+    }
 
-    nameToInfoStr, queryOk, err := etcdGet(etcdCli, query, false)
+    kvs, _, err := store.List(base + semver.VersionSeparator, ListOptions{})
     if err != nil {
-        return infoStr, queryOk, err
+        return kv, false, err
     }
 
-    infoStr, found := nameToInfoStr[query]
-    if !found {
-        return infoStr, false, err
+    candidates := []KeyValue{}
+    versions := []string{}
+    for _, candidate := range kvs {
+        // Skip names such as <base>:<version>:<more> that belong to another service
+        if nameBase, version := semver.SplitName(candidate.Key); nameBase == base {
+            candidates = append(candidates, candidate)
+            versions = append(versions, version)
+        }
+    }
+
+    i := semver.Resolve(constraint, versions)
+    if i < 0 {
+        return kv, false, nil
     }
 
-    return infoStr, queryOk, err
+    return candidates[i], true, nil
 }
 
-func listServiceInfo(etcdCli *clientv3.Client) (
-    nameToInfoStr map[string]string, queryOk bool, err error) {
+// Metadata sent to clients along with the entry
+func entryMeta(kv KeyValue) common.EntryMeta {
+    return common.EntryMeta{
+        Revision: kv.ModRevision,
+        Publisher: kv.Attrs.Publisher,
+        PublicKey: kv.Attrs.PublicKey,
+        Signature: kv.Attrs.Signature,
+        Owner: kv.Attrs.Owner,
+    }
+}
 
-    return etcdGet(etcdCli, "", true)
+// Smallest key sorting after key, where the next page of a list starts
+func keyAfter(key string) string {
+    return key + "\x00"
 }
 
-func etcdGet(etcdCli *clientv3.Client, query string, withPrefix bool) (
-    nameToInfoStr map[string]string, queryOk bool, err error) {
+// List a page of entries
+// next is where the following page starts, empty if this is the last page
+func listServiceInfo(store Store, req common.ListRequest) (
+    kvs []KeyValue, next string, queryOk bool, err error) {
 
-    ctx := context.Background()
-    var getResp *clientv3.GetResponse
-    if withPrefix {
-        getResp, err = etcdCli.Get(ctx, query, clientv3.WithPrefix())
-    } else {
-        getResp, err = etcdCli.Get(ctx, query)
+    if req.Limit < 0 {
+        return nil, "", false, &requestError{fmt.Errorf("Invalid limit %d", req.Limit)}
     }
+
+    kvs, more, err := store.List(req.Prefix, ListOptions{Start: req.Continue, Limit: req.Limit})
     if err != nil {
-        return nameToInfoStr, false, err
+        return kvs, "", false, err
     }
 
-    nameToInfoStr = make(map[string]string)
-    queryOk = len(getResp.Kvs) > 0
-    for _, kv := range getResp.Kvs {
-        nameToInfoStr[string(kv.Key)] = string(kv.Value)
+    if more && len(kvs) > 0 {
+        next = keyAfter(kvs[len(kvs) - 1].Key)
     }
-
-    return nameToInfoStr, queryOk, nil
+    // Later pages may be empty if entries were deleted since the previous page
+    return kvs, next, len(kvs) > 0 || req.Continue != "", nil
 }
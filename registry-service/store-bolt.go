@@ -0,0 +1,318 @@
+/* Copyright 2020 PhysarumSM Development Team
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+    "bytes"
+    "encoding/binary"
+    "encoding/json"
+    "net/url"
+    "time"
+
+    bolt "github.com/coreos/bbolt"
+)
+
+var (
+    boltServicesBucket = []byte("services")
+    boltMetaBucket = []byte("meta")
+
+    // Holds a bucket per key, mapping big endian revisions to json encoded EntryVersions
+    boltHistoryBucket = []byte("history")
+
+    // Maps keys to json encoded Tombstones
+    boltTombstonesBucket = []byte("tombstones")
+
+    // Maps big endian sequence numbers to json encoded AuditRecords
+    boltAuditBucket = []byte("audit")
+
+    // Holds an empty value under the index key of each index entry, see boltIndexKey
+    boltIndexesBucket = []byte("indexes")
+
+    boltRevisionKey = []byte("revision")
+)
+
+// Store kept in a single BoltDB file
+// Persists across restarts without needing an etcd cluster
+func newBoltStore(path string) (*localStore, error) {
+    db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+    if err != nil {
+        return nil, err
+    }
+
+    err = db.Update(func(tx *bolt.Tx) error {
+        // Files written before indexes were kept need their records indexed
+        backfill := tx.Bucket(boltIndexesBucket) == nil
+
+        buckets := [][]byte{boltServicesBucket, boltMetaBucket, boltHistoryBucket, boltTombstonesBucket,
+            boltAuditBucket, boltIndexesBucket}
+        for _, bucket := range buckets {
+            _, err := tx.CreateBucketIfNotExists(bucket)
+            if err != nil {
+                return err
+            }
+        }
+
+        if backfill {
+            return boltBackfillIndexes(boltTx{tx})
+        }
+        return nil
+    })
+    if err != nil {
+        db.Close()
+        return nil, err
+    }
+
+    return newLocalStore(&boltBackend{db: db}), nil
+}
+
+// Index every record, including expired ones as they are still indexed until deleted
+func boltBackfillIndexes(tx boltTx) error {
+    recs := []localRecord{}
+    err := tx.scan("", "", func(rec localRecord) bool {
+        recs = append(recs, rec)
+        return true
+    })
+    if err != nil {
+        return err
+    }
+
+    for _, rec := range recs {
+        err = localUpdateIndexes(tx, rec.Key, nil, serviceIndexes(rec.Value))
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+type boltBackend struct {
+    db *bolt.DB
+}
+
+func (b *boltBackend) update(fn func(tx localTx) error) error {
+    return b.db.Update(func(tx *bolt.Tx) error {
+        return fn(boltTx{tx})
+    })
+}
+
+func (b *boltBackend) view(fn func(tx localTx) error) error {
+    return b.db.View(func(tx *bolt.Tx) error {
+        return fn(boltTx{tx})
+    })
+}
+
+func (b *boltBackend) close() error {
+    return b.db.Close()
+}
+
+// Records are stored as json encoded localRecords
+type boltTx struct {
+    tx *bolt.Tx
+}
+
+func (t boltTx) get(key string) (rec localRecord, ok bool, err error) {
+    data := t.tx.Bucket(boltServicesBucket).Get([]byte(key))
+    if data == nil {
+        return rec, false, nil
+    }
+
+    err = json.Unmarshal(data, &rec)
+    if err != nil {
+        return rec, false, err
+    }
+    return rec, true, nil
+}
+
+func (t boltTx) scan(prefix, start string, fn func(rec localRecord) bool) error {
+    c := t.tx.Bucket(boltServicesBucket).Cursor()
+    prefixBytes := []byte(prefix)
+    seek := prefix
+    if start > seek {
+        seek = start
+    }
+    for k, v := c.Seek([]byte(seek)); k != nil && bytes.HasPrefix(k, prefixBytes); k, v = c.Next() {
+        var rec localRecord
+        err := json.Unmarshal(v, &rec)
+        if err != nil {
+            return err
+        }
+        if !fn(rec) {
+            break
+        }
+    }
+    return nil
+}
+
+func (t boltTx) put(rec localRecord) error {
+    data, err := json.Marshal(rec)
+    if err != nil {
+        return err
+    }
+    return t.tx.Bucket(boltServicesBucket).Put([]byte(rec.Key), data)
+}
+
+func (t boltTx) delete(key string) error {
+    return t.tx.Bucket(boltServicesBucket).Delete([]byte(key))
+}
+
+func (t boltTx) addVersion(v EntryVersion) error {
+    bucket, err := t.tx.Bucket(boltHistoryBucket).CreateBucketIfNotExists([]byte(v.Key))
+    if err != nil {
+        return err
+    }
+
+    data, err := json.Marshal(v)
+    if err != nil {
+        return err
+    }
+    revBytes := make([]byte, 8)
+    binary.BigEndian.PutUint64(revBytes, uint64(v.ModRevision))
+    return bucket.Put(revBytes, data)
+}
+
+func (t boltTx) versions(key string, fn func(v EntryVersion) bool) error {
+    bucket := t.tx.Bucket(boltHistoryBucket).Bucket([]byte(key))
+    if bucket == nil {
+        return nil
+    }
+
+    c := bucket.Cursor()
+    for k, data := c.Last(); k != nil; k, data = c.Prev() {
+        var v EntryVersion
+        err := json.Unmarshal(data, &v)
+        if err != nil {
+            return err
+        }
+        if !fn(v) {
+            break
+        }
+    }
+    return nil
+}
+
+func (t boltTx) getTombstone(key string) (tombstone Tombstone, ok bool, err error) {
+    data := t.tx.Bucket(boltTombstonesBucket).Get([]byte(key))
+    if data == nil {
+        return tombstone, false, nil
+    }
+
+    err = json.Unmarshal(data, &tombstone)
+    if err != nil {
+        return tombstone, false, err
+    }
+    return tombstone, true, nil
+}
+
+func (t boltTx) scanTombstones(prefix, start string, fn func(tombstone Tombstone) bool) error {
+    c := t.tx.Bucket(boltTombstonesBucket).Cursor()
+    prefixBytes := []byte(prefix)
+    seek := prefix
+    if start > seek {
+        seek = start
+    }
+    for k, v := c.Seek([]byte(seek)); k != nil && bytes.HasPrefix(k, prefixBytes); k, v = c.Next() {
+        var tombstone Tombstone
+        err := json.Unmarshal(v, &tombstone)
+        if err != nil {
+            return err
+        }
+        if !fn(tombstone) {
+            break
+        }
+    }
+    return nil
+}
+
+func (t boltTx) putTombstone(tombstone Tombstone) error {
+    data, err := json.Marshal(tombstone)
+    if err != nil {
+        return err
+    }
+    return t.tx.Bucket(boltTombstonesBucket).Put([]byte(tombstone.Key), data)
+}
+
+func (t boltTx) deleteTombstone(key string) error {
+    return t.tx.Bucket(boltTombstonesBucket).Delete([]byte(key))
+}
+
+// Keys of the index entries of value in index begin with boltIndexPrefix(index, value)
+// The value is escaped so it can't contain the separator
+func boltIndexPrefix(index, value string) string {
+    return index + "/" + url.PathEscape(value) + "/"
+}
+
+func (t boltTx) putIndex(index, value, key string) error {
+    return t.tx.Bucket(boltIndexesBucket).Put([]byte(boltIndexPrefix(index, value) + key), []byte{})
+}
+
+func (t boltTx) deleteIndex(index, value, key string) error {
+    return t.tx.Bucket(boltIndexesBucket).Delete([]byte(boltIndexPrefix(index, value) + key))
+}
+
+func (t boltTx) scanIndex(index, value string, fn func(key string) bool) error {
+    c := t.tx.Bucket(boltIndexesBucket).Cursor()
+    prefix := []byte(boltIndexPrefix(index, value))
+    for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+        if !fn(string(k[len(prefix):])) {
+            break
+        }
+    }
+    return nil
+}
+
+func (t boltTx) appendAudit(record AuditRecord) error {
+    bucket := t.tx.Bucket(boltAuditBucket)
+    seq, err := bucket.NextSequence()
+    if err != nil {
+        return err
+    }
+
+    data, err := json.Marshal(record)
+    if err != nil {
+        return err
+    }
+    seqBytes := make([]byte, 8)
+    binary.BigEndian.PutUint64(seqBytes, seq)
+    return bucket.Put(seqBytes, data)
+}
+
+func (t boltTx) scanAudit(fn func(record AuditRecord) bool) error {
+    c := t.tx.Bucket(boltAuditBucket).Cursor()
+    for k, data := c.Last(); k != nil; k, data = c.Prev() {
+        var record AuditRecord
+        err := json.Unmarshal(data, &record)
+        if err != nil {
+            return err
+        }
+        if !fn(record) {
+            break
+        }
+    }
+    return nil
+}
+
+func (t boltTx) revision() (rev int64, err error) {
+    data := t.tx.Bucket(boltMetaBucket).Get(boltRevisionKey)
+    if data == nil {
+        return 0, nil
+    }
+    return int64(binary.BigEndian.Uint64(data)), nil
+}
+
+func (t boltTx) setRevision(rev int64) error {
+    data := make([]byte, 8)
+    binary.BigEndian.PutUint64(data, uint64(rev))
+    return t.tx.Bucket(boltMetaBucket).Put(boltRevisionKey, data)
+}
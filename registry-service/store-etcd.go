@@ -0,0 +1,879 @@
+/* Copyright 2020 PhysarumSM Development Team
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "net/url"
+    "strings"
+    "time"
+
+    "go.etcd.io/etcd/clientv3"
+    "go.etcd.io/etcd/etcdserver/api/v3rpc/rpctypes"
+)
+
+// Store backed by an etcd cluster
+type etcdStore struct {
+    etcdCli *clientv3.Client
+}
+
+func newEtcdStore(etcdCli *clientv3.Client) (*etcdStore, error) {
+    s := &etcdStore{etcdCli: etcdCli}
+    err := s.backfillIndexes()
+    if err != nil {
+        return nil, err
+    }
+    return s, nil
+}
+
+// Keys beginning with etcdReservedPrefix hold the store's own data rather than entries
+// They sort before all other keys, so lists skip them by starting at etcdFirstEntryKey
+const (
+    etcdReservedPrefix = "\x00"
+    etcdFirstEntryKey = "\x01"
+)
+
+// How many times a write is retried when the entry changes between reading and writing it
+const etcdWriteAttempts = 5
+
+// Number of tombstones read at a time while purging
+const etcdPurgeBatch = 500
+
+// Number of audit records fetched at a time when listing them
+const etcdAuditBatch = 500
+
+// Number of entries read at a time while backfilling indexes
+const etcdBackfillBatch = 500
+
+var errReservedKey = &requestError{errors.New("Names beginning with a NUL byte are reserved")}
+
+// Key marking that the entry under key has value in index
+// Index keys are attached to the same lease as their entry, so expire along with it
+func etcdIndexKey(index, value, key string) string {
+    return etcdReservedPrefix + "index/" + index + "/" + url.PathEscape(value) + "/" + key
+}
+
+// Ops changing the index keys of key from oldIndexes to newIndexes
+func etcdIndexOps(key string, oldIndexes, newIndexes map[string]string, leaseID clientv3.LeaseID) []clientv3.Op {
+    ops := []clientv3.Op{}
+    for index, value := range oldIndexes {
+        if newValue, ok := newIndexes[index]; !ok || newValue != value {
+            ops = append(ops, clientv3.OpDelete(etcdIndexKey(index, value, key)))
+        }
+    }
+
+    putOpts := []clientv3.OpOption{}
+    if leaseID != clientv3.NoLease {
+        putOpts = append(putOpts, clientv3.WithLease(leaseID))
+    }
+    for index, value := range newIndexes {
+        ops = append(ops, clientv3.OpPut(etcdIndexKey(index, value, key), "", putOpts...))
+    }
+    return ops
+}
+
+// Set once the entries written before index keys were kept have been indexed
+const etcdIndexedKey = etcdReservedPrefix + "meta/indexed"
+
+// Write the index keys of entries written before they were kept
+// Only the index keys are written, so the entries keep their revisions
+// Index keys that already exist are written again, which is harmless, so concurrent backfills don't conflict
+func (s *etcdStore) backfillIndexes() error {
+    ctx := context.Background()
+    getResp, err := s.etcdCli.Get(ctx, etcdIndexedKey, clientv3.WithCountOnly())
+    if err != nil || getResp.Count > 0 {
+        return err
+    }
+
+    start := ""
+    for {
+        kvs, more, err := s.List("", ListOptions{Start: start, Limit: etcdBackfillBatch})
+        if err != nil {
+            return err
+        }
+
+        for _, kv := range kvs {
+            ops := etcdIndexOps(kv.Key, nil, serviceIndexes(kv.Value), clientv3.LeaseID(kv.Lease))
+            if len(ops) == 0 {
+                continue
+            }
+            // Entries changed since being read were indexed by that change
+            _, err = s.etcdCli.Txn(ctx).
+                If(clientv3.Compare(clientv3.ModRevision(kv.Key), "=", kv.ModRevision)).
+                Then(ops...).
+                Commit()
+            if err != nil {
+                return err
+            }
+        }
+
+        if !more || len(kvs) == 0 {
+            break
+        }
+        start = keyAfter(kvs[len(kvs) - 1].Key)
+    }
+
+    _, err = s.etcdCli.Put(ctx, etcdIndexedKey, "")
+    return err
+}
+
+// Key recording the latest version of the entry under key
+// It is written along with the entry and never deleted, so its past revisions are the entry's history
+func etcdHistoryKey(key string) string {
+    return etcdReservedPrefix + "history/" + key
+}
+
+// Value of a history key
+type etcdVersion struct {
+    // Value of the entry as stored under its own key
+    Stored string
+    Deleted bool
+
+    // Whether the put created the entry, in which case a live previous version must have expired
+    Created bool `json:",omitempty"`
+}
+
+func encodeEtcdVersion(version etcdVersion) (string, error) {
+    data, err := json.Marshal(version)
+    if err != nil {
+        return "", err
+    }
+    return string(data), nil
+}
+
+// Key holding the tombstone of the entry under key
+func etcdTombstoneKey(key string) string {
+    return etcdReservedPrefix + "tombstone/" + key
+}
+
+// Keys of audit records begin with the time of the record, so they are in time order
+// The peer ID keeps records made by different peers at the same time apart
+func etcdAuditKey(t time.Time, peer string) string {
+    return etcdAuditTimeKey(t) + "/" + peer
+}
+
+// Start of the keys of audit records made at t or later
+func etcdAuditTimeKey(t time.Time) string {
+    return etcdReservedPrefix + "audit/" + fmt.Sprintf("%020d", t.UnixNano())
+}
+
+// Op appending record to the audit log, only if the comparison holds, so it never overwrites
+// another record with the same time and peer
+func etcdAuditOp(record AuditRecord) (cmp clientv3.Cmp, op clientv3.Op, err error) {
+    data, err := json.Marshal(record)
+    if err != nil {
+        return cmp, op, err
+    }
+    key := etcdAuditKey(record.Time, record.Peer)
+    return clientv3.Compare(clientv3.CreateRevision(key), "=", 0), clientv3.OpPut(key, string(data)), nil
+}
+
+// Add the audit record of a write to its txn, unless nil
+func withEtcdAudit(cmps []clientv3.Cmp, ops []clientv3.Op, record *AuditRecord) (
+    []clientv3.Cmp, []clientv3.Op, error) {
+
+    if record == nil {
+        return cmps, ops, nil
+    }
+    cmp, op, err := etcdAuditOp(*record)
+    if err != nil {
+        return nil, nil, err
+    }
+    return append(cmps, cmp), append(ops, op), nil
+}
+
+// Move the audit record of a failed write forward, in case it failed because another record
+// from the same peer has the same time
+func retryEtcdAudit(record *AuditRecord) {
+    if record != nil {
+        record.Time = record.Time.Add(time.Nanosecond)
+    }
+}
+
+// Value of a tombstone key
+type etcdTombstone struct {
+    // Value of the entry as stored under its own key
+    Stored string
+    CreateRevision int64
+    ModRevision int64
+
+    Deleter string
+    DeletedAt time.Time
+}
+
+func encodeEtcdTombstone(kv KeyValue, deleter string, deletedAt time.Time) (string, error) {
+    stored, err := encodeEtcdValue(kv.Value, kv.Attrs)
+    if err != nil {
+        return "", err
+    }
+    data, err := json.Marshal(etcdTombstone{
+        Stored: stored,
+        CreateRevision: kv.CreateRevision,
+        ModRevision: kv.ModRevision,
+        Deleter: deleter,
+        DeletedAt: deletedAt,
+    })
+    if err != nil {
+        return "", err
+    }
+    return string(data), nil
+}
+
+func decodeEtcdTombstone(tombstoneKey, data []byte) (tombstone Tombstone, err error) {
+    var decoded etcdTombstone
+    err = json.Unmarshal(data, &decoded)
+    if err != nil {
+        return tombstone, err
+    }
+
+    value, attrs := decodeEtcdValue([]byte(decoded.Stored))
+    tombstone.KeyValue = KeyValue{
+        Key: strings.TrimPrefix(string(tombstoneKey), etcdTombstoneKey("")),
+        Value: value,
+        CreateRevision: decoded.CreateRevision,
+        ModRevision: decoded.ModRevision,
+        Attrs: attrs,
+    }
+    tombstone.Deleter, tombstone.DeletedAt = decoded.Deleter, decoded.DeletedAt
+    return tombstone, nil
+}
+
+// Values with attributes are stored in etcd as a json encoded etcdValue
+// Values without are stored as is, same as before attributes existed
+type etcdValue struct {
+    // Always set to 1, telling etcdValues apart from plain values that happen to be json
+    RegistryValue int
+    Value string
+    Attrs EntryAttrs
+}
+
+func encodeEtcdValue(value string, attrs EntryAttrs) (string, error) {
+    if attrs.empty() {
+        return value, nil
+    }
+
+    data, err := json.Marshal(etcdValue{RegistryValue: 1, Value: value, Attrs: attrs})
+    if err != nil {
+        return "", err
+    }
+    return string(data), nil
+}
+
+func decodeEtcdValue(stored []byte) (value string, attrs EntryAttrs) {
+    var decoded etcdValue
+    err := json.Unmarshal(stored, &decoded)
+    if err != nil || decoded.RegistryValue != 1 {
+        return string(stored), attrs
+    }
+    return decoded.Value, decoded.Attrs
+}
+
+func (s *etcdStore) Put(key, value string, opts PutOptions) (rev int64, err error) {
+    if strings.HasPrefix(key, etcdReservedPrefix) {
+        return 0, errReservedKey
+    }
+    ctx := context.Background()
+
+    indexes := serviceIndexes(value)
+    value, err = encodeEtcdValue(value, opts.Attrs)
+    if err != nil {
+        return 0, err
+    }
+    leaseID := clientv3.NoLease
+    if !opts.KeepLease && opts.TTL > 0 {
+        leaseResp, err := s.etcdCli.Grant(ctx, opts.TTL)
+        if err != nil {
+            return 0, err
+        }
+        leaseID = leaseResp.ID
+    }
+    defer func() {
+        if err != nil && leaseID != clientv3.NoLease {
+            // Nothing was attached to the lease, no need to wait for it to expire
+            s.etcdCli.Revoke(ctx, leaseID)
+        }
+    }()
+
+    // The index keys to replace are only known from the current entry, so read it first and only
+    // write if it has not changed since
+    for attempt := 1; ; attempt++ {
+        cur, exists, err := s.Get(key)
+        if err != nil {
+            return 0, err
+        }
+        err = checkPutOptions(key, cur, exists, opts)
+        if err != nil {
+            return 0, err
+        }
+        version, err := encodeEtcdVersion(etcdVersion{Stored: value, Created: !exists})
+        if err != nil {
+            return 0, err
+        }
+
+        putOpts := []clientv3.OpOption{}
+        indexLease := leaseID
+        if opts.KeepLease {
+            putOpts = append(putOpts, clientv3.WithIgnoreLease())
+            indexLease = clientv3.LeaseID(cur.Lease)
+        } else if leaseID != clientv3.NoLease {
+            putOpts = append(putOpts, clientv3.WithLease(leaseID))
+        }
+
+        ops := []clientv3.Op{
+            clientv3.OpPut(key, value, putOpts...),
+            clientv3.OpPut(etcdHistoryKey(key), version),
+            clientv3.OpDelete(etcdTombstoneKey(key)),
+        }
+        ops = append(ops, etcdIndexOps(key, serviceIndexes(cur.Value), indexes, indexLease)...)
+        cmps := []clientv3.Cmp{clientv3.Compare(clientv3.ModRevision(key), "=", cur.ModRevision)}
+        if opts.IfTombstone != 0 {
+            cmp, err := s.tombstoneCmp(key, opts)
+            if err != nil {
+                return 0, err
+            }
+            cmps = append(cmps, cmp)
+        }
+        cmps, ops, err = withEtcdAudit(cmps, ops, opts.Audit)
+        if err != nil {
+            return 0, err
+        }
+        txnResp, err := s.etcdCli.Txn(ctx).If(cmps...).Then(ops...).Commit()
+        // With KeepLease, the entry expired along with its lease since it was read, so it changed like
+        // in a failed txn
+        leaseExpired := opts.KeepLease && err == rpctypes.ErrLeaseNotFound
+        if err != nil && !leaseExpired {
+            return 0, err
+        }
+        if !leaseExpired && txnResp.Succeeded {
+            return txnResp.Header.Revision, nil
+        }
+        if attempt >= etcdWriteAttempts {
+            conditional := opts.IfAbsent || opts.IfRevision != 0 || opts.IfTombstone != 0
+            return 0, writeRaceError(key, cur.ModRevision, conditional)
+        }
+        retryEtcdAudit(opts.Audit)
+    }
+}
+
+// Check opts.IfTombstone against the current tombstone of key
+// Returns the comparison that keeps it satisfied for a txn
+func (s *etcdStore) tombstoneCmp(key string, opts PutOptions) (cmp clientv3.Cmp, err error) {
+    getResp, err := s.etcdCli.Get(context.Background(), etcdTombstoneKey(key))
+    if err != nil {
+        return cmp, err
+    }
+
+    var tombstone Tombstone
+    tombstoneRev := int64(0)
+    exists := len(getResp.Kvs) > 0
+    if exists {
+        tombstone, err = decodeEtcdTombstone(getResp.Kvs[0].Key, getResp.Kvs[0].Value)
+        if err != nil {
+            return cmp, err
+        }
+        tombstoneRev = getResp.Kvs[0].ModRevision
+    }
+    err = checkTombstone(key, tombstone, exists, opts)
+    if err != nil {
+        return cmp, err
+    }
+    return clientv3.Compare(clientv3.ModRevision(etcdTombstoneKey(key)), "=", tombstoneRev), nil
+}
+
+func (s *etcdStore) Get(key string) (kv KeyValue, ok bool, err error) {
+    if strings.HasPrefix(key, etcdReservedPrefix) {
+        return kv, false, nil
+    }
+    kvs, _, err := etcdGet(s.etcdCli, key)
+    if err != nil || len(kvs) == 0 {
+        return kv, false, err
+    }
+
+    return kvs[0], true, nil
+}
+
+func (s *etcdStore) GetAt(key string, rev int64) (kv KeyValue, ok bool, err error) {
+    if strings.HasPrefix(key, etcdReservedPrefix) {
+        return kv, false, nil
+    }
+    kvs, _, err := etcdGet(s.etcdCli, key, clientv3.WithRev(rev))
+    if err == rpctypes.ErrCompacted {
+        return kv, false, &requestError{fmt.Errorf("Revision %d was compacted", rev)}
+    } else if err == rpctypes.ErrFutureRev {
+        return kv, false, &requestError{fmt.Errorf("Revision %d is in the future", rev)}
+    } else if err != nil || len(kvs) == 0 {
+        return kv, false, err
+    }
+
+    return kvs[0], true, nil
+}
+
+// Walks back through the revisions of the history key, until one that was compacted
+// Lease expiry deletes entries without writing their history key, so those deletes are found
+// from the entry's own revisions
+func (s *etcdStore) History(key string, limit int64) (versions []EntryVersion, err error) {
+    if strings.HasPrefix(key, etcdReservedPrefix) {
+        return []EntryVersion{}, nil
+    }
+    ctx := context.Background()
+
+    curResp, err := s.etcdCli.Get(ctx, key)
+    if err != nil {
+        return nil, err
+    }
+    curKvs := etcdKeyValues(curResp)
+    exists := len(curKvs) > 0
+
+    // Whether the entry expired after the next older version, if it is live, and a revision it
+    // no longer existed at
+    expired := !exists
+    absentRev := curResp.Header.Revision
+
+    versions = []EntryVersion{}
+    getOpts := []clientv3.OpOption{clientv3.WithRev(curResp.Header.Revision)}
+    for limit <= 0 || int64(len(versions)) < limit {
+        getResp, err := s.etcdCli.Get(ctx, etcdHistoryKey(key), getOpts...)
+        if err == rpctypes.ErrCompacted {
+            break
+        } else if err != nil {
+            return nil, err
+        }
+        if len(getResp.Kvs) == 0 {
+            break
+        }
+
+        kv := getResp.Kvs[0]
+        var stored etcdVersion
+        err = json.Unmarshal(kv.Value, &stored)
+        if err != nil {
+            return nil, err
+        }
+        if expired && !stored.Deleted {
+            deletedRev, ok, err := s.expiryRevision(key, kv.ModRevision, absentRev)
+            if err != nil {
+                return nil, err
+            }
+            if ok {
+                deleted := EntryVersion{KeyValue: KeyValue{Key: key, ModRevision: deletedRev}, Deleted: true}
+                versions = append(versions, deleted)
+            }
+        }
+        version := EntryVersion{KeyValue: KeyValue{Key: key, ModRevision: kv.ModRevision}, Deleted: stored.Deleted}
+        if !stored.Deleted {
+            version.Value, version.Attrs = decodeEtcdValue([]byte(stored.Stored))
+        }
+        versions = append(versions, version)
+        expired, absentRev = stored.Created, kv.ModRevision - 1
+
+        // Revision 0 would read the latest revision again
+        if kv.ModRevision <= 1 {
+            break
+        }
+        getOpts = []clientv3.OpOption{clientv3.WithRev(kv.ModRevision - 1)}
+    }
+    if limit > 0 && int64(len(versions)) > limit {
+        versions = versions[:limit]
+    }
+
+    var cur KeyValue
+    if exists {
+        cur = curKvs[0]
+    }
+    return withCurrentVersion(versions, cur, exists, limit), nil
+}
+
+// Find the revision key expired at, given that it existed at liveRev and not at absentRev
+// ok is false if the revisions in between were compacted
+func (s *etcdStore) expiryRevision(key string, liveRev, absentRev int64) (rev int64, ok bool, err error) {
+    ctx := context.Background()
+    for absentRev - liveRev > 1 {
+        mid := liveRev + (absentRev - liveRev) / 2
+        getResp, err := s.etcdCli.Get(ctx, key, clientv3.WithRev(mid), clientv3.WithCountOnly())
+        if err == rpctypes.ErrCompacted {
+            return 0, false, nil
+        } else if err != nil {
+            return 0, false, err
+        }
+        if getResp.Count > 0 {
+            liveRev = mid
+        } else {
+            absentRev = mid
+        }
+    }
+    return absentRev, true, nil
+}
+
+func (s *etcdStore) List(prefix string, opts ListOptions) (kvs []KeyValue, more bool, err error) {
+    start := prefix
+    if opts.Start > start {
+        start = opts.Start
+    }
+    // Skip the reserved keys, which sort before all entries
+    if start < etcdFirstEntryKey {
+        start = etcdFirstEntryKey
+    }
+
+    getOpts := []clientv3.OpOption{clientv3.WithRange(clientv3.GetPrefixRangeEnd(prefix))}
+    if opts.Limit > 0 {
+        getOpts = append(getOpts, clientv3.WithLimit(opts.Limit))
+    }
+    return etcdGet(s.etcdCli, start, getOpts...)
+}
+
+func (s *etcdStore) FindByIndex(index, value string) (kvs []KeyValue, err error) {
+    ctx := context.Background()
+    indexPrefix := etcdIndexKey(index, value, "")
+    getResp, err := s.etcdCli.Get(ctx, indexPrefix, clientv3.WithPrefix(), clientv3.WithKeysOnly())
+    if err != nil {
+        return nil, err
+    }
+
+    // Read the entries at the revision of the index, so they are the ones it pointed to
+    kvs = []KeyValue{}
+    for _, indexKV := range getResp.Kvs {
+        key := strings.TrimPrefix(string(indexKV.Key), indexPrefix)
+        entries, _, err := etcdGet(s.etcdCli, key, clientv3.WithRev(getResp.Header.Revision))
+        if err != nil {
+            return nil, err
+        }
+        if len(entries) > 0 && serviceIndexes(entries[0].Value)[index] == value {
+            kvs = append(kvs, entries[0])
+        }
+    }
+    return kvs, nil
+}
+
+func (s *etcdStore) Delete(key string, opts DeleteOptions) (deleted int64, err error) {
+    if strings.HasPrefix(key, etcdReservedPrefix) {
+        return 0, errReservedKey
+    }
+    ctx := context.Background()
+    version, err := encodeEtcdVersion(etcdVersion{Deleted: true})
+    if err != nil {
+        return 0, err
+    }
+
+    for attempt := 1; ; attempt++ {
+        cur, exists, err := s.Get(key)
+        if err != nil {
+            return 0, err
+        }
+        err = checkDeleteOptions(key, cur, exists, opts)
+        if err != nil || !exists {
+            return 0, err
+        }
+
+        ops := []clientv3.Op{clientv3.OpDelete(key), clientv3.OpPut(etcdHistoryKey(key), version)}
+        if opts.SoftDelete {
+            tombstone, err := encodeEtcdTombstone(cur, opts.Deleter, time.Now())
+            if err != nil {
+                return 0, err
+            }
+            ops = append(ops, clientv3.OpPut(etcdTombstoneKey(key), tombstone))
+        }
+        ops = append(ops, etcdIndexOps(key, serviceIndexes(cur.Value), nil, clientv3.NoLease)...)
+        cmps := []clientv3.Cmp{clientv3.Compare(clientv3.ModRevision(key), "=", cur.ModRevision)}
+        cmps, ops, err = withEtcdAudit(cmps, ops, opts.Audit)
+        if err != nil {
+            return 0, err
+        }
+        txnResp, err := s.etcdCli.Txn(ctx).If(cmps...).Then(ops...).Commit()
+        if err != nil {
+            return 0, err
+        }
+        if txnResp.Succeeded {
+            return txnResp.Responses[0].GetResponseDeleteRange().Deleted, nil
+        }
+        if attempt >= etcdWriteAttempts {
+            return 0, writeRaceError(key, cur.ModRevision, opts.IfRevision != 0)
+        }
+        retryEtcdAudit(opts.Audit)
+    }
+}
+
+func (s *etcdStore) GetTombstone(key string) (tombstone Tombstone, ok bool, err error) {
+    getResp, err := s.etcdCli.Get(context.Background(), etcdTombstoneKey(key))
+    if err != nil || len(getResp.Kvs) == 0 {
+        return tombstone, false, err
+    }
+
+    tombstone, err = decodeEtcdTombstone(getResp.Kvs[0].Key, getResp.Kvs[0].Value)
+    return tombstone, err == nil, err
+}
+
+func (s *etcdStore) ListTombstones(prefix string, opts ListOptions) (
+    tombstones []Tombstone, more bool, err error) {
+
+    start := prefix
+    if opts.Start > start {
+        start = opts.Start
+    }
+
+    getOpts := []clientv3.OpOption{clientv3.WithRange(clientv3.GetPrefixRangeEnd(etcdTombstoneKey(prefix)))}
+    if opts.Limit > 0 {
+        getOpts = append(getOpts, clientv3.WithLimit(opts.Limit))
+    }
+    getResp, err := s.etcdCli.Get(context.Background(), etcdTombstoneKey(start), getOpts...)
+    if err != nil {
+        return nil, false, err
+    }
+
+    tombstones = []Tombstone{}
+    for _, kv := range getResp.Kvs {
+        tombstone, err := decodeEtcdTombstone(kv.Key, kv.Value)
+        if err != nil {
+            return nil, false, err
+        }
+        tombstones = append(tombstones, tombstone)
+    }
+    return tombstones, getResp.More, nil
+}
+
+// Each tombstone is only removed if unchanged, so entries deleted again meanwhile keep their new tombstone
+func (s *etcdStore) PurgeTombstones(before time.Time) (purged int64, err error) {
+    ctx := context.Background()
+    rangeEnd := clientv3.GetPrefixRangeEnd(etcdTombstoneKey(""))
+    start := etcdTombstoneKey("")
+    for {
+        getResp, err := s.etcdCli.Get(ctx, start,
+            clientv3.WithRange(rangeEnd), clientv3.WithLimit(etcdPurgeBatch))
+        if err != nil {
+            return purged, err
+        }
+
+        for _, kv := range getResp.Kvs {
+            tombstone, err := decodeEtcdTombstone(kv.Key, kv.Value)
+            if err != nil || !tombstone.DeletedAt.Before(before) {
+                continue
+            }
+            txnResp, err := s.etcdCli.Txn(ctx).
+                If(clientv3.Compare(clientv3.Value(string(kv.Key)), "=", string(kv.Value))).
+                Then(clientv3.OpDelete(string(kv.Key))).
+                Commit()
+            if err != nil {
+                return purged, err
+            }
+            if txnResp.Succeeded {
+                purged++
+            }
+        }
+
+        if !getResp.More || len(getResp.Kvs) == 0 {
+            return purged, nil
+        }
+        start = keyAfter(string(getResp.Kvs[len(getResp.Kvs) - 1].Key))
+    }
+}
+
+// Records are only ever created, never overwritten
+func (s *etcdStore) AppendAudit(record AuditRecord) error {
+    ctx := context.Background()
+    for attempt := 1; ; attempt++ {
+        cmp, op, err := etcdAuditOp(record)
+        if err != nil {
+            return err
+        }
+        txnResp, err := s.etcdCli.Txn(ctx).If(cmp).Then(op).Commit()
+        if err != nil {
+            return err
+        }
+        if txnResp.Succeeded {
+            return nil
+        }
+        if attempt >= etcdWriteAttempts {
+            return fmt.Errorf("Audit record %s already exists", etcdAuditKey(record.Time, record.Peer))
+        }
+
+        // Another record from the same peer has the same time, keep both
+        record.Time = record.Time.Add(time.Nanosecond)
+    }
+}
+
+func (s *etcdStore) ListAudit(opts AuditOptions) (records []AuditRecord, err error) {
+    start := etcdAuditTimeKey(time.Unix(0, 0))
+    if !opts.Since.IsZero() {
+        start = etcdAuditTimeKey(opts.Since)
+    }
+    end := clientv3.GetPrefixRangeEnd(etcdReservedPrefix + "audit/")
+    if !opts.Until.IsZero() {
+        end = etcdAuditTimeKey(opts.Until)
+    }
+
+    // Fetch batches newest first, each ending where the previous one stopped,
+    // all at the same revision so records appended meanwhile aren't listed
+    ctx := context.Background()
+    records = []AuditRecord{}
+    var rev int64
+    for {
+        getOpts := []clientv3.OpOption{
+            clientv3.WithRange(end),
+            clientv3.WithSort(clientv3.SortByKey, clientv3.SortDescend),
+            clientv3.WithLimit(etcdAuditBatch),
+        }
+        if rev != 0 {
+            getOpts = append(getOpts, clientv3.WithRev(rev))
+        }
+        getResp, err := s.etcdCli.Get(ctx, start, getOpts...)
+        if err != nil {
+            return nil, err
+        }
+        rev = getResp.Header.Revision
+
+        for _, kv := range getResp.Kvs {
+            var record AuditRecord
+            err = json.Unmarshal(kv.Value, &record)
+            if err != nil {
+                return nil, err
+            }
+            if !opts.matches(record) {
+                continue
+            }
+            records = append(records, record)
+            if opts.Limit > 0 && int64(len(records)) >= opts.Limit {
+                return records, nil
+            }
+        }
+
+        if !getResp.More || len(getResp.Kvs) == 0 {
+            return records, nil
+        }
+        end = string(getResp.Kvs[len(getResp.Kvs) - 1].Key)
+    }
+}
+
+func (s *etcdStore) Renew(key string) (ttl int64, ok bool, err error) {
+    kv, ok, err := s.Get(key)
+    if err != nil || !ok || kv.Lease == 0 {
+        return 0, false, err
+    }
+
+    ctx := context.Background()
+    keepAliveResp, err := s.etcdCli.KeepAliveOnce(ctx, clientv3.LeaseID(kv.Lease))
+    if err == rpctypes.ErrLeaseNotFound {
+        // Lease expired between the get and the keep alive
+        return 0, false, nil
+    } else if err != nil {
+        return 0, false, err
+    }
+
+    return keepAliveResp.TTL, true, nil
+}
+
+func (s *etcdStore) Watch(ctx context.Context, key string, withPrefix bool) (
+    <-chan StoreEvent, error) {
+
+    var watchChan clientv3.WatchChan
+    if withPrefix {
+        watchChan = s.etcdCli.Watch(ctx, key, clientv3.WithPrefix())
+    } else {
+        watchChan = s.etcdCli.Watch(ctx, key)
+    }
+
+    events := make(chan StoreEvent)
+    go func() {
+        defer close(events)
+        for watchResp := range watchChan {
+            if err := watchResp.Err(); err != nil {
+                log.Println("etcd watch failed:", err)
+                return
+            }
+
+            for _, ev := range watchResp.Events {
+                if strings.HasPrefix(string(ev.Kv.Key), etcdReservedPrefix) {
+                    continue
+                }
+                value, _ := decodeEtcdValue(ev.Kv.Value)
+                event := StoreEvent{Key: string(ev.Kv.Key), Value: value}
+                if ev.Type == clientv3.EventTypeDelete {
+                    event.Type = storeEventDelete
+                } else if ev.IsCreate() {
+                    event.Type = storeEventCreate
+                } else {
+                    event.Type = storeEventUpdate
+                }
+
+                select {
+                case events <- event:
+                case <-ctx.Done():
+                    return
+                }
+            }
+        }
+    }()
+
+    return events, nil
+}
+
+func (s *etcdStore) MemberAdd(name, peerUrl string) (initialCluster string, err error) {
+    ctx := context.Background()
+    memAddResp, err := s.etcdCli.MemberAdd(ctx, []string{peerUrl})
+    if err != nil {
+        return "", err
+    }
+
+    newMemId := memAddResp.Member.ID
+
+    clusterPeerUrls := []string{}
+    for _, mem := range memAddResp.Members {
+        memName := mem.Name
+        if mem.ID == newMemId {
+            memName = name
+        }
+        for _, memPeerUrl := range mem.PeerURLs {
+            clusterPeerUrls = append(clusterPeerUrls, fmt.Sprintf("%s=%s", memName, memPeerUrl))
+        }
+    }
+
+    initialCluster = strings.Join(clusterPeerUrls, ",")
+
+    return initialCluster, nil
+}
+
+func (s *etcdStore) Close() error {
+    return s.etcdCli.Close()
+}
+
+// etcd returns ranges sorted by key
+// more is true if a limit given in opts cut the range short
+func etcdGet(etcdCli *clientv3.Client, key string, opts ...clientv3.OpOption) (
+    kvs []KeyValue, more bool, err error) {
+
+    getResp, err := etcdCli.Get(context.Background(), key, opts...)
+    if err != nil {
+        return nil, false, err
+    }
+
+    return etcdKeyValues(getResp), getResp.More, nil
+}
+
+func etcdKeyValues(getResp *clientv3.GetResponse) []KeyValue {
+    kvs := []KeyValue{}
+    for _, kv := range getResp.Kvs {
+        value, attrs := decodeEtcdValue(kv.Value)
+        kvs = append(kvs, KeyValue{
+            Key: string(kv.Key),
+            Value: value,
+            CreateRevision: kv.CreateRevision,
+            ModRevision: kv.ModRevision,
+            Lease: kv.Lease,
+            Attrs: attrs,
+        })
+    }
+    return kvs
+}
@@ -0,0 +1,599 @@
+/* Copyright 2020 PhysarumSM Development Team
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+// Store logic shared by the stores that run without etcd
+// Revisions and watches are implemented here on top of a simple localBackend
+
+import (
+    "context"
+    "fmt"
+    "log"
+    "sync"
+    "time"
+)
+
+// How often expired leases are checked for
+const localLeaseCheckInterval = time.Second
+
+// Entry held by a localBackend
+type localRecord struct {
+    KeyValue
+
+    // TTL of the lease attached to the record, and when it expires unless renewed
+    // Only set if KeyValue.Lease is not 0
+    TTL int64
+    Expires time.Time
+}
+
+func (r localRecord) expired(now time.Time) bool {
+    return r.Lease != 0 && now.After(r.Expires)
+}
+
+// Backend holding the records of a local store
+type localBackend interface {
+    // Run fn with exclusive access to the backend
+    // Changes made by fn are discarded if it returns an error
+    update(fn func(tx localTx) error) error
+
+    // Run fn with read-only access to the backend
+    view(fn func(tx localTx) error) error
+
+    close() error
+}
+
+// Access to a localBackend within update() or view()
+type localTx interface {
+    get(key string) (rec localRecord, ok bool, err error)
+
+    // Call fn on each record with key beginning with prefix, from key start onwards, in key order
+    // Stops early if fn returns false
+    scan(prefix, start string, fn func(rec localRecord) bool) error
+
+    put(rec localRecord) error
+    delete(key string) error
+
+    // Record a version of v.Key, kept after the record itself is deleted
+    addVersion(v EntryVersion) error
+
+    // Call fn on the recorded versions of key, newest first
+    // Stops early if fn returns false
+    versions(key string, fn func(v EntryVersion) bool) error
+
+    // Tombstones are kept apart from records, under the key of the record they were left by
+    getTombstone(key string) (tombstone Tombstone, ok bool, err error)
+    scanTombstones(prefix, start string, fn func(tombstone Tombstone) bool) error
+    putTombstone(tombstone Tombstone) error
+    deleteTombstone(key string) error
+
+    // Index entries map a value in an index to the keys of the records indexed by it, see serviceIndexes
+    putIndex(index, value, key string) error
+    deleteIndex(index, value, key string) error
+
+    // Call fn on the keys indexed by value in index, in key order
+    // Stops early if fn returns false
+    scanIndex(index, value string, fn func(key string) bool) error
+
+    // Audit records are kept in the order they were appended
+    appendAudit(record AuditRecord) error
+
+    // Call fn on the audit records, newest first
+    // Stops early if fn returns false
+    scanAudit(fn func(record AuditRecord) bool) error
+
+    // Latest revision of the store
+    revision() (rev int64, err error)
+    setRevision(rev int64) error
+}
+
+type localStore struct {
+    backend localBackend
+    hub *watchHub
+
+    // Held across each write and its watch notification so watchers see writes in order
+    writeMutex sync.Mutex
+
+    stopExpiry chan struct{}
+}
+
+func newLocalStore(backend localBackend) *localStore {
+    s := &localStore{backend: backend, hub: newWatchHub(), stopExpiry: make(chan struct{})}
+    go s.expireLeases()
+    return s
+}
+
+// Get record stored under key, treating expired records as already deleted
+func localGet(tx localTx, key string) (rec localRecord, ok bool, err error) {
+    rec, ok, err = tx.get(key)
+    if err != nil || !ok || rec.expired(time.Now()) {
+        return localRecord{}, false, err
+    }
+    return rec, true, nil
+}
+
+// Replace the index entries of key from oldIndexes with those from newIndexes
+func localUpdateIndexes(tx localTx, key string, oldIndexes, newIndexes map[string]string) error {
+    for index, value := range oldIndexes {
+        if newValue, ok := newIndexes[index]; !ok || newValue != value {
+            err := tx.deleteIndex(index, value, key)
+            if err != nil {
+                return err
+            }
+        }
+    }
+    for index, value := range newIndexes {
+        err := tx.putIndex(index, value, key)
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func (s *localStore) Put(key, value string, opts PutOptions) (rev int64, err error) {
+    s.writeMutex.Lock()
+    defer s.writeMutex.Unlock()
+
+    var event StoreEvent
+    err = s.backend.update(func(tx localTx) error {
+        cur, exists, err := localGet(tx, key)
+        if err != nil {
+            return err
+        }
+        err = checkPutOptions(key, cur.KeyValue, exists, opts)
+        if err != nil {
+            return err
+        }
+        if opts.IfTombstone != 0 {
+            tombstone, tombstoneExists, err := tx.getTombstone(key)
+            if err != nil {
+                return err
+            }
+            err = checkTombstone(key, tombstone, tombstoneExists, opts)
+            if err != nil {
+                return err
+            }
+        }
+
+        rev, err = tx.revision()
+        if err != nil {
+            return err
+        }
+        rev++
+
+        rec := localRecord{
+            KeyValue: KeyValue{
+                Key: key, Value: value, CreateRevision: rev, ModRevision: rev, Attrs: opts.Attrs},
+        }
+        event = StoreEvent{Type: storeEventCreate, Key: key, Value: value}
+        if exists {
+            rec.CreateRevision = cur.CreateRevision
+            event.Type = storeEventUpdate
+        }
+
+        // Lease IDs only need to be unique, so reuse the revision that granted them
+        if opts.KeepLease {
+            rec.Lease, rec.TTL, rec.Expires = cur.Lease, cur.TTL, cur.Expires
+        } else if opts.TTL > 0 {
+            rec.Lease = rev
+            rec.TTL = opts.TTL
+            rec.Expires = time.Now().Add(time.Duration(opts.TTL) * time.Second)
+        }
+
+        // Expired records stay indexed until they are deleted
+        prev, _, err := tx.get(key)
+        if err != nil {
+            return err
+        }
+        err = localUpdateIndexes(tx, key, serviceIndexes(prev.Value), serviceIndexes(value))
+        if err != nil {
+            return err
+        }
+
+        err = tx.put(rec)
+        if err != nil {
+            return err
+        }
+        err = tx.addVersion(EntryVersion{KeyValue: KeyValue{
+            Key: key, Value: value, ModRevision: rev, Attrs: opts.Attrs}})
+        if err != nil {
+            return err
+        }
+        err = tx.deleteTombstone(key)
+        if err != nil {
+            return err
+        }
+        if opts.Audit != nil {
+            err = tx.appendAudit(*opts.Audit)
+            if err != nil {
+                return err
+            }
+        }
+        return tx.setRevision(rev)
+    })
+    if err != nil {
+        return 0, err
+    }
+
+    s.hub.notify(event)
+    return rev, nil
+}
+
+func (s *localStore) Get(key string) (kv KeyValue, ok bool, err error) {
+    err = s.backend.view(func(tx localTx) error {
+        rec, recOk, err := localGet(tx, key)
+        kv, ok = rec.KeyValue, recOk
+        return err
+    })
+    return kv, ok, err
+}
+
+func (s *localStore) GetAt(key string, rev int64) (kv KeyValue, ok bool, err error) {
+    err = s.backend.view(func(tx localTx) error {
+        storeRev, err := tx.revision()
+        if err != nil {
+            return err
+        }
+        if rev > storeRev {
+            return &requestError{fmt.Errorf("Revision %d is in the future, the store is at %d", rev, storeRev)}
+        }
+
+        // The current record was not modified since rev
+        cur, exists, err := localGet(tx, key)
+        if err != nil || (exists && cur.ModRevision <= rev) {
+            kv, ok = cur.KeyValue, exists
+            return err
+        }
+
+        return tx.versions(key, func(v EntryVersion) bool {
+            if v.ModRevision > rev {
+                return true
+            }
+            kv, ok = v.KeyValue, !v.Deleted
+            return false
+        })
+    })
+    if !ok {
+        return KeyValue{}, false, err
+    }
+    return kv, ok, err
+}
+
+func (s *localStore) History(key string, limit int64) (versions []EntryVersion, err error) {
+    err = s.backend.view(func(tx localTx) error {
+        versions = []EntryVersion{}
+        err := tx.versions(key, func(v EntryVersion) bool {
+            versions = append(versions, v)
+            return limit <= 0 || int64(len(versions)) < limit
+        })
+        if err != nil {
+            return err
+        }
+
+        cur, exists, err := localGet(tx, key)
+        versions = withCurrentVersion(versions, cur.KeyValue, exists, limit)
+        return err
+    })
+    return versions, err
+}
+
+func (s *localStore) List(prefix string, opts ListOptions) (kvs []KeyValue, more bool, err error) {
+    kvs = []KeyValue{}
+    now := time.Now()
+    err = s.backend.view(func(tx localTx) error {
+        more = false
+        kvs = kvs[:0]
+        return tx.scan(prefix, opts.Start, func(rec localRecord) bool {
+            if rec.expired(now) {
+                return true
+            }
+            if opts.Limit > 0 && int64(len(kvs)) >= opts.Limit {
+                more = true
+                return false
+            }
+            kvs = append(kvs, rec.KeyValue)
+            return true
+        })
+    })
+    return kvs, more, err
+}
+
+func (s *localStore) FindByIndex(index, value string) (kvs []KeyValue, err error) {
+    kvs = []KeyValue{}
+    err = s.backend.view(func(tx localTx) error {
+        kvs = kvs[:0]
+        keys := []string{}
+        err := tx.scanIndex(index, value, func(key string) bool {
+            keys = append(keys, key)
+            return true
+        })
+        if err != nil {
+            return err
+        }
+
+        for _, key := range keys {
+            rec, ok, err := localGet(tx, key)
+            if err != nil {
+                return err
+            }
+            if ok {
+                kvs = append(kvs, rec.KeyValue)
+            }
+        }
+        return nil
+    })
+    return kvs, err
+}
+
+func (s *localStore) Delete(key string, opts DeleteOptions) (deleted int64, err error) {
+    s.writeMutex.Lock()
+    defer s.writeMutex.Unlock()
+
+    err = s.backend.update(func(tx localTx) error {
+        cur, exists, err := localGet(tx, key)
+        if err != nil {
+            return err
+        }
+        err = checkDeleteOptions(key, cur.KeyValue, exists, opts)
+        if err != nil || !exists {
+            return err
+        }
+
+        rev, err := tx.revision()
+        if err != nil {
+            return err
+        }
+
+        err = tx.delete(key)
+        if err != nil {
+            return err
+        }
+        err = localUpdateIndexes(tx, key, serviceIndexes(cur.Value), nil)
+        if err != nil {
+            return err
+        }
+        err = tx.addVersion(EntryVersion{KeyValue: KeyValue{Key: key, ModRevision: rev + 1}, Deleted: true})
+        if err != nil {
+            return err
+        }
+        if opts.SoftDelete {
+            tombstone := Tombstone{KeyValue: cur.KeyValue, Deleter: opts.Deleter, DeletedAt: time.Now()}
+            tombstone.Lease = 0
+            err = tx.putTombstone(tombstone)
+            if err != nil {
+                return err
+            }
+        }
+        if opts.Audit != nil {
+            err = tx.appendAudit(*opts.Audit)
+            if err != nil {
+                return err
+            }
+        }
+        deleted = 1
+        return tx.setRevision(rev + 1)
+    })
+    if err != nil {
+        return 0, err
+    }
+
+    if deleted != 0 {
+        s.hub.notify(StoreEvent{Type: storeEventDelete, Key: key})
+    }
+    return deleted, nil
+}
+
+func (s *localStore) GetTombstone(key string) (tombstone Tombstone, ok bool, err error) {
+    err = s.backend.view(func(tx localTx) error {
+        tombstone, ok, err = tx.getTombstone(key)
+        return err
+    })
+    return tombstone, ok, err
+}
+
+func (s *localStore) ListTombstones(prefix string, opts ListOptions) (
+    tombstones []Tombstone, more bool, err error) {
+
+    tombstones = []Tombstone{}
+    err = s.backend.view(func(tx localTx) error {
+        more = false
+        tombstones = tombstones[:0]
+        return tx.scanTombstones(prefix, opts.Start, func(tombstone Tombstone) bool {
+            if opts.Limit > 0 && int64(len(tombstones)) >= opts.Limit {
+                more = true
+                return false
+            }
+            tombstones = append(tombstones, tombstone)
+            return true
+        })
+    })
+    return tombstones, more, err
+}
+
+// Tombstones are not entries, so purging them does not modify the store's revision
+func (s *localStore) PurgeTombstones(before time.Time) (purged int64, err error) {
+    s.writeMutex.Lock()
+    defer s.writeMutex.Unlock()
+
+    err = s.backend.update(func(tx localTx) error {
+        expired := []string{}
+        err := tx.scanTombstones("", "", func(tombstone Tombstone) bool {
+            if tombstone.DeletedAt.Before(before) {
+                expired = append(expired, tombstone.Key)
+            }
+            return true
+        })
+        if err != nil {
+            return err
+        }
+
+        for _, key := range expired {
+            err = tx.deleteTombstone(key)
+            if err != nil {
+                return err
+            }
+        }
+        purged = int64(len(expired))
+        return nil
+    })
+    if err != nil {
+        return 0, err
+    }
+    return purged, nil
+}
+
+// Audit records are not entries, so appending one does not modify the store's revision
+func (s *localStore) AppendAudit(record AuditRecord) error {
+    s.writeMutex.Lock()
+    defer s.writeMutex.Unlock()
+
+    return s.backend.update(func(tx localTx) error {
+        return tx.appendAudit(record)
+    })
+}
+
+func (s *localStore) ListAudit(opts AuditOptions) (records []AuditRecord, err error) {
+    records = []AuditRecord{}
+    err = s.backend.view(func(tx localTx) error {
+        return tx.scanAudit(func(record AuditRecord) bool {
+            if opts.matches(record) {
+                records = append(records, record)
+            }
+            return opts.Limit == 0 || int64(len(records)) < opts.Limit
+        })
+    })
+    return records, err
+}
+
+// Renewing does not modify the record's revision, like etcd lease keep alives
+func (s *localStore) Renew(key string) (ttl int64, ok bool, err error) {
+    s.writeMutex.Lock()
+    defer s.writeMutex.Unlock()
+
+    err = s.backend.update(func(tx localTx) error {
+        rec, exists, err := localGet(tx, key)
+        if err != nil || !exists || rec.Lease == 0 {
+            return err
+        }
+
+        rec.Expires = time.Now().Add(time.Duration(rec.TTL) * time.Second)
+        ttl, ok = rec.TTL, true
+        return tx.put(rec)
+    })
+    if err != nil {
+        return 0, false, err
+    }
+
+    return ttl, ok, nil
+}
+
+// Periodically delete records whose leases have expired, until the store is closed
+func (s *localStore) expireLeases() {
+    ticker := time.NewTicker(localLeaseCheckInterval)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <-ticker.C:
+            err := s.deleteExpired()
+            if err != nil {
+                log.Println("Failed to delete expired entries:", err)
+            }
+        case <-s.stopExpiry:
+            return
+        }
+    }
+}
+
+func (s *localStore) deleteExpired() error {
+    // Check with a read-only view first so idle stores aren't written to every interval
+    anyExpired := false
+    now := time.Now()
+    err := s.backend.view(func(tx localTx) error {
+        return tx.scan("", "", func(rec localRecord) bool {
+            anyExpired = anyExpired || rec.expired(now)
+            return !anyExpired
+        })
+    })
+    if err != nil || !anyExpired {
+        return err
+    }
+
+    s.writeMutex.Lock()
+    defer s.writeMutex.Unlock()
+
+    expired := []string{}
+    err = s.backend.update(func(tx localTx) error {
+        expired = expired[:0]
+        expiredValues := []string{}
+        now := time.Now()
+        err := tx.scan("", "", func(rec localRecord) bool {
+            if rec.expired(now) {
+                expired = append(expired, rec.Key)
+                expiredValues = append(expiredValues, rec.Value)
+            }
+            return true
+        })
+        if err != nil || len(expired) == 0 {
+            return err
+        }
+
+        // All keys attached to expired leases are deleted in a single revision, like etcd
+        rev, err := tx.revision()
+        if err != nil {
+            return err
+        }
+
+        for i, key := range expired {
+            err = tx.delete(key)
+            if err != nil {
+                return err
+            }
+            err = localUpdateIndexes(tx, key, serviceIndexes(expiredValues[i]), nil)
+            if err != nil {
+                return err
+            }
+            err = tx.addVersion(EntryVersion{KeyValue: KeyValue{Key: key, ModRevision: rev + 1}, Deleted: true})
+            if err != nil {
+                return err
+            }
+        }
+        return tx.setRevision(rev + 1)
+    })
+    if err != nil {
+        return err
+    }
+
+    for _, key := range expired {
+        s.hub.notify(StoreEvent{Type: storeEventDelete, Key: key})
+    }
+    return nil
+}
+
+func (s *localStore) Watch(ctx context.Context, key string, withPrefix bool) (
+    <-chan StoreEvent, error) {
+
+    return s.hub.watch(ctx, key, withPrefix), nil
+}
+
+func (s *localStore) MemberAdd(name, peerUrl string) (initialCluster string, err error) {
+    return "", errMemberAddUnsupported
+}
+
+func (s *localStore) Close() error {
+    close(s.stopExpiry)
+    s.hub.close()
+    return s.backend.close()
+}
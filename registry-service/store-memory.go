@@ -0,0 +1,321 @@
+/* Copyright 2020 PhysarumSM Development Team
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+    "sort"
+    "strings"
+    "sync"
+)
+
+// Store kept entirely in memory
+// Contents are lost when registry-service exits, useful for dev and testing
+func newMemoryStore() *localStore {
+    return newLocalStore(&memoryBackend{
+        records: make(map[string]localRecord),
+        history: make(map[string][]EntryVersion),
+        tombstones: make(map[string]Tombstone),
+        indexes: make(map[memoryIndexValue]map[string]bool),
+    })
+}
+
+// Value in an index, see localTx.putIndex
+type memoryIndexValue struct {
+    index, value string
+}
+
+type memoryBackend struct {
+    mutex sync.RWMutex
+    records map[string]localRecord
+    rev int64
+
+    // Recorded versions of each key, oldest first
+    history map[string][]EntryVersion
+
+    tombstones map[string]Tombstone
+
+    // Set of keys indexed by each index value
+    indexes map[memoryIndexValue]map[string]bool
+
+    // Audit records, oldest first
+    audit []AuditRecord
+}
+
+func (b *memoryBackend) update(fn func(tx localTx) error) error {
+    b.mutex.Lock()
+    defer b.mutex.Unlock()
+
+    // Writes are staged so they can be discarded if fn fails
+    tx := &memoryTx{
+        backend: b,
+        staged: make(map[string]*localRecord),
+        stagedTombstones: make(map[string]*Tombstone),
+        stagedIndexes: make(map[memoryIndexValue]map[string]bool),
+        rev: b.rev,
+    }
+    err := fn(tx)
+    if err != nil {
+        return err
+    }
+
+    for key, kv := range tx.staged {
+        if kv == nil {
+            delete(b.records, key)
+        } else {
+            b.records[key] = *kv
+        }
+    }
+    for _, v := range tx.stagedVersions {
+        b.history[v.Key] = append(b.history[v.Key], v)
+    }
+    b.audit = append(b.audit, tx.stagedAudit...)
+    for key, tombstone := range tx.stagedTombstones {
+        if tombstone == nil {
+            delete(b.tombstones, key)
+        } else {
+            b.tombstones[key] = *tombstone
+        }
+    }
+    for indexValue, keys := range tx.stagedIndexes {
+        for key, indexed := range keys {
+            if !indexed {
+                delete(b.indexes[indexValue], key)
+                continue
+            }
+            if b.indexes[indexValue] == nil {
+                b.indexes[indexValue] = make(map[string]bool)
+            }
+            b.indexes[indexValue][key] = true
+        }
+        if len(b.indexes[indexValue]) == 0 {
+            delete(b.indexes, indexValue)
+        }
+    }
+    b.rev = tx.rev
+    return nil
+}
+
+func (b *memoryBackend) view(fn func(tx localTx) error) error {
+    b.mutex.RLock()
+    defer b.mutex.RUnlock()
+
+    return fn(&memoryTx{backend: b, rev: b.rev})
+}
+
+func (b *memoryBackend) close() error {
+    return nil
+}
+
+type memoryTx struct {
+    backend *memoryBackend
+
+    // Pending writes, nil for deleted keys
+    staged map[string]*localRecord
+    stagedVersions []EntryVersion
+    stagedTombstones map[string]*Tombstone
+    // false for deleted index entries
+    stagedIndexes map[memoryIndexValue]map[string]bool
+    stagedAudit []AuditRecord
+    rev int64
+}
+
+func (tx *memoryTx) get(key string) (rec localRecord, ok bool, err error) {
+    if staged, isStaged := tx.staged[key]; isStaged {
+        if staged == nil {
+            return rec, false, nil
+        }
+        return *staged, true, nil
+    }
+
+    rec, ok = tx.backend.records[key]
+    return rec, ok, nil
+}
+
+func (tx *memoryTx) scan(prefix, start string, fn func(rec localRecord) bool) error {
+    inRange := func(key string) bool {
+        return strings.HasPrefix(key, prefix) && key >= start
+    }
+
+    keys := []string{}
+    for key := range tx.backend.records {
+        if _, isStaged := tx.staged[key]; !isStaged && inRange(key) {
+            keys = append(keys, key)
+        }
+    }
+    for key, kv := range tx.staged {
+        if kv != nil && inRange(key) {
+            keys = append(keys, key)
+        }
+    }
+    sort.Strings(keys)
+
+    for _, key := range keys {
+        rec, _, _ := tx.get(key)
+        if !fn(rec) {
+            break
+        }
+    }
+    return nil
+}
+
+func (tx *memoryTx) put(rec localRecord) error {
+    tx.staged[rec.Key] = &rec
+    return nil
+}
+
+func (tx *memoryTx) delete(key string) error {
+    tx.staged[key] = nil
+    return nil
+}
+
+func (tx *memoryTx) addVersion(v EntryVersion) error {
+    tx.stagedVersions = append(tx.stagedVersions, v)
+    return nil
+}
+
+func (tx *memoryTx) versions(key string, fn func(v EntryVersion) bool) error {
+    for i := len(tx.stagedVersions) - 1; i >= 0; i-- {
+        if v := tx.stagedVersions[i]; v.Key == key && !fn(v) {
+            return nil
+        }
+    }
+    history := tx.backend.history[key]
+    for i := len(history) - 1; i >= 0; i-- {
+        if !fn(history[i]) {
+            return nil
+        }
+    }
+    return nil
+}
+
+func (tx *memoryTx) getTombstone(key string) (tombstone Tombstone, ok bool, err error) {
+    if staged, isStaged := tx.stagedTombstones[key]; isStaged {
+        if staged == nil {
+            return tombstone, false, nil
+        }
+        return *staged, true, nil
+    }
+
+    tombstone, ok = tx.backend.tombstones[key]
+    return tombstone, ok, nil
+}
+
+func (tx *memoryTx) scanTombstones(prefix, start string, fn func(tombstone Tombstone) bool) error {
+    inRange := func(key string) bool {
+        return strings.HasPrefix(key, prefix) && key >= start
+    }
+
+    keys := []string{}
+    for key := range tx.backend.tombstones {
+        if _, isStaged := tx.stagedTombstones[key]; !isStaged && inRange(key) {
+            keys = append(keys, key)
+        }
+    }
+    for key, tombstone := range tx.stagedTombstones {
+        if tombstone != nil && inRange(key) {
+            keys = append(keys, key)
+        }
+    }
+    sort.Strings(keys)
+
+    for _, key := range keys {
+        tombstone, _, _ := tx.getTombstone(key)
+        if !fn(tombstone) {
+            break
+        }
+    }
+    return nil
+}
+
+func (tx *memoryTx) putTombstone(tombstone Tombstone) error {
+    tx.stagedTombstones[tombstone.Key] = &tombstone
+    return nil
+}
+
+func (tx *memoryTx) deleteTombstone(key string) error {
+    tx.stagedTombstones[key] = nil
+    return nil
+}
+
+func (tx *memoryTx) stageIndex(index, value, key string, indexed bool) {
+    indexValue := memoryIndexValue{index, value}
+    if tx.stagedIndexes[indexValue] == nil {
+        tx.stagedIndexes[indexValue] = make(map[string]bool)
+    }
+    tx.stagedIndexes[indexValue][key] = indexed
+}
+
+func (tx *memoryTx) putIndex(index, value, key string) error {
+    tx.stageIndex(index, value, key, true)
+    return nil
+}
+
+func (tx *memoryTx) deleteIndex(index, value, key string) error {
+    tx.stageIndex(index, value, key, false)
+    return nil
+}
+
+func (tx *memoryTx) scanIndex(index, value string, fn func(key string) bool) error {
+    indexValue := memoryIndexValue{index, value}
+    staged := tx.stagedIndexes[indexValue]
+
+    keys := []string{}
+    for key := range tx.backend.indexes[indexValue] {
+        if _, isStaged := staged[key]; !isStaged {
+            keys = append(keys, key)
+        }
+    }
+    for key, indexed := range staged {
+        if indexed {
+            keys = append(keys, key)
+        }
+    }
+    sort.Strings(keys)
+
+    for _, key := range keys {
+        if !fn(key) {
+            break
+        }
+    }
+    return nil
+}
+
+func (tx *memoryTx) appendAudit(record AuditRecord) error {
+    tx.stagedAudit = append(tx.stagedAudit, record)
+    return nil
+}
+
+func (tx *memoryTx) scanAudit(fn func(record AuditRecord) bool) error {
+    for i := len(tx.stagedAudit) - 1; i >= 0; i-- {
+        if !fn(tx.stagedAudit[i]) {
+            return nil
+        }
+    }
+    for i := len(tx.backend.audit) - 1; i >= 0; i-- {
+        if !fn(tx.backend.audit[i]) {
+            return nil
+        }
+    }
+    return nil
+}
+
+func (tx *memoryTx) revision() (rev int64, err error) {
+    return tx.rev, nil
+}
+
+func (tx *memoryTx) setRevision(rev int64) error {
+    tx.rev = rev
+    return nil
+}
@@ -0,0 +1,110 @@
+/* Copyright 2020 PhysarumSM Development Team
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+    "context"
+    "log"
+    "strings"
+    "sync"
+)
+
+// Number of events buffered per watcher before it is considered too slow and dropped
+const watchBufferSize = 128
+
+type storeWatcher struct {
+    key string
+    withPrefix bool
+    events chan StoreEvent
+}
+
+func (w *storeWatcher) matches(key string) bool {
+    if w.withPrefix {
+        return strings.HasPrefix(key, w.key)
+    }
+    return key == w.key
+}
+
+// Fans out store events to watchers, used by stores that don't have native watch support
+type watchHub struct {
+    mutex sync.Mutex
+    watchers map[*storeWatcher]struct{}
+}
+
+func newWatchHub() *watchHub {
+    return &watchHub{watchers: make(map[*storeWatcher]struct{})}
+}
+
+func (h *watchHub) watch(ctx context.Context, key string, withPrefix bool) <-chan StoreEvent {
+    w := &storeWatcher{
+        key: key,
+        withPrefix: withPrefix,
+        events: make(chan StoreEvent, watchBufferSize),
+    }
+
+    h.mutex.Lock()
+    h.watchers[w] = struct{}{}
+    h.mutex.Unlock()
+
+    go func() {
+        <-ctx.Done()
+        h.remove(w)
+    }()
+
+    return w.events
+}
+
+// Send event to all interested watchers
+// Callers should serialize calls so watchers see events in the order they were applied
+func (h *watchHub) notify(event StoreEvent) {
+    h.mutex.Lock()
+    defer h.mutex.Unlock()
+
+    for w := range h.watchers {
+        if !w.matches(event.Key) {
+            continue
+        }
+
+        select {
+        case w.events <- event:
+        default:
+            // Never block writers on a slow watcher, end its watch instead
+            log.Printf("Watcher on %s fell behind, closing watch\n", w.key)
+            delete(h.watchers, w)
+            close(w.events)
+        }
+    }
+}
+
+func (h *watchHub) remove(w *storeWatcher) {
+    h.mutex.Lock()
+    defer h.mutex.Unlock()
+
+    if _, ok := h.watchers[w]; ok {
+        delete(h.watchers, w)
+        close(w.events)
+    }
+}
+
+// End all watches
+func (h *watchHub) close() {
+    h.mutex.Lock()
+    defer h.mutex.Unlock()
+
+    for w := range h.watchers {
+        close(w.events)
+    }
+    h.watchers = make(map[*storeWatcher]struct{})
+}
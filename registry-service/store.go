@@ -0,0 +1,348 @@
+/* Copyright 2020 PhysarumSM Development Team
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+// Storage backends used by registry-service to hold service info
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "time"
+
+    "github.com/PhysarumSM/service-registry/common"
+    "github.com/PhysarumSM/service-registry/registry"
+)
+
+// Store is the key-value storage the stream handlers operate on
+// Keys are service names, values are the InfoStr sent by clients
+// Every change to the store increments its revision, like etcd
+type Store interface {
+    // Store value under key, subject to opts
+    // Returns revision of the store after the put
+    // Returns *conflictError if opts are not satisfied
+    Put(key, value string, opts PutOptions) (rev int64, err error)
+
+    // Get entry stored under key, ok is false if key does not exist
+    Get(key string) (kv KeyValue, ok bool, err error)
+
+    // Get entry as it was at store revision rev, ok is false if key did not exist then
+    // Returns *requestError if rev is in the future or no longer kept
+    GetAt(key string, rev int64) (kv KeyValue, ok bool, err error)
+
+    // Versions key was put and deleted at, newest first, at most limit unless 0
+    // Lease expiry shows as a delete, entries last written before the store kept history
+    // only have their current version
+    History(key string, limit int64) (versions []EntryVersion, err error)
+
+    // List entries with keys beginning with prefix, sorted by key, subject to opts
+    // more is true if opts.Limit cut the list short
+    List(prefix string, opts ListOptions) (kvs []KeyValue, more bool, err error)
+
+    // Delete key subject to opts, returning number of entries deleted
+    // Returns *conflictError if opts are not satisfied
+    Delete(key string, opts DeleteOptions) (deleted int64, err error)
+
+    // Get the tombstone left by a soft delete of key, ok is false if there is none
+    // Putting key again removes its tombstone
+    GetTombstone(key string) (tombstone Tombstone, ok bool, err error)
+
+    // List tombstones of keys beginning with prefix, sorted by key, subject to opts
+    ListTombstones(prefix string, opts ListOptions) (tombstones []Tombstone, more bool, err error)
+
+    // Remove tombstones of entries deleted before the given time, returning how many were removed
+    PurgeTombstones(before time.Time) (purged int64, err error)
+
+    // Append record to the audit log, records are never modified or removed
+    AppendAudit(record AuditRecord) error
+
+    // Get audit records newest first, subject to opts
+    ListAudit(opts AuditOptions) (records []AuditRecord, err error)
+
+    // Get entries whose attrs map index to value, sorted by key
+    FindByIndex(index, value string) (kvs []KeyValue, err error)
+
+    // Renew the lease attached to key, restarting its TTL
+    // ok is false if key does not exist or has no lease attached
+    Renew(key string) (ttl int64, ok bool, err error)
+
+    // Watch for changes to key, or to all keys beginning with key if withPrefix is set
+    // Returned channel is closed once ctx is done or the watch fails
+    Watch(ctx context.Context, key string, withPrefix bool) (<-chan StoreEvent, error)
+
+    // Add new member to the storage cluster
+    // Returns initial cluster string the new member should start with
+    MemberAdd(name, peerUrl string) (initialCluster string, err error)
+
+    Close() error
+}
+
+type KeyValue struct {
+    Key string
+    Value string
+
+    // Store revision when key was created, and when it was last modified
+    CreateRevision int64
+    ModRevision int64
+
+    // ID of lease attached to key, 0 if key does not expire
+    Lease int64
+
+    Attrs EntryAttrs
+}
+
+// Past or current version of an entry
+// CreateRevision and Lease are not kept
+type EntryVersion struct {
+    KeyValue
+
+    // Set if key was deleted at ModRevision, Value and Attrs are then empty
+    Deleted bool
+}
+
+// Combine the recorded versions of an entry with its current state, for entries whose latest
+// write was not recorded
+// versions are newest first, cur is ignored if exists is false
+func withCurrentVersion(versions []EntryVersion, cur KeyValue, exists bool, limit int64) []EntryVersion {
+    if !exists || (len(versions) > 0 && versions[0].ModRevision >= cur.ModRevision) {
+        return versions
+    }
+
+    current := EntryVersion{KeyValue: KeyValue{
+        Key: cur.Key, Value: cur.Value, ModRevision: cur.ModRevision, Attrs: cur.Attrs}}
+    versions = append([]EntryVersion{current}, versions...)
+    if limit > 0 && int64(len(versions)) > limit {
+        versions = versions[:limit]
+    }
+    return versions
+}
+
+// Metadata stored alongside the value, replaced along with it on every put
+type EntryAttrs struct {
+    // Peer ID of the publisher that signed the value, and its signature
+    // Empty if the value is unsigned
+    Publisher string
+    PublicKey []byte
+    Signature []byte
+
+    // Peer ID of the peer allowed to modify the entry, see ownership.go
+    // Empty for entries added before owners were recorded
+    Owner string
+}
+
+func (a EntryAttrs) empty() bool {
+    return a.Publisher == "" && len(a.PublicKey) == 0 && len(a.Signature) == 0 && a.Owner == ""
+}
+
+// Index values of an entry with info infoStr, that FindByIndex finds it by
+// Stores compute them on every write, in the same write as the entry itself
+// Entries whose info can't be decoded, or that have no hashes, are not indexed
+func serviceIndexes(infoStr string) map[string]string {
+    var info registry.ServiceInfo
+    err := json.Unmarshal([]byte(infoStr), &info)
+    if err != nil {
+        return nil
+    }
+
+    indexes := make(map[string]string)
+    if info.ContentHash != "" {
+        indexes[common.ContentHashIndex] = info.ContentHash
+    }
+    if info.DockerHash != "" {
+        indexes[common.DockerHashIndex] = info.DockerHash
+    }
+    if len(indexes) == 0 {
+        return nil
+    }
+    return indexes
+}
+
+// Conditions a put must satisfy, and how the value is stored
+type PutOptions struct {
+    // Only put if key does not exist
+    IfAbsent bool
+
+    // Only put if key was last modified at this revision, ignored if 0
+    IfRevision int64
+
+    // Only put if the tombstone of key holds the entry as last modified at this revision, ignored if 0
+    // So a deleted entry is only restored if it was not added and deleted again since
+    IfTombstone int64
+
+    // Attach a new lease to key, deleting it unless renewed within TTL seconds
+    // Key never expires if 0
+    TTL int64
+
+    // Keep the lease currently attached to key instead, TTL is ignored
+    KeepLease bool
+
+    // Attributes to store with the value
+    Attrs EntryAttrs
+
+    // Record of the change, appended to the audit log in the same write, unless nil
+    // Stores may move its Time forward to keep it apart from other records, see AppendAudit
+    Audit *AuditRecord
+}
+
+// Range of a list
+type ListOptions struct {
+    // Only list keys from Start onwards, ignored if empty
+    Start string
+
+    // List at most Limit entries, no limit if 0
+    Limit int64
+}
+
+// Change made through registry-service, see audit.go
+type AuditRecord struct {
+    Time time.Time
+
+    // Peer ID of the requesting peer, and the protocol of its request
+    Peer string
+    Protocol string
+
+    // Key of the changed entry, or name of the added member
+    Name string
+
+    // Digests of the entry's value before and after the change, empty if it did not exist
+    OldDigest string
+    NewDigest string
+}
+
+// Audit records to get
+type AuditOptions struct {
+    // Only get records from Since up to but excluding Until, either is ignored if zero
+    Since time.Time
+    Until time.Time
+
+    // Only get records Match returns true for, ignored if nil
+    Match func(record AuditRecord) bool
+
+    // Get at most Limit records, no limit if 0
+    Limit int64
+}
+
+func (opts AuditOptions) matches(record AuditRecord) bool {
+    if !opts.Since.IsZero() && record.Time.Before(opts.Since) {
+        return false
+    }
+    if !opts.Until.IsZero() && !record.Time.Before(opts.Until) {
+        return false
+    }
+    return opts.Match == nil || opts.Match(record)
+}
+
+// Conditions a delete must satisfy, and how the entry is deleted
+type DeleteOptions struct {
+    // Only delete if key was last modified at this revision, ignored if 0
+    IfRevision int64
+
+    // Keep the entry as a tombstone, recording Deleter as the peer that deleted it
+    SoftDelete bool
+    Deleter string
+
+    // Same as PutOptions.Audit, only appended if the entry is deleted
+    Audit *AuditRecord
+}
+
+// Entry kept after a soft delete, until it is purged or put again
+type Tombstone struct {
+    // Entry as it was when deleted, Lease is not kept
+    KeyValue
+
+    // Peer ID of the peer that deleted the entry, and when
+    Deleter string
+    DeletedAt time.Time
+}
+
+// Returned when a put's conditions are not satisfied
+type conflictError struct {
+    Key string
+
+    // Revision key was last modified at, 0 if key does not exist
+    CurrentRevision int64
+}
+
+func (e *conflictError) Error() string {
+    if e.CurrentRevision == 0 {
+        return fmt.Sprintf("Conflict on %s: entry does not exist", e.Key)
+    }
+    return fmt.Sprintf("Conflict on %s: entry is at revision %d", e.Key, e.CurrentRevision)
+}
+
+// Returned when a write without conditions keeps losing races with other writes to the same key
+// Unlike conflictError the caller did not ask for a condition, so it should simply try again
+type contentionError struct {
+    Key string
+}
+
+func (e *contentionError) Error() string {
+    return fmt.Sprintf("Too many concurrent writes to %s, try again", e.Key)
+}
+
+// Error for a write that lost every attempt to other writes, with the key at curRev
+// conditional is whether the caller's write had conditions
+func writeRaceError(key string, curRev int64, conditional bool) error {
+    if conditional {
+        return &conflictError{Key: key, CurrentRevision: curRev}
+    }
+    return &contentionError{Key: key}
+}
+
+// Check whether opts are satisfied by the current state of a key
+// cur is ignored if exists is false
+func checkPutOptions(key string, cur KeyValue, exists bool, opts PutOptions) error {
+    curRev := int64(0)
+    if exists {
+        curRev = cur.ModRevision
+    }
+
+    if (opts.IfAbsent && exists) || (opts.IfRevision != 0 && opts.IfRevision != curRev) {
+        return &conflictError{Key: key, CurrentRevision: curRev}
+    }
+    return nil
+}
+
+// Check whether opts.IfTombstone is satisfied by the current tombstone of a key
+// tombstone is ignored if exists is false
+func checkTombstone(key string, tombstone Tombstone, exists bool, opts PutOptions) error {
+    if opts.IfTombstone != 0 && (!exists || tombstone.ModRevision != opts.IfTombstone) {
+        return &conflictError{Key: key}
+    }
+    return nil
+}
+
+// Check whether opts are satisfied by the current state of a key
+func checkDeleteOptions(key string, cur KeyValue, exists bool, opts DeleteOptions) error {
+    return checkPutOptions(key, cur, exists, PutOptions{IfRevision: opts.IfRevision})
+}
+
+var errMemberAddUnsupported = errors.New("Store does not support adding cluster members")
+
+type StoreEventType int
+
+const (
+    storeEventCreate StoreEventType = iota
+    storeEventUpdate
+    storeEventDelete
+)
+
+// Change to a single key, as reported by Store.Watch()
+type StoreEvent struct {
+    Type StoreEventType
+    Key string
+    Value string
+}
@@ -0,0 +1,444 @@
+/* Copyright 2020 PhysarumSM Development Team
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+    "context"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/PhysarumSM/service-registry/common"
+)
+
+// Runs test function against every store type that doesn't need etcd
+func testLocalStores(t *testing.T, testFunc func(t *testing.T, store Store)) {
+    t.Run("memory", func(t *testing.T) {
+        store := newMemoryStore()
+        defer store.Close()
+        testFunc(t, store)
+    })
+
+    t.Run("bolt", func(t *testing.T) {
+        tmpDir, err := ioutil.TempDir("", "store-test-")
+        if err != nil {
+            t.Fatalf("%v", err)
+        }
+        defer os.RemoveAll(tmpDir)
+
+        store, err := newBoltStore(filepath.Join(tmpDir, "registry.db"))
+        if err != nil {
+            t.Fatalf("%v", err)
+        }
+        defer store.Close()
+        testFunc(t, store)
+    })
+}
+
+func TestStorePutGet(t *testing.T) {
+    testLocalStores(t, func(t *testing.T, store Store) {
+        _, ok, err := store.Get("my-service:1.0")
+        if err != nil || ok {
+            t.Errorf("Get on empty store returned ok=%v err=%v", ok, err)
+        }
+
+        rev1, err := store.Put("my-service:1.0", "info-1", PutOptions{})
+        if err != nil {
+            t.Fatalf("%v", err)
+        }
+        rev2, err := store.Put("my-service:1.0", "info-2", PutOptions{})
+        if err != nil {
+            t.Fatalf("%v", err)
+        }
+        if rev2 <= rev1 {
+            t.Errorf("Revision did not increase after put: %d -> %d", rev1, rev2)
+        }
+
+        kv, ok, err := store.Get("my-service:1.0")
+        if err != nil || !ok || kv.Value != "info-2" {
+            t.Errorf("Get returned (%s, %v, %v), expected (info-2, true, nil)", kv.Value, ok, err)
+        }
+        if kv.CreateRevision != rev1 || kv.ModRevision != rev2 {
+            t.Errorf("Get returned revisions (%d, %d), expected (%d, %d)",
+                kv.CreateRevision, kv.ModRevision, rev1, rev2)
+        }
+    })
+}
+
+func TestStoreAttrs(t *testing.T) {
+    testLocalStores(t, func(t *testing.T, store Store) {
+        attrs := EntryAttrs{Publisher: "QmPublisher", PublicKey: []byte("key"), Signature: []byte("sig")}
+        _, err := store.Put("my-service:1.0", "info-1", PutOptions{Attrs: attrs})
+        if err != nil {
+            t.Fatalf("%v", err)
+        }
+
+        kvs, _, err := store.List("", ListOptions{})
+        if err != nil || len(kvs) != 1 || kvs[0].Attrs.Publisher != attrs.Publisher ||
+            string(kvs[0].Attrs.Signature) != "sig" {
+            t.Errorf("List returned (%v, %v), expected entry with attrs %v", kvs, err, attrs)
+        }
+
+        // Attributes are replaced along with the value
+        _, err = store.Put("my-service:1.0", "info-2", PutOptions{})
+        if err != nil {
+            t.Fatalf("%v", err)
+        }
+        kv, _, err := store.Get("my-service:1.0")
+        if err != nil || !kv.Attrs.empty() {
+            t.Errorf("Get returned (%v, %v), expected entry without attrs", kv, err)
+        }
+    })
+}
+
+func TestEtcdValueEncoding(t *testing.T) {
+    attrs := EntryAttrs{Publisher: "QmPublisher", Signature: []byte("sig")}
+    stored, err := encodeEtcdValue("info", attrs)
+    if err != nil {
+        t.Fatalf("%v", err)
+    }
+    value, decodedAttrs := decodeEtcdValue([]byte(stored))
+    if value != "info" || decodedAttrs.Publisher != attrs.Publisher {
+        t.Errorf("Decoded (%s, %v), expected (info, %v)", value, decodedAttrs, attrs)
+    }
+
+    // Plain values, including json ones, are left as is
+    for _, plain := range []string{"info", `{"ContentHash":"abc"}`} {
+        stored, _ = encodeEtcdValue(plain, EntryAttrs{})
+        value, decodedAttrs = decodeEtcdValue([]byte(stored))
+        if value != plain || !decodedAttrs.empty() {
+            t.Errorf("Decoded (%s, %v), expected (%s, no attrs)", value, decodedAttrs, plain)
+        }
+    }
+}
+
+func TestStorePutConditional(t *testing.T) {
+    testLocalStores(t, func(t *testing.T, store Store) {
+        rev, err := store.Put("my-service:1.0", "info-1", PutOptions{IfAbsent: true})
+        if err != nil {
+            t.Fatalf("%v", err)
+        }
+
+        _, err = store.Put("my-service:1.0", "info-2", PutOptions{IfAbsent: true})
+        if conflict, ok := err.(*conflictError); !ok || conflict.CurrentRevision != rev {
+            t.Errorf("Put if absent on existing key returned %v, expected conflict at %d", err, rev)
+        }
+
+        _, err = store.Put("my-service:1.0", "info-2", PutOptions{IfRevision: rev + 100})
+        if conflict, ok := err.(*conflictError); !ok || conflict.CurrentRevision != rev {
+            t.Errorf("Put with stale revision returned %v, expected conflict at %d", err, rev)
+        }
+
+        _, err = store.Put("my-service:1.0", "info-2", PutOptions{IfRevision: rev})
+        if err != nil {
+            t.Errorf("Put with current revision failed: %v", err)
+        }
+
+        _, err = store.Put("other-service:1.0", "info", PutOptions{IfRevision: rev})
+        if conflict, ok := err.(*conflictError); !ok || conflict.CurrentRevision != 0 {
+            t.Errorf("Put with revision on missing key returned %v, expected conflict at 0", err)
+        }
+
+        kv, _, _ := store.Get("my-service:1.0")
+        if kv.Value != "info-2" {
+            t.Errorf("Get returned %s, expected info-2", kv.Value)
+        }
+    })
+}
+
+func TestStoreList(t *testing.T) {
+    testLocalStores(t, func(t *testing.T, store Store) {
+        for _, key := range []string{"a:1.0", "a:2.0", "b:1.0"} {
+            if _, err := store.Put(key, key + "-info", PutOptions{}); err != nil {
+                t.Fatalf("%v", err)
+            }
+        }
+
+        kvs, _, err := store.List("", ListOptions{})
+        if err != nil {
+            t.Fatalf("%v", err)
+        }
+        if len(kvs) != 3 {
+            t.Errorf("List all returned %d entries, expected 3", len(kvs))
+        }
+
+        kvs, _, err = store.List("a:", ListOptions{})
+        if err != nil {
+            t.Fatalf("%v", err)
+        }
+        if len(kvs) != 2 || kvs[0].Key != "a:1.0" || kvs[1].Value != "a:2.0-info" {
+            t.Errorf("List with prefix returned %v", kvs)
+        }
+    })
+}
+
+func TestListServiceInfoPages(t *testing.T) {
+    testLocalStores(t, func(t *testing.T, store Store) {
+        for _, key := range []string{"a:1.0", "a:2.0", "a:3.0", "b:1.0"} {
+            if _, err := store.Put(key, key + "-info", PutOptions{}); err != nil {
+                t.Fatalf("%v", err)
+            }
+        }
+
+        listed := []string{}
+        req := common.ListRequest{Prefix: "a:", Limit: 2}
+        for pages := 1; ; pages++ {
+            kvs, next, ok, err := listServiceInfo(store, req)
+            if err != nil || !ok {
+                t.Fatalf("Page %d returned ok=%v err=%v", pages, ok, err)
+            }
+            for _, kv := range kvs {
+                listed = append(listed, kv.Key)
+            }
+            if next == "" {
+                if pages != 2 {
+                    t.Errorf("Listed %d pages, expected 2", pages)
+                }
+                break
+            }
+            req.Continue = next
+        }
+
+        if strings.Join(listed, ",") != "a:1.0,a:2.0,a:3.0" {
+            t.Errorf("Pages listed %v, expected a:1.0, a:2.0 and a:3.0", listed)
+        }
+
+        _, _, ok, err := listServiceInfo(store, common.ListRequest{Prefix: "c:"})
+        if err != nil || ok {
+            t.Errorf("List of unknown prefix returned ok=%v err=%v", ok, err)
+        }
+    })
+}
+
+func TestGetServiceInfo(t *testing.T) {
+    testLocalStores(t, func(t *testing.T, store Store) {
+        for _, key := range []string{"a:1.0", "a:1.5", "a:2.0", "svc@host"} {
+            if _, err := store.Put(key, key + "-info", PutOptions{}); err != nil {
+                t.Fatalf("%v", err)
+            }
+        }
+
+        for query, expected := range map[string]string{
+            "a:1.0": "a:1.0",
+            "a@^1": "a:1.5",
+            "a@latest": "a:2.0",
+            "svc@host": "svc@host",
+        } {
+            kv, ok, err := getServiceInfo(store, query)
+            if err != nil || !ok || kv.Key != expected {
+                t.Errorf("Query %s returned %s ok=%v err=%v, expected %s", query, kv.Key, ok, err, expected)
+            }
+        }
+
+        if _, ok, err := getServiceInfo(store, "a@^3"); err != nil || ok {
+            t.Errorf("Unsatisfiable query returned ok=%v err=%v", ok, err)
+        }
+    })
+}
+
+func TestStoreDelete(t *testing.T) {
+    testLocalStores(t, func(t *testing.T, store Store) {
+        if _, err := store.Put("my-service:1.0", "info", PutOptions{}); err != nil {
+            t.Fatalf("%v", err)
+        }
+
+        deleted, err := store.Delete("my-service:1.0", DeleteOptions{})
+        if err != nil || deleted != 1 {
+            t.Errorf("Delete returned (%d, %v), expected (1, nil)", deleted, err)
+        }
+
+        deleted, err = store.Delete("my-service:1.0", DeleteOptions{})
+        if err != nil || deleted != 0 {
+            t.Errorf("Second delete returned (%d, %v), expected (0, nil)", deleted, err)
+        }
+
+        _, ok, err := store.Get("my-service:1.0")
+        if err != nil || ok {
+            t.Errorf("Get after delete returned ok=%v err=%v", ok, err)
+        }
+    })
+}
+
+func TestStoreHistory(t *testing.T) {
+    testLocalStores(t, func(t *testing.T, store Store) {
+        rev1, _ := store.Put("my-service:1.0", "info-1", PutOptions{})
+        store.Put("other-service:1.0", "other", PutOptions{})
+        rev2, _ := store.Put("my-service:1.0", "info-2", PutOptions{})
+        store.Delete("my-service:1.0", DeleteOptions{})
+        rev4, err := store.Put("my-service:1.0", "info-3", PutOptions{})
+        if err != nil {
+            t.Fatalf("%v", err)
+        }
+
+        versions, err := store.History("my-service:1.0", 0)
+        if err != nil {
+            t.Fatalf("%v", err)
+        }
+        described := []string{}
+        for _, v := range versions {
+            if v.Deleted {
+                described = append(described, "deleted")
+            } else {
+                described = append(described, v.Value)
+            }
+        }
+        if strings.Join(described, ",") != "info-3,deleted,info-2,info-1" {
+            t.Errorf("History returned %v, expected info-3, deleted, info-2 and info-1", described)
+        }
+        if versions[0].ModRevision != rev4 || versions[3].ModRevision != rev1 {
+            t.Errorf("History returned revisions %d..%d, expected %d..%d",
+                versions[0].ModRevision, versions[3].ModRevision, rev4, rev1)
+        }
+
+        versions, err = serviceHistory(store, common.HistoryRequest{Name: "my-service:1.0", Limit: 2})
+        if err != nil || len(versions) != 2 {
+            t.Errorf("History with limit 2 returned %d versions, err=%v", len(versions), err)
+        }
+
+        for _, test := range []struct {
+            rev int64
+            expected string
+        }{
+            {rev1, "info-1"},
+            {rev1 + 1, "info-1"},
+            {rev2, "info-2"},
+            {rev4 - 1, ""},
+            {rev4, "info-3"},
+        } {
+            kv, ok, err := store.GetAt("my-service:1.0", test.rev)
+            if err != nil || ok != (test.expected != "") || kv.Value != test.expected {
+                t.Errorf("GetAt revision %d returned (%s, %v, %v), expected %q",
+                    test.rev, kv.Value, ok, err, test.expected)
+            }
+        }
+
+        _, _, err = store.GetAt("my-service:1.0", rev4 + 1)
+        if _, ok := err.(*requestError); !ok {
+            t.Errorf("GetAt future revision returned %v, expected a requestError", err)
+        }
+    })
+}
+
+func TestStoreDeleteConditional(t *testing.T) {
+    testLocalStores(t, func(t *testing.T, store Store) {
+        rev, err := store.Put("my-service:1.0", "info", PutOptions{})
+        if err != nil {
+            t.Fatalf("%v", err)
+        }
+
+        _, err = store.Delete("my-service:1.0", DeleteOptions{IfRevision: rev + 1})
+        if conflict, ok := err.(*conflictError); !ok || conflict.CurrentRevision != rev {
+            t.Errorf("Delete at wrong revision returned %v, expected conflict at %d", err, rev)
+        }
+
+        deleted, err := store.Delete("my-service:1.0", DeleteOptions{IfRevision: rev})
+        if err != nil || deleted != 1 {
+            t.Errorf("Delete at current revision returned (%d, %v), expected (1, nil)", deleted, err)
+        }
+    })
+}
+
+func TestStoreLease(t *testing.T) {
+    testLocalStores(t, func(t *testing.T, store Store) {
+        if _, err := store.Put("leased:1.0", "info", PutOptions{TTL: 1}); err != nil {
+            t.Fatalf("%v", err)
+        }
+        if _, err := store.Put("permanent:1.0", "info", PutOptions{}); err != nil {
+            t.Fatalf("%v", err)
+        }
+
+        ttl, ok, err := store.Renew("leased:1.0")
+        if err != nil || !ok || ttl != 1 {
+            t.Errorf("Renew returned (%d, %v, %v), expected (1, true, nil)", ttl, ok, err)
+        }
+        _, ok, err = store.Renew("permanent:1.0")
+        if err != nil || ok {
+            t.Errorf("Renew without lease returned ok=%v err=%v", ok, err)
+        }
+
+        // Updating with KeepLease must not make the entry permanent
+        if _, err := store.Put("leased:1.0", "info-2", PutOptions{KeepLease: true}); err != nil {
+            t.Fatalf("%v", err)
+        }
+        if kv, _, _ := store.Get("leased:1.0"); kv.Lease == 0 {
+            t.Errorf("Lease dropped by put with KeepLease")
+        }
+
+        time.Sleep(2500 * time.Millisecond)
+
+        if _, ok, _ := store.Get("leased:1.0"); ok {
+            t.Errorf("Entry still exists after lease expired")
+        }
+        versions, err := store.History("leased:1.0", 0)
+        if err != nil || len(versions) != 3 || !versions[0].Deleted {
+            t.Errorf("History after lease expired is %v err=%v, expected the expiry as a delete", versions, err)
+        } else if _, ok, _ := store.GetAt("leased:1.0", versions[0].ModRevision); ok {
+            t.Errorf("Entry exists at the revision it expired at")
+        }
+        if _, ok, _ := store.Get("permanent:1.0"); !ok {
+            t.Errorf("Entry without lease was deleted")
+        }
+        _, ok, err = store.Renew("leased:1.0")
+        if err != nil || ok {
+            t.Errorf("Renew after expiry returned ok=%v err=%v", ok, err)
+        }
+    })
+}
+
+func TestStoreWatch(t *testing.T) {
+    testLocalStores(t, func(t *testing.T, store Store) {
+        ctx, cancel := context.WithCancel(context.Background())
+        defer cancel()
+
+        events, err := store.Watch(ctx, "a:", true)
+        if err != nil {
+            t.Fatalf("%v", err)
+        }
+
+        store.Put("a:1.0", "info-1", PutOptions{})
+        store.Put("b:1.0", "info-1", PutOptions{})
+        store.Put("a:1.0", "info-2", PutOptions{})
+        store.Delete("a:1.0", DeleteOptions{})
+
+        expected := []StoreEvent{
+            {Type: storeEventCreate, Key: "a:1.0", Value: "info-1"},
+            {Type: storeEventUpdate, Key: "a:1.0", Value: "info-2"},
+            {Type: storeEventDelete, Key: "a:1.0"},
+        }
+        for _, exp := range expected {
+            select {
+            case event := <-events:
+                if event != exp {
+                    t.Errorf("Got event %v, expected %v", event, exp)
+                }
+            case <-time.After(time.Second):
+                t.Fatalf("Timed out waiting for event %v", exp)
+            }
+        }
+
+        cancel()
+        select {
+        case _, ok := <-events:
+            if ok {
+                t.Errorf("Got unexpected event after cancelling watch")
+            }
+        case <-time.After(time.Second):
+            t.Errorf("Watch channel not closed after cancelling watch")
+        }
+    })
+}
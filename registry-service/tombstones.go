@@ -0,0 +1,107 @@
+/* Copyright 2020 PhysarumSM Development Team
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+// Deleted entries are kept as tombstones until purged, so they can be undeleted
+
+import (
+    "context"
+    "fmt"
+    "log"
+    "time"
+
+    "github.com/libp2p/go-libp2p-core/peer"
+
+    "github.com/PhysarumSM/service-registry/common"
+)
+
+// Longest time between purges of expired tombstones
+const maxTombstonePurgeInterval = time.Hour
+
+// Restore the deleted entry under key on behalf of requester, who must have owned it
+// ok is false if there is no tombstone of key
+// Returns *conflictError if an entry was added under key since it was deleted
+// record is appended to the audit log along with the undelete unless nil
+func undeleteEntry(store Store, acl *accessControl, requester peer.ID, key string, record *AuditRecord) (
+    rev int64, ok bool, err error) {
+
+    tombstone, exists, err := store.GetTombstone(key)
+    if err != nil || !exists {
+        return 0, false, err
+    }
+    _, err = checkOwner(acl, requester, key, tombstone.KeyValue, true)
+    if err != nil {
+        return 0, false, err
+    }
+
+    // Putting the entry removes its tombstone in the same write
+    // The lease is not kept, so the entry does not expire until added again with a TTL
+    // Only restore the tombstone whose owner was checked, not one left by a later add and delete
+    setAuditDigests(record, KeyValue{}, false, tombstone.Value, true)
+    opts := PutOptions{IfAbsent: true, IfTombstone: tombstone.ModRevision, Attrs: tombstone.Attrs, Audit: record}
+    rev, err = store.Put(key, tombstone.Value, opts)
+    if err != nil {
+        return 0, false, err
+    }
+    return rev, true, nil
+}
+
+// List a page of tombstones, see listServiceInfo
+func listTombstones(store Store, req common.ListRequest) (
+    tombstones []Tombstone, next string, queryOk bool, err error) {
+
+    if req.Limit < 0 {
+        return nil, "", false, &requestError{fmt.Errorf("Invalid limit %d", req.Limit)}
+    }
+
+    tombstones, more, err := store.ListTombstones(req.Prefix, ListOptions{Start: req.Continue, Limit: req.Limit})
+    if err != nil {
+        return nil, "", false, err
+    }
+
+    if more && len(tombstones) > 0 {
+        next = keyAfter(tombstones[len(tombstones) - 1].Key)
+    }
+    return tombstones, next, len(tombstones) > 0 || req.Continue != "", nil
+}
+
+// Remove tombstones older than purgeAfter until ctx is done
+// Tombstones are kept forever if purgeAfter is 0
+func purgeTombstones(ctx context.Context, store Store, purgeAfter time.Duration) {
+    if purgeAfter <= 0 {
+        return
+    }
+
+    interval := purgeAfter / 10
+    if interval > maxTombstonePurgeInterval {
+        interval = maxTombstonePurgeInterval
+    }
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <-ticker.C:
+            purged, err := store.PurgeTombstones(time.Now().Add(-purgeAfter))
+            if err != nil {
+                log.Println("Failed to purge deleted entries:", err)
+            } else if purged > 0 {
+                log.Printf("Purged %d deleted entries\n", purged)
+            }
+        case <-ctx.Done():
+            return
+        }
+    }
+}
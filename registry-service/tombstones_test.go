@@ -0,0 +1,128 @@
+/* Copyright 2020 PhysarumSM Development Team
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+    "testing"
+    "time"
+
+    "github.com/PhysarumSM/service-registry/common"
+)
+
+func TestStoreTombstones(t *testing.T) {
+    testLocalStores(t, func(t *testing.T, store Store) {
+        store.Put("my-service:1.0", "info-1", PutOptions{TTL: 60})
+        store.Put("my-service:2.0", "info-2", PutOptions{})
+        store.Put("other-service:1.0", "other", PutOptions{})
+        store.Delete("my-service:1.0", DeleteOptions{SoftDelete: true, Deleter: "deleter"})
+        store.Delete("my-service:2.0", DeleteOptions{SoftDelete: true, Deleter: "deleter"})
+        store.Delete("other-service:1.0", DeleteOptions{})
+
+        if _, ok, _ := store.Get("my-service:1.0"); ok {
+            t.Errorf("Soft deleted entry is still returned by Get")
+        }
+        tombstone, ok, err := store.GetTombstone("my-service:1.0")
+        if err != nil || !ok || tombstone.Value != "info-1" || tombstone.Deleter != "deleter" ||
+            tombstone.Lease != 0 || tombstone.DeletedAt.IsZero() {
+            t.Errorf("GetTombstone returned (%+v, %v, %v), expected info-1 deleted by deleter without a lease",
+                tombstone, ok, err)
+        }
+        if _, ok, _ := store.GetTombstone("other-service:1.0"); ok {
+            t.Errorf("Entry deleted without SoftDelete has a tombstone")
+        }
+
+        tombstones, more, err := store.ListTombstones("my-service:", ListOptions{Limit: 1})
+        if err != nil || len(tombstones) != 1 || !more || tombstones[0].Key != "my-service:1.0" {
+            t.Errorf("ListTombstones with limit 1 returned (%v, %v, %v), expected my-service:1.0 and more",
+                tombstones, more, err)
+        }
+
+        // Adding the entry again removes its tombstone
+        stale, _, _ := store.GetTombstone("my-service:2.0")
+        store.Put("my-service:2.0", "info-2", PutOptions{})
+        if _, ok, _ := store.GetTombstone("my-service:2.0"); ok {
+            t.Errorf("Tombstone is kept after the entry was added again")
+        }
+
+        // Puts conditional on a tombstone fail once it is replaced by a later delete
+        store.Delete("my-service:2.0", DeleteOptions{SoftDelete: true, Deleter: "other"})
+        _, err = store.Put("my-service:2.0", stale.Value, PutOptions{IfAbsent: true, IfTombstone: stale.ModRevision})
+        if _, ok := err.(*conflictError); !ok {
+            t.Errorf("Put with a replaced tombstone returned %v, expected conflictError", err)
+        }
+        current, _, _ := store.GetTombstone("my-service:2.0")
+        _, err = store.Put("my-service:2.0", current.Value, PutOptions{IfAbsent: true, IfTombstone: current.ModRevision})
+        if err != nil {
+            t.Errorf("Put with the current tombstone returned %v", err)
+        }
+
+        purged, err := store.PurgeTombstones(time.Now().Add(-time.Hour))
+        if err != nil || purged != 0 {
+            t.Errorf("PurgeTombstones of tombstones older than an hour returned (%d, %v), expected none", purged, err)
+        }
+        purged, err = store.PurgeTombstones(time.Now().Add(time.Minute))
+        if err != nil || purged != 1 {
+            t.Errorf("PurgeTombstones returned (%d, %v), expected 1 purged", purged, err)
+        }
+        if _, ok, _ := store.GetTombstone("my-service:1.0"); ok {
+            t.Errorf("Tombstone is kept after being purged")
+        }
+    })
+}
+
+func TestUndeleteEntry(t *testing.T) {
+    testLocalStores(t, func(t *testing.T, store Store) {
+        owner, other := testPeerID(t), testPeerID(t)
+        acl, _ := newAccessControl("", peerSet{})
+
+        ownedPut(store, acl, owner, "my-service:1.0", "info-1", PutOptions{})
+        _, _, err := ownedDelete(store, acl, owner, "my-service:1.0", nil)
+        if err != nil {
+            t.Fatalf("%v", err)
+        }
+
+        tombstones, _, ok, err := listTombstones(store, common.ListRequest{Prefix: "my-service:"})
+        if err != nil || !ok || len(tombstones) != 1 || tombstones[0].Deleter != owner.Pretty() {
+            t.Errorf("listTombstones returned (%v, %v, %v), expected my-service:1.0 deleted by its owner",
+                tombstones, ok, err)
+        }
+
+        _, _, err = undeleteEntry(store, acl, other, "my-service:1.0", nil)
+        if _, ok := err.(*forbiddenError); !ok {
+            t.Errorf("Undelete by other peer returned %v, expected forbiddenError", err)
+        }
+
+        rev, ok, err := undeleteEntry(store, acl, owner, "my-service:1.0", nil)
+        kv, _, _ := store.Get("my-service:1.0")
+        if err != nil || !ok || kv.Value != "info-1" || kv.ModRevision != rev || kv.Attrs.Owner != owner.Pretty() {
+            t.Errorf("Undelete returned (%d, %v, %v), left entry %+v, expected info-1 with its owner",
+                rev, ok, err, kv)
+        }
+
+        _, ok, err = undeleteEntry(store, acl, owner, "my-service:1.0", nil)
+        if err != nil || ok {
+            t.Errorf("Undelete of entry without a tombstone returned (%v, %v), expected not found", ok, err)
+        }
+
+        // Adding the entry again drops the tombstone, so it can't replace the new entry
+        ownedDelete(store, acl, owner, "my-service:1.0", nil)
+        store.Put("my-service:1.0", "new", PutOptions{})
+        _, ok, err = undeleteEntry(store, acl, owner, "my-service:1.0", nil)
+        kv, _, _ = store.Get("my-service:1.0")
+        if err != nil || ok || kv.Value != "new" {
+            t.Errorf("Undelete over a re-added entry returned (%v, %v), left value %s", ok, err, kv.Value)
+        }
+    })
+}
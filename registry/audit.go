@@ -0,0 +1,156 @@
+/* Copyright 2020 PhysarumSM Development Team
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package registry
+
+// Audit log of changes made to the registry, kept by registry-service
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "time"
+
+    "github.com/libp2p/go-libp2p-core/host"
+    "github.com/libp2p/go-libp2p-core/peer"
+    "github.com/libp2p/go-libp2p-core/pnet"
+    "github.com/libp2p/go-libp2p-core/protocol"
+    "github.com/libp2p/go-libp2p-discovery"
+
+    "github.com/multiformats/go-multiaddr"
+
+    "github.com/PhysarumSM/service-registry/common"
+)
+
+// Change made to the registry by Peer, through a request to Protocol
+type AuditRecord struct {
+    Time time.Time
+    Peer peer.ID
+    Protocol protocol.ID
+
+    // Name of the changed service, or of the registry-service instance added to the cluster
+    Name string
+
+    // SHA-256 digests of the service's info before and after the change, empty if it did not exist
+    OldDigest string
+    NewDigest string
+}
+
+// Option filtering the audit records returned
+type AuditOption func(req *common.AuditRequest) error
+
+// Only return records of changes to the service named serviceName
+func AuditService(serviceName string) AuditOption {
+    return func(req *common.AuditRequest) error {
+        req.Name = serviceName
+        return nil
+    }
+}
+
+// Only return records of changes requested by id
+func AuditPeer(id peer.ID) AuditOption {
+    return func(req *common.AuditRequest) error {
+        req.Peer = id.Pretty()
+        return nil
+    }
+}
+
+// Only return records from since up to but excluding until, either is ignored if zero
+func AuditBetween(since, until time.Time) AuditOption {
+    return func(req *common.AuditRequest) error {
+        if !since.IsZero() && !until.IsZero() && until.Before(since) {
+            return errors.New("registry: Audit range ends before it starts")
+        }
+        req.Since, req.Until = since, until
+        return nil
+    }
+}
+
+// Return at most limit records
+func AuditLimit(limit int64) AuditOption {
+    return func(req *common.AuditRequest) error {
+        if limit < 0 {
+            return errors.New("registry: Audit limit must not be negative")
+        }
+        req.Limit = limit
+        return nil
+    }
+}
+
+// Get the audit records of changes to the registry, newest first, filtered by opts
+// Adds, deletes, undeletes, rollbacks, ownership transfers and cluster member adds are recorded
+func (c *Client) Audit(ctx context.Context, opts ...AuditOption) (records []AuditRecord, err error) {
+    var reqInfo common.AuditRequest
+    for _, opt := range opts {
+        err = opt(&reqInfo)
+        if err != nil {
+            return nil, err
+        }
+    }
+    reqBytes, err := json.Marshal(reqInfo)
+    if err != nil {
+        return nil, err
+    }
+
+    response, err := c.send(ctx, common.AuditProtocolID, reqBytes)
+    if err != nil {
+        return nil, err
+    }
+
+    var respInfo common.AuditResponse
+    err = json.Unmarshal(response, &respInfo)
+    if err != nil {
+        return nil, err
+    }
+    err = statusError(respInfo.Status)
+    if err != nil {
+        return nil, err
+    }
+
+    records = []AuditRecord{}
+    for _, r := range respInfo.Records {
+        id, err := peer.IDB58Decode(r.Peer)
+        if err != nil {
+            return nil, err
+        }
+        records = append(records, AuditRecord{
+            Time: r.Time,
+            Peer: id,
+            Protocol: protocol.ID(r.Protocol),
+            Name: r.Name,
+            OldDigest: r.OldDigest,
+            NewDigest: r.NewDigest,
+        })
+    }
+    return records, nil
+}
+
+func GetAuditLog(bootstraps []multiaddr.Multiaddr, psk pnet.PSK, opts ...AuditOption) (
+    records []AuditRecord, err error) {
+
+    client, err := temporaryClient(bootstraps, psk, nil)
+    if err != nil {
+        return nil, err
+    }
+    defer client.Close()
+
+    return client.Audit(context.Background(), opts...)
+}
+
+func GetAuditLogWithHostRouting(
+    ctx context.Context, host host.Host, routingDiscovery *discovery.RoutingDiscovery,
+    opts ...AuditOption) (records []AuditRecord, err error) {
+
+    return hostRoutingClient(host, routingDiscovery).Audit(ctx, opts...)
+}
@@ -0,0 +1,220 @@
+/* Copyright 2020 PhysarumSM Development Team
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package registry
+
+// Read-through cache of Get results, enabled with WithCache
+
+import (
+    "context"
+    "errors"
+    "log"
+    "sync"
+    "time"
+
+    "github.com/prometheus/client_golang/prometheus"
+    "github.com/prometheus/client_golang/prometheus/promauto"
+
+    "github.com/PhysarumSM/service-registry/common"
+    "github.com/PhysarumSM/service-registry/common/semver"
+)
+
+var (
+    cacheHits = promauto.NewCounterVec(prometheus.CounterOpts{
+        Name: "registry_client_cache_hits_total",
+        Help: "Number of service lookups answered from the client-side cache",
+    }, []string{"result"})
+
+    cacheMisses = promauto.NewCounter(prometheus.CounterOpts{
+        Name: "registry_client_cache_misses_total",
+        Help: "Number of service lookups sent to registry-service because they were not cached",
+    })
+)
+
+type cacheEntry struct {
+    entry ServiceEntry
+
+    // Set for not found results
+    notFound bool
+
+    expires time.Time
+}
+
+// Cached results keyed by query
+type serviceCache struct {
+    ttl time.Duration
+    negativeTTL time.Duration
+
+    mutex sync.Mutex
+    entries map[string]cacheEntry
+
+    // Bumped by flush, and for each base name by invalidate, so a lookup can tell whether
+    // its result was invalidated while it was in flight
+    epoch uint64
+    generations map[string]uint64
+}
+
+func newServiceCache(ttl, negativeTTL time.Duration) *serviceCache {
+    return &serviceCache{
+        ttl: ttl,
+        negativeTTL: negativeTTL,
+        entries: make(map[string]cacheEntry),
+        generations: make(map[string]uint64),
+    }
+}
+
+// Changes whenever cached results of query are invalidated, taken before looking query up
+func (c *serviceCache) generation(query string) uint64 {
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+    return c.generationLocked(query)
+}
+
+// All counters only increase, so their sum changes whenever any of them does
+func (c *serviceCache) generationLocked(query string) uint64 {
+    base, _ := semver.SplitName(query)
+    generation := c.epoch + c.generations[base]
+    if queryBase, _, ok := semver.SplitQuery(query); ok && queryBase != base {
+        generation += c.generations[queryBase]
+    }
+    return generation
+}
+
+// Get cached result of query, ok is false if there is none
+// Returns ErrNotFound for cached not found results
+func (c *serviceCache) get(query string) (entry ServiceEntry, ok bool, err error) {
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+
+    cached, ok := c.entries[query]
+    if !ok || time.Now().After(cached.expires) {
+        delete(c.entries, query)
+        cacheMisses.Inc()
+        return entry, false, nil
+    }
+
+    if cached.notFound {
+        cacheHits.WithLabelValues("not_found").Inc()
+        return entry, true, &Error{Code: common.StatusNotFound, Message: "No service matching " + query}
+    }
+    cacheHits.WithLabelValues("found").Inc()
+    return cached.entry, true, nil
+}
+
+// Cache result of looking up query, if it should be cached
+// The result is dropped if query was invalidated since generation was taken
+func (c *serviceCache) put(query string, generation uint64, entry ServiceEntry, err error) {
+    cached := cacheEntry{entry: entry}
+    if errors.Is(err, ErrNotFound) {
+        if c.negativeTTL <= 0 {
+            return
+        }
+        cached.notFound = true
+        cached.expires = time.Now().Add(c.negativeTTL)
+    } else if err != nil {
+        return
+    } else {
+        cached.expires = time.Now().Add(c.ttl)
+    }
+
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+    if c.generationLocked(query) != generation {
+        return
+    }
+    c.entries[query] = cached
+}
+
+// Drop cached results that a change to the service called name could affect
+// That is queries for name itself, and version constraint queries on its base name
+func (c *serviceCache) invalidate(name string) {
+    base, _ := semver.SplitName(name)
+
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+
+    c.generations[base]++
+    for query := range c.entries {
+        if query == name {
+            delete(c.entries, query)
+        } else if queryBase, _, ok := semver.SplitQuery(query); ok && queryBase == base {
+            delete(c.entries, query)
+        }
+    }
+}
+
+func (c *serviceCache) flush() {
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+    c.entries = make(map[string]cacheEntry)
+    c.epoch++
+}
+
+// A watch that stays open this long is reconnected without backing off once it closes
+const cacheWatchStableAfter = 30 * time.Second
+
+// Watch all services, invalidating cached results as changes arrive, until ctx is cancelled
+func (c *Client) invalidateCache(ctx context.Context) {
+    attempt := 0
+    for ctx.Err() == nil {
+        // Back off after watches that failed or closed before proving they work
+        if attempt > 0 {
+            select {
+            case <-time.After(c.retryPolicy.Backoff(attempt)):
+            case <-ctx.Done():
+                return
+            }
+        }
+        attempt++
+
+        events, err := c.Watch(ctx, "", true)
+        if err != nil {
+            // Cached results still expire after their TTL while the watch is down
+            if ctx.Err() == nil {
+                log.Println("registry: Unable to watch for cache invalidation:", err)
+            }
+            continue
+        }
+
+        // Changes may have been missed while not watching
+        c.cache.flush()
+
+        opened := time.Now()
+        received := false
+        for event := range events {
+            received = true
+            c.cache.invalidate(event.Name)
+        }
+        if received || time.Since(opened) >= cacheWatchStableAfter {
+            attempt = 0
+        }
+    }
+}
+
+// Lookup through the cache, if enabled
+func (c *Client) cachedGetEntry(ctx context.Context, query string) (entry ServiceEntry, err error) {
+    if c.cache == nil {
+        return c.getEntry(ctx, query)
+    }
+
+    entry, ok, err := c.cache.get(query)
+    if ok {
+        return entry, err
+    }
+
+    generation := c.cache.generation(query)
+    entry, err = c.getEntry(ctx, query)
+    c.cache.put(query, generation, entry, err)
+    return entry, err
+}
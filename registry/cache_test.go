@@ -0,0 +1,102 @@
+/* Copyright 2020 PhysarumSM Development Team
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package registry
+
+import (
+    "errors"
+    "testing"
+    "time"
+
+    "github.com/PhysarumSM/service-registry/common"
+)
+
+func TestServiceCache(t *testing.T) {
+    cache := newServiceCache(time.Minute, time.Minute)
+    entry := ServiceEntry{Name: "my-service:1.2.0", Revision: 3}
+    notFound := &Error{Code: common.StatusNotFound}
+
+    cache.put("my-service:1.2.0", 0, entry, nil)
+    cache.put("my-service@^1.0", 0, entry, nil)
+    cache.put("other-service:1.0", 0, entry, nil)
+    cache.put("missing:1.0", 0, ServiceEntry{}, notFound)
+    cache.put("broken:1.0", 0, ServiceEntry{}, errors.New("unavailable"))
+
+    if cached, ok, err := cache.get("my-service@^1.0"); !ok || err != nil || cached != entry {
+        t.Errorf("get returned (%v, %v, %v), expected cached entry", cached, ok, err)
+    }
+    if _, ok, err := cache.get("missing:1.0"); !ok || !errors.Is(err, ErrNotFound) {
+        t.Errorf("get of not found result returned (%v, %v), expected ErrNotFound", ok, err)
+    }
+    if _, ok, _ := cache.get("broken:1.0"); ok {
+        t.Errorf("Failed lookup should not be cached")
+    }
+
+    // A new version of my-service may change what constraint queries resolve to
+    cache.invalidate("my-service:1.3.0")
+    if _, ok, _ := cache.get("my-service@^1.0"); ok {
+        t.Errorf("Constraint query still cached after invalidating a matching version")
+    }
+    if _, ok, _ := cache.get("my-service:1.2.0"); !ok {
+        t.Errorf("Unrelated version invalidated")
+    }
+    if _, ok, _ := cache.get("other-service:1.0"); !ok {
+        t.Errorf("Unrelated service invalidated")
+    }
+
+    cache.invalidate("my-service:1.2.0")
+    if _, ok, _ := cache.get("my-service:1.2.0"); ok {
+        t.Errorf("Entry still cached after invalidating it")
+    }
+}
+
+func TestServiceCacheInFlight(t *testing.T) {
+    cache := newServiceCache(time.Minute, time.Minute)
+    entry := ServiceEntry{Name: "my-service:1.2.0", Revision: 3}
+
+    // Results of lookups that were in flight when their query was invalidated are not cached
+    generation := cache.generation("my-service@^1.0")
+    other := cache.generation("other-service:1.0")
+    cache.invalidate("my-service:1.3.0")
+    cache.put("my-service@^1.0", generation, entry, nil)
+    cache.put("other-service:1.0", other, entry, nil)
+    if _, ok, _ := cache.get("my-service@^1.0"); ok {
+        t.Errorf("Result of lookup invalidated while in flight was cached")
+    }
+    if _, ok, _ := cache.get("other-service:1.0"); !ok {
+        t.Errorf("Result of unrelated lookup was not cached")
+    }
+
+    generation = cache.generation("my-service:1.2.0")
+    cache.flush()
+    cache.put("my-service:1.2.0", generation, entry, nil)
+    if _, ok, _ := cache.get("my-service:1.2.0"); ok {
+        t.Errorf("Result of lookup in flight during a flush was cached")
+    }
+}
+
+func TestServiceCacheExpiry(t *testing.T) {
+    cache := newServiceCache(time.Minute, 0)
+    cache.put("missing:1.0", 0, ServiceEntry{}, &Error{Code: common.StatusNotFound})
+    if _, ok, _ := cache.get("missing:1.0"); ok {
+        t.Errorf("Not found result cached with negative caching disabled")
+    }
+
+    cache = newServiceCache(time.Millisecond, 0)
+    cache.put("my-service:1.0", 0, ServiceEntry{Name: "my-service:1.0"}, nil)
+    time.Sleep(5 * time.Millisecond)
+    if _, ok, _ := cache.get("my-service:1.0"); ok {
+        t.Errorf("Entry still cached after its TTL")
+    }
+}
@@ -0,0 +1,284 @@
+/* Copyright 2020 PhysarumSM Development Team
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package registry
+
+import (
+    "context"
+    "encoding/json"
+    "log"
+    "time"
+
+    "github.com/libp2p/go-libp2p-core/crypto"
+    "github.com/libp2p/go-libp2p-core/host"
+    "github.com/libp2p/go-libp2p-core/pnet"
+    "github.com/libp2p/go-libp2p-core/protocol"
+    "github.com/libp2p/go-libp2p-discovery"
+
+    "github.com/multiformats/go-multiaddr"
+
+    "github.com/PhysarumSM/common/p2pnode"
+    "github.com/PhysarumSM/service-registry/common"
+)
+
+// Client for registry-service that reuses one libp2p host across requests
+// Meant for long-running programs, where creating a temporary node per request is too costly
+// Safe for concurrent use
+type Client struct {
+    host host.Host
+    routingDiscovery *discovery.RoutingDiscovery
+
+    // Set if the client created its own node, closed by Close()
+    node *p2pnode.Node
+
+    timeout time.Duration
+    retryPolicy common.RetryPolicy
+
+    // Set if caching is enabled with WithCache
+    cache *serviceCache
+    stopCache context.CancelFunc
+
+    // Set if WithSnapshot is given
+    snapshot *Snapshot
+
+    // Set if the client created its own node without WithPrivKey, so its peer ID
+    // only lasts until it is closed, and the entries it adds are left without an owner
+    unowned bool
+}
+
+type clientConfig struct {
+    bootstraps []multiaddr.Multiaddr
+    psk pnet.PSK
+    privKey crypto.PrivKey
+    host host.Host
+    routingDiscovery *discovery.RoutingDiscovery
+    timeout time.Duration
+    retryPolicy common.RetryPolicy
+    selector common.PeerSelector
+    cacheTTL time.Duration
+    negativeCacheTTL time.Duration
+    snapshot *Snapshot
+}
+
+type ClientOption func(conf *clientConfig)
+
+// Bootstrap addresses the client's node connects to
+// Ignored if WithHostRouting is given
+func WithBootstraps(bootstraps []multiaddr.Multiaddr) ClientOption {
+    return func(conf *clientConfig) {
+        conf.bootstraps = bootstraps
+    }
+}
+
+// PSK of the private network the client's node joins
+// Ignored if WithHostRouting is given
+func WithPSK(psk pnet.PSK) ClientOption {
+    return func(conf *clientConfig) {
+        conf.psk = psk
+    }
+}
+
+// Private key of the client's node, which identifies it as the owner of the entries it adds
+// If not given, a new key is generated and the client's adds and rollbacks don't record an owner,
+// leaving the entries modifiable by any peer
+// Ignored if WithHostRouting is given
+func WithPrivKey(priv crypto.PrivKey) ClientOption {
+    return func(conf *clientConfig) {
+        conf.privKey = priv
+    }
+}
+
+// Use an existing host and routing discovery instead of creating a new node
+func WithHostRouting(host host.Host, routingDiscovery *discovery.RoutingDiscovery) ClientOption {
+    return func(conf *clientConfig) {
+        conf.host = host
+        conf.routingDiscovery = routingDiscovery
+    }
+}
+
+// Limit how long each call may take, including retries
+// Does not apply to watches and keep alives, which run until their ctx is cancelled
+func WithTimeout(timeout time.Duration) ClientOption {
+    return func(conf *clientConfig) {
+        conf.timeout = timeout
+    }
+}
+
+// How to retry requests, common.DefaultRetryPolicy by default
+// Throttled requests are also retried up to the policy's Attempts, waiting as long as registry-service asks
+func WithRetryPolicy(policy common.RetryPolicy) ClientOption {
+    return func(conf *clientConfig) {
+        conf.retryPolicy = policy
+    }
+}
+
+// Order in which registry-service peers are tried, common.DefaultPeerSelector by default
+// Overrides the Selector of the retry policy
+func WithPeerSelector(selector common.PeerSelector) ClientOption {
+    return func(conf *clientConfig) {
+        conf.selector = selector
+    }
+}
+
+// Cache results of Get/GetEntry for up to ttl, and not found results for up to negativeTTL
+// Cached entries are also invalidated as soon as registry-service reports a change to them
+// Not found results are not cached if negativeTTL is 0
+func WithCache(ttl, negativeTTL time.Duration) ClientOption {
+    return func(conf *clientConfig) {
+        conf.cacheTTL = ttl
+        conf.negativeCacheTTL = negativeTTL
+    }
+}
+
+// Record results of Get/GetEntry/List, and of the client's own changes, in snapshot, and serve them from it when
+// registry-service can't be reached, see OpenSnapshot
+func WithSnapshot(snapshot *Snapshot) ClientOption {
+    return func(conf *clientConfig) {
+        conf.snapshot = snapshot
+    }
+}
+
+// Create client configured by opts
+// Unless WithHostRouting is given, a new libp2p node is created, living until
+// ctx is cancelled or Close() is called
+func NewClient(ctx context.Context, opts ...ClientOption) (*Client, error) {
+    conf := clientConfig{retryPolicy: common.DefaultRetryPolicy}
+    for _, opt := range opts {
+        opt(&conf)
+    }
+    if conf.selector != nil {
+        conf.retryPolicy.Selector = conf.selector
+    }
+
+    client := &Client{
+        host: conf.host,
+        routingDiscovery: conf.routingDiscovery,
+        timeout: conf.timeout,
+        retryPolicy: conf.retryPolicy,
+        snapshot: conf.snapshot,
+    }
+
+    if client.host == nil {
+        client.unowned = conf.privKey == nil
+        nodeConfig := p2pnode.NewConfig()
+        nodeConfig.BootstrapPeers = conf.bootstraps
+        nodeConfig.PSK = conf.psk
+        if conf.privKey != nil {
+            nodeConfig.PrivKey = conf.privKey
+        }
+        node, err := p2pnode.NewNode(ctx, nodeConfig)
+        if err != nil {
+            if node.Close != nil {
+                node.Close()
+            }
+            return nil, err
+        }
+
+        client.node = &node
+        client.host = node.Host
+        client.routingDiscovery = node.RoutingDiscovery
+    }
+
+    if conf.cacheTTL > 0 {
+        client.cache = newServiceCache(conf.cacheTTL, conf.negativeCacheTTL)
+        var cacheCtx context.Context
+        cacheCtx, client.stopCache = context.WithCancel(ctx)
+        go client.invalidateCache(cacheCtx)
+    }
+
+    return client, nil
+}
+
+// Client for the *WithHostRouting functions, cheap enough to create per call
+func hostRoutingClient(host host.Host, routingDiscovery *discovery.RoutingDiscovery) *Client {
+    return &Client{
+        host: host,
+        routingDiscovery: routingDiscovery,
+        retryPolicy: common.DefaultRetryPolicy,
+        snapshot: DefaultSnapshot,
+    }
+}
+
+// Client with its own temporary node for the *Service functions, must be closed after use
+// priv identifies the client as an entry's owner, see WithPrivKey, nil for a new key
+func temporaryClient(bootstraps []multiaddr.Multiaddr, psk pnet.PSK, priv crypto.PrivKey) (*Client, error) {
+    client, err := NewClient(context.Background(), WithBootstraps(bootstraps), WithPSK(psk),
+        WithPrivKey(priv), WithSnapshot(DefaultSnapshot))
+    if err != nil {
+        return nil, unavailableError(err)
+    }
+    return client, nil
+}
+
+// Close the client's node, if it created one, and flush its snapshot
+// Clients given an existing host with WithHostRouting leave it open
+func (c *Client) Close() {
+    if c.stopCache != nil {
+        c.stopCache()
+    }
+    if c.snapshot != nil {
+        err := c.snapshot.Flush()
+        if err != nil {
+            log.Println("registry: Unable to save snapshot:", err)
+        }
+    }
+    if c.node != nil {
+        c.node.Close()
+    }
+}
+
+// Apply the client's timeout to ctx
+func (c *Client) callContext(ctx context.Context) (context.Context, context.CancelFunc) {
+    if c.timeout > 0 {
+        return context.WithTimeout(ctx, c.timeout)
+    }
+    return context.WithCancel(ctx)
+}
+
+func (c *Client) send(ctx context.Context, protocolID protocol.ID, request []byte) (
+    response []byte, err error) {
+
+    ctx, cancel := c.callContext(ctx)
+    defer cancel()
+
+    for attempt := 1; ; attempt++ {
+        response, err = common.SendRequestWithPolicy(
+            ctx, c.host, c.routingDiscovery, c.retryPolicy, protocolID, request)
+        if err != nil {
+            return nil, unavailableError(err)
+        }
+
+        // Throttled requests were rejected before being handled, so even adds and deletes can be resent
+        var respInfo common.ErrorResponse
+        if json.Unmarshal(response, &respInfo) != nil || respInfo.Status.Code != common.StatusThrottled ||
+            attempt >= c.retryPolicy.Attempts {
+            return response, nil
+        }
+
+        backoff := respInfo.Status.RetryAfter
+        if backoff <= 0 {
+            backoff = c.retryPolicy.Backoff(attempt)
+        }
+        log.Println("registry: Request throttled, retrying in", backoff, "-", respInfo.Status.Message)
+
+        // Give up once ctx is done, returning the throttled response
+        timer := time.NewTimer(backoff)
+        select {
+        case <-timer.C:
+        case <-ctx.Done():
+            timer.Stop()
+            return response, nil
+        }
+    }
+}
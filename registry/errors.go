@@ -0,0 +1,88 @@
+/* Copyright 2020 PhysarumSM Development Team
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package registry
+
+import (
+    "errors"
+
+    "github.com/PhysarumSM/service-registry/common"
+)
+
+// Kinds of errors returned by this package, check for them with errors.Is
+var (
+    // Requested entry does not exist
+    ErrNotFound = errors.New("registry: not found")
+
+    // Conditions of a conditional request were not satisfied, see ConflictError
+    ErrConflict = errors.New("registry: conflict")
+
+    // Registry-service could not be reached, or could not reach its store
+    ErrUnavailable = errors.New("registry: unavailable")
+
+    // Registry-service rejected the request as malformed
+    ErrInvalidRequest = errors.New("registry: invalid request")
+
+    // Requesting peer is not allowed to make the request, eg. because another peer owns the entry
+    ErrForbidden = errors.New("registry: forbidden")
+
+    // Registry-service is busy, or the client has too many requests in progress, retry later
+    ErrThrottled = errors.New("registry: throttled")
+
+    // Entry is not signed by a trusted publisher, see VerifyPublishers
+    ErrUntrusted = errors.New("registry: untrusted")
+)
+
+var statusCodeToErr = map[common.StatusCode]error{
+    common.StatusNotFound: ErrNotFound,
+    common.StatusConflict: ErrConflict,
+    common.StatusUnavailable: ErrUnavailable,
+    common.StatusInvalidRequest: ErrInvalidRequest,
+    common.StatusForbidden: ErrForbidden,
+    common.StatusThrottled: ErrThrottled,
+}
+
+// Error for a request that registry-service failed, or that failed to reach registry-service
+type Error struct {
+    Code common.StatusCode
+    Message string
+
+    // Set if the request failed before registry-service could respond
+    Err error
+}
+
+func (e *Error) Error() string {
+    return "registry: " + e.Message
+}
+
+func (e *Error) Is(target error) bool {
+    return statusCodeToErr[e.Code] == target
+}
+
+func (e *Error) Unwrap() error {
+    return e.Err
+}
+
+// Returns nil if status is ok, otherwise an *Error describing it
+func statusError(status common.Status) error {
+    if status.Ok() {
+        return nil
+    }
+    return &Error{Code: status.Code, Message: status.Message}
+}
+
+// Wrap error from sending a request to registry-service
+func unavailableError(err error) error {
+    return &Error{Code: common.StatusUnavailable, Message: err.Error(), Err: err}
+}
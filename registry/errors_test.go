@@ -0,0 +1,78 @@
+/* Copyright 2020 PhysarumSM Development Team
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package registry
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "testing"
+
+    "github.com/PhysarumSM/service-registry/common"
+)
+
+func TestStatusErrors(t *testing.T) {
+    tests := map[common.StatusCode]error{
+        common.StatusNotFound: ErrNotFound,
+        common.StatusConflict: ErrConflict,
+        common.StatusUnavailable: ErrUnavailable,
+        common.StatusInvalidRequest: ErrInvalidRequest,
+        common.StatusForbidden: ErrForbidden,
+    }
+
+    for code, expected := range tests {
+        err := statusError(common.Status{Code: code, Message: "test"})
+        if !errors.Is(err, expected) {
+            t.Errorf("Status %s returned %v, expected %v", code, err, expected)
+        }
+    }
+
+    for _, code := range []common.StatusCode{common.StatusOK, ""} {
+        if err := statusError(common.Status{Code: code}); err != nil {
+            t.Errorf("Status %q returned %v, expected nil", code, err)
+        }
+    }
+
+    err := unavailableError(context.DeadlineExceeded)
+    if !errors.Is(err, ErrUnavailable) || !errors.Is(err, context.DeadlineExceeded) {
+        t.Errorf("unavailableError lost its kind or cause: %v", err)
+    }
+}
+
+func TestUnmarshalErrorResponse(t *testing.T) {
+    respBytes, _ := json.Marshal(common.ErrorResponse{
+        Status: common.Status{Code: common.StatusInvalidRequest, Message: "bad constraint"},
+    })
+
+    if _, err := unmarshalGetResponse(respBytes); !errors.Is(err, ErrInvalidRequest) {
+        t.Errorf("unmarshalGetResponse returned %v, expected ErrInvalidRequest", err)
+    }
+    if _, _, err := unmarshalListResponse(respBytes); !errors.Is(err, ErrInvalidRequest) {
+        t.Errorf("unmarshalListResponse returned %v, expected ErrInvalidRequest", err)
+    }
+    if _, err := unmarshalDeleteResponse(respBytes); !errors.Is(err, ErrInvalidRequest) {
+        t.Errorf("unmarshalDeleteResponse returned %v, expected ErrInvalidRequest", err)
+    }
+
+    respBytes, _ = json.Marshal(common.AddResponse{
+        Status: common.Status{Code: common.StatusConflict},
+        CurrentRevision: 5,
+    })
+    _, _, err := unmarshalAddResponse("my-service", respBytes)
+    var conflict *ConflictError
+    if !errors.Is(err, ErrConflict) || !errors.As(err, &conflict) || conflict.CurrentRevision != 5 {
+        t.Errorf("unmarshalAddResponse returned %v, expected conflict at revision 5", err)
+    }
+}
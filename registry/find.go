@@ -0,0 +1,109 @@
+/* Copyright 2020 PhysarumSM Development Team
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package registry
+
+// Finding the services an image belongs to, from registry-service's indexes of their hashes
+
+import (
+    "context"
+    "encoding/json"
+
+    "github.com/libp2p/go-libp2p-core/host"
+    "github.com/libp2p/go-libp2p-core/pnet"
+    "github.com/libp2p/go-libp2p-discovery"
+
+    "github.com/multiformats/go-multiaddr"
+
+    "github.com/PhysarumSM/service-registry/common"
+)
+
+// Find services whose ServiceInfo.ContentHash is contentHash, returning mapping from service name to entry
+// Returns ErrNotFound if there are none
+// Entries are only indexed by registry-service instances that support finding them, so services
+// added before they were upgraded are not found until added again
+func (c *Client) FindByContentHash(ctx context.Context, contentHash string, opts ...LookupOption) (
+    nameToEntry map[string]ServiceEntry, err error) {
+
+    return c.find(ctx, common.ContentHashIndex, contentHash, opts)
+}
+
+// Find services whose ServiceInfo.DockerHash is dockerHash, see FindByContentHash
+func (c *Client) FindByDockerHash(ctx context.Context, dockerHash string, opts ...LookupOption) (
+    nameToEntry map[string]ServiceEntry, err error) {
+
+    return c.find(ctx, common.DockerHashIndex, dockerHash, opts)
+}
+
+func (c *Client) find(ctx context.Context, index, value string, opts []LookupOption) (
+    nameToEntry map[string]ServiceEntry, err error) {
+
+    conf, err := newLookupConfig(opts)
+    if err != nil {
+        return nil, err
+    }
+
+    reqBytes, err := json.Marshal(common.FindRequest{Index: index, Value: value})
+    if err != nil {
+        return nil, err
+    }
+    response, err := c.send(ctx, common.FindProtocolID, reqBytes)
+    if err != nil {
+        return nil, err
+    }
+
+    nameToEntry, _, err = unmarshalListResponse(response)
+    if err != nil {
+        return nil, err
+    }
+    return conf.verifyAll(nameToEntry), nil
+}
+
+func FindByContentHash(bootstraps []multiaddr.Multiaddr, psk pnet.PSK, contentHash string, opts ...LookupOption) (
+    nameToEntry map[string]ServiceEntry, err error) {
+
+    client, err := temporaryClient(bootstraps, psk, nil)
+    if err != nil {
+        return nil, err
+    }
+    defer client.Close()
+
+    return client.FindByContentHash(context.Background(), contentHash, opts...)
+}
+
+func FindByContentHashWithHostRouting(
+    ctx context.Context, host host.Host, routingDiscovery *discovery.RoutingDiscovery,
+    contentHash string, opts ...LookupOption) (nameToEntry map[string]ServiceEntry, err error) {
+
+    return hostRoutingClient(host, routingDiscovery).FindByContentHash(ctx, contentHash, opts...)
+}
+
+func FindByDockerHash(bootstraps []multiaddr.Multiaddr, psk pnet.PSK, dockerHash string, opts ...LookupOption) (
+    nameToEntry map[string]ServiceEntry, err error) {
+
+    client, err := temporaryClient(bootstraps, psk, nil)
+    if err != nil {
+        return nil, err
+    }
+    defer client.Close()
+
+    return client.FindByDockerHash(context.Background(), dockerHash, opts...)
+}
+
+func FindByDockerHashWithHostRouting(
+    ctx context.Context, host host.Host, routingDiscovery *discovery.RoutingDiscovery,
+    dockerHash string, opts ...LookupOption) (nameToEntry map[string]ServiceEntry, err error) {
+
+    return hostRoutingClient(host, routingDiscovery).FindByDockerHash(ctx, dockerHash, opts...)
+}
@@ -0,0 +1,130 @@
+/* Copyright 2020 PhysarumSM Development Team
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package registry
+
+// Past versions of service entries, kept by registry-service
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+
+    "github.com/libp2p/go-libp2p-core/host"
+    "github.com/libp2p/go-libp2p-core/pnet"
+    "github.com/libp2p/go-libp2p-discovery"
+
+    "github.com/multiformats/go-multiaddr"
+
+    "github.com/PhysarumSM/service-registry/common"
+)
+
+// Version of a service entry, as it was added or deleted at Revision
+type EntryVersion struct {
+    ServiceEntry
+
+    // Set if the entry was deleted, only Name and Revision are then set
+    Deleted bool
+}
+
+// Get the entry as it was at revision rev instead of its latest version
+// Only applies to Get and GetEntry, which then need an exact service name rather than a constraint
+// Bypasses the client's cache and snapshot
+// Returns ErrNotFound if the entry did not exist at rev, and ErrInvalidRequest if rev is no longer kept
+func AtRevision(rev int64) LookupOption {
+    return func(conf *lookupConfig) error {
+        if rev <= 0 {
+            return errors.New("registry: Revision must be positive")
+        }
+        conf.revision = rev
+        return nil
+    }
+}
+
+func (c *Client) getEntryAt(ctx context.Context, serviceName string, rev int64) (entry ServiceEntry, err error) {
+    versions, err := c.history(ctx, common.HistoryRequest{Name: serviceName, Revision: rev})
+    if err != nil {
+        return entry, err
+    }
+    if len(versions) == 0 || versions[0].Deleted {
+        return entry, &Error{Code: common.StatusNotFound, Message: "Entry did not exist at that revision"}
+    }
+    return versions[0].ServiceEntry, nil
+}
+
+// Get the versions serviceName was added and deleted at, newest first, at most limit unless 0
+// Returns ErrNotFound if there are none
+// Lease expiry shows as a delete, services last added before registry-service kept history
+// only have their current version
+func (c *Client) History(ctx context.Context, serviceName string, limit int64) (
+    versions []EntryVersion, err error) {
+
+    return c.history(ctx, common.HistoryRequest{Name: serviceName, Limit: limit})
+}
+
+func (c *Client) history(ctx context.Context, req common.HistoryRequest) (versions []EntryVersion, err error) {
+    reqBytes, err := json.Marshal(req)
+    if err != nil {
+        return nil, err
+    }
+    response, err := c.send(ctx, common.HistoryProtocolID, reqBytes)
+    if err != nil {
+        return nil, err
+    }
+
+    var respInfo common.HistoryResponse
+    err = json.Unmarshal(response, &respInfo)
+    if err != nil {
+        return nil, err
+    }
+    err = statusError(respInfo.Status)
+    if err != nil {
+        return nil, err
+    }
+
+    versions = []EntryVersion{}
+    for _, v := range respInfo.Versions {
+        version := EntryVersion{
+            ServiceEntry: ServiceEntry{Name: req.Name, Revision: v.Meta.Revision},
+            Deleted: v.Deleted,
+        }
+        if !v.Deleted {
+            version.ServiceEntry, err = unmarshalEntry(req.Name, v.InfoStr, v.Meta)
+            if err != nil {
+                return nil, err
+            }
+        }
+        versions = append(versions, version)
+    }
+    return versions, nil
+}
+
+func GetServiceHistory(bootstraps []multiaddr.Multiaddr, psk pnet.PSK, serviceName string, limit int64) (
+    versions []EntryVersion, err error) {
+
+    client, err := temporaryClient(bootstraps, psk, nil)
+    if err != nil {
+        return nil, err
+    }
+    defer client.Close()
+
+    return client.History(context.Background(), serviceName, limit)
+}
+
+func GetServiceHistoryWithHostRouting(
+    ctx context.Context, host host.Host, routingDiscovery *discovery.RoutingDiscovery,
+    serviceName string, limit int64) (versions []EntryVersion, err error) {
+
+    return hostRoutingClient(host, routingDiscovery).History(ctx, serviceName, limit)
+}
@@ -0,0 +1,143 @@
+/* Copyright 2020 PhysarumSM Development Team
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package registry
+
+// Entries added with a TTL are deleted by registry-service unless renewed in time
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "log"
+    "time"
+
+    "github.com/libp2p/go-libp2p-core/host"
+    "github.com/libp2p/go-libp2p-core/pnet"
+    "github.com/libp2p/go-libp2p-discovery"
+
+    "github.com/multiformats/go-multiaddr"
+
+    "github.com/PhysarumSM/service-registry/common"
+)
+
+// Have registry-service delete the entry unless it is renewed within ttl
+// ttl is rounded up to the nearest second
+func WithTTL(ttl time.Duration) AddOption {
+    return func(req *common.AddRequest) error {
+        req.TTL = int64((ttl + time.Second - 1) / time.Second)
+        return nil
+    }
+}
+
+// Renew entry added with WithTTL, restarting its TTL
+// Returns the entry's TTL, or ErrNotFound if it does not exist or was added without a TTL
+func (c *Client) Renew(ctx context.Context, serviceName string) (ttl time.Duration, err error) {
+    response, err := c.send(ctx, common.RenewProtocolID, []byte(serviceName))
+    if err != nil {
+        return 0, err
+    }
+
+    return unmarshalRenewResponse(response)
+}
+
+func RenewService(bootstraps []multiaddr.Multiaddr, psk pnet.PSK, serviceName string) (
+    ttl time.Duration, err error) {
+
+    client, err := temporaryClient(bootstraps, psk, nil)
+    if err != nil {
+        return 0, err
+    }
+    defer client.Close()
+
+    return client.Renew(context.Background(), serviceName)
+}
+
+func RenewServiceWithHostRouting(
+    ctx context.Context, host host.Host, routingDiscovery *discovery.RoutingDiscovery, serviceName string) (
+    ttl time.Duration, err error) {
+
+    return hostRoutingClient(host, routingDiscovery).Renew(ctx, serviceName)
+}
+
+func unmarshalRenewResponse(renewResponse []byte) (ttl time.Duration, err error) {
+    var respInfo common.RenewResponse
+    err = json.Unmarshal(renewResponse, &respInfo)
+    if err != nil {
+        return 0, err
+    }
+
+    err = statusError(respInfo.Status)
+    if err != nil {
+        return 0, err
+    }
+
+    return time.Duration(respInfo.TTL) * time.Second, nil
+}
+
+// Keep entry added with WithTTL alive by periodically renewing it, until ctx is cancelled
+// Blocks until ctx is cancelled, returning ctx.Err(), or until the entry could not be
+// renewed before its TTL ran out, returning the error that caused it
+func (c *Client) KeepAlive(ctx context.Context, serviceName string) error {
+    ttl, err := c.Renew(ctx, serviceName)
+    if err != nil {
+        return err
+    }
+    lastRenewed := time.Now()
+
+    for {
+        // Renew well before the TTL runs out, leaving room for a few failed attempts
+        interval := ttl / 3
+        if interval < time.Second {
+            interval = time.Second
+        }
+
+        select {
+        case <-ctx.Done():
+            return ctx.Err()
+        case <-time.After(interval):
+        }
+
+        newTTL, err := c.Renew(ctx, serviceName)
+        if err != nil {
+            if ctx.Err() != nil {
+                return ctx.Err()
+            }
+            if errors.Is(err, ErrNotFound) || time.Since(lastRenewed) + interval >= ttl {
+                return err
+            }
+            log.Println("registry: Failed to renew", serviceName, "retrying:", err)
+            continue
+        }
+
+        ttl = newTTL
+        lastRenewed = time.Now()
+    }
+}
+
+func KeepAlive(ctx context.Context, bootstraps []multiaddr.Multiaddr, psk pnet.PSK, serviceName string) error {
+    client, err := NewClient(ctx, WithBootstraps(bootstraps), WithPSK(psk))
+    if err != nil {
+        return unavailableError(err)
+    }
+    defer client.Close()
+
+    return client.KeepAlive(ctx, serviceName)
+}
+
+func KeepAliveWithHostRouting(
+    ctx context.Context, host host.Host, routingDiscovery *discovery.RoutingDiscovery, serviceName string) error {
+
+    return hostRoutingClient(host, routingDiscovery).KeepAlive(ctx, serviceName)
+}
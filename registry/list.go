@@ -0,0 +1,145 @@
+/* Copyright 2020 PhysarumSM Development Team
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package registry
+
+// Listing services a page at a time, so large registries don't have to be sent in one response
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+
+    "github.com/libp2p/go-libp2p-core/host"
+    "github.com/libp2p/go-libp2p-core/pnet"
+    "github.com/libp2p/go-libp2p-discovery"
+
+    "github.com/multiformats/go-multiaddr"
+
+    "github.com/PhysarumSM/service-registry/common"
+)
+
+// Iterates over the pages of a list, see Client.ListPages
+//
+//     pages := client.ListPages(ctx, "my-service:", 100)
+//     defer pages.Close()
+//     for pages.Next() {
+//         for name, entry := range pages.Page() {
+//             ...
+//         }
+//     }
+//     if err := pages.Err(); err != nil {
+//         ...
+//     }
+type PageIterator struct {
+    client *Client
+    ctx context.Context
+    conf lookupConfig
+    req common.ListRequest
+
+    page map[string]ServiceEntry
+    done bool
+    err error
+
+    // Set if the iterator created the client, closed by Close()
+    ownsClient bool
+}
+
+// List services whose names begin with prefix, up to pageSize at a time
+// All services are listed if prefix is empty, in a single page if pageSize is 0
+// Older registry-service instances return all services in a single page
+func (c *Client) ListPages(ctx context.Context, prefix string, pageSize int64, opts ...LookupOption) *PageIterator {
+    conf, err := newLookupConfig(opts)
+    return &PageIterator{
+        client: c,
+        ctx: ctx,
+        conf: conf,
+        req: common.ListRequest{Prefix: prefix, Limit: pageSize},
+        done: err != nil,
+        err: err,
+    }
+}
+
+func ListServicePages(
+    bootstraps []multiaddr.Multiaddr, psk pnet.PSK, prefix string, pageSize int64,
+    opts ...LookupOption) *PageIterator {
+
+    client, err := temporaryClient(bootstraps, psk, nil)
+    if err != nil {
+        return &PageIterator{done: true, err: err}
+    }
+
+    pages := client.ListPages(context.Background(), prefix, pageSize, opts...)
+    pages.ownsClient = true
+    return pages
+}
+
+func ListServicePagesWithHostRouting(
+    ctx context.Context, host host.Host, routingDiscovery *discovery.RoutingDiscovery,
+    prefix string, pageSize int64, opts ...LookupOption) *PageIterator {
+
+    return hostRoutingClient(host, routingDiscovery).ListPages(ctx, prefix, pageSize, opts...)
+}
+
+// Fetch the next page, returning false once all pages were fetched or fetching one failed
+func (it *PageIterator) Next() bool {
+    if it.done {
+        return false
+    }
+
+    reqBytes, err := json.Marshal(it.req)
+    if err != nil {
+        it.done, it.err = true, err
+        return false
+    }
+    response, err := it.client.send(it.ctx, common.ListProtocolID, reqBytes)
+    if err != nil {
+        it.done, it.err = true, err
+        return false
+    }
+
+    nameToEntry, next, err := unmarshalListResponse(response)
+    if errors.Is(err, ErrNotFound) {
+        // No services to list, which is not an error when iterating over them
+        it.done = true
+        return false
+    }
+    if err != nil {
+        it.done, it.err = true, err
+        return false
+    }
+
+    it.page = it.conf.verifyAll(nameToEntry)
+    it.req.Continue = next
+    it.done = next == ""
+    return true
+}
+
+// Services of the page fetched by the last call to Next, mapping service name to entry
+// Entries failing verification with VerifyPublishers are left out
+func (it *PageIterator) Page() map[string]ServiceEntry {
+    return it.page
+}
+
+// Error that ended the iteration, nil if all pages were fetched
+func (it *PageIterator) Err() error {
+    return it.err
+}
+
+// Release the iterator's temporary node, if ListServicePages created one
+func (it *PageIterator) Close() {
+    if it.ownsClient {
+        it.client.Close()
+    }
+}
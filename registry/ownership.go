@@ -0,0 +1,94 @@
+/* Copyright 2020 PhysarumSM Development Team
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package registry
+
+// Entries are owned by the peer that added them
+// Only the owner, and registry-service admins, may update, delete or transfer an entry
+
+import (
+    "context"
+    "encoding/json"
+
+    "github.com/libp2p/go-libp2p-core/crypto"
+    "github.com/libp2p/go-libp2p-core/host"
+    "github.com/libp2p/go-libp2p-core/peer"
+    "github.com/libp2p/go-libp2p-core/pnet"
+    "github.com/libp2p/go-libp2p-discovery"
+
+    "github.com/multiformats/go-multiaddr"
+
+    "github.com/PhysarumSM/service-registry/common"
+)
+
+// Hand the entry over to the peer newOwner, which is then the only one besides admins allowed to modify it
+// Returns ErrForbidden if the client's peer neither owns the entry nor is an admin
+func (c *Client) TransferOwnership(ctx context.Context, serviceName string, newOwner peer.ID) (
+    transferResponse string, err error) {
+
+    reqBytes, err := json.Marshal(common.TransferOwnershipRequest{
+        Name: serviceName,
+        NewOwner: newOwner.Pretty(),
+    })
+    if err != nil {
+        return "", err
+    }
+
+    response, err := c.send(ctx, common.TransferOwnershipProtocolID, reqBytes)
+    if err != nil {
+        return "", err
+    }
+
+    if c.cache != nil {
+        c.cache.invalidate(serviceName)
+    }
+
+    return unmarshalTransferOwnershipResponse(response)
+}
+
+// priv is the key of the entry's owner or an admin, see WithPrivKey
+func TransferOwnership(
+    bootstraps []multiaddr.Multiaddr, psk pnet.PSK, priv crypto.PrivKey, serviceName string, newOwner peer.ID) (
+    transferResponse string, err error) {
+
+    client, err := temporaryClient(bootstraps, psk, priv)
+    if err != nil {
+        return "", err
+    }
+    defer client.Close()
+
+    return client.TransferOwnership(context.Background(), serviceName, newOwner)
+}
+
+func TransferOwnershipWithHostRouting(
+    ctx context.Context, host host.Host, routingDiscovery *discovery.RoutingDiscovery,
+    serviceName string, newOwner peer.ID) (transferResponse string, err error) {
+
+    return hostRoutingClient(host, routingDiscovery).TransferOwnership(ctx, serviceName, newOwner)
+}
+
+func unmarshalTransferOwnershipResponse(transferResponse []byte) (message string, err error) {
+    var respInfo common.TransferOwnershipResponse
+    err = json.Unmarshal(transferResponse, &respInfo)
+    if err != nil {
+        return "", err
+    }
+
+    err = statusError(respInfo.Status)
+    if err != nil {
+        return "", err
+    }
+
+    return respInfo.Status.Message, nil
+}
@@ -0,0 +1,115 @@
+/* Copyright 2020 PhysarumSM Development Team
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package registry
+
+// Finding services whose requirements a node can meet, filtered by registry-service
+
+import (
+    "context"
+    "encoding/json"
+    "time"
+
+    "github.com/libp2p/go-libp2p-core/host"
+    "github.com/libp2p/go-libp2p-core/pnet"
+    "github.com/libp2p/go-libp2p-discovery"
+
+    "github.com/multiformats/go-multiaddr"
+
+    "github.com/PhysarumSM/service-registry/common"
+)
+
+// Number of matching services fetched per request
+const queryPageSize = 500
+
+// Resources and network conditions of a node, which services must fit within to match
+// Zero fields are not checked
+type Query struct {
+    // Only match services whose names begin with Prefix
+    Prefix string
+
+    // CPU and memory available, in the units of ServiceInfo.CpuReq and MemoryReq
+    Cpu int
+    Memory int
+
+    // RTT between the node and its clients, which must not exceed a service's NetworkHardReq
+    RTT time.Duration
+
+    // Also require RTT to meet services' NetworkSoftReq
+    MeetSoftReq bool
+}
+
+// Find services that fit within query, returning mapping from service name to entry
+// Returns an empty map if no service matches
+// Requires registry-service instances that support the query protocol, older ones fail with ErrUnavailable
+func (c *Client) Query(ctx context.Context, query Query, opts ...LookupOption) (
+    nameToEntry map[string]ServiceEntry, err error) {
+
+    conf, err := newLookupConfig(opts)
+    if err != nil {
+        return nil, err
+    }
+
+    req := common.QueryRequest{
+        Prefix: query.Prefix,
+        Cpu: query.Cpu,
+        Memory: query.Memory,
+        RTT: query.RTT,
+        MeetSoftReq: query.MeetSoftReq,
+        Limit: queryPageSize,
+    }
+    nameToEntry = make(map[string]ServiceEntry)
+    for {
+        reqBytes, err := json.Marshal(req)
+        if err != nil {
+            return nil, err
+        }
+        response, err := c.send(ctx, common.QueryProtocolID, reqBytes)
+        if err != nil {
+            return nil, err
+        }
+
+        page, next, err := unmarshalListResponse(response)
+        if err != nil {
+            return nil, err
+        }
+        for name, entry := range conf.verifyAll(page) {
+            nameToEntry[name] = entry
+        }
+
+        if next == "" {
+            return nameToEntry, nil
+        }
+        req.Continue = next
+    }
+}
+
+func QueryServices(bootstraps []multiaddr.Multiaddr, psk pnet.PSK, query Query, opts ...LookupOption) (
+    nameToEntry map[string]ServiceEntry, err error) {
+
+    client, err := temporaryClient(bootstraps, psk, nil)
+    if err != nil {
+        return nil, err
+    }
+    defer client.Close()
+
+    return client.Query(context.Background(), query, opts...)
+}
+
+func QueryServicesWithHostRouting(
+    ctx context.Context, host host.Host, routingDiscovery *discovery.RoutingDiscovery,
+    query Query, opts ...LookupOption) (nameToEntry map[string]ServiceEntry, err error) {
+
+    return hostRoutingClient(host, routingDiscovery).Query(ctx, query, opts...)
+}
@@ -20,8 +20,12 @@ import (
     "context"
     "encoding/json"
     "errors"
+    "fmt"
+    "log"
 
+    "github.com/libp2p/go-libp2p-core/crypto"
     "github.com/libp2p/go-libp2p-core/host"
+    "github.com/libp2p/go-libp2p-core/peer"
     "github.com/libp2p/go-libp2p-core/pnet"
     "github.com/libp2p/go-libp2p-discovery"
 
@@ -43,170 +47,489 @@ type ServiceInfo struct {
     MemoryReq int
 }
 
+// Operations are methods of Client, see client.go
+// They are also available as free functions with 2 variants each:
 // Functions ending in *Service create a temporary p2p node to communicate with registry-service
 // Must pass in bootstrap addresses to connect to and optional PSK
 // Functions ending in *ServiceWithHostRouting take in an existing p2p node and routing discovery
 // to perform the operation without having to create that temporary p2p node
 
+// Option changing how an add is done, eg. making it conditional
+// Applied once the request's Name and InfoStr are set
+type AddOption func(req *common.AddRequest) error
+
+// Only add the service if no entry with the same name exists yet
+func IfAbsent() AddOption {
+    return func(req *common.AddRequest) error {
+        req.IfAbsent = true
+        return nil
+    }
+}
+
+// Only add the service if its entry was last modified at revision rev
+// Get the current revision with GetServiceEntry
+func IfRevision(rev int64) AddOption {
+    return func(req *common.AddRequest) error {
+        req.IfRevision = rev
+        return nil
+    }
+}
+
+// Send infoStr in place of the given ServiceInfo, eg. a ServiceEntry.InfoStr kept in a backup, so
+// the entry is added exactly as it was, including fields this version of ServiceInfo lacks
+// Must come before SignedBy, which signs the InfoStr sent
+func WithInfoStr(infoStr string) AddOption {
+    return func(req *common.AddRequest) error {
+        req.InfoStr = infoStr
+        return nil
+    }
+}
+
+// Leave the entry without an owner, for clients without a stable key
+func unowned(req *common.AddRequest) error {
+    req.Unowned = true
+    return nil
+}
+
+// Returned by AddService and RollbackService when the conditions given by their options are not satisfied
+type ConflictError struct {
+    Name string
+
+    // Revision the entry is currently at, 0 if it does not exist
+    CurrentRevision int64
+}
+
+func (e *ConflictError) Error() string {
+    if e.CurrentRevision == 0 {
+        return fmt.Sprintf("registry: Conflict updating %s, entry does not exist", e.Name)
+    }
+    return fmt.Sprintf("registry: Conflict updating %s, entry is at revision %d", e.Name, e.CurrentRevision)
+}
+
+func (e *ConflictError) Is(target error) bool {
+    return target == ErrConflict
+}
+
 // Add service info {serviceName, info} to registry-service
-func AddService(bootstraps []multiaddr.Multiaddr, psk pnet.PSK, serviceName string, info ServiceInfo) (
+// The client's peer becomes the owner of new entries, see TransferOwnership
+// Returns *ConflictError if the conditions given by opts are not satisfied
+// Returns ErrForbidden if the entry is owned by another peer
+func (c *Client) Add(ctx context.Context, serviceName string, info ServiceInfo, opts ...AddOption) (
     addResponse string, err error) {
 
-    reqBytes, err := marshalAddRequest(serviceName, info)
+    if c.unowned {
+        opts = append(opts[:len(opts):len(opts)], unowned)
+    }
+    reqBytes, err := marshalAddRequest(serviceName, info, opts)
     if err != nil {
         return "", err
     }
 
-    response, err := common.SendRequest(bootstraps, psk, common.AddProtocolID, reqBytes)
+    response, err := c.send(ctx, common.AddProtocolID, reqBytes)
     if err != nil {
         return "", err
     }
 
-    return string(response), nil
+    // Don't wait for the watch to report our own change
+    if c.cache != nil {
+        c.cache.invalidate(serviceName)
+    }
+
+    addResponse, rev, err := unmarshalAddResponse(serviceName, response)
+    if err == nil && c.snapshot != nil {
+        c.snapshotRevision(ctx, serviceName, rev)
+    }
+    return addResponse, err
 }
 
-func AddServiceWithHostRouting(
-    ctx context.Context, host host.Host, routingDiscovery *discovery.RoutingDiscovery,
-    serviceName string, info ServiceInfo) (addResponse string, err error) {
+// priv identifies the caller as the entry's owner, see WithPrivKey
+// If nil, the entry is left without an owner, and any peer may modify it
+func AddService(
+    bootstraps []multiaddr.Multiaddr, psk pnet.PSK, priv crypto.PrivKey, serviceName string, info ServiceInfo,
+    opts ...AddOption) (addResponse string, err error) {
 
-    reqBytes, err := marshalAddRequest(serviceName, info)
+    client, err := temporaryClient(bootstraps, psk, priv)
     if err != nil {
         return "", err
     }
+    defer client.Close()
 
-    data, err := common.SendRequestWithHostRouting(
-        ctx, host, routingDiscovery, common.AddProtocolID, reqBytes)
-    if err != nil {
-        return "", err
-    }
+    return client.Add(context.Background(), serviceName, info, opts...)
+}
 
-    return string(data), nil
+func AddServiceWithHostRouting(
+    ctx context.Context, host host.Host, routingDiscovery *discovery.RoutingDiscovery,
+    serviceName string, info ServiceInfo, opts ...AddOption) (addResponse string, err error) {
+
+    return hostRoutingClient(host, routingDiscovery).Add(ctx, serviceName, info, opts...)
 }
 
-func marshalAddRequest(serviceName string, info ServiceInfo) (addRequest []byte, err error) {
+func marshalAddRequest(serviceName string, info ServiceInfo, opts []AddOption) (
+    addRequest []byte, err error) {
+
     infoBytes, err := json.Marshal(info)
     if err != nil {
         return nil, err
     }
     reqInfo := common.AddRequest{Name: serviceName, InfoStr: string(infoBytes)}
+    for _, opt := range opts {
+        err = opt(&reqInfo)
+        if err != nil {
+            return nil, err
+        }
+    }
     return json.Marshal(reqInfo)
 }
 
+// rev is the revision the entry was added at, 0 if registry-service did not report it
+func unmarshalAddResponse(serviceName string, addResponse []byte) (message string, rev int64, err error) {
+    var respInfo common.AddResponse
+    err = json.Unmarshal(addResponse, &respInfo)
+    if err != nil {
+        // Older registry-service instances respond with a plain string
+        return string(addResponse), 0, nil
+    }
+
+    if respInfo.Status.Code == common.StatusConflict {
+        return "", 0, &ConflictError{Name: serviceName, CurrentRevision: respInfo.CurrentRevision}
+    }
+
+    err = statusError(respInfo.Status)
+    if err != nil {
+        return "", 0, err
+    }
+
+    return respInfo.Status.Message, respInfo.Revision, nil
+}
+
+// Service info along with the metadata registry-service keeps for it
+type ServiceEntry struct {
+    // Name the query resolved to
+    Name string
+    Info ServiceInfo
+
+    // Info exactly as stored by registry-service, including any fields this version of ServiceInfo lacks
+    InfoStr string `json:",omitempty"`
+
+    // Revision entry was last modified at, see IfRevision
+    Revision int64
+
+    // Publisher's signature, as checked by registry-service on add
+    // nil if the entry is unsigned, see SignedBy and VerifyPublishers
+    Signature *EntrySignature
+
+    // Peer allowed to modify the entry, see TransferOwnership
+    // Empty for entries added before registry-service recorded owners
+    Owner peer.ID `json:",omitempty"`
+}
+
 // Get service info from registry-service by searching for service with a name matching the given query
-func GetService(bootstraps []multiaddr.Multiaddr, psk pnet.PSK, query string) (
-    info ServiceInfo, err error) {
+// Query may also be <name>@<constraint>, eg. my-service@^1.2 or my-service@latest,
+// in which case registry-service picks the highest version <name>:<version> satisfying the constraint
+// If registry-service can't be reached and a snapshot is used, its result is returned along with *StaleError
+func (c *Client) Get(ctx context.Context, query string, opts ...LookupOption) (info ServiceInfo, err error) {
+    entry, err := c.GetEntry(ctx, query, opts...)
+    return entry.Info, err
+}
 
-    response, err := common.SendRequest(bootstraps, psk, common.GetProtocolID, []byte(query))
+// Same as Get, but also returns the name the query resolved to and the entry's metadata
+func (c *Client) GetEntry(ctx context.Context, query string, opts ...LookupOption) (
+    entry ServiceEntry, err error) {
+
+    conf, err := newLookupConfig(opts)
     if err != nil {
-        return info, err
+        return entry, err
+    }
+
+    if conf.revision != 0 {
+        entry, err = c.getEntryAt(ctx, query, conf.revision)
+        return verifiedEntry(conf, entry, err)
+    }
+
+    entry, err = c.cachedGetEntry(ctx, query)
+    if c.snapshot != nil {
+        entry, err = c.snapshot.getEntry(query, entry, err)
+    }
+    return verifiedEntry(conf, entry, err)
+}
+
+// Verify entry found by a lookup, keeping err if the entry is stale
+func verifiedEntry(conf lookupConfig, entry ServiceEntry, err error) (ServiceEntry, error) {
+    if err != nil && !errors.Is(err, ErrStale) {
+        return entry, err
+    }
+    verifyErr := conf.verify(entry)
+    if verifyErr != nil {
+        return ServiceEntry{}, verifyErr
+    }
+    return entry, err
+}
+
+func (c *Client) getEntry(ctx context.Context, query string) (entry ServiceEntry, err error) {
+    response, err := c.send(ctx, common.GetProtocolID, []byte(query))
+    if err != nil {
+        return entry, err
     }
 
     return unmarshalGetResponse(response)
 }
 
-func GetServiceWithHostRouting(
-    ctx context.Context, host host.Host, routingDiscovery *discovery.RoutingDiscovery, query string) (
+func GetService(bootstraps []multiaddr.Multiaddr, psk pnet.PSK, query string, opts ...LookupOption) (
     info ServiceInfo, err error) {
 
-    response, err := common.SendRequestWithHostRouting(
-        ctx, host, routingDiscovery, common.GetProtocolID, []byte(query))
+    entry, err := GetServiceEntry(bootstraps, psk, query, opts...)
+    return entry.Info, err
+}
+
+func GetServiceWithHostRouting(
+    ctx context.Context, host host.Host, routingDiscovery *discovery.RoutingDiscovery, query string,
+    opts ...LookupOption) (info ServiceInfo, err error) {
+
+    return hostRoutingClient(host, routingDiscovery).Get(ctx, query, opts...)
+}
+
+func GetServiceEntry(bootstraps []multiaddr.Multiaddr, psk pnet.PSK, query string, opts ...LookupOption) (
+    entry ServiceEntry, err error) {
+
+    client, err := temporaryClient(bootstraps, psk, nil)
     if err != nil {
-        return info, err
+        if DefaultSnapshot != nil {
+            conf, confErr := newLookupConfig(opts)
+            if confErr != nil {
+                return entry, confErr
+            }
+            // Snapshots only hold the latest version of entries
+            if conf.revision != 0 {
+                return entry, err
+            }
+            entry, err = DefaultSnapshot.getEntry(query, entry, err)
+            return verifiedEntry(conf, entry, err)
+        }
+        return entry, err
     }
+    defer client.Close()
 
-    return unmarshalGetResponse(response)
+    return client.GetEntry(context.Background(), query, opts...)
+}
+
+func GetServiceEntryWithHostRouting(
+    ctx context.Context, host host.Host, routingDiscovery *discovery.RoutingDiscovery, query string,
+    opts ...LookupOption) (entry ServiceEntry, err error) {
+
+    return hostRoutingClient(host, routingDiscovery).GetEntry(ctx, query, opts...)
 }
 
-func unmarshalGetResponse(getResponse []byte) (info ServiceInfo, err error) {
+func unmarshalGetResponse(getResponse []byte) (entry ServiceEntry, err error) {
     var respInfo common.GetResponse
     err = json.Unmarshal(getResponse, &respInfo)
     if err != nil {
-        return info, err
+        return entry, err
+    }
+
+    err = statusError(respInfo.Status)
+    if err != nil {
+        return entry, err
     }
 
+    // Older registry-service instances only set LookupOk
     if !respInfo.LookupOk {
-        return info, errors.New("registry: Error finding service info")
+        return entry, &Error{Code: common.StatusNotFound, Message: "Error finding service info"}
     }
 
-    err = json.Unmarshal([]byte(respInfo.InfoStr), &info)
+    return unmarshalEntry(respInfo.Name, respInfo.InfoStr, respInfo.Meta)
+}
+
+func unmarshalEntry(name, infoStr string, meta common.EntryMeta) (entry ServiceEntry, err error) {
+    err = json.Unmarshal([]byte(infoStr), &entry.Info)
     if err != nil {
-        return info, err
+        return entry, err
     }
 
-    return info, nil
+    entry.Name, entry.InfoStr = name, infoStr
+    entry.Revision = meta.Revision
+    if meta.Owner != "" {
+        entry.Owner, err = peer.IDB58Decode(meta.Owner)
+        if err != nil {
+            return entry, err
+        }
+    }
+    if len(meta.Signature) != 0 {
+        publisher, err := peer.IDB58Decode(meta.Publisher)
+        if err != nil {
+            return entry, err
+        }
+        entry.Signature = &EntrySignature{
+            Publisher: publisher,
+            InfoStr: infoStr,
+            PublicKey: meta.PublicKey,
+            Signature: meta.Signature,
+        }
+    }
+    return entry, nil
 }
 
 // List all services added to registry-service
 // Returns mapping from service name to service info
-func ListServices(bootstraps []multiaddr.Multiaddr, psk pnet.PSK) (
+// If registry-service can't be reached and a snapshot is used, its result is returned along with *StaleError
+func (c *Client) List(ctx context.Context, opts ...LookupOption) (
     nameToInfo map[string]ServiceInfo, err error) {
 
-    response, err := common.SendRequest(bootstraps, psk, common.ListProtocolID, []byte{})
+    nameToEntry, err := c.ListEntries(ctx, opts...)
+    return entriesToInfo(nameToEntry), err
+}
+
+// Same as List, but returns the metadata of each entry as well
+func (c *Client) ListEntries(ctx context.Context, opts ...LookupOption) (
+    nameToEntry map[string]ServiceEntry, err error) {
+
+    conf, err := newLookupConfig(opts)
     if err != nil {
         return nil, err
     }
 
-    return unmarshalListResponse(response)
+    nameToEntry, err = c.listEntries(ctx)
+    if c.snapshot != nil {
+        nameToEntry, err = c.snapshot.list(nameToEntry, err)
+    }
+    return conf.verifyAll(nameToEntry), err
 }
 
-func ListServicesWithHostRouting(
-    ctx context.Context, host host.Host, routingDiscovery *discovery.RoutingDiscovery) (
+func (c *Client) listEntries(ctx context.Context) (nameToEntry map[string]ServiceEntry, err error) {
+    response, err := c.send(ctx, common.ListProtocolID, []byte{})
+    if err != nil {
+        return nil, err
+    }
+
+    nameToEntry, _, err = unmarshalListResponse(response)
+    return nameToEntry, err
+}
+
+func entriesToInfo(nameToEntry map[string]ServiceEntry) (nameToInfo map[string]ServiceInfo) {
+    if nameToEntry == nil {
+        return nil
+    }
+    nameToInfo = make(map[string]ServiceInfo, len(nameToEntry))
+    for name, entry := range nameToEntry {
+        nameToInfo[name] = entry.Info
+    }
+    return nameToInfo
+}
+
+func ListServices(bootstraps []multiaddr.Multiaddr, psk pnet.PSK, opts ...LookupOption) (
     nameToInfo map[string]ServiceInfo, err error) {
 
-    response, err := common.SendRequestWithHostRouting(
-        ctx, host, routingDiscovery, common.ListProtocolID, []byte{})
+    client, err := temporaryClient(bootstraps, psk, nil)
     if err != nil {
+        if DefaultSnapshot != nil {
+            conf, confErr := newLookupConfig(opts)
+            if confErr != nil {
+                return nil, confErr
+            }
+            nameToEntry, err := DefaultSnapshot.list(nil, err)
+            return entriesToInfo(conf.verifyAll(nameToEntry)), err
+        }
         return nil, err
     }
+    defer client.Close()
 
-    return unmarshalListResponse(response)
+    return client.List(context.Background(), opts...)
 }
 
-func unmarshalListResponse(listResponse []byte) (nameToInfo map[string]ServiceInfo, err error) {
+func ListServicesWithHostRouting(
+    ctx context.Context, host host.Host, routingDiscovery *discovery.RoutingDiscovery,
+    opts ...LookupOption) (nameToInfo map[string]ServiceInfo, err error) {
+
+    return hostRoutingClient(host, routingDiscovery).List(ctx, opts...)
+}
+
+// next is where the following page starts, empty if there are no more entries
+func unmarshalListResponse(listResponse []byte) (
+    nameToEntry map[string]ServiceEntry, next string, err error) {
+
     var respInfo common.ListResponse
     err = json.Unmarshal(listResponse, &respInfo)
     if err != nil {
-        return nil, err
+        return nil, "", err
     }
 
+    err = statusError(respInfo.Status)
+    if err != nil {
+        return nil, "", err
+    }
+
+    // Older registry-service instances only set LookupOk
     if !respInfo.LookupOk {
-        return nil, errors.New("registry: Error finding service info")
+        return nil, "", &Error{Code: common.StatusNotFound, Message: "Error finding service info"}
     }
 
-    nameToInfo = make(map[string]ServiceInfo)
+    nameToEntry = make(map[string]ServiceEntry)
     for serviceName, infoStr := range respInfo.NameToInfoStr {
-        var info ServiceInfo
-        err = json.Unmarshal([]byte(infoStr), &info)
+        // NameToMeta is missing from older registry-service instances, leaving meta empty
+        entry, err := unmarshalEntry(serviceName, infoStr, respInfo.NameToMeta[serviceName])
         if err != nil {
-            return nil, err
+            // One bad entry should not hide all the others
+            log.Println("registry: Skipping", serviceName, "which could not be decoded:", err)
+            continue
         }
-        nameToInfo[serviceName] = info
+        nameToEntry[serviceName] = entry
     }
 
-    return nameToInfo, nil
+    return nameToEntry, respInfo.Continue, nil
 }
 
 // Delete service with given serviceName from registry-service
-func DeleteService(bootstraps []multiaddr.Multiaddr, psk pnet.PSK, serviceName string) (
+// Returns ErrNotFound if there is no such service
+// Returns ErrForbidden if the entry is owned by another peer
+func (c *Client) Delete(ctx context.Context, serviceName string) (deleteResponse string, err error) {
+    response, err := c.send(ctx, common.DeleteProtocolID, []byte(serviceName))
+    if err != nil {
+        return "", err
+    }
+
+    if c.cache != nil {
+        c.cache.invalidate(serviceName)
+    }
+
+    deleteResponse, err = unmarshalDeleteResponse(response)
+    if err == nil && c.snapshot != nil {
+        c.snapshot.forget(serviceName)
+    }
+    return deleteResponse, err
+}
+
+// priv is the key of the entry's owner or an admin, see WithPrivKey
+// Entries without an owner may be deleted with a nil key
+func DeleteService(bootstraps []multiaddr.Multiaddr, psk pnet.PSK, priv crypto.PrivKey, serviceName string) (
     deleteResponse string, err error) {
 
-    response, err := common.SendRequest(bootstraps, psk, common.DeleteProtocolID, []byte(serviceName))
+    client, err := temporaryClient(bootstraps, psk, priv)
     if err != nil {
         return "", err
     }
+    defer client.Close()
 
-    return string(response), nil
+    return client.Delete(context.Background(), serviceName)
 }
 
 func DeleteServiceWithHostRouting(
     ctx context.Context, host host.Host, routingDiscovery *discovery.RoutingDiscovery, serviceName string) (
     deleteResponse string, err error) {
 
-    response, err := common.SendRequestWithHostRouting(
-        ctx, host, routingDiscovery, common.DeleteProtocolID, []byte(serviceName))
+    return hostRoutingClient(host, routingDiscovery).Delete(ctx, serviceName)
+}
+
+func unmarshalDeleteResponse(deleteResponse []byte) (message string, err error) {
+    var respInfo common.DeleteResponse
+    err = json.Unmarshal(deleteResponse, &respInfo)
+    if err != nil {
+        // Older registry-service instances respond with a plain string
+        return string(deleteResponse), nil
+    }
+
+    err = statusError(respInfo.Status)
     if err != nil {
         return "", err
     }
 
-    return string(response), nil
+    return respInfo.Status.Message, nil
 }
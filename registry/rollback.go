@@ -0,0 +1,111 @@
+/* Copyright 2020 PhysarumSM Development Team
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package registry
+
+// Undoing bad updates by restoring earlier versions of entries, see History
+
+import (
+    "context"
+    "encoding/json"
+
+    "github.com/libp2p/go-libp2p-core/crypto"
+    "github.com/libp2p/go-libp2p-core/host"
+    "github.com/libp2p/go-libp2p-core/pnet"
+    "github.com/libp2p/go-libp2p-discovery"
+
+    "github.com/multiformats/go-multiaddr"
+
+    "github.com/PhysarumSM/service-registry/common"
+)
+
+// Option changing how a rollback is done
+type RollbackOption func(req *common.RollbackRequest) error
+
+// Only roll back if the entry is still at revision rev, eg. the revision of the bad version seen in its history
+// Keeps two peers rolling back the same entry at once from undoing each other's rollback
+func RollbackFrom(rev int64) RollbackOption {
+    return func(req *common.RollbackRequest) error {
+        req.IfRevision = rev
+        return nil
+    }
+}
+
+// Restore the version serviceName had at revision toRevision as its current value, in a single update
+// toRevision 0 restores the version before the current one, or the last version of a deleted service
+// Returns *ConflictError if the entry is not at the revision given with RollbackFrom,
+// ErrNotFound if there is no version to restore, and ErrForbidden if the entry is owned by another peer
+func (c *Client) Rollback(ctx context.Context, serviceName string, toRevision int64, opts ...RollbackOption) (
+    rollbackResponse string, err error) {
+
+    reqInfo := common.RollbackRequest{Name: serviceName, ToRevision: toRevision, Unowned: c.unowned}
+    for _, opt := range opts {
+        err = opt(&reqInfo)
+        if err != nil {
+            return "", err
+        }
+    }
+    reqBytes, err := json.Marshal(reqInfo)
+    if err != nil {
+        return "", err
+    }
+
+    response, err := c.send(ctx, common.RollbackProtocolID, reqBytes)
+    if err != nil {
+        return "", err
+    }
+
+    if c.cache != nil {
+        c.cache.invalidate(serviceName)
+    }
+
+    var respInfo common.RollbackResponse
+    err = json.Unmarshal(response, &respInfo)
+    if err != nil {
+        return "", err
+    }
+    if respInfo.Status.Code == common.StatusConflict {
+        return "", &ConflictError{Name: serviceName, CurrentRevision: respInfo.CurrentRevision}
+    }
+    err = statusError(respInfo.Status)
+    if err != nil {
+        return "", err
+    }
+
+    if c.snapshot != nil {
+        c.snapshotRevision(ctx, serviceName, respInfo.Revision)
+    }
+    return respInfo.Status.Message, nil
+}
+
+// priv is the key of the entry's owner or an admin, see DeleteService
+func RollbackService(
+    bootstraps []multiaddr.Multiaddr, psk pnet.PSK, priv crypto.PrivKey, serviceName string, toRevision int64,
+    opts ...RollbackOption) (rollbackResponse string, err error) {
+
+    client, err := temporaryClient(bootstraps, psk, priv)
+    if err != nil {
+        return "", err
+    }
+    defer client.Close()
+
+    return client.Rollback(context.Background(), serviceName, toRevision, opts...)
+}
+
+func RollbackServiceWithHostRouting(
+    ctx context.Context, host host.Host, routingDiscovery *discovery.RoutingDiscovery,
+    serviceName string, toRevision int64, opts ...RollbackOption) (rollbackResponse string, err error) {
+
+    return hostRoutingClient(host, routingDiscovery).Rollback(ctx, serviceName, toRevision, opts...)
+}
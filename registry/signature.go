@@ -0,0 +1,163 @@
+/* Copyright 2020 PhysarumSM Development Team
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package registry
+
+// Entries signed by their publisher, and verification of those signatures on lookup
+
+import (
+    "encoding/json"
+    "fmt"
+    "log"
+
+    "github.com/libp2p/go-libp2p-core/crypto"
+    "github.com/libp2p/go-libp2p-core/peer"
+
+    "github.com/PhysarumSM/service-registry/common"
+)
+
+// Sign the added entry with the publisher's private key, eg. one loaded with util.CreateOrLoadKey
+// Registry-service rejects the add if the signature does not hold
+func SignedBy(priv crypto.PrivKey) AddOption {
+    return func(req *common.AddRequest) error {
+        pubKey, signature, err := common.SignEntry(priv, req.Name, req.InfoStr)
+        if err != nil {
+            return err
+        }
+        req.PublicKey = pubKey
+        req.Signature = signature
+        return nil
+    }
+}
+
+// Add the entry with a signature made earlier, eg. one kept in a backup of the registry
+// The signed InfoStr is sent in place of the given ServiceInfo, since the signature only holds for it
+func WithSignature(sig EntrySignature) AddOption {
+    return func(req *common.AddRequest) error {
+        req.InfoStr = sig.InfoStr
+        req.PublicKey = sig.PublicKey
+        req.Signature = sig.Signature
+        return nil
+    }
+}
+
+// Publisher's signature over an entry, as stored by registry-service
+type EntrySignature struct {
+    // Peer ID of the publisher's key
+    Publisher peer.ID
+
+    // Serialized ServiceInfo exactly as it was signed
+    InfoStr string
+
+    PublicKey []byte
+    Signature []byte
+}
+
+// Returned by lookups with VerifyPublishers for entries not signed by a trusted publisher
+type UntrustedError struct {
+    Name string
+    Reason string
+}
+
+func (e *UntrustedError) Error() string {
+    return fmt.Sprintf("registry: Untrusted entry %s: %s", e.Name, e.Reason)
+}
+
+func (e *UntrustedError) Is(target error) bool {
+    return target == ErrUntrusted
+}
+
+type lookupConfig struct {
+    // Verify entries against these publishers if not nil
+    trusted map[peer.ID]bool
+
+    // Get the entry as it was at this revision if not 0, see AtRevision
+    revision int64
+}
+
+// Option changing how Get/GetEntry/List handle the entries they find
+type LookupOption func(conf *lookupConfig) error
+
+// Reject entries that are not signed by one of the given publisher keys
+// Get returns *UntrustedError for such entries, List leaves them out
+func VerifyPublishers(pubKeys ...crypto.PubKey) LookupOption {
+    return func(conf *lookupConfig) error {
+        if conf.trusted == nil {
+            conf.trusted = make(map[peer.ID]bool)
+        }
+        for _, pubKey := range pubKeys {
+            id, err := peer.IDFromPublicKey(pubKey)
+            if err != nil {
+                return err
+            }
+            conf.trusted[id] = true
+        }
+        return nil
+    }
+}
+
+func newLookupConfig(opts []LookupOption) (conf lookupConfig, err error) {
+    for _, opt := range opts {
+        err = opt(&conf)
+        if err != nil {
+            return conf, err
+        }
+    }
+    return conf, nil
+}
+
+// Check entry against the lookup's trusted publishers, if any
+func (conf lookupConfig) verify(entry ServiceEntry) error {
+    if conf.trusted == nil {
+        return nil
+    }
+
+    sig := entry.Signature
+    if sig == nil {
+        return &UntrustedError{Name: entry.Name, Reason: "entry is not signed"}
+    }
+    publisher, err := common.VerifyEntry(entry.Name, sig.InfoStr, sig.PublicKey, sig.Signature)
+    if err != nil {
+        return &UntrustedError{Name: entry.Name, Reason: err.Error()}
+    }
+    if !conf.trusted[publisher] {
+        return &UntrustedError{Name: entry.Name, Reason: "signed by untrusted publisher " + publisher.Pretty()}
+    }
+
+    // Info must be what was signed, not just come with a valid signature for something else
+    var signedInfo ServiceInfo
+    err = json.Unmarshal([]byte(sig.InfoStr), &signedInfo)
+    if err != nil || signedInfo != entry.Info {
+        return &UntrustedError{Name: entry.Name, Reason: "info does not match signature"}
+    }
+    return nil
+}
+
+// Leave out entries that fail verification
+func (conf lookupConfig) verifyAll(nameToEntry map[string]ServiceEntry) map[string]ServiceEntry {
+    if conf.trusted == nil {
+        return nameToEntry
+    }
+
+    verified := make(map[string]ServiceEntry, len(nameToEntry))
+    for name, entry := range nameToEntry {
+        err := conf.verify(entry)
+        if err != nil {
+            log.Println(err)
+            continue
+        }
+        verified[name] = entry
+    }
+    return verified
+}
@@ -0,0 +1,137 @@
+/* Copyright 2020 PhysarumSM Development Team
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package registry
+
+import (
+    "encoding/json"
+    "errors"
+    "testing"
+
+    "github.com/libp2p/go-libp2p-core/crypto"
+
+    "github.com/PhysarumSM/service-registry/common"
+)
+
+// Entry as a client would receive it after adding it with SignedBy(priv)
+func signedEntry(t *testing.T, priv crypto.PrivKey, name string, info ServiceInfo) ServiceEntry {
+    reqBytes, err := marshalAddRequest(name, info, []AddOption{SignedBy(priv)})
+    if err != nil {
+        t.Fatal(err)
+    }
+    var req common.AddRequest
+    err = json.Unmarshal(reqBytes, &req)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    publisher, err := common.VerifyEntry(req.Name, req.InfoStr, req.PublicKey, req.Signature)
+    if err != nil {
+        t.Fatalf("Signature made by SignedBy does not verify: %v", err)
+    }
+    meta := common.EntryMeta{
+        Publisher: publisher.Pretty(),
+        PublicKey: req.PublicKey,
+        Signature: req.Signature,
+    }
+    entry, err := unmarshalEntry(req.Name, req.InfoStr, meta)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return entry
+}
+
+func TestVerifyPublishers(t *testing.T) {
+    trusted, _, err := crypto.GenerateKeyPair(crypto.Ed25519, 0)
+    if err != nil {
+        t.Fatal(err)
+    }
+    untrusted, _, err := crypto.GenerateKeyPair(crypto.Ed25519, 0)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    conf, err := newLookupConfig([]LookupOption{VerifyPublishers(trusted.GetPublic())})
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    info := ServiceInfo{ContentHash: "abc"}
+    entry := signedEntry(t, trusted, "my-service:1.0", info)
+    if err := conf.verify(entry); err != nil {
+        t.Errorf("Entry signed by trusted publisher rejected: %v", err)
+    }
+
+    if err := conf.verify(signedEntry(t, untrusted, "my-service:1.0", info)); !errors.Is(err, ErrUntrusted) {
+        t.Errorf("Entry signed by untrusted publisher returned %v, expected ErrUntrusted", err)
+    }
+
+    unsigned := ServiceEntry{Name: "my-service:1.0", Info: info}
+    if err := conf.verify(unsigned); !errors.Is(err, ErrUntrusted) {
+        t.Errorf("Unsigned entry returned %v, expected ErrUntrusted", err)
+    }
+
+    // A signed entry can't be passed off under another name
+    renamed := entry
+    renamed.Name = "other-service:1.0"
+    if err := conf.verify(renamed); !errors.Is(err, ErrUntrusted) {
+        t.Errorf("Renamed entry returned %v, expected ErrUntrusted", err)
+    }
+
+    // Names with a newline could be split differently from how they were signed
+    pubKey, signature, err := common.SignEntry(trusted, "my-service\nx", "y")
+    if err == nil {
+        t.Errorf("Signed name containing a newline")
+    }
+    if _, err := common.VerifyEntry("my-service\nx", "y", pubKey, signature); err == nil {
+        t.Errorf("Verified name containing a newline")
+    }
+
+    verified := conf.verifyAll(map[string]ServiceEntry{entry.Name: entry, "unsigned": unsigned})
+    if _, ok := verified[entry.Name]; !ok || len(verified) != 1 {
+        t.Errorf("verifyAll returned %v, expected only the trusted entry", verified)
+    }
+
+    // Without VerifyPublishers, everything is accepted
+    if err := (lookupConfig{}).verify(unsigned); err != nil {
+        t.Errorf("Unsigned entry rejected without VerifyPublishers: %v", err)
+    }
+}
+
+func TestEntryJSON(t *testing.T) {
+    priv, _, err := crypto.GenerateKeyPair(crypto.Ed25519, 0)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    // Entries are persisted in snapshots, signed or not
+    for _, entry := range []ServiceEntry{
+        signedEntry(t, priv, "my-service:1.0", ServiceInfo{ContentHash: "abc"}),
+        {Name: "unsigned:1.0"},
+    } {
+        data, err := json.Marshal(entry)
+        if err != nil {
+            t.Fatal(err)
+        }
+        var decoded ServiceEntry
+        err = json.Unmarshal(data, &decoded)
+        if err != nil {
+            t.Fatalf("Unable to decode %s: %v", data, err)
+        }
+        if (decoded.Signature == nil) != (entry.Signature == nil) ||
+            (entry.Signature != nil && decoded.Signature.Publisher != entry.Signature.Publisher) {
+            t.Errorf("Decoded %v, expected %v", decoded, entry)
+        }
+    }
+}
@@ -0,0 +1,341 @@
+/* Copyright 2020 PhysarumSM Development Team
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package registry
+
+// On-disk snapshot of Get/List results, served when registry-service can't be reached
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io/ioutil"
+    "log"
+    "os"
+    "path/filepath"
+    "reflect"
+    "sync"
+    "time"
+)
+
+// Returned along with results served from a Snapshot, check for it with errors.Is
+var ErrStale = errors.New("registry: stale")
+
+// Returned along with results served from a Snapshot because registry-service could not be reached
+// Wraps the error of the failed lookup, so errors.Is(err, ErrUnavailable) also holds
+type StaleError struct {
+    // When the served result was fetched from registry-service
+    Fetched time.Time
+
+    Err error
+}
+
+func (e *StaleError) Error() string {
+    return fmt.Sprintf("registry: Serving stale result fetched at %s: %v",
+        e.Fetched.Format(time.RFC3339), e.Err)
+}
+
+func (e *StaleError) Is(target error) bool {
+    return target == ErrStale
+}
+
+func (e *StaleError) Unwrap() error {
+    return e.Err
+}
+
+// Should be set by programs that want the *Service and *ServiceWithHostRouting functions
+// to use a snapshot, nil by default
+var DefaultSnapshot *Snapshot
+
+// How long changes are batched before the snapshot file is rewritten
+const snapshotFlushDelay = time.Second
+
+type snapshotEntry struct {
+    Entry ServiceEntry
+    Fetched time.Time
+
+    // Fetched as last written to the file
+    saved time.Time
+}
+
+type snapshotList struct {
+    NameToEntry map[string]ServiceEntry
+    Fetched time.Time
+
+    saved time.Time
+}
+
+// Format of the snapshot file
+type snapshotFile struct {
+    // Get results keyed by query
+    Queries map[string]snapshotEntry
+    List *snapshotList
+}
+
+// Last successful Get/List results, persisted to a file so they survive restarts
+// Safe for concurrent use, and may be shared by several clients
+type Snapshot struct {
+    path string
+    maxAge time.Duration
+
+    mutex sync.Mutex
+    contents snapshotFile
+    // Whether contents changed since they were last written, and the pending write if so
+    dirty bool
+    flushTimer *time.Timer
+
+    // Serializes writes to the file, held without mutex so lookups aren't blocked on disk
+    saveMutex sync.Mutex
+}
+
+// Open snapshot kept in the file at path, which is created on the first successful lookup
+// Results older than maxAge are not served, no limit if 0
+func OpenSnapshot(path string, maxAge time.Duration) (*Snapshot, error) {
+    s := &Snapshot{
+        path: path,
+        maxAge: maxAge,
+        contents: snapshotFile{Queries: make(map[string]snapshotEntry)},
+    }
+
+    data, err := ioutil.ReadFile(path)
+    if os.IsNotExist(err) {
+        return s, nil
+    } else if err != nil {
+        return nil, err
+    }
+
+    err = json.Unmarshal(data, &s.contents)
+    if err != nil {
+        return nil, fmt.Errorf("registry: Invalid snapshot %s: %v", path, err)
+    }
+    if s.contents.Queries == nil {
+        s.contents.Queries = make(map[string]snapshotEntry)
+    }
+    for query, cached := range s.contents.Queries {
+        cached.saved = cached.Fetched
+        s.contents.Queries[query] = cached
+    }
+    if s.contents.List != nil {
+        s.contents.List.saved = s.contents.List.Fetched
+    }
+    return s, nil
+}
+
+// Record result of looking up query, or serve a stale result if registry-service could not be reached
+func (s *Snapshot) getEntry(query string, entry ServiceEntry, err error) (ServiceEntry, error) {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
+    if err == nil {
+        s.putQuery(query, entry)
+        return entry, nil
+    }
+
+    if errors.Is(err, ErrNotFound) {
+        if _, ok := s.contents.Queries[query]; ok {
+            delete(s.contents.Queries, query)
+            s.markDirty()
+        }
+        return entry, err
+    }
+
+    if !errors.Is(err, ErrUnavailable) {
+        return entry, err
+    }
+
+    if cached, ok := s.contents.Queries[query]; ok && s.fresh(cached.Fetched) {
+        return cached.Entry, &StaleError{Fetched: cached.Fetched, Err: err}
+    }
+    // Exact names may also be answered by the last list
+    if list := s.contents.List; list != nil && s.fresh(list.Fetched) {
+        if listed, ok := list.NameToEntry[query]; ok {
+            return listed, &StaleError{Fetched: list.Fetched, Err: err}
+        }
+    }
+    return entry, err
+}
+
+// Record result of listing services, or serve a stale result if registry-service could not be reached
+func (s *Snapshot) list(nameToEntry map[string]ServiceEntry, err error) (map[string]ServiceEntry, error) {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
+    if err == nil {
+        // Copied, as record and forget change the snapshot's list
+        copied := make(map[string]ServiceEntry, len(nameToEntry))
+        for name, entry := range nameToEntry {
+            copied[name] = entry
+        }
+
+        now := time.Now()
+        list := &snapshotList{NameToEntry: copied, Fetched: now, saved: now}
+        if old := s.contents.List; old != nil && reflect.DeepEqual(old.NameToEntry, nameToEntry) &&
+            !s.needsRefresh(old.saved) {
+            list.saved = old.saved
+        } else {
+            s.markDirty()
+        }
+        s.contents.List = list
+        return nameToEntry, nil
+    }
+
+    if !errors.Is(err, ErrUnavailable) {
+        return nameToEntry, err
+    }
+
+    if list := s.contents.List; list != nil && s.fresh(list.Fetched) {
+        stale := make(map[string]ServiceEntry, len(list.NameToEntry))
+        for name, entry := range list.NameToEntry {
+            stale[name] = entry
+        }
+        return stale, &StaleError{Fetched: list.Fetched, Err: err}
+    }
+    return nameToEntry, err
+}
+
+// Record entry as the current version of its service, after it was added, rolled back or undeleted
+func (s *Snapshot) record(entry ServiceEntry) {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
+    s.putQuery(entry.Name, entry)
+    if list := s.contents.List; list != nil && !reflect.DeepEqual(list.NameToEntry[entry.Name], entry) {
+        list.NameToEntry[entry.Name] = entry
+        s.markDirty()
+    }
+}
+
+// Record the entry serviceName has after the client changed it to revision rev
+// Entries that can't be fetched are forgotten rather than left at their old version
+func (c *Client) snapshotRevision(ctx context.Context, serviceName string, rev int64) {
+    // Older registry-service instances don't report the revision
+    if rev == 0 {
+        c.snapshot.forget(serviceName)
+        return
+    }
+
+    entry, err := c.getEntryAt(ctx, serviceName, rev)
+    if err != nil {
+        log.Println("registry: Unable to record", serviceName, "in snapshot:", err)
+        c.snapshot.forget(serviceName)
+        return
+    }
+    c.snapshot.record(entry)
+}
+
+// Forget results for a deleted service
+func (s *Snapshot) forget(name string) {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
+    if _, ok := s.contents.Queries[name]; ok {
+        delete(s.contents.Queries, name)
+        s.markDirty()
+    }
+    if list := s.contents.List; list != nil {
+        if _, ok := list.NameToEntry[name]; ok {
+            delete(list.NameToEntry, name)
+            s.markDirty()
+        }
+    }
+}
+
+func (s *Snapshot) fresh(fetched time.Time) bool {
+    return s.maxAge <= 0 || time.Since(fetched) <= s.maxAge
+}
+
+// Whether an unchanged result last written at saved should be written again, so its
+// fetch time on disk doesn't pass maxAge while it is still being fetched
+func (s *Snapshot) needsRefresh(saved time.Time) bool {
+    return s.maxAge > 0 && time.Since(saved) > s.maxAge / 2
+}
+
+// Record successful result of looking up query, must hold mutex
+// The file is only rewritten if the result changed, or needs a refresh
+func (s *Snapshot) putQuery(query string, entry ServiceEntry) {
+    now := time.Now()
+    updated := snapshotEntry{Entry: entry, Fetched: now, saved: now}
+    if cached, ok := s.contents.Queries[query]; ok && reflect.DeepEqual(cached.Entry, entry) &&
+        !s.needsRefresh(cached.saved) {
+        updated.saved = cached.saved
+    } else {
+        s.markDirty()
+    }
+    s.contents.Queries[query] = updated
+}
+
+// Schedule writing contents to the file, must hold mutex
+// Changes within snapshotFlushDelay are written together
+func (s *Snapshot) markDirty() {
+    s.dirty = true
+    if s.flushTimer == nil {
+        s.flushTimer = time.AfterFunc(snapshotFlushDelay, func() {
+            err := s.Flush()
+            if err != nil {
+                log.Println("registry: Unable to save snapshot:", err)
+            }
+        })
+    }
+}
+
+// Write changes to the snapshot file now rather than after a delay
+// Clients using the snapshot flush it when closed, other programs should flush it before exiting
+func (s *Snapshot) Flush() error {
+    s.saveMutex.Lock()
+    defer s.saveMutex.Unlock()
+
+    s.mutex.Lock()
+    if s.flushTimer != nil {
+        s.flushTimer.Stop()
+        s.flushTimer = nil
+    }
+    if !s.dirty {
+        s.mutex.Unlock()
+        return nil
+    }
+    data, err := json.Marshal(s.contents)
+    s.dirty = false
+    s.mutex.Unlock()
+
+    if err == nil {
+        err = writeSnapshotFile(s.path, data)
+    }
+    if err != nil {
+        // Written along with the next change
+        s.mutex.Lock()
+        s.dirty = true
+        s.mutex.Unlock()
+    }
+    return err
+}
+
+// Write to a temporary file first so a crash can't leave a partial snapshot behind
+func writeSnapshotFile(path string, data []byte) error {
+    tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path) + ".tmp")
+    if err != nil {
+        return err
+    }
+    _, err = tmp.Write(data)
+    if closeErr := tmp.Close(); err == nil {
+        err = closeErr
+    }
+    if err == nil {
+        err = os.Rename(tmp.Name(), path)
+    }
+    if err != nil {
+        os.Remove(tmp.Name())
+    }
+    return err
+}
@@ -0,0 +1,163 @@
+/* Copyright 2020 PhysarumSM Development Team
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package registry
+
+import (
+    "errors"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+
+    "github.com/PhysarumSM/service-registry/common"
+)
+
+func TestSnapshot(t *testing.T) {
+    dir, err := ioutil.TempDir("", "registry-snapshot")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    path := filepath.Join(dir, "snapshot.json")
+
+    snapshot, err := OpenSnapshot(path, time.Hour)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    entry := ServiceEntry{Name: "my-service:1.2.0", Info: ServiceInfo{ContentHash: "abc"}, Revision: 3}
+    snapshot.getEntry("my-service@^1.0", entry, nil)
+    snapshot.list(map[string]ServiceEntry{
+        "other-service": {Name: "other-service", Info: ServiceInfo{ContentHash: "def"}},
+    }, nil)
+    err = snapshot.Flush()
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    // Results must survive reopening the snapshot
+    snapshot, err = OpenSnapshot(path, time.Hour)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    unavailable := unavailableError(errors.New("no peers"))
+    stale, err := snapshot.getEntry("my-service@^1.0", ServiceEntry{}, unavailable)
+    if !errors.Is(err, ErrStale) || !errors.Is(err, ErrUnavailable) {
+        t.Errorf("Expected stale error wrapping ErrUnavailable, got %v", err)
+    }
+    if stale != entry {
+        t.Errorf("Expected stale entry %v, got %v", entry, stale)
+    }
+
+    stale, err = snapshot.getEntry("other-service", ServiceEntry{}, unavailable)
+    if !errors.Is(err, ErrStale) || stale.Info.ContentHash != "def" {
+        t.Errorf("Expected stale entry from list, got (%v, %v)", stale, err)
+    }
+
+    nameToInfo, err := snapshot.list(nil, unavailable)
+    if !errors.Is(err, ErrStale) || len(nameToInfo) != 1 {
+        t.Errorf("Expected stale list, got (%v, %v)", nameToInfo, err)
+    }
+
+    // Only unavailability is answered from the snapshot
+    notFound := &Error{Code: common.StatusNotFound}
+    _, err = snapshot.getEntry("my-service@^1.0", ServiceEntry{}, notFound)
+    if errors.Is(err, ErrStale) {
+        t.Errorf("Not found result answered from snapshot")
+    }
+    _, err = snapshot.getEntry("my-service@^1.0", ServiceEntry{}, unavailable)
+    if errors.Is(err, ErrStale) {
+        t.Errorf("Query still in snapshot after it was not found")
+    }
+
+    snapshot.forget("other-service")
+    _, err = snapshot.getEntry("other-service", ServiceEntry{}, unavailable)
+    if errors.Is(err, ErrStale) {
+        t.Errorf("Deleted service still in snapshot")
+    }
+}
+
+func TestSnapshotMaxAge(t *testing.T) {
+    dir, err := ioutil.TempDir("", "registry-snapshot")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+
+    snapshot, err := OpenSnapshot(filepath.Join(dir, "snapshot.json"), time.Millisecond)
+    if err != nil {
+        t.Fatal(err)
+    }
+    snapshot.getEntry("my-service", ServiceEntry{Name: "my-service"}, nil)
+    time.Sleep(5 * time.Millisecond)
+
+    _, err = snapshot.getEntry("my-service", ServiceEntry{}, unavailableError(errors.New("no peers")))
+    if errors.Is(err, ErrStale) || !errors.Is(err, ErrUnavailable) {
+        t.Errorf("Expected entry older than max age to be refused, got %v", err)
+    }
+}
+
+func TestSnapshotWrites(t *testing.T) {
+    dir, err := ioutil.TempDir("", "registry-snapshot")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    path := filepath.Join(dir, "snapshot.json")
+
+    snapshot, err := OpenSnapshot(path, time.Hour)
+    if err != nil {
+        t.Fatal(err)
+    }
+    entry := ServiceEntry{Name: "my-service", Info: ServiceInfo{ContentHash: "abc"}, Revision: 3}
+    snapshot.getEntry("my-service", entry, nil)
+    if !snapshot.dirty {
+        t.Fatalf("New result not scheduled to be written")
+    }
+    err = snapshot.Flush()
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    // Repeating a lookup with the same result doesn't rewrite the file
+    snapshot.getEntry("my-service", entry, nil)
+    if snapshot.dirty {
+        t.Errorf("Unchanged result scheduled to be written")
+    }
+
+    // Changes made by the client are recorded
+    updated := entry
+    updated.Info.ContentHash = "def"
+    updated.Revision = 4
+    snapshot.record(updated)
+    if !snapshot.dirty {
+        t.Errorf("Recorded change not scheduled to be written")
+    }
+    err = snapshot.Flush()
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    snapshot, err = OpenSnapshot(path, time.Hour)
+    if err != nil {
+        t.Fatal(err)
+    }
+    stale, err := snapshot.getEntry("my-service", ServiceEntry{}, unavailableError(errors.New("no peers")))
+    if !errors.Is(err, ErrStale) || stale != updated {
+        t.Errorf("Expected recorded entry %v, got (%v, %v)", updated, stale, err)
+    }
+}
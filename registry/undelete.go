@@ -0,0 +1,189 @@
+/* Copyright 2020 PhysarumSM Development Team
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package registry
+
+// Restoring deleted services, which registry-service keeps until its purge window passes
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "time"
+
+    "github.com/libp2p/go-libp2p-core/crypto"
+    "github.com/libp2p/go-libp2p-core/host"
+    "github.com/libp2p/go-libp2p-core/peer"
+    "github.com/libp2p/go-libp2p-core/pnet"
+    "github.com/libp2p/go-libp2p-discovery"
+
+    "github.com/multiformats/go-multiaddr"
+
+    "github.com/PhysarumSM/service-registry/common"
+)
+
+// Number of deleted services fetched per request by ListDeleted
+const deletedPageSize = 500
+
+// Service entry as it was when deleted
+type DeletedEntry struct {
+    ServiceEntry
+
+    // Peer that deleted the entry
+    DeletedBy peer.ID
+    DeletedAt time.Time
+}
+
+// Restore the deleted service serviceName as it was when deleted
+// Returns ErrNotFound if it was not deleted or was already purged, ErrForbidden if it was owned by another peer,
+// and *ConflictError if a service was added under the same name since
+func (c *Client) Undelete(ctx context.Context, serviceName string) (undeleteResponse string, err error) {
+    response, err := c.send(ctx, common.UndeleteProtocolID, []byte(serviceName))
+    if err != nil {
+        return "", err
+    }
+
+    if c.cache != nil {
+        c.cache.invalidate(serviceName)
+    }
+
+    var respInfo common.UndeleteResponse
+    err = json.Unmarshal(response, &respInfo)
+    if err != nil {
+        return "", err
+    }
+    if respInfo.Status.Code == common.StatusConflict {
+        return "", &ConflictError{Name: serviceName, CurrentRevision: respInfo.CurrentRevision}
+    }
+    err = statusError(respInfo.Status)
+    if err != nil {
+        return "", err
+    }
+
+    if c.snapshot != nil {
+        c.snapshotRevision(ctx, serviceName, respInfo.Revision)
+    }
+    return respInfo.Status.Message, nil
+}
+
+// priv is the key of the entry's owner or an admin, see DeleteService
+func UndeleteService(bootstraps []multiaddr.Multiaddr, psk pnet.PSK, priv crypto.PrivKey, serviceName string) (
+    undeleteResponse string, err error) {
+
+    client, err := temporaryClient(bootstraps, psk, priv)
+    if err != nil {
+        return "", err
+    }
+    defer client.Close()
+
+    return client.Undelete(context.Background(), serviceName)
+}
+
+func UndeleteServiceWithHostRouting(
+    ctx context.Context, host host.Host, routingDiscovery *discovery.RoutingDiscovery,
+    serviceName string) (undeleteResponse string, err error) {
+
+    return hostRoutingClient(host, routingDiscovery).Undelete(ctx, serviceName)
+}
+
+// List deleted services whose names begin with prefix, that can still be undeleted
+// Returns an empty map if there are none
+func (c *Client) ListDeleted(ctx context.Context, prefix string) (nameToEntry map[string]DeletedEntry, err error) {
+    nameToEntry = make(map[string]DeletedEntry)
+    req := common.ListRequest{Prefix: prefix, Limit: deletedPageSize, Deleted: true}
+    for {
+        reqBytes, err := json.Marshal(req)
+        if err != nil {
+            return nil, err
+        }
+        response, err := c.send(ctx, common.ListProtocolID, reqBytes)
+        if err != nil {
+            return nil, err
+        }
+
+        next, err := unmarshalDeletedResponse(response, nameToEntry)
+        if errors.Is(err, ErrNotFound) {
+            return nameToEntry, nil
+        }
+        if err != nil {
+            return nil, err
+        }
+        if next == "" {
+            return nameToEntry, nil
+        }
+        req.Continue = next
+    }
+}
+
+func ListDeletedServices(bootstraps []multiaddr.Multiaddr, psk pnet.PSK, prefix string) (
+    nameToEntry map[string]DeletedEntry, err error) {
+
+    client, err := temporaryClient(bootstraps, psk, nil)
+    if err != nil {
+        return nil, err
+    }
+    defer client.Close()
+
+    return client.ListDeleted(context.Background(), prefix)
+}
+
+func ListDeletedServicesWithHostRouting(
+    ctx context.Context, host host.Host, routingDiscovery *discovery.RoutingDiscovery,
+    prefix string) (nameToEntry map[string]DeletedEntry, err error) {
+
+    return hostRoutingClient(host, routingDiscovery).ListDeleted(ctx, prefix)
+}
+
+// Add the deleted entries of a list response to nameToEntry
+// next is where the following page starts, empty if there are no more entries
+func unmarshalDeletedResponse(listResponse []byte, nameToEntry map[string]DeletedEntry) (
+    next string, err error) {
+
+    var respInfo common.ListResponse
+    err = json.Unmarshal(listResponse, &respInfo)
+    if err != nil {
+        return "", err
+    }
+
+    err = statusError(respInfo.Status)
+    if err != nil {
+        return "", err
+    }
+    if !respInfo.LookupOk {
+        return "", &Error{Code: common.StatusNotFound, Message: "No deleted services found"}
+    }
+
+    for serviceName, infoStr := range respInfo.NameToInfoStr {
+        // Older registry-service instances ignore Deleted and list live services instead
+        deletion, ok := respInfo.NameToDeletion[serviceName]
+        if !ok {
+            return "", errors.New("registry: registry-service does not support listing deleted services")
+        }
+        entry, err := unmarshalEntry(serviceName, infoStr, respInfo.NameToMeta[serviceName])
+        if err != nil {
+            return "", err
+        }
+        deletedBy, err := peer.IDB58Decode(deletion.DeletedBy)
+        if err != nil {
+            return "", err
+        }
+        nameToEntry[serviceName] = DeletedEntry{
+            ServiceEntry: entry,
+            DeletedBy: deletedBy,
+            DeletedAt: deletion.DeletedAt,
+        }
+    }
+
+    return respInfo.Continue, nil
+}
@@ -0,0 +1,165 @@
+/* Copyright 2020 PhysarumSM Development Team
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package registry
+
+import (
+    "context"
+    "encoding/json"
+    "io"
+    "log"
+    "time"
+
+    "github.com/libp2p/go-libp2p-core/host"
+    "github.com/libp2p/go-libp2p-discovery"
+
+    "github.com/PhysarumSM/service-registry/common"
+)
+
+type ServiceEventType int
+
+const (
+    ServiceAdded ServiceEventType = iota
+    ServiceUpdated
+    ServiceDeleted
+)
+
+func (t ServiceEventType) String() string {
+    switch t {
+    case ServiceAdded:
+        return "added"
+    case ServiceUpdated:
+        return "updated"
+    case ServiceDeleted:
+        return "deleted"
+    default:
+        return "unknown"
+    }
+}
+
+// Change to a service entry in registry-service
+// Info is left empty for ServiceDeleted events
+type ServiceEvent struct {
+    Type ServiceEventType
+    Name string
+    Info ServiceInfo
+}
+
+var watchTypeToEventType = map[common.WatchEventType]ServiceEventType{
+    common.WatchAdd: ServiceAdded,
+    common.WatchUpdate: ServiceUpdated,
+    common.WatchDelete: ServiceDeleted,
+}
+
+// Watch registry-service for changes to the service with the given name,
+// or to all services with names beginning with name if prefix is set
+// Events are sent on the returned channel until ctx is cancelled or the watch ends,
+// after which the channel is closed
+// Returns ErrInvalidRequest or ErrUnavailable if the watch could not be set up
+func (c *Client) Watch(ctx context.Context, name string, prefix bool) (
+    events <-chan ServiceEvent, err error) {
+
+    reqBytes, err := json.Marshal(common.WatchRequest{Name: name, Prefix: prefix})
+    if err != nil {
+        return nil, err
+    }
+
+    stream, err := common.OpenRequestStreamWithPolicy(
+        ctx, c.host, c.routingDiscovery, c.retryPolicy, common.WatchProtocolID, reqBytes)
+    if err != nil {
+        return nil, unavailableError(err)
+    }
+
+    // Registry-service sends a progress event once the watch is set up, or an error if it failed
+    // Only setting up the watch is bound by the client's timeout
+    if c.timeout > 0 {
+        stream.SetReadDeadline(time.Now().Add(c.timeout))
+    }
+    decoder := json.NewDecoder(stream)
+    var firstEvent common.WatchEvent
+    err = decoder.Decode(&firstEvent)
+    if err != nil {
+        stream.Reset()
+        return nil, unavailableError(err)
+    }
+    stream.SetReadDeadline(time.Time{})
+    err = statusError(firstEvent.Status)
+    if err != nil {
+        stream.Reset()
+        return nil, err
+    }
+
+    eventChan := make(chan ServiceEvent)
+    go func() {
+        defer close(eventChan)
+        defer stream.Reset()
+
+        // Unblock the decoder below once the caller is no longer interested
+        watchDone := make(chan struct{})
+        defer close(watchDone)
+        go func() {
+            select {
+            case <-ctx.Done():
+                stream.Reset()
+            case <-watchDone:
+            }
+        }()
+
+        for {
+            var watchEvent common.WatchEvent
+            err := decoder.Decode(&watchEvent)
+            if err != nil {
+                if err != io.EOF && ctx.Err() == nil {
+                    log.Println("registry: Watch failed:", err)
+                }
+                return
+            }
+
+            if err := statusError(watchEvent.Status); err != nil {
+                log.Println("registry: Watch ended:", err)
+                return
+            }
+
+            eventType, ok := watchTypeToEventType[watchEvent.Type]
+            if !ok {
+                // Progress events and any types we don't know about
+                continue
+            }
+
+            event := ServiceEvent{Type: eventType, Name: watchEvent.Name}
+            if eventType != ServiceDeleted {
+                err = json.Unmarshal([]byte(watchEvent.InfoStr), &event.Info)
+                if err != nil {
+                    log.Println("registry: Unable to decode info for", watchEvent.Name, err)
+                    continue
+                }
+            }
+
+            select {
+            case eventChan <- event:
+            case <-ctx.Done():
+                return
+            }
+        }
+    }()
+
+    return eventChan, nil
+}
+
+func WatchServicesWithHostRouting(
+    ctx context.Context, host host.Host, routingDiscovery *discovery.RoutingDiscovery,
+    name string, prefix bool) (events <-chan ServiceEvent, err error) {
+
+    return hostRoutingClient(host, routingDiscovery).Watch(ctx, name, prefix)
+}